@@ -0,0 +1,265 @@
+package containrunner
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"strings"
+	"time"
+)
+
+/*
+	A blue/green service replaces its container without a gap in service. The service has two
+	container slots: the blue slot uses the service name as the container name and EndpointPort,
+	the green slot uses <name>-green and BlueGreen.AlternatePort. The container must listen on
+	the port of its slot, which is available as the {{.EndpointPort}} template variable, and the
+	checks must use it too, for example:
+
+	"EndpointPort": 3500,
+	"BlueGreen": {"AlternatePort": 3501},
+	"Checks": [{"Type": "http", "Url": "http://localhost:{{.EndpointPort}}/check"}],
+	"Container": {"Config": {"Env": ["PORT={{.EndpointPort}}"], ...}, ...}
+
+	When the running container doesn't match the configuration any more, the new container is
+	launched in the other slot next to the old one. Once the new container passes its checks its
+	endpoint is published and the check engine is switched over to it. After DrainPeriod the
+	endpoint of the old container is removed, and after another DrainPeriod, during which the
+	haproxies drop the old backend, the old container is stopped and removed. If the new
+	container doesn't pass its checks within Timeout it is removed and the old one keeps running.
+*/
+
+const (
+	BlueSlot  = "blue"
+	GreenSlot = "green"
+
+	defaultBlueGreenTimeout     = 120
+	defaultBlueGreenDrainPeriod = 10
+)
+
+type BlueGreenSettings struct {
+	// Endpoint port of the green slot
+	AlternatePort int
+
+	// Seconds the new container has to pass its checks. Defaults to 120
+	Timeout int
+
+	// Seconds to wait for the haproxies before the old endpoint is removed and again before
+	// the old container is stopped. Defaults to 10
+	DrainPeriod int
+}
+
+func (b BlueGreenSettings) Validate() error {
+	if b.AlternatePort <= 0 || b.AlternatePort > 65535 {
+		return errors.New("BlueGreen.AlternatePort must be a valid port number")
+	}
+	if b.Timeout < 0 || b.DrainPeriod < 0 {
+		return errors.New("BlueGreen.Timeout and BlueGreen.DrainPeriod can't be negative")
+	}
+	return nil
+}
+
+func (b BlueGreenSettings) timeout() time.Duration {
+	if b.Timeout == 0 {
+		return defaultBlueGreenTimeout * time.Second
+	}
+	return time.Duration(b.Timeout) * time.Second
+}
+
+func (b BlueGreenSettings) drainPeriod() time.Duration {
+	if b.DrainPeriod == 0 {
+		return defaultBlueGreenDrainPeriod * time.Second
+	}
+	return time.Duration(b.DrainPeriod) * time.Second
+}
+
+// Returns the endpoint port of the container slot of the service
+func (c *ServiceConfiguration) GetEndpointPort() int {
+	if c.BlueGreen != nil && c.ContainerSlot == GreenSlot {
+		return c.BlueGreen.AlternatePort
+	}
+	return c.EndpointPort
+}
+
+// Returns the container name of the container slot of the service
+func (c *ServiceConfiguration) GetContainerName() string {
+	if c.BlueGreen != nil && c.ContainerSlot == GreenSlot {
+		return c.Name + "-" + GreenSlot
+	}
+	return c.Name
+}
+
+// Returns a copy of the service set to the container slot. Services without BlueGreen
+// settings have only one slot and are returned as is.
+func (c *ServiceConfiguration) InContainerSlot(slot string) ServiceConfiguration {
+	service := *c
+	if service.BlueGreen != nil {
+		service.ContainerSlot = slot
+	}
+	return service
+}
+
+func OtherContainerSlot(slot string) string {
+	if slot == GreenSlot {
+		return BlueSlot
+	}
+	return GreenSlot
+}
+
+// Returns the slot of the running container of the blue/green service, or the blue slot if
+// neither slot has a running container. If an interrupted replacement left containers running
+// in both slots the older one is returned, as it is the one which was in use.
+func FindContainerSlot(containers []docker.APIContainers, service ServiceConfiguration) string {
+	slot := BlueSlot
+	var created int64
+	found := false
+
+	for _, container := range containers {
+		if !strings.HasPrefix(container.Status, "Up") {
+			continue
+		}
+
+		for _, candidate := range []string{BlueSlot, GreenSlot} {
+			slotService := service.InContainerSlot(candidate)
+			name := slotService.GetContainerName()
+			if !stringInSlice("/"+name, container.Names) && !stringInSlice(name, container.Names) {
+				continue
+			}
+			if !found || container.Created < created {
+				slot = candidate
+				created = container.Created
+				found = true
+			}
+		}
+	}
+
+	return slot
+}
+
+// Returns a copy of the configuration where every blue/green service is set to the slot of its
+// running container. This must be done before the templates are expanded.
+func SelectContainerSlots(conf MachineConfiguration, client *docker.Client) (MachineConfiguration, error) {
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return conf, err
+	}
+
+	return selectContainerSlots(conf, containers), nil
+}
+
+func selectContainerSlots(conf MachineConfiguration, containers []docker.APIContainers) MachineConfiguration {
+	services := make(map[string]BoundService)
+	for name, boundService := range conf.Services {
+		service := boundService.GetConfig()
+		if service.BlueGreen == nil {
+			services[name] = boundService
+			continue
+		}
+		services[name] = BoundService{DefaultConfiguration: service.InContainerSlot(FindContainerSlot(containers, service))}
+	}
+	conf.Services = services
+
+	return conf
+}
+
+// Runs the checks until all of them pass. Returns false if they didn't pass before the timeout.
+func WaitForServiceChecks(checks []ServiceCheck, timeout time.Duration, pollInterval time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok := true
+		for _, check := range checks {
+			if !runServiceCheck(check) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Replaces the running container of the blue/green service with a new container in the other
+// slot. raw is the service configuration before its templates were expanded. configuration is
+// the expanded machine configuration: the service is switched to the new slot in it and it is
+// pushed to the check engine once the new container passes its checks.
+func (s *Containrunner) ReplaceContainer(name string, raw ServiceConfiguration, running ContainerDetails, configuration MachineConfiguration, secrets SecretResolver, registries map[string]RegistryCredentials, postDelay bool, client *docker.Client) error {
+	if raw.BlueGreen == nil {
+		return fmt.Errorf("Service %s doesn't have BlueGreen settings", name)
+	}
+
+	current := raw.InContainerSlot(BlueSlot)
+	if green := raw.InContainerSlot(GreenSlot); running.Container.Name == green.GetContainerName() {
+		current = green
+	}
+	next := raw.InContainerSlot(OtherContainerSlot(current.ContainerSlot))
+
+	expanded, err := ExpandServiceConfiguration(next, s.GetServiceTemplateVariables(next))
+	if err != nil {
+		return err
+	}
+	expanded, err = SetSecretDigestLabel(expanded, secrets)
+	if err != nil {
+		return err
+	}
+	resolved, err := ResolveServiceSecrets(expanded, secrets)
+	if err != nil {
+		return err
+	}
+
+	log.Notice("Replacing container %s of service %s with %s", current.GetContainerName(), name, next.GetContainerName())
+
+	imageName := GetContainerImageNameWithRevision(expanded, "")
+	err = LaunchContainer(next.GetContainerName(), imageName, resolved.Container, registries, true, postDelay, client)
+	if err != nil {
+		return err
+	}
+
+	if !WaitForServiceChecks(resolved.Checks, raw.BlueGreen.timeout(), time.Second) {
+		DestroyContainer(next.GetContainerName(), client)
+		return fmt.Errorf("Container %s of service %s did not pass its checks within %s, keeping %s", next.GetContainerName(), name, raw.BlueGreen.timeout(), current.GetContainerName())
+	}
+
+	// The endpoint of the new container is published right away, the check engine keeps it up to date from now on
+	configuration.Services[name] = BoundService{DefaultConfiguration: expanded}
+	s.CheckEngine.PushNewConfiguration(configuration)
+
+	publisher := s.getConfigResultPublisher(nil)
+	if !s.IsDraining() {
+		info := &EndpointInfo{
+			Revision:             expanded.GetRevision(),
+			AvailabilityZone:     s.AvailabilityZone,
+			ServiceConfiguration: RedactServiceConfiguration(expanded),
+		}
+		publisher.PublishServiceState(name, fmt.Sprintf("%s:%d", s.MachineAddress, next.GetEndpointPort()), true, info)
+	}
+
+	time.Sleep(raw.BlueGreen.drainPeriod())
+	publisher.PublishServiceState(name, fmt.Sprintf("%s:%d", s.MachineAddress, current.GetEndpointPort()), false, nil)
+
+	time.Sleep(raw.BlueGreen.drainPeriod())
+	log.Notice("Container %s of service %s is in use, removing %s", next.GetContainerName(), name, current.GetContainerName())
+
+	return DestroyContainer(current.GetContainerName(), client)
+}
+
+// Stops and removes the containers of the service in all of its slots
+func DestroyServiceContainers(service ServiceConfiguration, client *docker.Client) error {
+	slots := []string{BlueSlot}
+	if service.BlueGreen != nil {
+		slots = append(slots, GreenSlot)
+	}
+
+	for _, slot := range slots {
+		slotService := service.InContainerSlot(slot)
+		err := DestroyContainer(slotService.GetContainerName(), client)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package containrunner
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func blueGreenTestService() ServiceConfiguration {
+	service := expandTestService()
+	service.BlueGreen = &BlueGreenSettings{AlternatePort: 3501}
+	return service
+}
+
+func TestBlueGreenContainerSlots(t *testing.T) {
+	service := blueGreenTestService()
+	assert.Equal(t, 3500, service.GetEndpointPort())
+	assert.Equal(t, "web", service.GetContainerName())
+
+	green := service.InContainerSlot(GreenSlot)
+	assert.Equal(t, 3501, green.GetEndpointPort())
+	assert.Equal(t, "web-green", green.GetContainerName())
+	assert.Equal(t, "", service.ContainerSlot)
+
+	blue := green.InContainerSlot(BlueSlot)
+	assert.Equal(t, 3500, blue.GetEndpointPort())
+	assert.Equal(t, "web", blue.GetContainerName())
+
+	assert.Equal(t, GreenSlot, OtherContainerSlot(BlueSlot))
+	assert.Equal(t, BlueSlot, OtherContainerSlot(GreenSlot))
+
+	// Services without the settings have only one slot
+	plain := expandTestService()
+	plain = plain.InContainerSlot(GreenSlot)
+	assert.Equal(t, "", plain.ContainerSlot)
+	assert.Equal(t, 3500, plain.GetEndpointPort())
+	assert.Equal(t, "web", plain.GetContainerName())
+}
+
+func TestBlueGreenSettingsValidate(t *testing.T) {
+	assert.Nil(t, BlueGreenSettings{AlternatePort: 3501}.Validate())
+	assert.Nil(t, BlueGreenSettings{AlternatePort: 3501, Timeout: 60, DrainPeriod: 5}.Validate())
+	assert.NotNil(t, BlueGreenSettings{}.Validate())
+	assert.NotNil(t, BlueGreenSettings{AlternatePort: 70000}.Validate())
+	assert.NotNil(t, BlueGreenSettings{AlternatePort: 3501, DrainPeriod: -1}.Validate())
+
+	assert.Equal(t, 120*time.Second, BlueGreenSettings{}.timeout())
+	assert.Equal(t, 10*time.Second, BlueGreenSettings{}.drainPeriod())
+	assert.Equal(t, 5*time.Second, BlueGreenSettings{DrainPeriod: 5}.drainPeriod())
+}
+
+func TestFindContainerSlot(t *testing.T) {
+	service := blueGreenTestService()
+
+	assert.Equal(t, BlueSlot, FindContainerSlot(nil, service))
+
+	containers := []docker.APIContainers{
+		{Names: []string{"/other"}, Status: "Up 2 hours", Created: 100},
+		{Names: []string{"/web-green"}, Status: "Up 5 minutes", Created: 200},
+		{Names: []string{"/web"}, Status: "Exited (0) 5 minutes ago", Created: 100},
+	}
+	assert.Equal(t, GreenSlot, FindContainerSlot(containers, service))
+
+	// An interrupted replacement left both running, the older one was in use
+	containers[2].Status = "Up 2 hours"
+	assert.Equal(t, BlueSlot, FindContainerSlot(containers, service))
+	containers[2].Created = 300
+	assert.Equal(t, GreenSlot, FindContainerSlot(containers, service))
+}
+
+func TestSelectContainerSlots(t *testing.T) {
+	var ct Containrunner
+	ct.MachineAddress = "10.0.0.1"
+
+	var mc MachineConfiguration
+	mc.Services = map[string]BoundService{
+		"web": {DefaultConfiguration: blueGreenTestService()},
+		"api": {DefaultConfiguration: ServiceConfiguration{Name: "api", EndpointPort: 3600, Container: &ContainerConfiguration{}}},
+	}
+	mc.Services["api"].DefaultConfiguration.Container.Config.Image = "registry:5000/api:1.0"
+
+	containers := []docker.APIContainers{{Names: []string{"/web-green"}, Status: "Up 5 minutes"}}
+	selected := selectContainerSlots(mc, containers)
+	assert.Equal(t, GreenSlot, selected.Services["web"].GetConfig().ContainerSlot)
+	assert.Equal(t, "", selected.Services["api"].GetConfig().ContainerSlot)
+	assert.Equal(t, "", mc.Services["web"].GetConfig().ContainerSlot)
+
+	// The templates are expanded with the port of the slot
+	expanded, err := ct.ExpandMachineConfiguration(selected)
+	assert.Nil(t, err)
+	web := expanded.Services["web"].GetConfig()
+	assert.Equal(t, "ADVERTISE=10.0.0.1:3501", web.Container.Config.Env[0])
+	assert.Equal(t, "http://10.0.0.1:3501/check", web.Checks[0].Url)
+
+	// Only the container of the current slot matches
+	running := ContainerDetails{Container: &docker.Container{Name: "web", Config: &docker.Config{Image: "registry:5000/web:abc123"}}}
+	running.Container.Config.Hostname = web.Container.Config.Hostname
+	running.Container.Config.Env = web.Container.Config.Env
+	found, _ := FindMatchingContainers([]ContainerDetails{running}, web)
+	assert.Equal(t, 0, len(found))
+
+	running.Container.Name = "web-green"
+	found, _ = FindMatchingContainers([]ContainerDetails{running}, web)
+	assert.Equal(t, 1, len(found))
+}
+
+func TestTakeRunningContainer(t *testing.T) {
+	containers := []ContainerDetails{
+		{Container: &docker.Container{Name: "web", State: docker.State{Running: false}}},
+		{Container: &docker.Container{Name: "api", State: docker.State{Running: true}}},
+		{Container: &docker.Container{Name: "web", State: docker.State{Running: true}}},
+	}
+
+	running, remaining := takeRunningContainer(containers, "web")
+	assert.NotNil(t, running)
+	assert.True(t, running.Container.State.Running)
+	assert.Equal(t, 2, len(remaining))
+	assert.Equal(t, 3, len(containers))
+
+	running, remaining = takeRunningContainer(remaining, "web")
+	assert.Nil(t, running)
+	assert.Equal(t, 2, len(remaining))
+}
+
+func TestWaitForServiceChecks(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	checks := []ServiceCheck{{Type: "http", Url: ts.URL}}
+	assert.True(t, WaitForServiceChecks(checks, time.Second, time.Millisecond*10))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	checks = append(checks, ServiceCheck{Type: "dummy", DummyResult: false})
+	assert.False(t, WaitForServiceChecks(checks, time.Millisecond*50, time.Millisecond*10))
+
+	assert.True(t, WaitForServiceChecks(nil, 0, time.Millisecond))
+}
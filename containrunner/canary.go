@@ -0,0 +1,256 @@
+package containrunner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	A canary deployment sets the new revision on a few machines, spread across the availability
+	zones, with the services/<name>/machines/<ip> override. Once the canaries report a healthy
+	endpoint with the new revision their check results (see EndpointHealth) are compared against
+	the rest of the machines, the baseline, for a bake period. If the canaries are as healthy as
+	the baseline the revision is set for the whole service, otherwise the canaries are rolled back
+	to their previous revision. Every decision is published as a DeploymentEvent.
+*/
+
+// Settings of a canary deployment. See RunCanary
+type CanaryDeployment struct {
+	Service  string
+	Revision ServiceRevision
+
+	// Number of canary machines. Percent of the machines of the service is used if Count is zero
+	Count   int
+	Percent float64
+
+	// Canary machines. Selected with SelectCanaryMachines if empty
+	Machines []string
+
+	// How long to wait for the canaries to report a healthy endpoint with the new revision
+	Timeout time.Duration
+
+	// How long the health of the canaries is compared against the baseline
+	BakePeriod time.Duration
+
+	// How often the endpoints are checked while waiting for the canaries. Defaults to one second
+	PollInterval time.Duration
+
+	// Largest allowed drop of the check pass rate from the baseline, 0.01 is one percentage point
+	MaxPassRateDrop float64
+
+	// Largest allowed increase of the state changes per endpoint from the baseline
+	MaxExtraFlaps float64
+
+	User string
+
+	// Called with progress messages, can be nil
+	Progress func(message string)
+}
+
+type CanaryResult struct {
+	Machines []string
+	Canary   HealthSummary
+	Baseline HealthSummary
+
+	// Whether the revision was set for the whole service. The canaries were rolled back if not
+	Promoted bool
+	Reason   string
+}
+
+func (d *CanaryDeployment) progress(format string, args ...interface{}) {
+	if d.Progress != nil {
+		d.Progress(fmt.Sprintf(format, args...))
+	}
+}
+
+// Returns the number of canaries out of total machines for a count or a percentage
+func CanaryCount(total int, count int, percent float64) int {
+	if count > 0 {
+		return count
+	}
+	if percent <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(total) * percent / 100))
+}
+
+// Picks count machines from the machine address to availability zone map so that the availability
+// zones take turns. The result is sorted.
+func SelectCanaryMachines(zones map[string]string, count int) []string {
+	byZone := make(map[string][]string)
+	var zoneNames []string
+	for address, zone := range zones {
+		if _, found := byZone[zone]; !found {
+			zoneNames = append(zoneNames, zone)
+		}
+		byZone[zone] = append(byZone[zone], address)
+	}
+	sort.Strings(zoneNames)
+	for _, zone := range zoneNames {
+		sort.Strings(byZone[zone])
+	}
+
+	var selected []string
+	for i := 0; len(selected) < count && len(selected) < len(zones); i++ {
+		for _, zone := range zoneNames {
+			if i < len(byZone[zone]) && len(selected) < count {
+				selected = append(selected, byZone[zone][i])
+			}
+		}
+	}
+
+	sort.Strings(selected)
+	return selected
+}
+
+// Compares the health of the canaries against the baseline. Returns whether the canaries
+// can be promoted and the reason.
+func EvaluateCanary(canary HealthSummary, baseline HealthSummary, maxPassRateDrop float64, maxExtraFlaps float64) (bool, string) {
+	if canary.Checks == 0 {
+		return false, "no check results from the canaries during the bake period"
+	}
+
+	if canary.PassRate() < baseline.PassRate()-maxPassRateDrop {
+		return false, fmt.Sprintf("check pass rate %.1f%% is below the baseline %.1f%%", canary.PassRate()*100, baseline.PassRate()*100)
+	}
+
+	if canary.FlapRate() > baseline.FlapRate()+maxExtraFlaps {
+		return false, fmt.Sprintf("%.1f state changes per endpoint against %.1f on the baseline", canary.FlapRate(), baseline.FlapRate())
+	}
+
+	return true, fmt.Sprintf("check pass rate %.1f%% (baseline %.1f%%), %.1f state changes per endpoint (baseline %.1f)",
+		canary.PassRate()*100, baseline.PassRate()*100, canary.FlapRate(), baseline.FlapRate())
+}
+
+func (c *Containrunner) publishDeploymentEvent(action string, service string, revision string, machines []string, user string, reason string) {
+	if c.Events == nil {
+		return
+	}
+
+	c.Events.PublishOrbitEvent(NewOrbitEvent(DeploymentEvent{
+		Action:         action,
+		Service:        service,
+		User:           user,
+		Revision:       revision,
+		MachineAddress: strings.Join(machines, ","),
+		Reason:         reason,
+	}))
+}
+
+// Runs a canary deployment. An error is returned only if the deployment could not be run; a
+// rolled back canary is reported in the result.
+func (c *Containrunner) RunCanary(d CanaryDeployment, store ConfigStore) (*CanaryResult, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	if d.Revision.Revision == "" {
+		return nil, errors.New("No revision given")
+	}
+
+	zones, err := c.GetServiceMachineZones(d.Service, store)
+	if err != nil {
+		return nil, err
+	}
+
+	canaries := d.Machines
+	if len(canaries) == 0 {
+		count := CanaryCount(len(zones), d.Count, d.Percent)
+		if count < 1 {
+			return nil, errors.New("Give the number or the percentage of canary machines")
+		}
+		if count >= len(zones) {
+			return nil, fmt.Errorf("Service %s runs on %d machines, at least one must be left for the baseline", d.Service, len(zones))
+		}
+		canaries = SelectCanaryMachines(zones, count)
+	}
+
+	var baseline []string
+	for address := range zones {
+		if !stringInSlice(address, canaries) {
+			baseline = append(baseline, address)
+		}
+	}
+	sort.Strings(baseline)
+
+	result := &CanaryResult{Machines: canaries}
+
+	// The revision overrides of the canaries are restored on rollback
+	previous := make(map[string]*string)
+	for _, machine := range canaries {
+		res, err := store.Get(c.EtcdBasePath + "/services/" + d.Service + "/machines/" + machine)
+		if err == nil {
+			previous[machine] = &res.Value
+		} else if !IsKeyNotFound(err) {
+			return nil, err
+		}
+	}
+
+	c.publishDeploymentEvent("CanaryStarted", d.Service, d.Revision.Revision, canaries, d.User, "")
+	d.progress("Setting revision %s on canaries %s", d.Revision.Revision, strings.Join(canaries, ", "))
+	for _, machine := range canaries {
+		err := c.SetServiceRevisionForMachine(d.Service, d.Revision, machine, store)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	pending, err := c.WaitForServiceRevision(d.Service, d.Revision.Revision, canaries, d.Timeout, d.PollInterval, store)
+	if err != nil {
+		return result, err
+	}
+
+	if len(pending) > 0 {
+		result.Reason = fmt.Sprintf("%s did not report a healthy endpoint with revision %s within %s", strings.Join(pending, ", "), d.Revision.Revision, d.Timeout)
+	} else {
+		start, err := c.GetEndpointHealth(d.Service, store)
+		if err != nil {
+			return result, err
+		}
+
+		d.progress("Canaries are up, comparing them against %d baseline machines for %s", len(baseline), d.BakePeriod)
+		time.Sleep(d.BakePeriod)
+
+		end, err := c.GetEndpointHealth(d.Service, store)
+		if err != nil {
+			return result, err
+		}
+
+		result.Canary = SummarizeEndpointHealth(start, end, canaries)
+		result.Baseline = SummarizeEndpointHealth(start, end, baseline)
+		result.Promoted, result.Reason = EvaluateCanary(result.Canary, result.Baseline, d.MaxPassRateDrop, d.MaxExtraFlaps)
+	}
+
+	if result.Promoted {
+		d.progress("Canaries are healthy: %s. Promoting revision %s", result.Reason, d.Revision.Revision)
+		err = c.SetServiceRevision(d.Service, d.Revision, store)
+		if err != nil {
+			return result, err
+		}
+		c.publishDeploymentEvent("CanaryPromoted", d.Service, d.Revision.Revision, canaries, d.User, result.Reason)
+		return result, nil
+	}
+
+	d.progress("Rolling back the canaries: %s", result.Reason)
+	for _, machine := range canaries {
+		key := c.EtcdBasePath + "/services/" + d.Service + "/machines/" + machine
+		if previous[machine] != nil {
+			err = store.Set(key, *previous[machine], 0)
+		} else {
+			err = store.Delete(key)
+			if IsKeyNotFound(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	c.publishDeploymentEvent("CanaryAborted", d.Service, d.Revision.Revision, canaries, d.User, result.Reason)
+
+	return result, nil
+}
@@ -0,0 +1,209 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type TestEventRecorder struct {
+	events []OrbitEvent
+}
+
+func (r *TestEventRecorder) Init(amqp_address string, listen_queue_name string) bool { return true }
+func (r *TestEventRecorder) Declare() error                                          { return nil }
+func (r *TestEventRecorder) ListenDeploymentEventsExchange(queue_name string, receivered_events chan OrbitEvent) error {
+	return nil
+}
+func (r *TestEventRecorder) GetReceiveredEventChannel() <-chan OrbitEvent { return nil }
+func (r *TestEventRecorder) PublishOrbitEvent(oe OrbitEvent) error {
+	r.events = append(r.events, oe)
+	return nil
+}
+
+// Like simulateDeployDaemons but also publishes the endpoint health. Machines which run
+// the revision failingRevision pass only every other check.
+func simulateCanaryDaemons(ct *Containrunner, store ConfigStore, machines []string, failingRevision string, stop *int32) {
+	healths := make(map[string]*EndpointHealth)
+	for atomic.LoadInt32(stop) == 0 {
+		global, _ := ct.GetServiceRevision("web", store)
+		for _, machine := range machines {
+			revision := global.Revision
+			res, err := store.Get("/orbit/services/web/machines/" + machine)
+			if err == nil {
+				var override ServiceRevision
+				json.Unmarshal([]byte(res.Value), &override)
+				revision = override.Revision
+			}
+
+			bytes, _ := json.Marshal(EndpointInfo{Revision: revision})
+			store.Set("/orbit/services/web/endpoints/"+machine+":3500", string(bytes), time.Minute)
+
+			health := healths[machine]
+			if health == nil || health.Revision != revision {
+				health = &EndpointHealth{Service: "web", Endpoint: machine + ":3500", Revision: revision, Since: time.Now()}
+				healths[machine] = health
+			}
+			health.Checks++
+			if revision != failingRevision || health.Checks%2 == 0 {
+				health.Passed++
+			}
+			ct.PublishEndpointHealth(*health, store)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSelectCanaryMachines(t *testing.T) {
+	zones := map[string]string{
+		"10.0.0.1": "a", "10.0.0.2": "a", "10.0.0.3": "a",
+		"10.0.1.1": "b", "10.0.1.2": "b",
+		"10.0.2.1": "c",
+	}
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.1.1"}, SelectCanaryMachines(zones, 2))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.2.1"}, SelectCanaryMachines(zones, 4))
+	assert.Equal(t, 6, len(SelectCanaryMachines(zones, 10)))
+
+	assert.Equal(t, 3, CanaryCount(20, 3, 50))
+	assert.Equal(t, 2, CanaryCount(20, 0, 10))
+	assert.Equal(t, 1, CanaryCount(5, 0, 1))
+	assert.Equal(t, 0, CanaryCount(5, 0, 0))
+}
+
+func TestEvaluateCanary(t *testing.T) {
+	baseline := HealthSummary{Endpoints: 4, Checks: 400, Passed: 398, StateChanges: 2}
+
+	ok, _ := EvaluateCanary(HealthSummary{Endpoints: 1, Checks: 100, Passed: 99}, baseline, 0.01, 1)
+	assert.True(t, ok)
+
+	ok, reason := EvaluateCanary(HealthSummary{Endpoints: 1, Checks: 100, Passed: 90}, baseline, 0.01, 1)
+	assert.False(t, ok)
+	assert.Equal(t, "check pass rate 90.0% is below the baseline 99.5%", reason)
+
+	ok, _ = EvaluateCanary(HealthSummary{Endpoints: 1, Checks: 100, Passed: 100, StateChanges: 4}, baseline, 0.01, 1)
+	assert.False(t, ok)
+
+	ok, _ = EvaluateCanary(HealthSummary{Endpoints: 1}, baseline, 0.01, 1)
+	assert.False(t, ok)
+}
+
+func TestRecordEndpointHealth(t *testing.T) {
+	ct := new(Containrunner)
+
+	e := ServiceStateEvent{Service: "web", Endpoint: "10.0.0.1:3500", IsUp: true, StateChanged: true, EndpointInfo: &EndpointInfo{Revision: "a"}}
+	health, publish := ct.recordEndpointHealth(e)
+	assert.True(t, publish)
+	assert.Equal(t, int64(0), health.StateChanges)
+
+	e.StateChanged = false
+	health, publish = ct.recordEndpointHealth(e)
+	assert.False(t, publish)
+	assert.Equal(t, int64(2), health.Passed)
+
+	e.IsUp = false
+	e.StateChanged = true
+	health, publish = ct.recordEndpointHealth(e)
+	assert.True(t, publish)
+	assert.Equal(t, HealthSummary{Endpoints: 1, Checks: 3, Passed: 2, StateChanges: 1}, SummarizeEndpointHealth(nil, map[string]EndpointHealth{e.Endpoint: health}, []string{"10.0.0.1"}))
+
+	// A new revision starts the counters from zero
+	e.EndpointInfo = &EndpointInfo{Revision: "b"}
+	health, _ = ct.recordEndpointHealth(e)
+	assert.Equal(t, int64(1), health.Checks)
+}
+
+func TestSummarizeEndpointHealth(t *testing.T) {
+	since := time.Now()
+	start := map[string]EndpointHealth{
+		"10.0.0.1:3500": {Revision: "a", Since: since, Checks: 10, Passed: 10},
+		"10.0.0.2:3500": {Revision: "a", Since: since, Checks: 10, Passed: 10},
+	}
+	end := map[string]EndpointHealth{
+		"10.0.0.1:3500": {Revision: "a", Since: since, Checks: 15, Passed: 14, StateChanges: 2},
+		"10.0.0.2:3500": {Revision: "b", Since: since.Add(time.Second), Checks: 3, Passed: 3},
+		"10.0.0.3:3500": {Revision: "a", Since: since, Checks: 100, Passed: 100},
+	}
+
+	assert.Equal(t, HealthSummary{Endpoints: 2, Checks: 8, Passed: 7, StateChanges: 2}, SummarizeEndpointHealth(start, end, []string{"10.0.0.1", "10.0.0.2"}))
+}
+
+func TestRunCanary(t *testing.T) {
+	ct, store, machines := setupDeployTest()
+	recorder := new(TestEventRecorder)
+	ct.Events = recorder
+
+	var stop int32
+	go simulateCanaryDaemons(ct, store, machines, "broken", &stop)
+	defer atomic.StoreInt32(&stop, 1)
+
+	canary := CanaryDeployment{
+		Service:         "web",
+		Revision:        ServiceRevision{Revision: "new"},
+		Count:           2,
+		Timeout:         5 * time.Second,
+		BakePeriod:      50 * time.Millisecond,
+		PollInterval:    time.Millisecond,
+		MaxPassRateDrop: 0.05,
+		MaxExtraFlaps:   1,
+		User:            "garo",
+	}
+
+	result, err := ct.RunCanary(canary, store)
+	assert.Nil(t, err)
+	assert.True(t, result.Promoted, result.Reason)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, result.Machines)
+
+	revision, _ := ct.GetServiceRevision("web", store)
+	assert.Equal(t, "new", revision.Revision)
+
+	if assert.Equal(t, 2, len(recorder.events)) {
+		assert.Equal(t, "CanaryStarted", recorder.events[0].Ptr.(DeploymentEvent).Action)
+		assert.Equal(t, "CanaryPromoted", recorder.events[1].Ptr.(DeploymentEvent).Action)
+		assert.Equal(t, "10.0.0.1,10.0.0.2", recorder.events[1].Ptr.(DeploymentEvent).MachineAddress)
+	}
+}
+
+func TestRunCanaryRollsBack(t *testing.T) {
+	ct, store, machines := setupDeployTest()
+	recorder := new(TestEventRecorder)
+	ct.Events = recorder
+
+	// A previous override on a canary is restored
+	bytes, _ := json.Marshal(ServiceRevision{Revision: "pinned"})
+	store.Set("/orbit/services/web/machines/10.0.0.1", string(bytes), 0)
+
+	var stop int32
+	go simulateCanaryDaemons(ct, store, machines, "broken", &stop)
+	defer atomic.StoreInt32(&stop, 1)
+
+	result, err := ct.RunCanary(CanaryDeployment{
+		Service:         "web",
+		Revision:        ServiceRevision{Revision: "broken"},
+		Percent:         40,
+		Timeout:         5 * time.Second,
+		BakePeriod:      50 * time.Millisecond,
+		PollInterval:    time.Millisecond,
+		MaxPassRateDrop: 0.05,
+		MaxExtraFlaps:   1,
+	}, store)
+	assert.Nil(t, err)
+	assert.False(t, result.Promoted)
+	assert.Contains(t, result.Reason, "below the baseline")
+
+	revision, _ := ct.GetServiceRevision("web", store)
+	assert.Equal(t, "old", revision.Revision)
+
+	res, err := store.Get("/orbit/services/web/machines/10.0.0.1")
+	assert.Nil(t, err)
+	assert.Contains(t, res.Value, "pinned")
+	_, err = store.Get("/orbit/services/web/machines/10.0.0.2")
+	assert.True(t, IsKeyNotFound(err))
+
+	assert.Equal(t, "CanaryAborted", recorder.events[len(recorder.events)-1].Ptr.(DeploymentEvent).Action)
+
+	_, err = ct.RunCanary(CanaryDeployment{Service: "web", Revision: ServiceRevision{Revision: "x"}, Count: 5}, store)
+	assert.NotNil(t, err)
+}
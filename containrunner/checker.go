@@ -6,6 +6,7 @@ import "fmt"
 import "net/http"
 import "strings"
 import "io/ioutil"
+import "sync"
 
 type ServiceCheck struct {
 	Type             string
@@ -43,6 +44,12 @@ type CheckEngine struct {
 	results         chan CheckResult
 	configurations  chan MachineConfiguration
 	endpointAddress string
+
+	// Protects configurations, which is nil while the engine is stopped
+	lock sync.Mutex
+
+	// Resolves the secret references in the check credentials
+	Secrets SecretResolver
 }
 
 type ServiceState int
@@ -54,24 +61,44 @@ const (
 )
 
 func (ce *CheckEngine) Start(workers int, results chan<- OrbitEvent, endpointAddress string, intervalInMs int) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
 	ce.configurations = make(chan MachineConfiguration, 1)
 	ce.endpointAddress = endpointAddress
 
 	log.Info("CheckEngine Start. configurations chan: %+v", ce.configurations)
-	go CheckConfigUpdateWorker(ce.configurations, results, endpointAddress, 2000)
+	go CheckConfigUpdateWorker(ce.configurations, results, endpointAddress, ce.Secrets, 2000)
 }
 
+// Stops all check workers. Configurations pushed after this are ignored until the engine is started again.
 func (ce *CheckEngine) Stop() {
-	close(ce.jobs)
-	close(ce.results)
-	close(ce.configurations)
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	if ce.configurations != nil {
+		close(ce.configurations)
+		ce.configurations = nil
+	}
 }
 
+// Pushes the configuration to the check workers. The secret references in the check
+// credentials are resolved by the workers.
 func (ce *CheckEngine) PushNewConfiguration(configuration MachineConfiguration) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+
+	if ce.configurations == nil {
+		log.Debug("CheckEngine is stopped, ignoring the new configuration")
+		return
+	}
 	ce.configurations <- configuration
 }
 
-func CheckConfigUpdateWorker(configurations <-chan MachineConfiguration, results chan<- OrbitEvent, endpointAddress string, delay int) {
+// Runs a CheckServiceWorker for every service of the configurations. The secret references in the
+// check credentials are resolved with secrets for the checks, the EndpointInfo which is published
+// keeps the references.
+func CheckConfigUpdateWorker(configurations <-chan MachineConfiguration, results chan<- OrbitEvent, endpointAddress string, secrets SecretResolver, delay int) {
 	log.Info("CheckConfigUpdateWorker starting")
 
 	serviceCheckWorkerChannels := make(map[string]chan ServiceChecks)
@@ -110,15 +137,22 @@ func CheckConfigUpdateWorker(configurations <-chan MachineConfiguration, results
 				service := boundService.GetConfig()
 				var cc ServiceChecks
 				cc.ServiceName = name
-				cc.EndpointPort = service.EndpointPort
+				cc.EndpointPort = service.GetEndpointPort()
 				cc.Checks = service.Checks
 				if service.Container != nil {
 					cc.EndpointInfo = &EndpointInfo{
 						Revision:             service.GetRevision(),
-						ServiceConfiguration: service,
+						ServiceConfiguration: RedactServiceConfiguration(service),
 					}
 				}
 
+				resolved, err := ResolveServiceSecrets(ServiceConfiguration{Name: service.Name, Checks: service.Checks}, secrets)
+				if err != nil {
+					log.Error(LogString(err.Error()))
+				} else {
+					cc.Checks = resolved.Checks
+				}
+
 				serviceCheckWorkerChannels[name] <- cc
 			}
 		} else {
@@ -173,14 +207,7 @@ func CheckServiceWorker(serviceChecksChannel <-chan ServiceChecks, results chan<
 				if check.Delay > 0 {
 					delay = check.Delay
 				}
-				switch check.Type {
-				case "dummy":
-					ok = CheckDummyService(check)
-				case "http":
-					ok = CheckHttpService(check)
-				case "tcp":
-					ok = CheckTcpService(check)
-				}
+				ok = runServiceCheck(check)
 				if !ok {
 					result.IsUp = false
 				}
@@ -213,6 +240,19 @@ func CheckServiceWorker(serviceChecksChannel <-chan ServiceChecks, results chan<
 
 }
 
+// Runs the check. Unknown check types pass.
+func runServiceCheck(check ServiceCheck) bool {
+	switch check.Type {
+	case "dummy":
+		return CheckDummyService(check)
+	case "http":
+		return CheckHttpService(check)
+	case "tcp":
+		return CheckTcpService(check)
+	}
+	return true
+}
+
 type TimeoutConfig struct {
 	ConnectTimeout   time.Duration
 	ReadWriteTimeout time.Duration
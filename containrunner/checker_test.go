@@ -131,7 +131,7 @@ func TestCheckConfigUpdateWorker(t *testing.T) {
 	boundService.DefaultConfiguration = v
 	mc.Services["myService"] = boundService
 
-	go CheckConfigUpdateWorker(configurations, resultsChannel, "10.0.0.1", 10)
+	go CheckConfigUpdateWorker(configurations, resultsChannel, "10.0.0.1", nil, 10)
 	configurations <- mc
 	result := (<-resultsChannel).Ptr.(ServiceStateEvent)
 	close(configurations)
@@ -140,6 +140,31 @@ func TestCheckConfigUpdateWorker(t *testing.T) {
 	assert.Equal(t, true, result.IsUp)
 }
 
+func TestCheckConfigUpdateWorkerKeepsSecretReferences(t *testing.T) {
+	configurations := make(chan MachineConfiguration)
+	resultsChannel := make(chan OrbitEvent, 1)
+
+	secrets := func(name string) (string, error) {
+		return map[string]string{"checks/user": "alice", "checks/password": "s3cret"}[name], nil
+	}
+
+	service := ServiceConfiguration{Name: "myService", Container: &ContainerConfiguration{}}
+	service.Container.Config.Image = "registry:5000/my:1.0"
+	service.Checks = []ServiceCheck{{Type: "dummyCheck", DummyResult: true, Username: "secret:checks/user", Password: "secret:checks/password"}}
+
+	var mc MachineConfiguration
+	mc.Services = map[string]BoundService{"myService": {DefaultConfiguration: service}}
+
+	go CheckConfigUpdateWorker(configurations, resultsChannel, "10.0.0.1", secrets, 10)
+	configurations <- mc
+	result := (<-resultsChannel).Ptr.(ServiceStateEvent)
+	close(configurations)
+
+	assert.Equal(t, true, result.IsUp)
+	assert.Equal(t, "secret:checks/user", result.EndpointInfo.ServiceConfiguration.Checks[0].Username)
+	assert.Equal(t, "secret:checks/password", result.EndpointInfo.ServiceConfiguration.Checks[0].Password)
+}
+
 func TestCheckConfigUpdateWorkerWhenServiceIsRemoved(t *testing.T) {
 
 	configurations := make(chan MachineConfiguration, 1)
@@ -163,7 +188,7 @@ func TestCheckConfigUpdateWorkerWhenServiceIsRemoved(t *testing.T) {
 	boundService.DefaultConfiguration = v
 	mc.Services["myService"] = boundService
 
-	go CheckConfigUpdateWorker(configurations, resultsChannel, "TestCheckConfigUpdateWorkerWhenServiceIsRemoved", 100)
+	go CheckConfigUpdateWorker(configurations, resultsChannel, "TestCheckConfigUpdateWorkerWhenServiceIsRemoved", nil, 100)
 	configurations <- mc
 	time.Sleep(time.Millisecond * 150)
 	fmt.Println("Removing service...")
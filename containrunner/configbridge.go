@@ -6,28 +6,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
-	etcd "github.com/coreos/etcd/client"
 	"io/ioutil"
 	"os"
 	"path"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 /*
 	Data model referred
-	/orbit/env <-- file contents tells the environment
+	/orbit/environments/<env>	// JSON file containing EnvironmentConfiguration data
 	/orbit/globalproperties				// JSON file containing GlobalOrbitProperties data
 	/orbit/services/<name>/config
 	/orbit/services/<name>/revision	// contains revision string inside which overwrites the set revision in /config
 	/orbit/services/<name>/endpoints/<endpoint host:port>
 	/orbit/machineconfigurations/tags/<tag>/authoritative_names
+	/orbit/machineconfigurations/tags/<tag>/includes	// JSON list of tags which this tag includes (see tags.go)
+	/orbit/machineconfigurations/tags/<tag>/priority	// Priority of the tag when tags of a machine conflict (see tags.go)
 	/orbit/machineconfigurations/tags/<tag>/services/<service_name>				// Tags service to a tag
 	/orbit/machineconfigurations/tags/<tag>/haproxy_endpoints/<service_name>
 
-	Example:
+	When environments are used each environment has the layout above under /orbit/<env>/, for example:
 	/orbit/<env>/machineconfigurations/tags/frontend-a/services/comet
 	/orbit/<env>/machineconfigurations/tags/loadbalancer-a/haproxy_endpoints/comet
 
@@ -44,6 +44,9 @@ type OrbitConfiguration struct {
 type GlobalOrbitProperties struct {
 	AMQPUrl           string
 	AvailabilityZones map[string][]string
+
+	// Credentials of the private docker registries by the registry host. See registry.go
+	Registries map[string]RegistryCredentials `json:",omitempty"`
 }
 
 // Represents a single tag inside a /orbit/machineconfiguration/
@@ -51,6 +54,8 @@ type TagConfiguration struct {
 	Services             map[string]BoundService `json:"services"`
 	HAProxyConfiguration *HAProxyConfiguration
 	AuthoritativeNames   []string `json:"authoritative_names"`
+	Includes             []string `json:"includes"`
+	Priority             int      `json:"priority"`
 }
 
 // Represents all configurations for a single physical machine.
@@ -84,6 +89,18 @@ type ServiceConfiguration struct {
 	Revision      *ServiceRevision
 	SourceControl *SourceControl
 	Attributes    map[string]string
+
+	// Merge directives when this is used as the overwrites of a tag binding. See MergeServiceConfig.
+	Merge *MergeDirectives `json:",omitempty"`
+
+	// Restores the previous revision if a new revision doesn't become healthy. See WatchDeployment.
+	RollbackPolicy *RollbackPolicy `json:",omitempty"`
+
+	// Replaces the container next to the old one in a second slot. See bluegreen.go.
+	BlueGreen *BlueGreenSettings `json:",omitempty"`
+
+	// Slot of the container this configuration is for. Set by the daemon for blue/green services.
+	ContainerSlot string `json:",omitempty"`
 }
 
 type SourceControl struct {
@@ -95,6 +112,10 @@ type SourceControl struct {
 type ServiceRevision struct {
 	Revision       string
 	DeploymentTime time.Time
+
+	// Who set the revision and why. Shown in the revision history
+	User    string `json:",omitempty"`
+	Message string `json:",omitempty"`
 }
 
 type ConfigResultPublisher interface {
@@ -102,10 +123,9 @@ type ConfigResultPublisher interface {
 }
 
 type ConfigResultEtcdPublisher struct {
-	ttl           uint64
-	EtcdBasePath  string
-	EtcdEndpoints []string
-	etcd          etcd.KeysAPI
+	ttl          uint64
+	EtcdBasePath string
+	store        ConfigStore
 }
 
 // Stored inside file /orbit/services/<service>/endpoints/<host:port>
@@ -151,12 +171,6 @@ func (c BoundService) GetConfig() ServiceConfiguration {
 }
 
 func (c *ConfigResultEtcdPublisher) PublishServiceState(serviceName string, endpoint string, ok bool, info *EndpointInfo) {
-	if c.etcd == nil {
-		log.Debug("Creating new Etcd client (%+v) so that we can report that service %s at %s is %+v using ttl %d\n", c.EtcdEndpoints, serviceName, endpoint, ok, c.ttl)
-		c.etcd = GetEtcdClient(c.EtcdEndpoints)
-
-	}
-
 	if info != nil {
 		log.Debug("Setting service %s endpoint %s info, ok:%s, revision:%s\n", serviceName, endpoint, ok, info.Revision)
 	} else {
@@ -165,71 +179,90 @@ func (c *ConfigResultEtcdPublisher) PublishServiceState(serviceName string, endp
 
 	key := c.EtcdBasePath + "/services/" + serviceName + "/endpoints/" + endpoint
 
-	_, err := c.etcd.Get(context.Background(), key, nil)
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+	_, err := c.store.Get(key)
+	if err != nil && !IsKeyNotFound(err) {
 		fmt.Fprintf(os.Stderr, "Error getting key %s from etcd. Error: %+v\n", key, err)
-		c.etcd = nil
 		return
 	}
-	if ok == true && err != nil && strings.HasPrefix(err.Error(), "100:") {
+	if ok == true && IsKeyNotFound(err) {
 		// Key did not exists so we need to add the key
 		log.Info(LogEvent(ServiceStateChangeEvent{serviceName, endpoint, ok}))
-	} else if ok == false {
-		if err == nil {
-			log.Info(LogEvent(ServiceStateChangeEvent{serviceName, endpoint, ok}))
-		}
+	} else if ok == false && err == nil {
+		log.Info(LogEvent(ServiceStateChangeEvent{serviceName, endpoint, ok}))
 
-		_, err = c.etcd.Delete(context.Background(), key, &etcd.DeleteOptions{Recursive: true})
-		if err != nil && !strings.HasPrefix(err.Error(), "100:") {
+		err = c.store.Delete(key)
+		if err != nil && !IsKeyNotFound(err) {
 			fmt.Fprintf(os.Stderr, "Error deleting key %s from etcd. Error: %+v\n", key, err)
-			c.etcd = nil
 		}
 	}
 
 	if ok {
 		bytes, err := json.Marshal(info)
-		_, err = c.etcd.Set(context.Background(), key, string(bytes), &etcd.SetOptions{TTL: time.Duration(c.ttl) * time.Second})
+		err = c.store.Set(key, string(bytes), time.Duration(c.ttl)*time.Second)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error setting key %s to etcd. Error: %+v\n", key, err)
-			c.etcd = nil
 		}
 	}
 }
 
 // Polls for configuration updates and triggers a NewRuntimeConfigurationEvent.
+//
+// When the ConfigurationCache is running the configuration is read from the cache
+// instead of etcd, so polling is cheap and can be done after every cache change.
+// While the cache is not synced (for example its watch failed because etcd is down)
+// the configuration is read from etcd, and if that fails too the configuration is stale.
 func (s *Containrunner) PollConfigurationUpdate() {
-	etcdClient := GetEtcdClient(s.EtcdEndpoints)
+	var store ConfigStore
+	if s.configurationCache != nil && s.configurationCache.IsSynced() {
+		store = s.configurationCache
+	} else {
+		store = s.GetConfigStore()
+	}
 
-	var err error
+	// Read the configuration keys from the active generation so that half applied imports are never seen
+	store, err := s.GetActiveConfigurationView(store)
+	if err != nil {
+		log.Error(LogString("Error getting active configuration generation: " + err.Error()))
+		s.UseLastKnownGoodConfiguration()
+		return
+	}
 
 	var newConfiguration RuntimeConfiguration
+	var conflicts []TagConflict
 	// Handle new MachineConfiguration
-	newConfiguration.MachineConfiguration, err = s.GetMachineConfigurationByTags(etcdClient, s.Tags, s.MachineAddress)
+	newConfiguration.MachineConfiguration, conflicts, err = s.GetMachineConfigurationByTagsWithConflicts(store, s.Tags, s.MachineAddress)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "100:") {
-			log.Info(LogString("Error:" + err.Error()))
-		} else if strings.HasPrefix(err.Error(), "50") {
+		if IsKeyNotFound(err) {
 			log.Info(LogString("Error:" + err.Error()))
-			log.Info(LogString("Reconnecting to etcd..."))
-			etcdClient = GetEtcdClient(s.EtcdEndpoints)
-
 		} else {
-			panic(err)
+			log.Error(LogString("Error getting machine configuration: " + err.Error()))
 		}
+		s.UseLastKnownGoodConfiguration()
 		return
 	}
 
+	if len(conflicts) > 0 {
+		s.refuseTagConflicts(&newConfiguration.MachineConfiguration, conflicts)
+	}
+
 	// Handle new ServiceBackends
-	backends, err := GetAllServiceEndpoints(s.EtcdEndpoints, s.EtcdBasePath)
+	backends, err := GetAllServiceEndpointsFromStore(store, s.EtcdBasePath)
 	newConfiguration.ServiceBackends = backends
 	if err != nil {
 		log.Error("GetAllServiceEndpoints error: %+v", err)
+		s.UseLastKnownGoodConfiguration()
 		return
 	}
 
-	if !CompareOldAndNewConfiguration(s.currentConfiguration, newConfiguration) {
+	if stale, _ := s.IsConfigurationStale(); stale {
+		log.Info(LogString("Configuration was loaded from etcd again, it's no longer stale"))
+	}
+	s.setConfigurationStale(false, time.Now())
+
+	currentConfiguration := s.getCurrentConfiguration()
+	if !CompareOldAndNewConfiguration(currentConfiguration, newConfiguration) {
 		event := NewRuntimeConfigurationEvent{}
-		event.OldRuntimeConfiguration = s.currentConfiguration
+		event.OldRuntimeConfiguration = currentConfiguration
 		event.NewRuntimeConfiguration = newConfiguration
 
 		log.Info("Going to send NewRuntimeConfigurationEvent")
@@ -243,7 +276,50 @@ func (s *Containrunner) PollConfigurationUpdate() {
 		}
 		log.Info(msg)
 		*/
-		s.currentConfiguration = newConfiguration
+		s.setCurrentConfiguration(newConfiguration)
+
+		if s.StateFile != "" {
+			err = SaveRuntimeConfiguration(s.StateFile, newConfiguration)
+			if err != nil {
+				log.Warning("Could not save configuration into state file %s: %+v", s.StateFile, err)
+			}
+		}
+	}
+}
+
+// Falls back to the last known good configuration when the configuration can't be loaded from etcd.
+//
+// If this daemon has already loaded a configuration then it just keeps using it. Otherwise (for example
+// the machine was booted during an etcd outage) the configuration is loaded from the StateFile and
+// a NewRuntimeConfigurationEvent is triggered so that containers and haproxy are converged with it.
+// In both cases the configuration is marked as stale until it has been loaded from etcd again.
+func (s *Containrunner) UseLastKnownGoodConfiguration() {
+	stale, savedAt := s.IsConfigurationStale()
+	currentConfiguration := s.getCurrentConfiguration()
+
+	if currentConfiguration.MachineConfiguration.Services == nil && s.StateFile != "" && !stale {
+		configuration, savedAt, err := LoadRuntimeConfiguration(s.StateFile)
+		if err != nil {
+			log.Error("Could not load last known good configuration from state file %s: %+v", s.StateFile, err)
+			return
+		}
+
+		log.Warning(LogString(fmt.Sprintf("Using STALE configuration from state file %s saved at %s because etcd is not available", s.StateFile, savedAt)))
+
+		event := NewRuntimeConfigurationEvent{}
+		event.OldRuntimeConfiguration = currentConfiguration
+		event.NewRuntimeConfiguration = configuration
+
+		s.setCurrentConfiguration(configuration)
+		s.setConfigurationStale(true, savedAt)
+
+		s.incomingLoopbackEvents <- NewOrbitEvent(event)
+		return
+	}
+
+	if !stale {
+		log.Warning(LogString("Configuration could not be loaded from etcd, continuing with STALE configuration"))
+		s.setConfigurationStale(true, savedAt)
 	}
 }
 
@@ -294,7 +370,7 @@ func (c *Containrunner) LoadOrbitConfigurationFromFiles(startpath string) (*Orbi
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("LoadConfigurationsFromFiles: Could not load globalproperties.json due to error %+v", err))
 		} else {
-			fmt.Printf("Read globalproperties from %s\n", file)
+			log.Info(LogString("Read globalproperties from " + file))
 		}
 	}
 
@@ -343,6 +419,24 @@ func (c *Containrunner) LoadOrbitConfigurationFromFiles(startpath string) (*Orbi
 			err = json.Unmarshal([]byte(bytes), &mc.AuthoritativeNames)
 		}
 
+		fname = startpath + "/machineconfigurations/tags/" + tag.Name() + "/priority.json"
+		bytes, err = ioutil.ReadFile(fname)
+		if err == nil {
+			err = json.Unmarshal([]byte(bytes), &mc.Priority)
+			if err != nil {
+				return nil, fmt.Errorf("LoadConfigurationsFromFiles: Could not parse %s. Error: %+v", fname, err)
+			}
+		}
+
+		fname = startpath + "/machineconfigurations/tags/" + tag.Name() + "/includes.json"
+		bytes, err = ioutil.ReadFile(fname)
+		if err == nil {
+			err = json.Unmarshal([]byte(bytes), &mc.Includes)
+			if err != nil {
+				return nil, fmt.Errorf("LoadConfigurationsFromFiles: Could not parse %s. Error: %+v", fname, err)
+			}
+		}
+
 		files, err = ioutil.ReadDir(startpath + "/machineconfigurations/tags/" + tag.Name() + "/certs/")
 		if err == nil {
 			for _, file := range files {
@@ -427,40 +521,45 @@ func (c *Containrunner) LoadOrbitConfigurationFromFiles(startpath string) (*Orbi
 
 	}
 
+	// The tags are stored with their own bindings only, but all includes must resolve
+	for tag := range oc.MachineConfigurations {
+		_, _, err := ResolveTagConfiguration(tag, oc.TagLookup())
+		if err != nil {
+			return nil, fmt.Errorf("LoadConfigurationsFromFiles: %+v", err)
+		}
+	}
+
 	return oc, nil
 }
 
-func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *OrbitConfiguration, etcdClient etcd.KeysAPI) error {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
-
+func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *OrbitConfiguration, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
 		fmt.Fprintf(os.Stderr, "EtcdEndpoints: %s\n", c.EtcdEndpoints)
 	}
 
 	bytes, err := json.Marshal(orbitConfiguration.GlobalOrbitProperties)
-	_, err = etcdClient.Set(context.Background(), c.EtcdBasePath+"/globalproperties", string(bytes), nil)
+	err = store.Set(c.EtcdBasePath+"/globalproperties", string(bytes), 0)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error here: %+v\n", err)
-		fmt.Fprintf(os.Stderr, "etcdClient: %+v\n", etcdClient)
+		fmt.Fprintf(os.Stderr, "store: %+v\n", store)
 
 		return err
 	}
 
 	for tag, mc := range orbitConfiguration.MachineConfigurations {
-		etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag, "", &etcd.SetOptions{Dir: true})
-		etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/services", "", &etcd.SetOptions{Dir: true})
+		store.MkDir(c.EtcdBasePath + "/machineconfigurations/tags/" + tag)
+		store.MkDir(c.EtcdBasePath + "/machineconfigurations/tags/" + tag + "/services")
 
 		if mc.HAProxyConfiguration != nil {
-			_, err := etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/haproxy_config", mc.HAProxyConfiguration.Template, nil)
+			err := store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/haproxy_config", mc.HAProxyConfiguration.Template, 0)
 			if err != nil {
 				return err
 			}
 
 			if mc.HAProxyConfiguration.Certs != nil {
 				for name, contents := range mc.HAProxyConfiguration.Certs {
-					// TODO: implement old file removal
-
-					_, err := etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/certs/"+name, contents, nil)
+					err := store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/certs/"+name, contents, 0)
 					if err != nil {
 						return err
 					}
@@ -469,9 +568,7 @@ func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *Orbit
 
 			if mc.HAProxyConfiguration.Files != nil {
 				for name, contents := range mc.HAProxyConfiguration.Files {
-					// TODO: implement old file removal
-
-					_, err := etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/haproxy_files/"+name, contents, nil)
+					err := store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/haproxy_files/"+name, contents, 0)
 					if err != nil {
 						return err
 					}
@@ -482,23 +579,38 @@ func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *Orbit
 
 		if len(mc.AuthoritativeNames) > 0 {
 			bytes, err := json.Marshal(mc.AuthoritativeNames)
-			_, err = etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/authoritative_names", string(bytes), nil)
+			err = store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/authoritative_names", string(bytes), 0)
+			if err != nil {
+				return err
+			}
+
+		}
+
+		if len(mc.Includes) > 0 {
+			bytes, err := json.Marshal(mc.Includes)
+			err = store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/includes", string(bytes), 0)
 			if err != nil {
 				return err
 			}
+		}
 
+		if mc.Priority != 0 {
+			err = store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/priority", strconv.Itoa(mc.Priority), 0)
+			if err != nil {
+				return err
+			}
 		}
 
 		// First check if a service needs to be removed
 		key := c.EtcdBasePath + "/machineconfigurations/tags/" + tag + "/services"
-		res, err := etcdClient.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
+		res, err := store.List(key)
 		if err == nil {
-			for _, node := range res.Node.Nodes {
-				name := string(node.Key[len(res.Node.Key)+1:])
+			for _, node := range res.Nodes {
+				name := string(node.Key[len(res.Key)+1:])
 				_, exists := mc.Services[name]
 				if exists == false {
 					fmt.Printf("Service %s does not exists any more in tag %s, deleting it.\n", name, tag)
-					etcdClient.Delete(context.Background(), node.Key, &etcd.DeleteOptions{Recursive: true})
+					store.Delete(node.Key)
 				}
 			}
 		}
@@ -513,7 +625,7 @@ func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *Orbit
 				str = string(bytes)
 			}
 
-			_, err := etcdClient.Set(context.Background(), c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/services/"+name, str, nil)
+			err := store.Set(c.EtcdBasePath+"/machineconfigurations/tags/"+tag+"/services/"+name, str, 0)
 			if err != nil {
 				return err
 			}
@@ -521,10 +633,10 @@ func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *Orbit
 	}
 
 	for name, service := range orbitConfiguration.Services {
-		etcdClient.Set(context.Background(), c.EtcdBasePath+"/services/"+name, "", &etcd.SetOptions{Dir: true})
+		store.MkDir(c.EtcdBasePath + "/services/" + name)
 
 		bytes, err := json.Marshal(service)
-		_, err = etcdClient.Set(context.Background(), c.EtcdBasePath+"/services/"+name+"/config", string(bytes), nil)
+		err = store.Set(c.EtcdBasePath+"/services/"+name+"/config", string(bytes), 0)
 		if err != nil {
 			return err
 		}
@@ -534,18 +646,149 @@ func (c *Containrunner) UploadOrbitConfigurationToEtcd(orbitConfiguration *Orbit
 	return nil
 }
 
-func (c *Containrunner) GetAllServices(etcdClient etcd.KeysAPI) (map[string]ServiceConfiguration, error) {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
+// Returns the set of etcd keys which are owned by the orbit configuration directory tree.
+// Both files and directories are included. Runtime keys (service revisions, machine specific
+// revisions and endpoints) are not part of the tree and are never included.
+func (c *Containrunner) GetOrbitConfigurationKeys(orbitConfiguration *OrbitConfiguration) map[string]bool {
+	keys := make(map[string]bool)
+
+	keys[c.EtcdBasePath+"/globalproperties"] = true
+
+	for tag, mc := range orbitConfiguration.MachineConfigurations {
+		prefix := c.EtcdBasePath + "/machineconfigurations/tags/" + tag
+		keys[prefix] = true
+		keys[prefix+"/services"] = true
+
+		for name := range mc.Services {
+			keys[prefix+"/services/"+name] = true
+		}
+
+		if mc.HAProxyConfiguration != nil {
+			keys[prefix+"/haproxy_config"] = true
+
+			if len(mc.HAProxyConfiguration.Certs) > 0 {
+				keys[prefix+"/certs"] = true
+				for name := range mc.HAProxyConfiguration.Certs {
+					keys[prefix+"/certs/"+name] = true
+				}
+			}
+
+			if len(mc.HAProxyConfiguration.Files) > 0 {
+				keys[prefix+"/haproxy_files"] = true
+				for name := range mc.HAProxyConfiguration.Files {
+					keys[prefix+"/haproxy_files/"+name] = true
+				}
+			}
+		}
+
+		if len(mc.AuthoritativeNames) > 0 {
+			keys[prefix+"/authoritative_names"] = true
+		}
+
+		if len(mc.Includes) > 0 {
+			keys[prefix+"/includes"] = true
+		}
+
+		if mc.Priority != 0 {
+			keys[prefix+"/priority"] = true
+		}
+	}
+
+	for name := range orbitConfiguration.Services {
+		keys[c.EtcdBasePath+"/services/"+name] = true
+		keys[c.EtcdBasePath+"/services/"+name+"/config"] = true
+	}
+
+	return keys
+}
+
+// Deletes all keys from etcd which are not anymore present in the orbit configuration directory tree.
+// See GetPrunableKeys.
+//
+// Returns the list of deleted keys.
+func (c *Containrunner) PruneOrbitConfigurationFromEtcd(orbitConfiguration *OrbitConfiguration, store ConfigStore) ([]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	keys, err := c.GetPrunableKeys(orbitConfiguration, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	for _, key := range keys {
+		fmt.Printf("Key %s does not exists any more in the configuration, deleting it.\n", key)
+		err := store.Delete(key)
+		if err != nil && !IsKeyNotFound(err) {
+			return pruned, err
+		}
+		pruned = append(pruned, key)
+	}
+
+	return pruned, nil
+}
+
+// Returns the keys in the store which are not anymore present in the orbit configuration directory tree.
+//
+// Everything under /machineconfigurations/tags/ is owned by the tree, so tags, certs, haproxy files
+// and service bindings which are not in the orbitConfiguration are returned. Under /services/ only the
+// <service>/config key is owned by the tree; runtime keys like revision, machines/ and endpoints/
+// are left alone. Only the topmost key of a removed subtree is returned.
+func (c *Containrunner) GetPrunableKeys(orbitConfiguration *OrbitConfiguration, store ConfigStore) ([]string, error) {
+	keys := c.GetOrbitConfigurationKeys(orbitConfiguration)
+	var prunable []string
+
+	var prune func(node *ConfigNode)
+	prune = func(node *ConfigNode) {
+		if !keys[node.Key] {
+			prunable = append(prunable, node.Key)
+			return
+		}
+
+		for _, child := range node.Nodes {
+			prune(child)
+		}
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/machineconfigurations/tags")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, tag := range res.Nodes {
+			prune(tag)
+		}
+	}
 
+	res, err = store.List(c.EtcdBasePath + "/services")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, service := range res.Nodes {
+			for _, node := range service.Nodes {
+				if node.Key == service.Key+"/config" {
+					prune(node)
+				}
+			}
+		}
+	}
+
+	return prunable, nil
+}
+
+func (c *Containrunner) GetAllServices(store ConfigStore) (map[string]ServiceConfiguration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
 	services := make(map[string]ServiceConfiguration)
 	var service ServiceConfiguration
 
 	key := c.EtcdBasePath + "/services/"
-	res, err := etcdClient.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+	res, err := store.List(key)
+	if err != nil && !IsKeyNotFound(err) {
 		return nil, err
 	}
 
@@ -553,10 +796,10 @@ func (c *Containrunner) GetAllServices(etcdClient etcd.KeysAPI) (map[string]Serv
 		return nil, errors.New("No services found. Etcd path was: " + key)
 	}
 
-	for _, node := range res.Node.Nodes {
+	for _, node := range res.Nodes {
 		if node.Dir == true {
-			name := string(node.Key[len(res.Node.Key)+1:])
-			service, err = c.GetServiceByName(name, etcdClient, "")
+			name := string(node.Key[len(res.Key)+1:])
+			service, err = c.GetServiceByName(name, store, "")
 			if err != nil {
 				panic(err)
 			}
@@ -567,15 +810,14 @@ func (c *Containrunner) GetAllServices(etcdClient etcd.KeysAPI) (map[string]Serv
 	return services, nil
 }
 
-func (c *Containrunner) TagServiceToTag(service string, tag string, etcdClient etcd.KeysAPI) error {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
-
+func (c *Containrunner) TagServiceToTag(service string, tag string, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
 	key := c.EtcdBasePath + "/machineconfigurations/tags/" + tag + "/services/" + service
 	//fmt.Fprintf(os.Stderr, "Set key: %s\n", key)
-	_, err := etcdClient.Set(context.Background(), key, "{}", nil)
+	err := store.Set(key, "{}", 0)
 	if err != nil {
 		return err
 	}
@@ -583,12 +825,12 @@ func (c *Containrunner) TagServiceToTag(service string, tag string, etcdClient e
 	return nil
 }
 
-func (c *Containrunner) RemoveService(name string, etcdClient etcd.KeysAPI) error {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
+func (c *Containrunner) RemoveService(name string, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
-	_, err := etcdClient.Delete(context.Background(), c.EtcdBasePath+"/services/"+name, &etcd.DeleteOptions{Recursive: true})
+	err := store.Delete(c.EtcdBasePath + "/services/" + name)
 	if err != nil {
 		return err
 	}
@@ -596,13 +838,13 @@ func (c *Containrunner) RemoveService(name string, etcdClient etcd.KeysAPI) erro
 	return nil
 }
 
-func (c *Containrunner) GetServiceByName(name string, etcdClient etcd.KeysAPI, machineAddress string) (ServiceConfiguration, error) {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
+func (c *Containrunner) GetServiceByName(name string, store ConfigStore, machineAddress string) (ServiceConfiguration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
-	res, err := etcdClient.Get(context.Background(), c.EtcdBasePath+"/services/"+name, &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil { // 100: Key not found
+	res, err := store.List(c.EtcdBasePath + "/services/" + name)
+	if err != nil {
 		return ServiceConfiguration{}, err
 	}
 
@@ -610,7 +852,7 @@ func (c *Containrunner) GetServiceByName(name string, etcdClient etcd.KeysAPI, m
 	var serviceRevision *ServiceRevision = nil
 	//var machineServiceRevision *ServiceRevision
 
-	for _, node := range res.Node.Nodes {
+	for _, node := range res.Nodes {
 		if node.Dir == false && strings.HasSuffix(node.Key, "/config") {
 			err = json.Unmarshal([]byte(node.Value), &serviceConfiguration)
 			if err != nil {
@@ -660,32 +902,32 @@ func (c *Containrunner) GetServiceByName(name string, etcdClient etcd.KeysAPI, m
 	return serviceConfiguration, nil
 }
 
-func (c *Containrunner) GetGlobalOrbitProperties(etcdClient etcd.KeysAPI) (GlobalOrbitProperties, error) {
+func (c *Containrunner) GetGlobalOrbitProperties(store ConfigStore) (GlobalOrbitProperties, error) {
 	gop := GlobalOrbitProperties{}
 
 	key := c.EtcdBasePath + "/globalproperties"
-	res, err := etcdClient.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
+	res, err := store.List(key)
 
 	if err != nil {
-		if !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+		if !IsKeyNotFound(err) {
 			return gop, err
 		} else {
 			return gop, nil
 		}
 	}
 
-	err = json.Unmarshal([]byte(res.Node.Value), &gop)
+	err = json.Unmarshal([]byte(res.Value), &gop)
 
 	return gop, err
 }
 
 func (c *Containrunner) GetKnownTags() ([]string, error) {
 	var tags []string
-	etcdClient := GetEtcdClient(c.EtcdEndpoints)
+	store := c.GetConfigStore()
 
 	key := c.EtcdBasePath + "/machineconfigurations/tags/"
-	res, err := etcdClient.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+	res, err := store.List(key)
+	if err != nil && !IsKeyNotFound(err) {
 		return nil, err
 	}
 
@@ -693,9 +935,9 @@ func (c *Containrunner) GetKnownTags() ([]string, error) {
 		return nil, errors.New("No tags found. Etcd path was: " + key)
 	}
 
-	for _, node := range res.Node.Nodes {
+	for _, node := range res.Nodes {
 		if node.Dir == true {
-			name := string(node.Key[len(res.Node.Key)+1:])
+			name := string(node.Key[len(res.Key)+1:])
 			tags = append(tags, name)
 		}
 	}
@@ -722,175 +964,173 @@ func CopyServiceConfiguration(src ServiceConfiguration) ServiceConfiguration {
 	return dst
 }
 
-func MergeServiceConfig(dst ServiceConfiguration, overwrite ServiceConfiguration) ServiceConfiguration {
-
-	dst = CopyServiceConfiguration(dst)
-	overwrite = CopyServiceConfiguration(overwrite)
-
-	if overwrite.EndpointPort != 0 {
-		dst.EndpointPort = overwrite.EndpointPort
+// Returns the union of the given tags, with their includes resolved. Tags which don't exist are skipped.
+// Parts which the tags define differently are left out, see GetMachineConfigurationByTagsWithConflicts.
+func (c *Containrunner) GetMachineConfigurationByTags(store ConfigStore, tags []string, machineAddress string) (MachineConfiguration, error) {
+	configuration, conflicts, err := c.GetMachineConfigurationByTagsWithConflicts(store, tags, machineAddress)
+	for _, conflict := range conflicts {
+		fmt.Fprintf(os.Stderr, "Conflict in machine configuration: %s\n", conflict)
 	}
 
-	if overwrite.Container != nil {
-		if &overwrite.Container.Config != nil {
-			if &overwrite.Container.Config.Env != nil {
-				if &dst.Container.Config.Env == nil {
-					dst.Container.Config.Env = overwrite.Container.Config.Env
-				} else {
-					env := make(map[string]string)
-					for _, e := range dst.Container.Config.Env {
-						parts := strings.Split(e, "=")
-						env[parts[0]] = strings.Join(parts[1:], "=")
-					}
-
-					for _, e := range overwrite.Container.Config.Env {
-						parts := strings.Split(e, "=")
-						env[parts[0]] = strings.Join(parts[1:], "=")
-					}
-
-					dst.Container.Config.Env = make([]string, len(env))
-					i := 0
-					for k, v := range env {
-						dst.Container.Config.Env[i] = (k + "=" + v)
-						i++
-					}
-
-					sort.Strings(dst.Container.Config.Env)
-
-				}
-			}
+	return configuration, err
+}
 
-			if overwrite.Container.Config.Image != "" {
-				dst.Container.Config.Image = overwrite.Container.Config.Image
-			}
+// Returns the union of the given tags and the conflicts between the tags. See MergeMachineTags.
+func (c *Containrunner) GetMachineConfigurationByTagsWithConflicts(store ConfigStore, tags []string, machineAddress string) (MachineConfiguration, []TagConflict, error) {
+	configurations := make(map[string]*MachineConfiguration)
+	lookup := func(tag string) (*MachineConfiguration, error) {
+		return c.getTagConfiguration(store, tag, machineAddress)
+	}
 
-			if overwrite.Container.Config.Hostname != "" {
-				dst.Container.Config.Hostname = overwrite.Container.Config.Hostname
-			}
+	for _, tag := range tags {
+		mc, _, err := ResolveTagConfiguration(tag, lookup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting machine configuration for tag %s. Err: %+v\n", tag, err)
+			return MachineConfiguration{}, nil, err
+		}
 
+		if mc != nil {
+			configurations[tag] = mc
 		}
 	}
 
-	// If any check is defined in the overwrite settings then the entire overwrite checks rule array
-	// will overwrite the default. ie. we don't try to merge these together.
-	if overwrite.Checks != nil {
-		dst.Checks = overwrite.Checks
+	configuration, conflicts := MergeMachineTags(tags, configurations)
+	return configuration, conflicts, nil
+}
+
+// Returns the configuration of a single tag with its includes resolved and the tags which
+// were merged into it. See ResolveTagConfiguration.
+func (c *Containrunner) GetResolvedTagConfiguration(tag string, store ConfigStore) (*MachineConfiguration, []string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
-	if overwrite.Attributes != nil {
-		if dst.Attributes == nil {
-			dst.Attributes = overwrite.Attributes
-		} else {
-			for key, value := range overwrite.Attributes {
-				dst.Attributes[key] = value
-			}
-		}
+	mc, order, err := ResolveTagConfiguration(tag, func(tag string) (*MachineConfiguration, error) {
+		return c.getTagConfiguration(store, tag, "")
+	})
+	if err == nil && mc == nil {
+		err = fmt.Errorf("Tag %s not found", tag)
 	}
 
-	return dst
+	return mc, order, err
 }
 
-func (c *Containrunner) GetMachineConfigurationByTags(etcdClient etcd.KeysAPI, tags []string, machineAddress string) (MachineConfiguration, error) {
+// Reads the configuration of a single tag without resolving its includes. Returns nil if the tag doesn't exist.
+func (c *Containrunner) getTagConfiguration(store ConfigStore, tag string, machineAddress string) (*MachineConfiguration, error) {
 
-	var configuration MachineConfiguration
-	for _, tag := range tags {
+	configuration := new(MachineConfiguration)
 
-		key := c.EtcdBasePath + "/machineconfigurations/tags/" + tag
-		res, err := etcdClient.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
-		if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
-			fmt.Fprintf(os.Stderr, "Error getting machine configuration from key %s. Err: %+v\n", key, err)
-			return configuration, err
+	key := c.EtcdBasePath + "/machineconfigurations/tags/" + tag
+	res, err := store.List(key)
+	if err != nil && !IsKeyNotFound(err) {
+		fmt.Fprintf(os.Stderr, "Error getting machine configuration from key %s. Err: %+v\n", key, err)
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, node := range res.Nodes {
+		if node.Dir == false && strings.HasSuffix(node.Key, "/authoritative_names") {
+			json.Unmarshal([]byte(node.Value), &configuration.AuthoritativeNames)
 		}
 
-		if err != nil {
-			continue
+		if node.Dir == false && strings.HasSuffix(node.Key, "/priority") {
+			configuration.Priority, err = strconv.Atoi(node.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+			}
 		}
 
-		for _, node := range res.Node.Nodes {
-			if node.Dir == false && strings.HasSuffix(node.Key, "/authoritative_names") {
-				json.Unmarshal([]byte(node.Value), &configuration.AuthoritativeNames)
+		if node.Dir == false && strings.HasSuffix(node.Key, "/includes") {
+			err = json.Unmarshal([]byte(node.Value), &configuration.Includes)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
 			}
+		}
 
-			if node.Dir == true && strings.HasSuffix(node.Key, "/services") {
-				if configuration.Services == nil {
-					configuration.Services = make(map[string]BoundService, len(node.Nodes))
-				}
+		if node.Dir == true && strings.HasSuffix(node.Key, "/services") {
+			if configuration.Services == nil {
+				configuration.Services = make(map[string]BoundService, len(node.Nodes))
+			}
 
-				for _, serviceNode := range node.Nodes {
-					if serviceNode.Dir == false {
-						name := string(serviceNode.Key[len(node.Key)+1:])
+			for _, serviceNode := range node.Nodes {
+				if serviceNode.Dir == false {
+					name := string(serviceNode.Key[len(node.Key)+1:])
 
-						boundService := BoundService{}
+					boundService := BoundService{}
 
-						// The GetServiceByName creates completly new ServiceConfiguration instance
-						// So it's later safe to use MergeServiceConfig to modify it (it's not shared between machines or anything)
-						boundService.DefaultConfiguration, err = c.GetServiceByName(name, etcdClient, machineAddress)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "Error getting service %s: %+v\n", name, err)
-							return configuration, err
-						}
+					// The GetServiceByName creates completly new ServiceConfiguration instance
+					// So it's later safe to use MergeServiceConfig to modify it (it's not shared between machines or anything)
+					boundService.DefaultConfiguration, err = c.GetServiceByName(name, store, machineAddress)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error getting service %s: %+v\n", name, err)
+						return nil, err
+					}
 
-						if serviceNode.Value != "" && serviceNode.Value != "{}" {
-							var overwrite ServiceConfiguration
-							err = json.Unmarshal([]byte(serviceNode.Value), &overwrite)
+					if serviceNode.Value != "" && serviceNode.Value != "{}" {
+						var overwrite ServiceConfiguration
+						err = json.Unmarshal([]byte(serviceNode.Value), &overwrite)
 
-							boundService.Overwrites = &overwrite
-						}
-						configuration.Services[name] = boundService
+						boundService.Overwrites = &overwrite
 					}
+					configuration.Services[name] = boundService
 				}
 			}
+		}
 
-			if node.Dir == false && strings.HasSuffix(node.Key, "/haproxy_config") {
-				if configuration.HAProxyConfiguration == nil {
-					configuration.HAProxyConfiguration = NewHAProxyConfiguration()
-				}
-
-				configuration.HAProxyConfiguration.Template = node.Value
+		if node.Dir == false && strings.HasSuffix(node.Key, "/haproxy_config") {
+			if configuration.HAProxyConfiguration == nil {
+				configuration.HAProxyConfiguration = NewHAProxyConfiguration()
 			}
 
-			if node.Dir == true && strings.HasSuffix(node.Key, "/certs") {
-				if configuration.HAProxyConfiguration == nil {
-					configuration.HAProxyConfiguration = NewHAProxyConfiguration()
-				}
+			configuration.HAProxyConfiguration.Template = node.Value
+		}
 
-				for _, file := range node.Nodes {
-					if file.Dir == false {
-						name := string(file.Key[len(node.Key)+1:])
-						configuration.HAProxyConfiguration.Certs[name] = file.Value
-					}
-				}
+		if node.Dir == true && strings.HasSuffix(node.Key, "/certs") {
+			if configuration.HAProxyConfiguration == nil {
+				configuration.HAProxyConfiguration = NewHAProxyConfiguration()
 			}
 
-			if node.Dir == true && strings.HasSuffix(node.Key, "/haproxy_files") {
-				if configuration.HAProxyConfiguration == nil {
-					configuration.HAProxyConfiguration = NewHAProxyConfiguration()
+			for _, file := range node.Nodes {
+				if file.Dir == false {
+					name := string(file.Key[len(node.Key)+1:])
+					configuration.HAProxyConfiguration.Certs[name] = file.Value
 				}
+			}
+		}
 
-				for _, file := range node.Nodes {
-					if file.Dir == false {
-						name := string(file.Key[len(node.Key)+1:])
-						configuration.HAProxyConfiguration.Files[name] = file.Value
-					}
-				}
+		if node.Dir == true && strings.HasSuffix(node.Key, "/haproxy_files") {
+			if configuration.HAProxyConfiguration == nil {
+				configuration.HAProxyConfiguration = NewHAProxyConfiguration()
 			}
 
+			for _, file := range node.Nodes {
+				if file.Dir == false {
+					name := string(file.Key[len(node.Key)+1:])
+					configuration.HAProxyConfiguration.Files[name] = file.Value
+				}
+			}
 		}
+
 	}
 
 	return configuration, nil
 }
 
-func GetAllServiceEndpoints(etcdEndpoints []string, etcdBasePath string) (map[string]map[string]*EndpointInfo, error) {
+func GetAllServiceEndpoints(etcdEndpoints []string, security EtcdSecurity, etcdBasePath string) (map[string]map[string]*EndpointInfo, error) {
+	return GetAllServiceEndpointsFromStore(NewEtcdConfigStore(etcdEndpoints, security), etcdBasePath)
+}
 
-	serviceBackends := make(map[string]map[string]*EndpointInfo)
+func GetAllServiceEndpointsFromStore(store ConfigStore, etcdBasePath string) (map[string]map[string]*EndpointInfo, error) {
 
-	etcdClient := GetEtcdClient(etcdEndpoints)
+	serviceBackends := make(map[string]map[string]*EndpointInfo)
 
-	res, err := etcdClient.Get(context.Background(), etcdBasePath+"/services/", &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
-		log.Error("Could not get services from etcd endpoint: %+v", etcdEndpoints)
-		panic(err)
+	res, err := store.List(etcdBasePath + "/services/")
+	if err != nil && !IsKeyNotFound(err) {
+		log.Error("Could not get services from etcd: %+v", err)
+		return nil, err
 	}
 
 	if err != nil {
@@ -898,11 +1138,11 @@ func GetAllServiceEndpoints(etcdEndpoints []string, etcdBasePath string) (map[st
 	}
 
 	// Iterate over all services...
-	for _, service := range res.Node.Nodes {
+	for _, service := range res.Nodes {
 
 		// By finding the directory which name is the service name
 		if service.Dir == true {
-			serviceName := string(service.Key[len(res.Node.Key)+1:])
+			serviceName := string(service.Key[len(res.Key)+1:])
 
 			// From that directory iterate over all items
 			for _, item := range service.Nodes {
@@ -935,10 +1175,10 @@ func GetAllServiceEndpoints(etcdEndpoints []string, etcdBasePath string) (map[st
 
 func (c Containrunner) GetEndpointsForService(service_name string) (map[string]*EndpointInfo, error) {
 
-	etcdClient := GetEtcdClient(c.EtcdEndpoints)
+	store := c.GetConfigStore()
 
-	res, err := etcdClient.Get(context.Background(), c.EtcdBasePath+"/services/"+service_name+"/endpoints", &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+	res, err := store.List(c.EtcdBasePath + "/services/" + service_name + "/endpoints")
+	if err != nil && !IsKeyNotFound(err) {
 		log.Error("Could not get service endpoints: %+v", err.Error())
 		return nil, err
 	}
@@ -949,9 +1189,9 @@ func (c Containrunner) GetEndpointsForService(service_name string) (map[string]*
 
 	backendServers := make(map[string]*EndpointInfo)
 
-	for _, endpoint := range res.Node.Nodes {
+	for _, endpoint := range res.Nodes {
 		if endpoint.Dir == false {
-			name := string(endpoint.Key[len(res.Node.Key)+1:])
+			name := string(endpoint.Key[len(res.Key)+1:])
 			endpointInfo := new(EndpointInfo)
 			json.Unmarshal([]byte(endpoint.Value), endpointInfo)
 			backendServers[name] = endpointInfo
@@ -986,16 +1226,22 @@ func (c *Containrunner) ReadServiceFromFile(filename string) (ServiceConfigurati
 	return serviceConfiguration, nil
 }
 
-func (c Containrunner) GetServiceRevision(service_name string, etcdClient etcd.KeysAPI) (*ServiceRevision, error) {
+// Returns nil if the service has no revision set
+func (c Containrunner) GetServiceRevision(service_name string, store ConfigStore) (*ServiceRevision, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
 
-	res, err := etcdClient.Get(context.Background(), c.EtcdBasePath+"/services/"+service_name+"/revision", &etcd.GetOptions{Recursive: true, Sort: true})
-	if err != nil && !strings.HasPrefix(err.Error(), "100:") { // 100: Key not found
+	res, err := store.List(c.EtcdBasePath + "/services/" + service_name + "/revision")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
 		panic(err)
 	}
 
 	serviceRevision := new(ServiceRevision)
 
-	err = json.Unmarshal([]byte(res.Node.Value), serviceRevision)
+	err = json.Unmarshal([]byte(res.Value), serviceRevision)
 	if err != nil {
 		return nil, err
 	}
@@ -1003,29 +1249,22 @@ func (c Containrunner) GetServiceRevision(service_name string, etcdClient etcd.K
 	return serviceRevision, nil
 }
 
-func (c Containrunner) SetServiceRevision(service_name string, serviceRevision ServiceRevision, etcdClient etcd.KeysAPI) error {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
-	}
-
-	bytes, err := json.Marshal(serviceRevision)
-	_, err = etcdClient.Set(context.Background(), c.EtcdBasePath+"/services/"+service_name+"/revision", string(bytes), nil)
-	if err != nil {
-		return err
+// Sets the revision on every machine and appends it into the revision history
+func (c Containrunner) SetServiceRevision(service_name string, serviceRevision ServiceRevision, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
-	etcdClient.Delete(context.Background(), c.EtcdBasePath+"/services/"+service_name+"/machines", &etcd.DeleteOptions{Recursive: true})
-
-	return nil
+	return setServiceRevision(c.EtcdBasePath+"/services/"+service_name, serviceRevision, store)
 }
 
-func (c Containrunner) SetServiceRevisionForMachine(service_name string, serviceRevision ServiceRevision, machineAddress string, etcdClient etcd.KeysAPI) error {
-	if etcdClient == nil {
-		etcdClient = GetEtcdClient(c.EtcdEndpoints)
+func (c Containrunner) SetServiceRevisionForMachine(service_name string, serviceRevision ServiceRevision, machineAddress string, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
 	}
 
 	bytes, err := json.Marshal(serviceRevision)
-	_, err = etcdClient.Set(context.Background(), c.EtcdBasePath+"/services/"+service_name+"/machines/"+machineAddress, string(bytes), nil)
+	err = store.Set(c.EtcdBasePath+"/services/"+service_name+"/machines/"+machineAddress, string(bytes), 0)
 	if err != nil {
 		return err
 	}
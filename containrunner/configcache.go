@@ -0,0 +1,225 @@
+package containrunner
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReadOnlyConfigurationCache = errors.New("ConfigurationCache is read only")
+
+// Local mirror of the orbit keyspace in the ConfigStore.
+//
+// The cache is populated with a single recursive list and after that it's kept
+// up to date by applying the events from a recursive watch, starting from
+// the last seen index. A full resync is only done when the watch has fallen
+// so far behind that the store no longer has the events (ErrIndexCleared).
+//
+// The cache implements the read side of ConfigStore so that it can be passed to
+// all the existing functions which read configuration (GetMachineConfigurationByTags etc).
+// All write operations return ErrReadOnlyConfigurationCache.
+type ConfigurationCache struct {
+	EtcdBasePath string
+
+	lock    sync.Mutex
+	memory  *MemoryConfigStore
+	synced  bool
+	changes chan bool
+	watcher ConfigWatcher
+	stopped bool
+}
+
+func NewConfigurationCache(etcdBasePath string) *ConfigurationCache {
+	cc := new(ConfigurationCache)
+	cc.EtcdBasePath = etcdBasePath
+	cc.changes = make(chan bool, 1)
+	cc.memory = NewMemoryConfigStore()
+
+	return cc
+}
+
+// Returns a channel which receives a value every time the cache contents has changed.
+// Multiple changes are coalesced into one notification if nobody is reading the channel.
+func (cc *ConfigurationCache) Changes() <-chan bool {
+	return cc.changes
+}
+
+// Returns true after the cache has been populated from the store and it's not waiting for a resync.
+// The cache is not synced after its watch on the store has failed until the next successful resync.
+func (cc *ConfigurationCache) IsSynced() bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.synced
+}
+
+func (cc *ConfigurationCache) setSynced(synced bool) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.synced = synced
+}
+
+// Returns the last store index which has been applied into the cache.
+func (cc *ConfigurationCache) Index() uint64 {
+	return cc.memory.Index()
+}
+
+func (cc *ConfigurationCache) notify() {
+	select {
+	case cc.changes <- true:
+	default:
+	}
+}
+
+// Reads the entire orbit keyspace from the store and replaces the cache contents with it.
+func (cc *ConfigurationCache) Resync(store ConfigStore) error {
+	node, err := store.List(cc.EtcdBasePath)
+	if err != nil {
+		notFound, ok := err.(*KeyNotFoundError)
+		if !ok {
+			return err
+		}
+
+		// Nothing has been imported yet, so we just start from an empty cache
+		cc.memory.replace(nil, notFound.Index)
+	} else {
+		cc.memory.replace(node, node.Index)
+	}
+
+	cc.setSynced(true)
+
+	log.Info(LogString("ConfigurationCache resynced"))
+	cc.notify()
+
+	return nil
+}
+
+// Applies a single watch event into the cache. Returns true if the cache contents changed.
+//
+// Refreshing a key with the same value (like the endpoint TTL refreshes do) is not considered as a change.
+// Changes to the runtime status of the machines and endpoints are applied but don't notify the listeners,
+// see isStatusKey.
+func (cc *ConfigurationCache) Apply(event *ConfigEvent) bool {
+	if event == nil || event.Node == nil {
+		return false
+	}
+
+	if event.Node.Key != cc.EtcdBasePath && !strings.HasPrefix(event.Node.Key, cc.EtcdBasePath+"/") {
+		cc.memory.advanceIndex(event.Node.ModifiedIndex)
+		return false
+	}
+
+	changed := cc.memory.Apply(event)
+	if changed && !cc.isStatusKey(event.Node.Key) {
+		cc.notify()
+	}
+
+	return changed
+}
+
+// Returns true for the keys under machines/ and services/<name>/health which the daemons publish
+// about themselves. They are kept in the cache (the drain requests are read from it) but don't
+// affect the configuration, so there's no need to poll the configuration when they change.
+func (cc *ConfigurationCache) isStatusKey(key string) bool {
+	machines := cc.EtcdBasePath + "/machines"
+	if key == machines || strings.HasPrefix(key, machines+"/") {
+		return true
+	}
+
+	services := cc.EtcdBasePath + "/services/"
+	if !strings.HasPrefix(key, services) {
+		return false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, services), "/", 3)
+	return len(parts) >= 2 && parts[1] == "health"
+}
+
+// Keeps the cache up to date by following the changes in the store. Blocks until Stop() is called.
+func (cc *ConfigurationCache) Follow(store ConfigStore) {
+	for {
+		cc.lock.Lock()
+		stopped := cc.stopped
+		cc.lock.Unlock()
+		if stopped {
+			return
+		}
+
+		if !cc.IsSynced() {
+			err := cc.Resync(store)
+			if err != nil {
+				log.Warning("ConfigurationCache could not resync: %+v", err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+		}
+
+		watcher := store.Watch(cc.EtcdBasePath, cc.Index())
+		cc.lock.Lock()
+		if cc.stopped {
+			cc.lock.Unlock()
+			watcher.Stop()
+			return
+		}
+		cc.watcher = watcher
+		cc.lock.Unlock()
+
+		for {
+			event, err := watcher.Next()
+			if err != nil {
+				if err == ErrIndexCleared {
+					log.Info(LogString("ConfigurationCache watch fell too far behind, doing full resync"))
+					cc.setSynced(false)
+				} else if err != ErrWatcherStopped {
+					// The cache might miss changes until it has been resynced, so it can't be
+					// used as an up to date copy of the store in the meantime
+					log.Warning("ConfigurationCache watch error: %+v", err)
+					cc.setSynced(false)
+					time.Sleep(time.Second)
+				}
+				break
+			}
+
+			cc.Apply(event)
+		}
+	}
+}
+
+// Stops a running Follow()
+func (cc *ConfigurationCache) Stop() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	cc.stopped = true
+	if cc.watcher != nil {
+		cc.watcher.Stop()
+	}
+}
+
+func (cc *ConfigurationCache) Get(key string) (*ConfigNode, error) {
+	return cc.memory.Get(key)
+}
+
+func (cc *ConfigurationCache) List(key string) (*ConfigNode, error) {
+	return cc.memory.List(key)
+}
+
+func (cc *ConfigurationCache) Set(key string, value string, ttl time.Duration) error {
+	return ErrReadOnlyConfigurationCache
+}
+
+func (cc *ConfigurationCache) MkDir(key string) error {
+	return ErrReadOnlyConfigurationCache
+}
+
+func (cc *ConfigurationCache) Delete(key string) error {
+	return ErrReadOnlyConfigurationCache
+}
+
+func (cc *ConfigurationCache) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	return ErrReadOnlyConfigurationCache
+}
+
+// Watches the changes which are applied into the cache
+func (cc *ConfigurationCache) Watch(key string, afterIndex uint64) ConfigWatcher {
+	return cc.memory.Watch(key, afterIndex)
+}
@@ -0,0 +1,245 @@
+package containrunner
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfigurationCacheApply(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	changed := cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/config", Value: "{}", ModifiedIndex: 5}})
+	assert.Equal(t, true, changed)
+	assert.Equal(t, uint64(5), cc.Index())
+
+	res, err := cc.List("/test/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, true, res.Dir)
+	assert.Equal(t, "/test/services/ubuntu", res.Nodes[0].Key)
+	assert.Equal(t, true, res.Nodes[0].Dir)
+	assert.Equal(t, "{}", res.Nodes[0].Nodes[0].Value)
+
+	// Refreshing the same value is not a change
+	changed = cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/config", Value: "{}", ModifiedIndex: 6}})
+	assert.Equal(t, false, changed)
+	assert.Equal(t, uint64(6), cc.Index())
+
+	changed = cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/endpoints/10.0.0.1:3500", Value: "{}", ModifiedIndex: 7}})
+	assert.Equal(t, true, changed)
+
+	changed = cc.Apply(&ConfigEvent{Action: "expire", Node: &ConfigNode{Key: "/test/services/ubuntu/endpoints/10.0.0.1:3500", ModifiedIndex: 8}})
+	assert.Equal(t, true, changed)
+
+	_, err = cc.Get("/test/services/ubuntu/endpoints/10.0.0.1:3500")
+	assert.True(t, IsKeyNotFound(err))
+
+	changed = cc.Apply(&ConfigEvent{Action: "delete", Node: &ConfigNode{Key: "/test/services/ubuntu", Dir: true, ModifiedIndex: 9}})
+	assert.Equal(t, true, changed)
+
+	res, err = cc.List("/test/services")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res.Nodes))
+
+	// Keys outside the base path are ignored
+	changed = cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/other/foo", Value: "bar", ModifiedIndex: 10}})
+	assert.Equal(t, false, changed)
+	assert.Equal(t, uint64(10), cc.Index())
+}
+
+func TestConfigurationCacheApplyStatusKeysDoesNotNotify(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	changed := cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machines/10.0.0.1/heartbeat", Value: "{}", ModifiedIndex: 5}})
+	assert.Equal(t, true, changed)
+
+	select {
+	case <-cc.Changes():
+		t.Fatal("Change notification for a machine heartbeat")
+	default:
+	}
+
+	// The status is still kept in the cache
+	res, err := cc.Get("/test/machines/10.0.0.1/heartbeat")
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", res.Value)
+
+	changed = cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/health/10.0.0.1:3500", Value: "{}", ModifiedIndex: 6}})
+	assert.Equal(t, true, changed)
+
+	select {
+	case <-cc.Changes():
+		t.Fatal("Change notification for an endpoint health update")
+	default:
+	}
+
+	for index, key := range []string{"/test/machinesettings", "/test/services/health/config"} {
+		cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Value: "{}", ModifiedIndex: uint64(7 + index)}})
+		select {
+		case <-cc.Changes():
+		default:
+			t.Fatal("No change notification for " + key)
+		}
+	}
+}
+
+func TestConfigurationCacheGetNonRecursive(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/b/services/ubuntu", Value: "{}", ModifiedIndex: 1}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/a/haproxy_config", Value: "foo", ModifiedIndex: 2}})
+
+	res, err := cc.Get("/test/machineconfigurations/tags")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res.Nodes))
+	assert.Equal(t, "/test/machineconfigurations/tags/a", res.Nodes[0].Key)
+	assert.Equal(t, "/test/machineconfigurations/tags/b", res.Nodes[1].Key)
+	assert.Equal(t, 0, len(res.Nodes[0].Nodes))
+
+	err = cc.Set("/test/foo", "bar", 0)
+	assert.Equal(t, ErrReadOnlyConfigurationCache, err)
+}
+
+func TestGetMachineConfigurationByTagsFromConfigurationCache(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/config", Value: `{"Name":"ubuntu","EndpointPort":3500,"Container":{"Config":{"Image":"ubuntu"}}}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/revision", Value: `{"Revision":"asdf"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/endpoints/10.0.0.1:3500", Value: `{"Revision":"asdf"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/services/ubuntu", Value: `{"EndpointPort":3501}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/haproxy_config", Value: "foobar"}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/certs/test.pem", Value: "----TEST-----"}})
+
+	var containrunner Containrunner
+	containrunner.EtcdBasePath = "/test"
+
+	configuration, err := containrunner.GetMachineConfigurationByTags(cc, []string{"testtag"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ubuntu", configuration.Services["ubuntu"].GetConfig().Name)
+	assert.Equal(t, 3501, configuration.Services["ubuntu"].GetConfig().EndpointPort)
+	assert.Equal(t, "asdf", configuration.Services["ubuntu"].GetConfig().Revision.Revision)
+	assert.Equal(t, "foobar", configuration.HAProxyConfiguration.Template)
+	assert.Equal(t, "----TEST-----", configuration.HAProxyConfiguration.Certs["test.pem"])
+
+	backends, err := GetAllServiceEndpointsFromStore(cc, "/test")
+	assert.Nil(t, err)
+	assert.Equal(t, "asdf", backends["ubuntu"]["10.0.0.1:3500"].Revision)
+}
+
+func TestConfigurationCacheFollow(t *testing.T) {
+	store := NewMemoryConfigStore()
+	store.Set("/test/services/ubuntu/config", "{}", 0)
+
+	cc := NewConfigurationCache("/test")
+	go cc.Follow(store)
+	defer cc.Stop()
+
+	<-cc.Changes()
+	assert.True(t, cc.IsSynced())
+
+	res, err := cc.Get("/test/services/ubuntu/config")
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", res.Value)
+
+	store.Set("/test/services/ubuntu/revision", `{"Revision":"asdf"}`, 0)
+
+	select {
+	case <-cc.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("No change notification")
+	}
+
+	res, err = cc.Get("/test/services/ubuntu/revision")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Revision":"asdf"}`, res.Value)
+	assert.Equal(t, store.Index(), cc.Index())
+}
+
+var errTestStoreUnavailable = errors.New("store is unavailable")
+
+// MemoryConfigStore which can be made unavailable like etcd during an outage
+type unavailableConfigStore struct {
+	*MemoryConfigStore
+	down int32
+}
+
+func (s *unavailableConfigStore) Get(key string) (*ConfigNode, error) {
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errTestStoreUnavailable
+	}
+	return s.MemoryConfigStore.Get(key)
+}
+
+func (s *unavailableConfigStore) List(key string) (*ConfigNode, error) {
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errTestStoreUnavailable
+	}
+	return s.MemoryConfigStore.List(key)
+}
+
+func (s *unavailableConfigStore) Watch(key string, afterIndex uint64) ConfigWatcher {
+	return &unavailableConfigWatcher{s, s.MemoryConfigStore.Watch(key, afterIndex)}
+}
+
+type unavailableConfigWatcher struct {
+	store   *unavailableConfigStore
+	watcher ConfigWatcher
+}
+
+func (w *unavailableConfigWatcher) Next() (*ConfigEvent, error) {
+	if atomic.LoadInt32(&w.store.down) == 1 {
+		return nil, errTestStoreUnavailable
+	}
+	event, err := w.watcher.Next()
+	if err == nil && atomic.LoadInt32(&w.store.down) == 1 {
+		return nil, errTestStoreUnavailable
+	}
+	return event, err
+}
+
+func (w *unavailableConfigWatcher) Stop() {
+	w.watcher.Stop()
+}
+
+func TestConfigurationCacheWatchErrorMarksConfigurationStale(t *testing.T) {
+	store := &unavailableConfigStore{MemoryConfigStore: NewMemoryConfigStore()}
+	store.Set("/test/services/ubuntu/config", "{}", 0)
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+	ct.ConfigStore = store
+	ct.configurationCache = NewConfigurationCache("/test")
+	go ct.configurationCache.Follow(store)
+	defer ct.configurationCache.Stop()
+
+	<-ct.configurationCache.Changes()
+	assert.True(t, ct.configurationCache.IsSynced())
+
+	// etcd goes down, the watch fails when it wakes up
+	atomic.StoreInt32(&store.down, 1)
+	store.MemoryConfigStore.Set("/test/services/ubuntu/revision", `{"Revision":"asdf"}`, 0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ct.configurationCache.IsSynced() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, ct.configurationCache.IsSynced())
+
+	ct.PollConfigurationUpdate()
+	stale, _ := ct.IsConfigurationStale()
+	assert.True(t, stale)
+
+	// The cache resyncs once etcd is back
+	atomic.StoreInt32(&store.down, 0)
+	select {
+	case <-ct.configurationCache.Changes():
+	case <-time.After(10 * time.Second):
+		t.Fatal("No resync")
+	}
+	assert.True(t, ct.configurationCache.IsSynced())
+	res, err := ct.configurationCache.Get("/test/services/ubuntu/revision")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Revision":"asdf"}`, res.Value)
+}
@@ -0,0 +1,174 @@
+package containrunner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage for the orbit configuration and runtime state (revisions, endpoints etc).
+//
+// Keys are slash separated paths like "/orbit/services/comet/config". Parent directories
+// are created automatically when a key is set.
+//
+// There are four implementations: EtcdConfigStore and EtcdV3ConfigStore which are used in clusters,
+// DirectoryConfigStore which allows a single standalone machine to run orbit without
+// etcd and MemoryConfigStore for tests.
+type ConfigStore interface {
+	// Returns a single key. A directory is returned with its direct children.
+	// Returns a *KeyNotFoundError if the key doesn't exist.
+	Get(key string) (*ConfigNode, error)
+
+	// Returns the key and everything under it. Children are sorted by their key.
+	// Returns a *KeyNotFoundError if the key doesn't exist.
+	List(key string) (*ConfigNode, error)
+
+	// Sets the value of a key. The key expires after ttl unless ttl is zero.
+	Set(key string, value string, ttl time.Duration) error
+
+	// Creates a directory. Creating a directory which already exists is not an error.
+	MkDir(key string) error
+
+	// Deletes a key and everything under it.
+	// Returns a *KeyNotFoundError if the key doesn't exist.
+	Delete(key string) error
+
+	// Sets the value of a key only if its ModifiedIndex is prevIndex. Zero prevIndex means
+	// that the key must not exist. Returns a *CompareFailedError if the condition doesn't hold.
+	CompareAndSwap(key string, value string, prevIndex uint64) error
+
+	// Returns a watcher which receives all changes under key which happened after afterIndex.
+	Watch(key string, afterIndex uint64) ConfigWatcher
+}
+
+// ConfigStores which can apply several changes atomically. Used by the import so that
+// the live configuration keys are only changed while the import is still the latest one.
+type TransactionalConfigStore interface {
+	ConfigStore
+
+	// Applies all operations if every key in conditions still has the given ModifiedIndex
+	// (zero means that the key must not exist). Returns a *CompareFailedError if a condition
+	// doesn't hold and ErrTransactionTooLarge if the store can't apply that many operations at once.
+	Commit(conditions map[string]uint64, operations []ConfigOperation) error
+
+	// Returns how many operations a single Commit can apply, zero means that there's no limit.
+	MaxOperations() int
+}
+
+// A single change inside a transaction
+type ConfigOperation struct {
+	Action string // "set", "mkdir" or "delete" (recursive)
+	Key    string
+	Value  string
+}
+
+type ConfigWatcher interface {
+	// Blocks until the next change. Returns ErrIndexCleared if the changes after the
+	// requested index are no longer available and ErrWatcherStopped after Stop.
+	Next() (*ConfigEvent, error)
+
+	// Stops the watcher and unblocks a waiting Next
+	Stop()
+}
+
+type ConfigNode struct {
+	Key           string
+	Value         string
+	Dir           bool
+	Nodes         []*ConfigNode
+	ModifiedIndex uint64
+
+	// Index of the store when the node was read. Only set on the node returned by Get and List.
+	Index uint64
+}
+
+// Change which is returned by ConfigWatcher.Next
+type ConfigEvent struct {
+	Action string // "set", "delete" or "expire"
+	Node   *ConfigNode
+}
+
+var ErrIndexCleared = errors.New("ConfigStore: the requested watch index has been cleared")
+var ErrWatcherStopped = errors.New("ConfigStore: watcher stopped")
+
+type KeyNotFoundError struct {
+	Key   string
+	Index uint64
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key not found: %s", e.Key)
+}
+
+type CompareFailedError struct {
+	Key string
+}
+
+func (e *CompareFailedError) Error() string {
+	return fmt.Sprintf("Compare failed: %s", e.Key)
+}
+
+func IsKeyNotFound(err error) bool {
+	_, ok := err.(*KeyNotFoundError)
+	return ok
+}
+
+func IsCompareFailed(err error) bool {
+	_, ok := err.(*CompareFailedError)
+	return ok
+}
+
+// Returns the ConfigStore of this Containrunner. If no store has been set then
+// an EtcdConfigStore is created from EtcdEndpoints and EtcdSecurity.
+func (c *Containrunner) GetConfigStore() ConfigStore {
+	if c.ConfigStore == nil {
+		c.ConfigStore = NewEtcdConfigStore(c.EtcdEndpoints, c.EtcdSecurity)
+	}
+	return c.ConfigStore
+}
+
+// Returns the keys and values of all keys (not directories) under the node.
+func FlattenConfigNode(node *ConfigNode) map[string]string {
+	values := make(map[string]string)
+
+	var flatten func(node *ConfigNode)
+	flatten = func(node *ConfigNode) {
+		if !node.Dir {
+			values[node.Key] = node.Value
+		}
+		for _, child := range node.Nodes {
+			flatten(child)
+		}
+	}
+	flatten(node)
+
+	return values
+}
+
+func parentKey(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return key[0:i]
+}
+
+func cleanKey(key string) string {
+	key = "/" + strings.Trim(key, "/")
+	for strings.Contains(key, "//") {
+		key = strings.Replace(key, "//", "/", -1)
+	}
+	return key
+}
+
+type configNodesByKey []*ConfigNode
+
+func (a configNodesByKey) Len() int           { return len(a) }
+func (a configNodesByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a configNodesByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+
+func sortConfigNodes(nodes []*ConfigNode) {
+	sort.Sort(configNodesByKey(nodes))
+}
@@ -16,6 +16,7 @@ var log = logging.MustGetLogger("containrunner")
 type Containrunner struct {
 	Tags                       []string
 	EtcdEndpoints              []string
+	EtcdSecurity               EtcdSecurity
 	exitChannel                chan bool
 	MachineAddress             string
 	CheckIntervalInMs          int
@@ -30,7 +31,10 @@ type Containrunner struct {
 	CheckEngine                CheckEngine
 	lastConverge               time.Time
 	lastConvergeMu             sync.Mutex
+	lastConvergeAttempt        time.Time
+	lastConvergeError          string
 	currentConfiguration       RuntimeConfiguration
+	currentConfigurationMu     sync.RWMutex
 	newConfiguration           RuntimeConfiguration
 	webserver                  Webserver
 	pollerStarted              int32
@@ -41,6 +45,55 @@ type Containrunner struct {
 
 	localInstanceInformation *LocalInstanceInformation
 
+	// Expanded configuration of the services at the last successful converge. See keepFailedServices
+	expandedServices map[string]ServiceConfiguration
+
+	configurationCache *ConfigurationCache
+
+	// Number of configuration generations kept by the imports. Zero means DefaultConfigurationGenerationRetention
+	ConfigurationGenerationRetention int
+	activeView                       activeConfigurationView
+	activeViewMu                     sync.Mutex
+
+	// Name of the environment (see SetEnvironment) and the base path without the environment.
+	Environment  string
+	EtcdRootPath string
+
+	// Storage for the configuration and runtime state. Created from EtcdEndpoints by GetConfigStore if not set.
+	ConfigStore ConfigStore
+
+	// Path to the local file where the last known good configuration is stored. Empty disables the feature.
+	StateFile             string
+	configurationStale    bool
+	configurationLoadedAt time.Time
+	configurationStaleMu  sync.Mutex
+
+	// Seconds to wait after the endpoints have been removed before the daemon exits. See Shutdown
+	DrainPeriodInSeconds int
+	draining             int32
+	leaving              int32
+
+	// Address (host:port) of the service discovery DNS server, empty disables it. See DNSServer
+	DNSAddress string
+	DNSTTL     int
+	dnsServer  DNSServer
+
+	// Check result counters of the local endpoints, see EndpointHealth
+	endpointHealth   map[string]*endpointHealthState
+	endpointHealthMu sync.Mutex
+
+	// Build date of orbitctl, published in the machine heartbeat
+	Version   string
+	startedAt time.Time
+
+	// Output of haproxy -v, read once at startup for the machine heartbeat
+	haproxyVersion string
+
+	// Local file with the cluster key which decrypts the secrets referenced by the services. See secrets.go
+	SecretKeyFile string
+
+	// Local docker config.json with registry credentials. DefaultDockerConfigFile is used if empty
+	DockerConfigFile string
 }
 
 var configResultPublisher ConfigResultPublisher
@@ -70,14 +123,16 @@ func NewLocalInstanceInformation() (*LocalInstanceInformation) {
 func (s *Containrunner) Init() {
 	rand.Seed(time.Now().UnixNano())
 
-	etcdClient := GetEtcdClient(s.EtcdEndpoints)
+	store := s.GetConfigStore()
 
 	s.localInstanceInformation = NewLocalInstanceInformation()
+	s.configurationCache = NewConfigurationCache(s.EtcdBasePath)
 
-	globalConfiguration, err := s.GetGlobalOrbitProperties(etcdClient)
+	// Don't give up if etcd is not available, so that the daemon can still run
+	// with the last known good configuration from the StateFile.
+	globalConfiguration, err := s.GetGlobalOrbitProperties(store)
 	if err != nil {
-		log.Info(LogString("Could not get global orbit properties"))
-		return
+		log.Warning(LogString("Could not get global orbit properties, continuing without them: " + err.Error()))
 	}
 
 	log.Debug("Containrunner.Init called. etcd endpoints: %+v, Global configuration: %+v\n", s.EtcdEndpoints, globalConfiguration)
@@ -111,9 +166,11 @@ func (s *Containrunner) Init() {
 // are simply sent from somewhere in the application instance.
 //
 // In addition there's a secondary priority block which executes after a short timeout. This
-// block polls for new configuration changes and triggers periodic operations.
+// block polls for new configuration changes and triggers periodic operations. Configuration
+// changes are normally picked up right away by PollConfigurationOnChanges, so the periodic
+// poll is a fallback which also makes sure that the containers are converged every now and then.
 func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, incomingLoopbackEvents <-chan OrbitEvent) {
-	etcdClient := GetEtcdClient(s.EtcdEndpoints)
+	store := s.GetConfigStore()
 
 	for {
 		select {
@@ -129,7 +186,7 @@ func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, in
 				incomingNetworkEvents = nil
 			}
 			log.Debug("Got incoming network event: %+v", netEvent)
-			s.DispatchEvent(netEvent, etcdClient)
+			s.DispatchEvent(netEvent, store)
 			break
 
 		case loopbackEvent, ok := <-incomingLoopbackEvents:
@@ -142,7 +199,7 @@ func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, in
 			}
 
 			log.Debug(str)
-			s.DispatchEvent(loopbackEvent, etcdClient)
+			s.DispatchEvent(loopbackEvent, store)
 			break
 
 		case <-time.After(2 * time.Second):
@@ -162,7 +219,7 @@ func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, in
 						log.Debug("Going to push a ConvergeContainerEvent")
 						s.PollConfigurationUpdate()
 
-						s.HandleConvergeContainersEvent(ConvergeContainersEvent{s.currentConfiguration.MachineConfiguration})
+						s.HandleConvergeContainersEvent(ConvergeContainersEvent{s.getCurrentConfiguration().MachineConfiguration})
 						log.Debug("direct call to HandleConvergeContainersEvent is done")
 
 						return nil
@@ -183,7 +240,7 @@ func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, in
 			s.haproxyUpdateWindowStart = 0
 			s.haproxyUpdateWindowCurrent = 0
 
-			msg := fmt.Sprintf("haproxy restart, currentConfiguration: %+v", s.currentConfiguration)
+			msg := fmt.Sprintf("haproxy restart, currentConfiguration: %+v", s.getCurrentConfiguration())
 			if len(msg) > 200 {
 				msg = msg[0:200]
 			}
@@ -201,7 +258,7 @@ func (s *Containrunner) EventHandler(incomingNetworkEvents <-chan OrbitEvent, in
 }
 
 // Takes an OrbitEvent and calls appropriate handler function in a new goroutine.
-func (s *Containrunner) DispatchEvent(receiveredEvent OrbitEvent, etcdClient etcd.KeysAPI) {
+func (s *Containrunner) DispatchEvent(receiveredEvent OrbitEvent, store ConfigStore) {
 	switch receiveredEvent.Type {
 	case "NoopEvent":
 		log.Debug("Got NoopEvent %+v\n", receiveredEvent)
@@ -212,7 +269,7 @@ func (s *Containrunner) DispatchEvent(receiveredEvent OrbitEvent, etcdClient etc
 		go s.HandleDeploymentEvent(receiveredEvent.Ptr.(DeploymentEvent))
 		break
 	case "ServiceStateEvent":
-		s.HandleServiceStateEvent(receiveredEvent.Ptr.(ServiceStateEvent), etcdClient)
+		s.HandleServiceStateEvent(receiveredEvent.Ptr.(ServiceStateEvent), store)
 		break
 	case "NewRuntimeConfigurationEvent":
 		log.Info("Event: %s", receiveredEvent.Type)
@@ -256,9 +313,10 @@ func (s *Containrunner) HandleNewRuntimeConfigurationEvent(e NewRuntimeConfigura
 }
 
 func (s *Containrunner) ConvergeHAProxy() {
+	configuration := s.getCurrentConfiguration()
 
-	if s.currentConfiguration.MachineConfiguration.HAProxyConfiguration != nil {
-		err := s.HAProxySettings.ConvergeHAProxy(&s.currentConfiguration, s.localInstanceInformation)
+	if configuration.MachineConfiguration.HAProxyConfiguration != nil {
+		err := s.HAProxySettings.ConvergeHAProxy(&configuration, s.localInstanceInformation)
 		if err != nil {
 			log.Error("Error doing ConvergeHAProxy: %+v", err)
 		}
@@ -268,11 +326,13 @@ func (s *Containrunner) ConvergeHAProxy() {
 }
 
 func (s *Containrunner) SoftUpdateHAProxy() {
-	if s.currentConfiguration.MachineConfiguration.HAProxyConfiguration != nil && s.localInstanceInformation != nil && s.localInstanceInformation.LocallyRequiredServices != nil {
+	configuration := s.getCurrentConfiguration()
+
+	if configuration.MachineConfiguration.HAProxyConfiguration != nil && s.localInstanceInformation != nil && s.localInstanceInformation.LocallyRequiredServices != nil {
 		//log.Debug("Doing soft haproxy update: %s", s.localInstanceInformation.LocallyRequiredServices)
-		s.HAProxySettings.UpdateBackends(&s.currentConfiguration, s.localInstanceInformation)
+		s.HAProxySettings.UpdateBackends(&configuration, s.localInstanceInformation)
 	} else {
-		if s.currentConfiguration.MachineConfiguration.HAProxyConfiguration == nil {
+		if configuration.MachineConfiguration.HAProxyConfiguration == nil {
 			log.Error("Could not do soft haproxy update: no HAProxyConfiguration")
 		}
 
@@ -294,11 +354,37 @@ func (s *Containrunner) HandleConvergeContainersEvent(e ConvergeContainersEvent)
 	if !s.CommandController.IsRunning("ConvergeContainers") {
 		f := func(arguments interface{}) error {
 			docker := GetDockerClient()
-			configuration := arguments.(MachineConfiguration)
+			raw, err := SelectContainerSlots(arguments.(MachineConfiguration), docker)
+			if err != nil {
+				log.Error(LogString("Not converging containers: " + err.Error()))
+				s.setConvergeResult(err)
+				return err
+			}
+			// A service whose templates can't be expanded doesn't stop the other services from converging
+			configuration, err := s.ExpandMachineConfiguration(raw)
+			expandErr, partial := err.(ServiceExpansionErrors)
+			if err != nil && !partial {
+				log.Error(LogString("Not converging containers: " + err.Error()))
+				s.setConvergeResult(err)
+				return err
+			}
+			if partial {
+				log.Error(LogString(expandErr.Error()))
+				configuration = keepFailedServices(configuration, raw, expandErr, s.expandedServices)
+			}
 			//log.Info("Converging containers with configuration")
 			//log.Info("Converging containers with configuration: %+v", configuration)
 
-			err := ConvergeContainers(configuration, true, !s.NoSleep, docker)
+			secrets := s.GetSecretResolver(nil)
+			registries, err := s.GetRegistryCredentials(nil)
+			if err != nil {
+				log.Warning(LogString("Registry credentials: " + err.Error()))
+			}
+			replace := func(name string, service ServiceConfiguration, running ContainerDetails) error {
+				return s.ReplaceContainer(name, raw.Services[name].GetConfig(), running, configuration, secrets, registries, !s.NoSleep, docker)
+			}
+
+			err = ConvergeContainers(configuration, true, !s.NoSleep, secrets, registries, replace, docker)
 
 			if err == nil {
 				// This must be done after the containers have been converged so that the Check Engine
@@ -307,9 +393,18 @@ func (s *Containrunner) HandleConvergeContainersEvent(e ConvergeContainersEvent)
 				s.CheckEngine.PushNewConfiguration(configuration)
 
 				s.SetLastConvergeTime(time.Now())
+
+				s.expandedServices = make(map[string]ServiceConfiguration)
+				for name, boundService := range configuration.Services {
+					s.expandedServices[name] = boundService.GetConfig()
+				}
+				if partial {
+					err = expandErr
+				}
 			} else {
 				fmt.Printf("Error on ConvergeContainers: %+v\n", err)
 			}
+			s.setConvergeResult(err)
 
 			return err
 		}
@@ -328,8 +423,15 @@ func (s *Containrunner) HandleDeploymentEvent(e DeploymentEvent) {
 				log.Debug("Sleeping %d seconds before destroying old container", d)
 				time.Sleep(time.Second * time.Duration(d))
 			}
+			// A blue/green service may run in either slot
+			service, err := s.GetServiceByName(e.Service, nil, s.MachineAddress)
+			if err != nil {
+				log.Warning("Error getting service %s configuration: %+v", e.Service, err)
+			}
+			service.Name = e.Service
+
 			docker := GetDockerClient()
-			err := DestroyContainer(e.Service, docker)
+			err = DestroyServiceContainers(service, docker)
 			if err != nil {
 				log.Error("Error on RelaunchContainerEvent: %+v\n", err)
 			} else {
@@ -346,11 +448,22 @@ func (s *Containrunner) HandleDeploymentEvent(e DeploymentEvent) {
 	}
 }
 
-func (s *Containrunner) HandleServiceStateEvent(e ServiceStateEvent, etcdClient etcd.KeysAPI) {
+func (s *Containrunner) HandleServiceStateEvent(e ServiceStateEvent, store ConfigStore) {
 	log.Debug("ServiceStateEvent %+v", e)
 
-	if configResultPublisher == nil {
-		configResultPublisher = &ConfigResultEtcdPublisher{60, s.EtcdBasePath, s.EtcdEndpoints, etcdClient}
+	// A check which was running while the machine was drained must not publish the endpoint again
+	if s.IsDraining() {
+		return
+	}
+
+	publisher := s.getConfigResultPublisher(store)
+
+	health, publish := s.recordEndpointHealth(e)
+	if publish {
+		err := s.PublishEndpointHealth(health, store)
+		if err != nil {
+			log.Warning(LogString("Could not publish endpoint health: " + err.Error()))
+		}
 	}
 
 	// Store the availability zone information here
@@ -358,21 +471,19 @@ func (s *Containrunner) HandleServiceStateEvent(e ServiceStateEvent, etcdClient
 		e.EndpointInfo.AvailabilityZone = s.AvailabilityZone
 	}
 
-	// The etcd result publisher only wants to know when services are up.
-	// the TTL feature will automatically kill services which aren't constantly refreshed as
-	// being up
-	if e.IsUp {
-		configResultPublisher.PublishServiceState(e.Service, e.Endpoint, e.IsUp, e.EndpointInfo)
-	}
+	// Endpoints which are up are refreshed with a TTL. Endpoints which are down are removed
+	// right away instead of waiting for the TTL to expire.
+	publisher.PublishServiceState(e.Service, e.Endpoint, e.IsUp, e.EndpointInfo)
 
 	if e.IsUp == false && time.Since(e.SameStateSince) > time.Minute {
 		name := fmt.Sprintf("automatic-relaunch-service-%s", e.Service)
 
-		serviceConfiguration, err := s.GetServiceByName(e.Service, etcdClient, s.MachineAddress)
+		serviceConfiguration, err := s.GetServiceByName(e.Service, store, s.MachineAddress)
 		if err != nil {
 			log.Warning("Error getting service %s configuration from endpoints %+v: %+v", e.Service, s.EtcdEndpoints, err)
 			return
 		}
+		serviceConfiguration.Name = e.Service
 
 		// Only try to relaunch services which has Container configuration and that the restart command is not already running
 		if serviceConfiguration.Container != nil && !s.CommandController.IsRunning(name) {
@@ -392,7 +503,7 @@ func (s *Containrunner) HandleServiceStateEvent(e ServiceStateEvent, etcdClient
 				}
 
 				docker := GetDockerClient()
-				err := DestroyContainer(e.Service, docker)
+				err := DestroyServiceContainers(serviceConfiguration, docker)
 				if err != nil {
 					log.Error("Error destroying container for relaunch: %+v", err)
 				}
@@ -410,6 +521,17 @@ func (s *Containrunner) HandleServiceStateEvent(e ServiceStateEvent, etcdClient
 
 }
 
+// Returns the publisher of the endpoints. It's created on the first call with the store, nil means GetConfigStore.
+func (s *Containrunner) getConfigResultPublisher(store ConfigStore) ConfigResultPublisher {
+	if configResultPublisher == nil {
+		if store == nil {
+			store = s.GetConfigStore()
+		}
+		configResultPublisher = &ConfigResultEtcdPublisher{60, s.EtcdBasePath, store}
+	}
+	return configResultPublisher
+}
+
 func (s *Containrunner) GetLastConvergeTime() time.Time {
 	s.lastConvergeMu.Lock()
 	defer s.lastConvergeMu.Unlock()
@@ -422,21 +544,102 @@ func (s *Containrunner) SetLastConvergeTime(t time.Time) {
 	s.lastConverge = t
 }
 
+// Returns true if the current configuration could not be loaded from etcd and the daemon is
+// running with the last known good configuration. The returned time tells when the current
+// configuration was loaded from etcd.
+func (s *Containrunner) IsConfigurationStale() (bool, time.Time) {
+	s.configurationStaleMu.Lock()
+	defer s.configurationStaleMu.Unlock()
+	return s.configurationStale, s.configurationLoadedAt
+}
+
+func (s *Containrunner) setConfigurationStale(stale bool, loadedAt time.Time) {
+	s.configurationStaleMu.Lock()
+	defer s.configurationStaleMu.Unlock()
+	s.configurationStale = stale
+	s.configurationLoadedAt = loadedAt
+}
+
+// Returns the configuration which the daemon is running. The DNS server and the heartbeat read it
+// concurrently with the configuration poller, which replaces it with setCurrentConfiguration.
+func (s *Containrunner) getCurrentConfiguration() RuntimeConfiguration {
+	s.currentConfigurationMu.RLock()
+	defer s.currentConfigurationMu.RUnlock()
+	return s.currentConfiguration
+}
+
+func (s *Containrunner) setCurrentConfiguration(configuration RuntimeConfiguration) {
+	s.currentConfigurationMu.Lock()
+	defer s.currentConfigurationMu.Unlock()
+	s.currentConfiguration = configuration
+}
+
 func (s *Containrunner) Start() {
 	log.Info("Starting check engine with machine address %s", s.MachineAddress)
+	s.CheckEngine.Secrets = s.GetSecretResolver(nil)
+	s.startedAt = time.Now()
+	s.haproxyVersion = getHAProxyVersion(s.HAProxySettings.HAProxyBinary)
 	s.CheckEngine.Start(4, s.incomingLoopbackEvents, s.MachineAddress, s.CheckIntervalInMs)
+
+	if s.configurationCache != nil {
+		go s.configurationCache.Follow(s.GetConfigStore())
+		go s.PollConfigurationOnChanges()
+	}
+
+	if s.DNSAddress != "" {
+		s.dnsServer.Containrunner = s
+		s.dnsServer.TTL = uint32(s.DNSTTL)
+		err := s.dnsServer.Start(s.DNSAddress)
+		if err != nil {
+			log.Error(LogString("Could not start the DNS server: " + err.Error()))
+		}
+	}
+
+	if s.MachineAddress != "" {
+		go s.MachineHeartbeatLoop()
+		go s.WatchDrainRequests()
+	}
+
 	atomic.StoreInt32(&s.pollerStarted, 1)
 }
 
+// Polls the configuration from the ConfigurationCache every time the cache contents change.
+// Only one PollConfigurationUpdate is executed at a time, so a change which arrives during
+// a poll will trigger a new poll right after the current one has completed.
+func (s *Containrunner) PollConfigurationOnChanges() {
+	f := func(arguments interface{}) error {
+		s.PollConfigurationUpdate()
+		return nil
+	}
+
+	for _ = range s.configurationCache.Changes() {
+		for {
+			command, _ := s.CommandController.InvokeIfNotAlreadyRunning("PollConfigurationUpdate", f, nil)
+			if command != nil {
+				command.Wait()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
 func (s *Containrunner) Wait() {
 	<-s.exitChannel
 }
 
-func GetEtcdClient(endpoints []string) etcd.KeysAPI {
+func GetEtcdClient(endpoints []string, security EtcdSecurity) etcd.KeysAPI {
+
+	transport, err := security.transport()
+	if err != nil {
+		panic(err)
+	}
 
 	cfg := etcd.Config{
 		Endpoints:               endpoints,
-		Transport:               etcd.DefaultTransport,
+		Transport:               transport,
+		Username:                security.Username,
+		Password:                security.Password,
 		HeaderTimeoutPerRequest: time.Second,
 	}
 	client, err := etcd.New(cfg)
@@ -77,6 +77,7 @@ func TestCanStoreDeploymentEventToDatabase(t *testing.T) {
 			"revision id",
 			"machine address",
 			10,
+			"",
 		}
 
 		stored_id, err := s.dbLog.StoreDeploymentEvent(e, time.Now())
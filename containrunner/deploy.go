@@ -0,0 +1,245 @@
+package containrunner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	A rolling deployment sets the new revision machine by machine with the
+	services/<name>/machines/<ip> override instead of the global revision key, so that only
+	one batch of machines relaunches its container at a time. After every batch it waits
+	until the endpoints of the batch are healthy and report the new revision. When all
+	machines are updated the global revision is set and the machine overrides are removed.
+
+	A failed batch halts the deployment. The machines which were already updated keep the
+	new revision and the global revision is not changed.
+*/
+
+// Settings of a rolling deployment. See RollingDeploy
+type RollingDeployment struct {
+	Service  string
+	Revision ServiceRevision
+
+	// Machines to update, in this order. GetServiceMachines is used if empty
+	Machines []string
+
+	// Number of machines which are updated at the same time. Defaults to one
+	BatchSize int
+
+	// How long to wait for the machines of a batch to become healthy before halting the deployment
+	BatchTimeout time.Duration
+
+	// Wait between a healthy batch and the next one
+	Pause time.Duration
+
+	// How often the endpoints are checked. Defaults to one second
+	PollInterval time.Duration
+
+	// Called with progress messages, can be nil
+	Progress func(message string)
+}
+
+type RollingDeploymentResult struct {
+	// Machines which were set to the new revision
+	Updated []string
+
+	// Machines of the halted batch which did not become healthy with the new revision
+	Failed []string
+}
+
+func (d *RollingDeployment) progress(format string, args ...interface{}) {
+	if d.Progress != nil {
+		d.Progress(fmt.Sprintf(format, args...))
+	}
+}
+
+// Returns the addresses of the machines which run the service: the alive machines whose heartbeat
+// lists the service and the machines which have an endpoint of the service. Draining machines are
+// left out as they don't publish endpoints.
+func (c *Containrunner) GetServiceMachines(service string, store ConfigStore) ([]string, error) {
+	zones, err := c.GetServiceMachineZones(service, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for address := range zones {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// Returns the availability zones of the machines which run the service by their address. See GetServiceMachines
+func (c *Containrunner) GetServiceMachineZones(service string, store ConfigStore) (map[string]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	zones := make(map[string]string)
+
+	machines, err := c.GetMachines(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, machine := range machines {
+		if machine.Alive && !machine.Draining && machine.LeftAt.IsZero() && stringInSlice(service, machine.Services) {
+			zones[machine.Address] = machine.AvailabilityZone
+		}
+	}
+
+	serviceBackends, err := GetAllServiceEndpointsFromStore(store, c.EtcdBasePath)
+	if err != nil {
+		return nil, err
+	}
+	for endpoint, info := range serviceBackends[service] {
+		address := endpointMachineAddress(endpoint)
+		if zones[address] == "" && info != nil {
+			zones[address] = info.AvailabilityZone
+		}
+	}
+
+	return zones, nil
+}
+
+// Returns the address part of an "<address>:<port>" endpoint
+func endpointMachineAddress(endpoint string) string {
+	i := strings.LastIndex(endpoint, ":")
+	if i == -1 {
+		return endpoint
+	}
+	return endpoint[:i]
+}
+
+// Returns the machines which don't have a healthy endpoint of the service yet or which have an
+// endpoint which reports a different revision.
+func (c *Containrunner) GetMachinesPendingRevision(service string, revision string, machines []string, store ConfigStore) ([]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	serviceBackends, err := GetAllServiceEndpointsFromStore(store, c.EtcdBasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := make(map[string]bool)
+	for endpoint, info := range serviceBackends[service] {
+		address := endpointMachineAddress(endpoint)
+		ok := info != nil && info.Revision == revision
+		if current, seen := healthy[address]; seen {
+			ok = ok && current
+		}
+		healthy[address] = ok
+	}
+
+	var pending []string
+	for _, machine := range machines {
+		if !healthy[machine] {
+			pending = append(pending, machine)
+		}
+	}
+
+	return pending, nil
+}
+
+// Waits until all machines have a healthy endpoint with the revision. Returns the machines which
+// were still pending when the timeout expired.
+func (c *Containrunner) WaitForServiceRevision(service string, revision string, machines []string, timeout time.Duration, pollInterval time.Duration, store ConfigStore) ([]string, error) {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending, err := c.GetMachinesPendingRevision(service, revision, machines, store)
+		if err != nil || len(pending) == 0 || time.Now().After(deadline) {
+			return pending, err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Splits the machines into batches of batchSize machines
+func SplitDeploymentBatches(machines []string, batchSize int) [][]string {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var batches [][]string
+	for i := 0; i < len(machines); i += batchSize {
+		end := i + batchSize
+		if end > len(machines) {
+			end = len(machines)
+		}
+		batches = append(batches, machines[i:end])
+	}
+	return batches
+}
+
+// Runs a rolling deployment. The result lists the updated machines also when an error is returned.
+func (c *Containrunner) RollingDeploy(d RollingDeployment, store ConfigStore) (*RollingDeploymentResult, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	result := new(RollingDeploymentResult)
+
+	if d.Revision.Revision == "" {
+		return result, errors.New("No revision given")
+	}
+
+	machines := d.Machines
+	if len(machines) == 0 {
+		var err error
+		machines, err = c.GetServiceMachines(d.Service, store)
+		if err != nil {
+			return result, err
+		}
+		if len(machines) == 0 {
+			return result, fmt.Errorf("No machines found for service %s", d.Service)
+		}
+	}
+
+	batches := SplitDeploymentBatches(machines, d.BatchSize)
+	for i, batch := range batches {
+		d.progress("Batch %d/%d: setting revision %s on %s", i+1, len(batches), d.Revision.Revision, strings.Join(batch, ", "))
+
+		for _, machine := range batch {
+			err := c.SetServiceRevisionForMachine(d.Service, d.Revision, machine, store)
+			if err != nil {
+				return result, err
+			}
+			result.Updated = append(result.Updated, machine)
+		}
+
+		pending, err := c.WaitForServiceRevision(d.Service, d.Revision.Revision, batch, d.BatchTimeout, d.PollInterval, store)
+		if err != nil {
+			return result, err
+		}
+		if len(pending) > 0 {
+			result.Failed = pending
+			return result, fmt.Errorf("Batch %d/%d: %s did not report a healthy endpoint with revision %s within %s", i+1, len(batches), strings.Join(pending, ", "), d.Revision.Revision, d.BatchTimeout)
+		}
+
+		d.progress("Batch %d/%d is healthy", i+1, len(batches))
+
+		if i < len(batches)-1 && d.Pause > 0 {
+			d.progress("Waiting %s before the next batch", d.Pause)
+			time.Sleep(d.Pause)
+		}
+	}
+
+	// Setting the global revision also removes the machine overrides
+	err := c.SetServiceRevision(d.Service, d.Revision, store)
+	if err != nil {
+		return result, err
+	}
+	d.progress("Revision %s set for service %s", d.Revision.Revision, d.Service)
+
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Publishes a healthy endpoint with the revision of the machine override, like the daemons would
+// after relaunching the container. Machines in broken never come up.
+func simulateDeployDaemons(store ConfigStore, machines []string, broken []string, stop *int32) {
+	for atomic.LoadInt32(stop) == 0 {
+		for _, machine := range machines {
+			if stringInSlice(machine, broken) {
+				continue
+			}
+			res, err := store.Get("/orbit/services/web/machines/" + machine)
+			if err != nil {
+				continue
+			}
+			var revision ServiceRevision
+			json.Unmarshal([]byte(res.Value), &revision)
+			bytes, _ := json.Marshal(EndpointInfo{Revision: revision.Revision})
+			store.Set("/orbit/services/web/endpoints/"+machine+":3500", string(bytes), time.Minute)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func setupDeployTest() (*Containrunner, ConfigStore, []string) {
+	ct := new(Containrunner)
+	ct.EtcdBasePath = "/orbit"
+	store := NewMemoryConfigStore()
+
+	machines := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+	bytes, _ := json.Marshal(ServiceRevision{Revision: "old"})
+	store.Set("/orbit/services/web/revision", string(bytes), 0)
+	bytes, _ = json.Marshal(EndpointInfo{Revision: "old"})
+	for _, machine := range machines {
+		store.Set("/orbit/services/web/endpoints/"+machine+":3500", string(bytes), time.Minute)
+	}
+
+	return ct, store, machines
+}
+
+func TestGetServiceMachines(t *testing.T) {
+	ct, store, _ := setupDeployTest()
+
+	ct.PublishMachineHeartbeat(MachineInfo{Address: "10.0.0.9", Services: []string{"web"}}, store)
+	ct.PublishMachineHeartbeat(MachineInfo{Address: "10.0.0.8", Services: []string{"web"}, Draining: true}, store)
+	ct.PublishMachineHeartbeat(MachineInfo{Address: "10.0.0.7", Services: []string{"api"}}, store)
+
+	machines, err := ct.GetServiceMachines("web", store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.9"}, machines)
+}
+
+func TestSplitDeploymentBatches(t *testing.T) {
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, SplitDeploymentBatches([]string{"a", "b", "c", "d", "e"}, 2))
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, SplitDeploymentBatches([]string{"a", "b"}, 0))
+}
+
+func TestRollingDeploy(t *testing.T) {
+	ct, store, machines := setupDeployTest()
+
+	var stop int32
+	go simulateDeployDaemons(store, machines, nil, &stop)
+	defer atomic.StoreInt32(&stop, 1)
+
+	var messages []string
+	result, err := ct.RollingDeploy(RollingDeployment{
+		Service:      "web",
+		Revision:     ServiceRevision{Revision: "new"},
+		BatchSize:    2,
+		BatchTimeout: 5 * time.Second,
+		Pause:        time.Millisecond,
+		PollInterval: time.Millisecond,
+		Progress:     func(message string) { messages = append(messages, message) },
+	}, store)
+	assert.Nil(t, err)
+	assert.Equal(t, machines, result.Updated)
+	assert.Equal(t, 0, len(result.Failed))
+	assert.Equal(t, "Batch 1/3: setting revision new on 10.0.0.1, 10.0.0.2", messages[0])
+
+	revision, err := ct.GetServiceRevision("web", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", revision.Revision)
+
+	_, err = store.List("/orbit/services/web/machines")
+	assert.True(t, IsKeyNotFound(err))
+}
+
+func TestRollingDeployHaltsOnFailure(t *testing.T) {
+	ct, store, machines := setupDeployTest()
+
+	var stop int32
+	go simulateDeployDaemons(store, machines, []string{"10.0.0.3"}, &stop)
+	defer atomic.StoreInt32(&stop, 1)
+
+	result, err := ct.RollingDeploy(RollingDeployment{
+		Service:      "web",
+		Revision:     ServiceRevision{Revision: "new"},
+		BatchSize:    2,
+		BatchTimeout: 50 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	}, store)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "Batch 2/3"))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, result.Updated)
+	assert.Equal(t, []string{"10.0.0.3"}, result.Failed)
+
+	revision, err := ct.GetServiceRevision("web", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", revision.Revision)
+
+	_, err = store.Get("/orbit/services/web/machines/10.0.0.5")
+	assert.True(t, IsKeyNotFound(err))
+}
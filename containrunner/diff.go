@@ -0,0 +1,435 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DifferenceAdded   = "added"   // Key exists in the local tree but not in etcd
+	DifferenceRemoved = "removed" // Key exists in etcd but not in the local tree
+	DifferenceChanged = "changed" // Key exists in both but the contents differ
+)
+
+// A single difference between the local configuration tree and etcd.
+//
+// JSON keys (service configs, tag bindings, globalproperties, authoritative_names, includes)
+// are compared field by field and the differences are listed in Fields. All other
+// keys (haproxy templates, certs and static files) get an unified text diff in Diff.
+type ConfigurationDifference struct {
+	Key    string
+	Type   string
+	Fields []FieldDifference `json:",omitempty"`
+	Diff   string            `json:",omitempty"`
+}
+
+type FieldDifference struct {
+	Field string
+	Local interface{}
+	Etcd  interface{}
+}
+
+// Returns the etcd keys and their values which UploadOrbitConfigurationToEtcd would write.
+// Directories are not included.
+func (c *Containrunner) GetOrbitConfigurationValues(orbitConfiguration *OrbitConfiguration) (map[string]string, error) {
+	values := make(map[string]string)
+
+	bytes, err := json.Marshal(orbitConfiguration.GlobalOrbitProperties)
+	if err != nil {
+		return nil, err
+	}
+	values[c.EtcdBasePath+"/globalproperties"] = string(bytes)
+
+	for tag, mc := range orbitConfiguration.MachineConfigurations {
+		prefix := c.EtcdBasePath + "/machineconfigurations/tags/" + tag
+
+		for name, boundService := range mc.Services {
+			str := "{}"
+			if boundService.Overwrites != nil {
+				bytes, err := json.Marshal(boundService.Overwrites)
+				if err != nil {
+					return nil, err
+				}
+				str = string(bytes)
+			}
+			values[prefix+"/services/"+name] = str
+		}
+
+		if mc.HAProxyConfiguration != nil {
+			values[prefix+"/haproxy_config"] = mc.HAProxyConfiguration.Template
+			for name, contents := range mc.HAProxyConfiguration.Certs {
+				values[prefix+"/certs/"+name] = contents
+			}
+			for name, contents := range mc.HAProxyConfiguration.Files {
+				values[prefix+"/haproxy_files/"+name] = contents
+			}
+		}
+
+		if len(mc.AuthoritativeNames) > 0 {
+			bytes, err := json.Marshal(mc.AuthoritativeNames)
+			if err != nil {
+				return nil, err
+			}
+			values[prefix+"/authoritative_names"] = string(bytes)
+		}
+
+		if mc.Priority != 0 {
+			values[prefix+"/priority"] = strconv.Itoa(mc.Priority)
+		}
+
+		if len(mc.Includes) > 0 {
+			bytes, err := json.Marshal(mc.Includes)
+			if err != nil {
+				return nil, err
+			}
+			values[prefix+"/includes"] = string(bytes)
+		}
+	}
+
+	for name, service := range orbitConfiguration.Services {
+		bytes, err := json.Marshal(service)
+		if err != nil {
+			return nil, err
+		}
+		values[c.EtcdBasePath+"/services/"+name+"/config"] = string(bytes)
+	}
+
+	return values, nil
+}
+
+// Returns the raw values of all keys in etcd which are owned by the orbit configuration tree.
+// Runtime keys like revisions and endpoints are not included.
+func (c *Containrunner) GetOrbitConfigurationValuesFromEtcd(store ConfigStore) (map[string]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	values := make(map[string]string)
+
+	var flatten func(node *ConfigNode)
+	flatten = func(node *ConfigNode) {
+		if !node.Dir {
+			values[node.Key] = node.Value
+		}
+		for _, child := range node.Nodes {
+			flatten(child)
+		}
+	}
+
+	res, err := store.Get(c.EtcdBasePath + "/globalproperties")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		values[res.Key] = res.Value
+	}
+
+	res, err = store.List(c.EtcdBasePath + "/machineconfigurations/tags")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		flatten(res)
+	}
+
+	res, err = store.List(c.EtcdBasePath + "/services")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, service := range res.Nodes {
+			for _, node := range service.Nodes {
+				if node.Key == service.Key+"/config" && !node.Dir {
+					values[node.Key] = node.Value
+				}
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// Compares the local orbit configuration against etcd and returns every difference, sorted by key.
+func (c *Containrunner) DiffAgainstConfiguration(localoc *OrbitConfiguration, store ConfigStore) ([]ConfigurationDifference, error) {
+	local, err := c.GetOrbitConfigurationValues(localoc)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := c.GetOrbitConfigurationValuesFromEtcd(store)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.DiffOrbitConfigurationValues(local, remote), nil
+}
+
+// Compares the local directory tree against etcd. See DiffAgainstConfiguration.
+func (c *Containrunner) DiffAgainstLocalDirectory(directory string, store ConfigStore) ([]ConfigurationDifference, error) {
+	localoc, err := c.LoadOrbitConfigurationFromFiles(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.DiffAgainstConfiguration(localoc, store)
+}
+
+// Formats the differences for orbitctl diff --json. No differences is an empty list.
+func FormatConfigurationDifferencesJSON(differences []ConfigurationDifference) ([]byte, error) {
+	if differences == nil {
+		differences = []ConfigurationDifference{}
+	}
+	return json.MarshalIndent(differences, "", "  ")
+}
+
+// Compares two sets of key values. Local is the wanted state and remote is what is in etcd.
+func (c *Containrunner) DiffOrbitConfigurationValues(local map[string]string, remote map[string]string) []ConfigurationDifference {
+	var keys []string
+	for key := range local {
+		keys = append(keys, key)
+	}
+	for key := range remote {
+		if _, found := local[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var differences []ConfigurationDifference
+	for _, key := range keys {
+		localValue, inLocal := local[key]
+		remoteValue, inRemote := remote[key]
+
+		difference := ConfigurationDifference{Key: key}
+		switch {
+		case !inRemote:
+			difference.Type = DifferenceAdded
+		case !inLocal:
+			difference.Type = DifferenceRemoved
+		case localValue == remoteValue:
+			continue
+		default:
+			difference.Type = DifferenceChanged
+		}
+
+		if c.isJSONKey(key) {
+			fields, err := DiffJSON(localValue, remoteValue)
+			if err != nil {
+				// Broken json in etcd is shown as a text diff so that the user sees what's wrong
+				difference.Diff = UnifiedDiff(key, localValue, remoteValue)
+			} else {
+				if len(fields) == 0 && difference.Type == DifferenceChanged {
+					// Only formatting differs
+					continue
+				}
+				difference.Fields = fields
+			}
+		} else {
+			difference.Diff = UnifiedDiff(key, localValue, remoteValue)
+		}
+
+		differences = append(differences, difference)
+	}
+
+	return differences
+}
+
+func (c *Containrunner) isJSONKey(key string) bool {
+	if key == c.EtcdBasePath+"/globalproperties" || strings.HasSuffix(key, "/authoritative_names") || strings.HasSuffix(key, "/includes") {
+		return true
+	}
+
+	if strings.HasPrefix(key, c.EtcdBasePath+"/services/") && strings.HasSuffix(key, "/config") {
+		return true
+	}
+
+	rest := strings.TrimPrefix(key, c.EtcdBasePath+"/machineconfigurations/tags/")
+	parts := strings.Split(rest, "/")
+	return rest != key && len(parts) == 3 && parts[1] == "services"
+}
+
+// Compares two JSON documents and returns the differing fields. Missing documents
+// (empty strings) are treated as empty objects. Fields are named with a dotted path,
+// array elements as Field[index].
+func DiffJSON(local string, remote string) ([]FieldDifference, error) {
+	var l, r interface{}
+
+	if local == "" {
+		local = "{}"
+	}
+	if remote == "" {
+		remote = "{}"
+	}
+
+	err := json.Unmarshal([]byte(local), &l)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(remote), &r)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []FieldDifference
+	diffJSONValue("", l, r, &fields)
+
+	return fields, nil
+}
+
+func diffJSONValue(field string, local interface{}, remote interface{}, fields *[]FieldDifference) {
+	if reflect.DeepEqual(local, remote) {
+		return
+	}
+
+	switch l := local.(type) {
+	case map[string]interface{}:
+		if r, ok := remote.(map[string]interface{}); ok {
+			var keys []string
+			for key := range l {
+				keys = append(keys, key)
+			}
+			for key := range r {
+				if _, found := l[key]; !found {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				name := key
+				if field != "" {
+					name = field + "." + key
+				}
+				diffJSONValue(name, l[key], r[key], fields)
+			}
+			return
+		}
+	case []interface{}:
+		if r, ok := remote.([]interface{}); ok {
+			for i := 0; i < len(l) || i < len(r); i++ {
+				var li, ri interface{}
+				if i < len(l) {
+					li = l[i]
+				}
+				if i < len(r) {
+					ri = r[i]
+				}
+				diffJSONValue(fmt.Sprintf("%s[%d]", field, i), li, ri, fields)
+			}
+			return
+		}
+	}
+
+	*fields = append(*fields, FieldDifference{Field: field, Local: local, Etcd: remote})
+}
+
+// Returns an unified diff which transforms the etcd contents into the local contents.
+func UnifiedDiff(key string, local string, remote string) string {
+	a := splitLines(remote)
+	b := splitLines(local)
+
+	// Longest common subsequence table, lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		ai   int // line number in a before this line
+		bi   int // line number in b before this line
+	}
+
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, line{'+', b[j], i, j})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	const context = 3
+	out := fmt.Sprintf("--- etcd%s\n+++ local%s\n", key, key)
+
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Find the end of this hunk, merging changes which are close to each other
+		first := start - context
+		if first < 0 {
+			first = 0
+		}
+		last := start
+		for k := start; k < len(lines) && k <= last+2*context; k++ {
+			if lines[k].op != ' ' {
+				last = k
+			}
+		}
+		end := last + context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		acount, bcount := 0, 0
+		body := ""
+		for _, l := range lines[first:end] {
+			if l.op != '+' {
+				acount++
+			}
+			if l.op != '-' {
+				bcount++
+			}
+			body += string(l.op) + l.text + "\n"
+		}
+
+		astart, bstart := lines[first].ai+1, lines[first].bi+1
+		if acount == 0 {
+			astart--
+		}
+		if bcount == 0 {
+			bstart--
+		}
+		out += fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", astart, acount, bstart, bcount) + body
+
+		start = end
+	}
+
+	return out
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,118 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	fields, err := DiffJSON(`{"Name":"ubuntu","EndpointPort":3500,"Checks":[{"Type":"http"}]}`, `{"Name":"ubuntu", "EndpointPort":3501,"Checks":[{"Type":"tcp"},{"Type":"http"}],"Extra":true}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(fields))
+
+	assert.Equal(t, "Checks[0].Type", fields[0].Field)
+	assert.Equal(t, "http", fields[0].Local)
+	assert.Equal(t, "tcp", fields[0].Etcd)
+
+	assert.Equal(t, "Checks[1]", fields[1].Field)
+	assert.Nil(t, fields[1].Local)
+
+	assert.Equal(t, "EndpointPort", fields[2].Field)
+	assert.Equal(t, float64(3500), fields[2].Local)
+	assert.Equal(t, float64(3501), fields[2].Etcd)
+
+	assert.Equal(t, "Extra", fields[3].Field)
+
+	fields, err = DiffJSON(`{}`, ``)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(fields))
+
+	_, err = DiffJSON(`{}`, `{broken`)
+	assert.NotNil(t, err)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	diff := UnifiedDiff("/test/haproxy_config", "a\nb\nc\nd\n", "a\nc\nd\ne\n")
+	assert.Equal(t, "--- etcd/test/haproxy_config\n+++ local/test/haproxy_config\n@@ -1,4 +1,4 @@\n a\n+b\n c\n d\n-e\n", diff)
+
+	diff = UnifiedDiff("/test/certs/test.pem", "foo\n", "")
+	assert.Equal(t, "--- etcd/test/certs/test.pem\n+++ local/test/certs/test.pem\n@@ -0,0 +1,1 @@\n+foo\n", diff)
+}
+
+func TestDiffOrbitConfigurationValues(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	local, err := ct.GetOrbitConfigurationValues(orbitConfiguration)
+	assert.Nil(t, err)
+
+	remote := make(map[string]string)
+	for key, value := range local {
+		remote[key] = value
+	}
+
+	assert.Equal(t, 0, len(ct.DiffOrbitConfigurationValues(local, remote)))
+
+	delete(remote, "/test/machineconfigurations/tags/testtag/certs/test.pem")
+	remote["/test/machineconfigurations/tags/testtag/haproxy_files/old.txt"] = "old"
+	remote["/test/machineconfigurations/tags/testtag/haproxy_config"] = "hotfix\n" + remote["/test/machineconfigurations/tags/testtag/haproxy_config"]
+	remote["/test/services/ubuntu/config"] = `{"Name":"ubuntu","EndpointPort":3600}`
+	remote["/test/services/test/config"] = " " + remote["/test/services/test/config"]
+
+	differences := ct.DiffOrbitConfigurationValues(local, remote)
+	assert.Equal(t, 4, len(differences))
+
+	assert.Equal(t, "/test/machineconfigurations/tags/testtag/certs/test.pem", differences[0].Key)
+	assert.Equal(t, DifferenceAdded, differences[0].Type)
+	assert.NotEqual(t, "", differences[0].Diff)
+
+	assert.Equal(t, "/test/machineconfigurations/tags/testtag/haproxy_config", differences[1].Key)
+	assert.Equal(t, DifferenceChanged, differences[1].Type)
+	assert.Contains(t, differences[1].Diff, "-hotfix\n")
+
+	assert.Equal(t, "/test/machineconfigurations/tags/testtag/haproxy_files/old.txt", differences[2].Key)
+	assert.Equal(t, DifferenceRemoved, differences[2].Type)
+
+	assert.Equal(t, "/test/services/ubuntu/config", differences[3].Key)
+	assert.Equal(t, DifferenceChanged, differences[3].Type)
+	assert.Equal(t, "", differences[3].Diff)
+	assert.True(t, len(differences[3].Fields) > 1)
+}
+
+// orbitctl diff --json prints only the differences into stdout, so nothing else may be printed while they are read
+func TestDiffAgainstLocalDirectoryJSONOutput(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	os.Stdout = w
+
+	differences, err := ct.DiffAgainstLocalDirectory("../testdata", NewMemoryConfigStore())
+	if err == nil {
+		var bytes []byte
+		bytes, err = FormatConfigurationDifferencesJSON(differences)
+		fmt.Printf("%s\n", bytes)
+	}
+
+	os.Stdout = stdout
+	w.Close()
+	assert.Nil(t, err)
+
+	output, _ := ioutil.ReadAll(r)
+	var parsed []ConfigurationDifference
+	assert.Nil(t, json.Unmarshal(output, &parsed), string(output))
+	assert.NotEmpty(t, parsed)
+
+	bytes, err := FormatConfigurationDifferencesJSON(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", string(bytes))
+}
@@ -0,0 +1,315 @@
+package containrunner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigStore which keeps every key as a file under a local directory. This allows a single
+// standalone machine to run orbit without etcd.
+//
+// The ModifiedIndex of a key is the modification time of its file in nanoseconds. Key
+// expiration times are stored under the hidden .ttl directory and expired keys are removed
+// when they are read. Watches are implemented by polling the directory tree, so changes are
+// seen with up to PollInterval delay and a key which is set and deleted between two polls
+// is not seen at all.
+//
+// Writes are serialised only inside a single process, so only one orbitctl daemon should
+// use the same directory.
+type DirectoryConfigStore struct {
+	Root         string
+	PollInterval time.Duration
+
+	lock sync.Mutex
+}
+
+func NewDirectoryConfigStore(root string) *DirectoryConfigStore {
+	s := new(DirectoryConfigStore)
+	s.Root = root
+	s.PollInterval = time.Second
+
+	return s
+}
+
+func (s *DirectoryConfigStore) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(cleanKey(key)))
+}
+
+func (s *DirectoryConfigStore) ttlPath(key string) string {
+	return filepath.Join(s.Root, ".ttl", filepath.FromSlash(cleanKey(key)))
+}
+
+// Returns true and removes the key if its ttl has passed
+func (s *DirectoryConfigStore) expired(key string) bool {
+	bytes, err := ioutil.ReadFile(s.ttlPath(key))
+	if err != nil {
+		return false
+	}
+
+	expires, err := time.Parse(time.RFC3339Nano, string(bytes))
+	if err != nil || expires.After(time.Now()) {
+		return false
+	}
+
+	os.RemoveAll(s.path(key))
+	os.Remove(s.ttlPath(key))
+	return true
+}
+
+func (s *DirectoryConfigStore) Get(key string) (*ConfigNode, error) {
+	return s.get(key, false)
+}
+
+func (s *DirectoryConfigStore) List(key string) (*ConfigNode, error) {
+	return s.get(key, true)
+}
+
+func (s *DirectoryConfigStore) get(key string, recursive bool) (*ConfigNode, error) {
+	key = cleanKey(key)
+	index := uint64(time.Now().UnixNano())
+
+	node, err := s.read(key, recursive, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &KeyNotFoundError{Key: key, Index: index}
+		}
+		return nil, err
+	}
+
+	node.Index = index
+	return node, nil
+}
+
+func (s *DirectoryConfigStore) read(key string, recursive bool, depth int) (*ConfigNode, error) {
+	if s.expired(key) {
+		return nil, os.ErrNotExist
+	}
+
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	node := &ConfigNode{Key: key, Dir: info.IsDir(), ModifiedIndex: uint64(info.ModTime().UnixNano())}
+	if !node.Dir {
+		bytes, err := ioutil.ReadFile(s.path(key))
+		if err != nil {
+			return nil, err
+		}
+		node.Value = string(bytes)
+		return node, nil
+	}
+
+	if !recursive && depth > 0 {
+		return node, nil
+	}
+
+	files, err := ioutil.ReadDir(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		child, err := s.read(strings.TrimSuffix(key, "/")+"/"+file.Name(), recursive, depth+1)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		node.Nodes = append(node.Nodes, child)
+	}
+
+	sortConfigNodes(node.Nodes)
+
+	return node, nil
+}
+
+func (s *DirectoryConfigStore) Set(key string, value string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.set(key, value, ttl)
+}
+
+// Must be called while holding the lock.
+func (s *DirectoryConfigStore) set(key string, value string, ttl time.Duration) error {
+	filename := s.path(key)
+
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		os.RemoveAll(filename)
+	}
+
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write([]byte(value))
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if ttl <= 0 {
+		os.Remove(s.ttlPath(key))
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.ttlPath(key)), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.ttlPath(key), []byte(time.Now().Add(ttl).Format(time.RFC3339Nano)), 0644)
+}
+
+func (s *DirectoryConfigStore) MkDir(key string) error {
+	return os.MkdirAll(s.path(key), 0755)
+}
+
+func (s *DirectoryConfigStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = cleanKey(key)
+	if _, err := os.Stat(s.path(key)); err != nil || s.expired(key) {
+		return &KeyNotFoundError{Key: key, Index: uint64(time.Now().UnixNano())}
+	}
+
+	os.RemoveAll(s.ttlPath(key))
+	return os.RemoveAll(s.path(key))
+}
+
+func (s *DirectoryConfigStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = cleanKey(key)
+	node, err := s.read(key, false, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if (prevIndex == 0 && node != nil) || (prevIndex != 0 && (node == nil || node.ModifiedIndex != prevIndex)) {
+		return &CompareFailedError{Key: key}
+	}
+
+	return s.set(key, value, 0)
+}
+
+// Zero afterIndex watches only the changes which happen after this call.
+func (s *DirectoryConfigStore) Watch(key string, afterIndex uint64) ConfigWatcher {
+	if afterIndex == 0 {
+		afterIndex = uint64(time.Now().UnixNano())
+	}
+
+	return &directoryConfigWatcher{store: s, key: cleanKey(key), afterIndex: afterIndex, stop: make(chan bool)}
+}
+
+type directoryConfigWatcher struct {
+	store      *DirectoryConfigStore
+	key        string
+	afterIndex uint64
+	previous   map[string]*ConfigNode
+	pending    []*ConfigEvent
+	stop       chan bool
+	stopOnce   sync.Once
+}
+
+// Returns all keys (not directories) under the watched key
+func (w *directoryConfigWatcher) snapshot() (map[string]*ConfigNode, error) {
+	nodes := make(map[string]*ConfigNode)
+
+	root, err := w.store.List(w.key)
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return nodes, nil
+		}
+		return nil, err
+	}
+
+	var add func(node *ConfigNode)
+	add = func(node *ConfigNode) {
+		if !node.Dir {
+			nodes[node.Key] = node
+		}
+		for _, child := range node.Nodes {
+			add(child)
+		}
+	}
+	add(root)
+
+	return nodes, nil
+}
+
+func (w *directoryConfigWatcher) Next() (*ConfigEvent, error) {
+	for len(w.pending) == 0 {
+		if w.previous != nil {
+			select {
+			case <-w.stop:
+				return nil, ErrWatcherStopped
+			case <-time.After(w.store.PollInterval):
+			}
+		}
+
+		current, err := w.snapshot()
+		if err != nil {
+			return nil, err
+		}
+
+		for key, node := range current {
+			if old, found := w.previous[key]; found {
+				if old.Value != node.Value || old.ModifiedIndex != node.ModifiedIndex {
+					w.pending = append(w.pending, &ConfigEvent{Action: "set", Node: node})
+				}
+			} else if w.previous != nil || node.ModifiedIndex > w.afterIndex {
+				w.pending = append(w.pending, &ConfigEvent{Action: "set", Node: node})
+			}
+		}
+
+		for key := range w.previous {
+			if _, found := current[key]; !found {
+				w.pending = append(w.pending, &ConfigEvent{Action: "delete", Node: &ConfigNode{Key: key, ModifiedIndex: uint64(time.Now().UnixNano())}})
+			}
+		}
+
+		w.previous = current
+	}
+
+	select {
+	case <-w.stop:
+		return nil, ErrWatcherStopped
+	default:
+	}
+
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	return event, nil
+}
+
+func (w *directoryConfigWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
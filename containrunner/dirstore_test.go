@@ -0,0 +1,105 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirectoryConfigStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDirectoryConfigStore(dir)
+
+	err = store.Set("/test/services/ubuntu/config", "{}", 0)
+	assert.Nil(t, err)
+	err = store.Set("/test/services/ubuntu/endpoints/10.0.0.1:3500", "ok", 0)
+	assert.Nil(t, err)
+
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, "test/services/ubuntu/config"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(bytes))
+
+	node, err := store.Get("/test/services/ubuntu")
+	assert.Nil(t, err)
+	assert.Equal(t, true, node.Dir)
+	assert.Equal(t, 2, len(node.Nodes))
+	assert.Equal(t, "/test/services/ubuntu/config", node.Nodes[0].Key)
+	assert.Equal(t, 0, len(node.Nodes[1].Nodes))
+
+	node, err = store.List("/test")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/test/services/ubuntu/config":                  "{}",
+		"/test/services/ubuntu/endpoints/10.0.0.1:3500": "ok",
+	}, FlattenConfigNode(node))
+
+	err = store.CompareAndSwap("/test/active_generation", "1", 0)
+	assert.Nil(t, err)
+	err = store.CompareAndSwap("/test/active_generation", "1", 0)
+	assert.True(t, IsCompareFailed(err))
+
+	node, _ = store.Get("/test/active_generation")
+	err = store.CompareAndSwap("/test/active_generation", "2", node.ModifiedIndex)
+	assert.Nil(t, err)
+
+	err = store.Delete("/test/services")
+	assert.Nil(t, err)
+	_, err = store.Get("/test/services/ubuntu/config")
+	assert.True(t, IsKeyNotFound(err))
+	assert.True(t, IsKeyNotFound(store.Delete("/test/services")))
+}
+
+func TestDirectoryConfigStoreTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDirectoryConfigStore(dir)
+
+	store.Set("/test/services/ubuntu/endpoints/10.0.0.1:3500", "ok", 50*time.Millisecond)
+	node, err := store.List("/test/services/ubuntu/endpoints")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(node.Nodes))
+
+	time.Sleep(100 * time.Millisecond)
+
+	node, err = store.List("/test/services/ubuntu/endpoints")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(node.Nodes))
+}
+
+func TestDirectoryConfigStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDirectoryConfigStore(dir)
+	store.PollInterval = 10 * time.Millisecond
+	store.Set("/test/services/ubuntu/config", "{}", 0)
+
+	watcher := store.Watch("/test", 0)
+	defer watcher.Stop()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.Set("/test/services/ubuntu/revision", "asdf", 0)
+	}()
+
+	event, err := watcher.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "set", event.Action)
+	assert.Equal(t, "/test/services/ubuntu/revision", event.Node.Key)
+
+	store.Delete("/test/services/ubuntu/config")
+
+	event, err = watcher.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "delete", event.Action)
+	assert.Equal(t, "/test/services/ubuntu/config", event.Node.Key)
+}
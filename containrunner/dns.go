@@ -0,0 +1,420 @@
+package containrunner
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DNSServer answers service discovery queries from the live ServiceBackends of the daemon:
+//
+//	<service>.orbit.        A records of the machines which have the service up and SRV records
+//	                        with the endpoint ports. _<service>._tcp.orbit. returns the same SRV records.
+//	<service>.local.orbit.  The same but only the endpoints in the availability zone of this
+//	                        machine, like LocalEndpoints in the haproxy templates.
+//	<a-b-c-d>.ip.orbit.     The A record of the SRV targets.
+//
+// A UDP response which doesn't fit is truncated, which makes the client retry over TCP
+// on the same address.
+type DNSServer struct {
+	Containrunner *Containrunner
+
+	// Domain without the trailing dot, "orbit" if empty
+	Domain string
+
+	// TTL of the records in seconds, defaultDNSTTL if zero. Kept short as the endpoints change often
+	TTL uint32
+
+	packetConn net.PacketConn
+	listener   net.Listener
+	lock       sync.Mutex
+}
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+	dnsTypeOPT = 41
+	dnsTypeANY = 255
+
+	dnsClassINET = 1
+
+	dnsRcodeSuccess        = 0
+	dnsRcodeFormatError    = 1
+	dnsRcodeNameError      = 3
+	dnsRcodeNotImplemented = 4
+	dnsRcodeRefused        = 5
+
+	dnsMaxUDPSize = 512
+
+	defaultDNSTTL = 5
+)
+
+var errDNSFormat = errors.New("invalid dns message")
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// An answer record. The name of the record is always the question name
+type dnsRecord struct {
+	Type uint16
+	Data []byte
+}
+
+// Starts serving udp and tcp on the address, for example "127.0.0.1:53"
+func (ds *DNSServer) Start(address string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	// Use the same port for tcp even if the port was picked by the system
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+
+	ds.packetConn = packetConn
+	ds.listener = listener
+
+	go ds.serveUDP(packetConn)
+	go ds.serveTCP(listener)
+
+	return nil
+}
+
+// Returns the udp address where the server is listening, nil if it's not started
+func (ds *DNSServer) Addr() net.Addr {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if ds.packetConn == nil {
+		return nil
+	}
+	return ds.packetConn.LocalAddr()
+}
+
+func (ds *DNSServer) Close() {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if ds.packetConn != nil {
+		ds.packetConn.Close()
+		ds.listener.Close()
+		ds.packetConn = nil
+		ds.listener = nil
+	}
+}
+
+func (ds *DNSServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		response := ds.handleQuery(buf[:n], dnsMaxUDPSize)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (ds *DNSServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go ds.serveTCPConn(conn)
+	}
+}
+
+// Each message is prefixed with its length as two bytes
+func (ds *DNSServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var length uint16
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+
+		query := make([]byte, length)
+		_, err = io.ReadFull(conn, query)
+		if err != nil {
+			return
+		}
+
+		response := ds.handleQuery(query, 65535)
+		if response == nil {
+			return
+		}
+
+		err = binary.Write(conn, binary.BigEndian, uint16(len(response)))
+		if err == nil {
+			_, err = conn.Write(response)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Returns the response to the query or nil if the query is so broken that it can't be answered
+func (ds *DNSServer) handleQuery(query []byte, maxSize int) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+
+	id := binary.BigEndian.Uint16(query[0:2])
+	opcode := (query[2] >> 3) & 0x0f
+	recursionDesired := query[2]&0x01 != 0
+
+	if opcode != 0 {
+		return encodeDNSResponse(id, recursionDesired, dnsRcodeNotImplemented, nil, nil, 0, false)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return encodeDNSResponse(id, recursionDesired, dnsRcodeFormatError, nil, nil, 0, false)
+	}
+
+	question, offset, err := parseDNSQuestion(query, 12)
+	if err != nil {
+		return encodeDNSResponse(id, recursionDesired, dnsRcodeFormatError, nil, nil, 0, false)
+	}
+
+	// EDNS0 tells how large udp responses the client accepts
+	if maxSize == dnsMaxUDPSize && binary.BigEndian.Uint16(query[10:12]) > 0 {
+		if size := parseDNSOptSize(query, offset); size > dnsMaxUDPSize {
+			maxSize = size
+		}
+	}
+
+	ttl := ds.TTL
+	if ttl == 0 {
+		ttl = defaultDNSTTL
+	}
+
+	rcode, answers := ds.answer(question)
+	response := encodeDNSResponse(id, recursionDesired, rcode, &question, answers, ttl, false)
+	if len(response) > maxSize {
+		response = encodeDNSResponse(id, recursionDesired, rcode, &question, nil, ttl, true)
+	}
+	return response
+}
+
+func (ds *DNSServer) domain() string {
+	if ds.Domain == "" {
+		return "orbit"
+	}
+	return strings.ToLower(strings.TrimSuffix(ds.Domain, "."))
+}
+
+// Returns the response code and the answer records for the question
+func (ds *DNSServer) answer(question dnsQuestion) (int, []dnsRecord) {
+	if question.Class != dnsClassINET {
+		return dnsRcodeRefused, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+	suffix := "." + ds.domain()
+	if !strings.HasSuffix(name, suffix) {
+		return dnsRcodeRefused, nil
+	}
+	name = strings.TrimSuffix(name, suffix)
+
+	wantA := question.Type == dnsTypeA || question.Type == dnsTypeANY
+	wantSRV := question.Type == dnsTypeSRV || question.Type == dnsTypeANY
+
+	if strings.HasSuffix(name, ".ip") {
+		ip := net.ParseIP(strings.Replace(strings.TrimSuffix(name, ".ip"), "-", ".", -1)).To4()
+		if ip == nil || strings.Contains(strings.TrimSuffix(name, ".ip"), ".") {
+			return dnsRcodeNameError, nil
+		}
+		if !wantA {
+			return dnsRcodeSuccess, nil
+		}
+		return dnsRcodeSuccess, []dnsRecord{{dnsTypeA, []byte(ip)}}
+	}
+
+	local := false
+	if strings.HasSuffix(name, ".local") {
+		local = true
+		name = strings.TrimSuffix(name, ".local")
+	}
+
+	if strings.HasPrefix(name, "_") && strings.HasSuffix(name, "._tcp") {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "_"), "._tcp")
+		wantA = false
+	}
+
+	endpoints, found := ds.getEndpoints(name, local)
+	if !found {
+		return dnsRcodeNameError, nil
+	}
+
+	var answers []dnsRecord
+	ips := make(map[string]bool)
+	for _, hostport := range endpoints {
+		host, portString, err := net.SplitHostPort(hostport)
+		ip := net.ParseIP(host).To4()
+		port, perr := strconv.Atoi(portString)
+		if err != nil || perr != nil || ip == nil {
+			continue
+		}
+
+		if wantA && !ips[host] {
+			ips[host] = true
+			answers = append(answers, dnsRecord{dnsTypeA, []byte(ip)})
+		}
+
+		if wantSRV {
+			target := strings.Replace(host, ".", "-", -1) + ".ip." + ds.domain() + "."
+			data := make([]byte, 6)
+			binary.BigEndian.PutUint16(data[0:2], 0)  // priority
+			binary.BigEndian.PutUint16(data[2:4], 10) // weight
+			binary.BigEndian.PutUint16(data[4:6], uint16(port))
+			data = append(data, encodeDNSName(target)...)
+			answers = append(answers, dnsRecord{dnsTypeSRV, data})
+		}
+	}
+
+	return dnsRcodeSuccess, answers
+}
+
+// Returns the sorted host:port endpoints of the service. The service name is case insensitive.
+func (ds *DNSServer) getEndpoints(service string, local bool) ([]string, bool) {
+	s := ds.Containrunner
+	configuration := s.getCurrentConfiguration()
+	backends := configuration.ServiceBackends
+
+	var endpoints []string
+	found := false
+	for name, servers := range backends {
+		if strings.ToLower(name) != service {
+			continue
+		}
+		found = true
+		for hostport, endpointInfo := range servers {
+			if local && (endpointInfo == nil || endpointInfo.AvailabilityZone != s.AvailabilityZone) {
+				continue
+			}
+			endpoints = append(endpoints, hostport)
+		}
+	}
+
+	// Services which are configured but don't have any endpoints up exist but have no records
+	for name := range configuration.MachineConfiguration.Services {
+		if strings.ToLower(name) == service {
+			found = true
+		}
+	}
+
+	sort.Strings(endpoints)
+	return endpoints, found
+}
+
+func parseDNSQuestion(msg []byte, offset int) (dnsQuestion, int, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return dnsQuestion{}, 0, errDNSFormat
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Compression pointers are not used in questions
+		if length&0xc0 != 0 || offset+length > len(msg) {
+			return dnsQuestion{}, 0, errDNSFormat
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+
+	if offset+4 > len(msg) {
+		return dnsQuestion{}, 0, errDNSFormat
+	}
+
+	question := dnsQuestion{
+		Name:  strings.Join(labels, ".") + ".",
+		Type:  binary.BigEndian.Uint16(msg[offset : offset+2]),
+		Class: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+	}
+	return question, offset + 4, nil
+}
+
+// Returns the udp payload size of an EDNS0 OPT record right after the question, or 0
+func parseDNSOptSize(msg []byte, offset int) int {
+	// The OPT record has the root name (a single zero byte), type 41 and the size as the class
+	if offset+5 > len(msg) || msg[offset] != 0 || binary.BigEndian.Uint16(msg[offset+1:offset+3]) != dnsTypeOPT {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(msg[offset+3 : offset+5]))
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func encodeDNSResponse(id uint16, recursionDesired bool, rcode int, question *dnsQuestion, answers []dnsRecord, ttl uint32, truncated bool) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+
+	// QR and AA
+	msg[2] = 0x84
+	if truncated {
+		msg[2] |= 0x02
+	}
+	if recursionDesired {
+		msg[2] |= 0x01
+	}
+	msg[3] = byte(rcode)
+
+	if question != nil {
+		binary.BigEndian.PutUint16(msg[4:6], 1)
+		msg = append(msg, encodeDNSName(question.Name)...)
+		msg = appendUint16(msg, question.Type)
+		msg = appendUint16(msg, question.Class)
+	}
+
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+	for _, answer := range answers {
+		// The answers are always for the question name, which is at offset 12
+		msg = append(msg, 0xc0, 12)
+		msg = appendUint16(msg, answer.Type)
+		msg = appendUint16(msg, dnsClassINET)
+		msg = append(msg, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(msg[len(msg)-4:], ttl)
+		msg = appendUint16(msg, uint16(len(answer.Data)))
+		msg = append(msg, answer.Data...)
+	}
+
+	return msg
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
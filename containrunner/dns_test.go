@@ -0,0 +1,143 @@
+package containrunner
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sort"
+	"testing"
+)
+
+func startTestDNSServer(t *testing.T) (*Containrunner, *DNSServer, *net.Resolver) {
+	ct := new(Containrunner)
+	ct.AvailabilityZone = "eu-west-1a"
+	ct.currentConfiguration.ServiceBackends = map[string]map[string]*EndpointInfo{
+		"web": {
+			"10.0.0.1:3500": &EndpointInfo{AvailabilityZone: "eu-west-1a"},
+			"10.0.0.2:3500": &EndpointInfo{AvailabilityZone: "eu-west-1b"},
+			"10.0.0.2:3501": &EndpointInfo{AvailabilityZone: "eu-west-1b"},
+		},
+	}
+	ct.currentConfiguration.MachineConfiguration.Services = map[string]BoundService{"api": {}}
+
+	ds := &DNSServer{Containrunner: ct}
+	err := ds.Start("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, ds.Addr().String())
+		},
+	}
+
+	return ct, ds, resolver
+}
+
+func TestDNSServerA(t *testing.T) {
+	_, ds, resolver := startTestDNSServer(t)
+	defer ds.Close()
+
+	addrs, err := resolver.LookupHost(context.Background(), "web.orbit.")
+	assert.Nil(t, err)
+	sort.Strings(addrs)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addrs)
+
+	addrs, err = resolver.LookupHost(context.Background(), "WEB.local.orbit.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addrs)
+
+	addrs, err = resolver.LookupHost(context.Background(), "10-0-0-2.ip.orbit.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, addrs)
+
+	// Unknown service and a service which has no endpoints up
+	_, err = resolver.LookupHost(context.Background(), "missing.orbit.")
+	assert.NotNil(t, err)
+	_, err = resolver.LookupHost(context.Background(), "api.orbit.")
+	assert.NotNil(t, err)
+}
+
+func TestDNSServerSRV(t *testing.T) {
+	_, ds, resolver := startTestDNSServer(t)
+	defer ds.Close()
+
+	_, srvs, err := resolver.LookupSRV(context.Background(), "", "", "web.orbit.")
+	assert.Nil(t, err)
+
+	var endpoints []string
+	for _, srv := range srvs {
+		endpoints = append(endpoints, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	}
+	sort.Strings(endpoints)
+	assert.Equal(t, []string{"10-0-0-1.ip.orbit.:3500", "10-0-0-2.ip.orbit.:3500", "10-0-0-2.ip.orbit.:3501"}, endpoints)
+
+	_, srvs, err = resolver.LookupSRV(context.Background(), "web", "tcp", "local.orbit.")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(srvs)) {
+		assert.Equal(t, uint16(3500), srvs[0].Port)
+	}
+}
+
+func TestDNSServerTruncatesToTCP(t *testing.T) {
+	ct, ds, resolver := startTestDNSServer(t)
+	defer ds.Close()
+
+	for i := 0; i < 100; i++ {
+		ct.currentConfiguration.ServiceBackends["web"][fmt.Sprintf("10.0.1.%d:3500", i)] = &EndpointInfo{}
+	}
+
+	_, srvs, err := resolver.LookupSRV(context.Background(), "", "", "web.orbit.")
+	assert.Nil(t, err)
+	assert.Equal(t, 103, len(srvs))
+}
+
+// The poller replaces the configuration while the DNS server answers. Run with -race.
+func TestDNSServerConfigurationReplaced(t *testing.T) {
+	ct, ds, resolver := startTestDNSServer(t)
+	defer ds.Close()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			var configuration RuntimeConfiguration
+			configuration.ServiceBackends = map[string]map[string]*EndpointInfo{
+				"web": {fmt.Sprintf("10.0.2.%d:3500", i): &EndpointInfo{}},
+			}
+			ct.setCurrentConfiguration(configuration)
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 20; i++ {
+		_, err := resolver.LookupHost(context.Background(), "web.orbit.")
+		assert.Nil(t, err)
+	}
+	<-done
+
+	addrs, err := resolver.LookupHost(context.Background(), "web.orbit.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.2.49"}, addrs)
+}
+
+func TestDNSServerHandleQuery(t *testing.T) {
+	ds := &DNSServer{Containrunner: new(Containrunner), TTL: 3}
+
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, encodeDNSName("example.com.")...)
+	query = append(query, 0, dnsTypeA, 0, dnsClassINET)
+
+	response := ds.handleQuery(query, dnsMaxUDPSize)
+	assert.Equal(t, []byte{0x12, 0x34}, response[0:2])
+	assert.Equal(t, byte(dnsRcodeRefused), response[3]&0x0f)
+
+	// Responses are not answered
+	query[2] |= 0x80
+	assert.Nil(t, ds.handleQuery(query, dnsMaxUDPSize))
+
+	assert.Nil(t, ds.handleQuery([]byte{1, 2, 3}, dnsMaxUDPSize))
+	response = ds.handleQuery([]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a'}, dnsMaxUDPSize)
+	assert.Equal(t, byte(dnsRcodeFormatError), response[3]&0x0f)
+}
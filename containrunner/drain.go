@@ -0,0 +1,196 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stored in <EtcdBasePath>/machines/<address>/drain by "orbitctl machine <ip> drain". The daemon
+// drains itself while the key exists and resumes when it's removed.
+type DrainRequest struct {
+	User        string
+	RequestedAt time.Time
+}
+
+func (s *Containrunner) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Stops serving the endpoints of this machine without touching the containers:
+// the CheckEngine is stopped, the endpoint keys of this machine are deleted so that
+// the loadbalancers stop sending traffic here right away instead of waiting for the
+// endpoint TTL, and a MachineLeavingEvent is published.
+func (s *Containrunner) Drain(reason string) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+
+	log.Notice(LogString(fmt.Sprintf("Draining machine %s: %s", s.MachineAddress, reason)))
+
+	s.CheckEngine.Stop()
+
+	deleted, err := s.DeleteMachineEndpoints(s.MachineAddress, nil)
+	for _, key := range deleted {
+		log.Info(LogString("Deleted endpoint " + key))
+	}
+
+	if s.Events != nil {
+		s.Events.PublishOrbitEvent(NewOrbitEvent(MachineLeavingEvent{s.MachineAddress, reason, s.DrainPeriodInSeconds}))
+	}
+
+	return err
+}
+
+// Starts serving the endpoints again after Drain
+func (s *Containrunner) Undrain() {
+	if atomic.LoadInt32(&s.leaving) == 1 || !atomic.CompareAndSwapInt32(&s.draining, 1, 0) {
+		return
+	}
+
+	log.Notice(LogString(fmt.Sprintf("Machine %s is not drained any more", s.MachineAddress)))
+
+	s.CheckEngine.Start(4, s.incomingLoopbackEvents, s.MachineAddress, s.CheckIntervalInMs)
+
+	// The checks are configured again after the next converge
+	s.SetLastConvergeTime(time.Time{})
+}
+
+// Drains the machine for a graceful shutdown, waits for DrainPeriodInSeconds and marks the
+// machine as left. The daemon should exit after this returns.
+func (s *Containrunner) Shutdown(reason string) {
+	atomic.StoreInt32(&s.leaving, 1)
+
+	err := s.Drain(reason)
+	if err != nil {
+		log.Error(LogString("Error on deleting the endpoints: " + err.Error()))
+	}
+
+	if s.DrainPeriodInSeconds > 0 {
+		log.Info(LogString(fmt.Sprintf("Waiting %d seconds before exiting", s.DrainPeriodInSeconds)))
+		time.Sleep(time.Duration(s.DrainPeriodInSeconds) * time.Second)
+	}
+
+	if s.MachineAddress != "" {
+		info := s.GetMachineInfo()
+		info.LeftAt = time.Now()
+		err = s.PublishMachineHeartbeat(info, nil)
+		if err == nil {
+			err = s.GetConfigStore().Delete(s.getMachineKey(s.MachineAddress) + "/heartbeat")
+		}
+		if err != nil {
+			log.Warning(LogString("Could not publish the machine leaving: " + err.Error()))
+		}
+	}
+}
+
+// Deletes the endpoint keys of all services on the machine. Returns the deleted keys.
+func (c *Containrunner) DeleteMachineEndpoints(address string, store ConfigStore) ([]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/services")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, service := range res.Nodes {
+		for _, node := range service.Nodes {
+			if node.Key != service.Key+"/endpoints" {
+				continue
+			}
+			for _, endpoint := range node.Nodes {
+				if !strings.HasPrefix(path.Base(endpoint.Key), address+":") {
+					continue
+				}
+				err = store.Delete(endpoint.Key)
+				if err != nil && !IsKeyNotFound(err) {
+					return deleted, err
+				}
+				deleted = append(deleted, endpoint.Key)
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+func (c *Containrunner) RequestMachineDrain(address string, request DrainRequest, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	bytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return store.Set(c.getMachineKey(address)+"/drain", string(bytes), 0)
+}
+
+func (c *Containrunner) CancelMachineDrain(address string, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	err := store.Delete(c.getMachineKey(address) + "/drain")
+	if IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns nil if the machine has not been requested to drain
+func (c *Containrunner) GetMachineDrainRequest(address string, store ConfigStore) (*DrainRequest, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.Get(c.getMachineKey(address) + "/drain")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var request DrainRequest
+	err = json.Unmarshal([]byte(res.Value), &request)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// Applies a drain request of this machine
+func (s *Containrunner) checkDrainRequest(store ConfigStore) {
+	request, err := s.GetMachineDrainRequest(s.MachineAddress, store)
+	if err != nil {
+		log.Warning(LogString("Could not read the drain request: " + err.Error()))
+		return
+	}
+
+	if request != nil && !s.IsDraining() {
+		s.Drain(fmt.Sprintf("drain requested by %s at %s", request.User, request.RequestedAt.Format(time.RFC3339)))
+	} else if request == nil && s.IsDraining() {
+		s.Undrain()
+	}
+}
+
+// Polls the drain request of this machine from the configuration cache
+func (s *Containrunner) WatchDrainRequests() {
+	for atomic.LoadInt32(&s.leaving) == 0 {
+		var store ConfigStore = s.configurationCache
+		if s.configurationCache == nil || !s.configurationCache.IsSynced() {
+			store = s.GetConfigStore()
+		}
+		s.checkDrainRequest(store)
+		time.Sleep(2 * time.Second)
+	}
+}
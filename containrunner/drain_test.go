@@ -0,0 +1,85 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeleteMachineEndpoints(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	store := NewMemoryConfigStore()
+
+	store.Set("/orbit/services/web/config", "{}", 0)
+	store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", time.Minute)
+	store.Set("/orbit/services/web/endpoints/10.0.0.10:3500", "{}", time.Minute)
+	store.Set("/orbit/services/api/endpoints/10.0.0.1:3501", "{}", time.Minute)
+	store.Set("/orbit/services/api/machines/10.0.0.1", "abc", 0)
+
+	deleted, err := ct.DeleteMachineEndpoints("10.0.0.1", store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/orbit/services/api/endpoints/10.0.0.1:3501", "/orbit/services/web/endpoints/10.0.0.1:3500"}, deleted)
+
+	_, err = store.Get("/orbit/services/web/endpoints/10.0.0.10:3500")
+	assert.Nil(t, err)
+	_, err = store.Get("/orbit/services/api/machines/10.0.0.1")
+	assert.Nil(t, err)
+	_, err = store.Get("/orbit/services/web/endpoints/10.0.0.1:3500")
+	assert.True(t, IsKeyNotFound(err))
+}
+
+func TestMachineDrainRequest(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	ct.MachineAddress = "10.0.0.1"
+	store := NewMemoryConfigStore()
+	ct.ConfigStore = store
+
+	store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", time.Minute)
+
+	request, err := ct.GetMachineDrainRequest("10.0.0.1", store)
+	assert.Nil(t, err)
+	assert.Nil(t, request)
+
+	err = ct.RequestMachineDrain("10.0.0.1", DrainRequest{User: "garo", RequestedAt: time.Now()}, store)
+	assert.Nil(t, err)
+
+	ct.checkDrainRequest(store)
+	assert.True(t, ct.IsDraining())
+	_, err = store.Get("/orbit/services/web/endpoints/10.0.0.1:3500")
+	assert.True(t, IsKeyNotFound(err))
+
+	// Converges don't configure the checks while drained
+	ct.CheckEngine.PushNewConfiguration(MachineConfiguration{})
+
+	assert.Nil(t, ct.CancelMachineDrain("10.0.0.1", store))
+	assert.Nil(t, ct.CancelMachineDrain("10.0.0.1", store))
+	ct.checkDrainRequest(store)
+	assert.False(t, ct.IsDraining())
+	ct.CheckEngine.Stop()
+}
+
+func TestShutdown(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	ct.MachineAddress = "10.0.0.1"
+	store := NewMemoryConfigStore()
+	ct.ConfigStore = store
+
+	err := ct.PublishMachineHeartbeat(ct.GetMachineInfo(), store)
+	assert.Nil(t, err)
+
+	ct.Shutdown("SIGTERM")
+	assert.True(t, ct.IsDraining())
+
+	machine, err := ct.GetMachine("10.0.0.1", store)
+	assert.Nil(t, err)
+	assert.False(t, machine.Alive)
+	assert.True(t, machine.Draining)
+	assert.False(t, machine.LeftAt.IsZero())
+
+	// A removed drain request doesn't undrain a machine which is shutting down
+	ct.checkDrainRequest(store)
+	assert.True(t, ct.IsDraining())
+}
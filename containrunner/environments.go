@@ -0,0 +1,255 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+/*
+	Several environments (staging, production etc) can share one etcd. Each environment has
+	the normal orbit layout under its own directory:
+
+	/orbit/<env>/globalproperties
+	/orbit/<env>/services/<name>/config
+	/orbit/<env>/machineconfigurations/...
+	/orbit/environments/<env>		// JSON file containing EnvironmentConfiguration data
+
+	Installations which don't use environments keep using /orbit directly.
+*/
+
+// Settings of a single environment
+type EnvironmentConfiguration struct {
+	// Commands which change a protected environment must be given the environment explicitly
+	Protected bool
+}
+
+type Environment struct {
+	Name string
+	EnvironmentConfiguration
+}
+
+var environmentNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Names of the keys under the base path which can't be used as environment names
+var reservedEnvironmentNames = map[string]bool{
+	"environments":          true,
+	"services":              true,
+	"machineconfigurations": true,
+	"globalproperties":      true,
+	"generations":           true,
+	"active_generation":     true,
+	"machines":              true,
+	"secrets":               true,
+}
+
+func ValidateEnvironmentName(env string) error {
+	if !environmentNameRegexp.MatchString(env) {
+		return fmt.Errorf("Invalid environment name '%s'. Use lower case letters, numbers, '-' and '_'", env)
+	}
+	if reservedEnvironmentNames[env] {
+		return fmt.Errorf("Environment name '%s' is reserved", env)
+	}
+	return nil
+}
+
+// Returns the base path without the environment
+func (c *Containrunner) GetEtcdRootPath() string {
+	if c.EtcdRootPath != "" {
+		return c.EtcdRootPath
+	}
+	return c.EtcdBasePath
+}
+
+// Returns the base path of an environment
+func (c *Containrunner) GetEnvironmentBasePath(env string) string {
+	return c.GetEtcdRootPath() + "/" + env
+}
+
+// Switches this Containrunner to use the environment. Must be called before Init.
+func (c *Containrunner) SetEnvironment(env string) error {
+	err := ValidateEnvironmentName(env)
+	if err != nil {
+		return err
+	}
+
+	c.EtcdRootPath = c.GetEtcdRootPath()
+	c.EtcdBasePath = c.GetEnvironmentBasePath(env)
+	c.Environment = env
+
+	return nil
+}
+
+// Returns all environments, sorted by name. An environment exists if it has been registered
+// with SetEnvironmentConfiguration or if there is orbit configuration under its base path.
+func (c *Containrunner) GetEnvironments(store ConfigStore) ([]Environment, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	environments := make(map[string]Environment)
+
+	res, err := store.List(c.GetEtcdRootPath())
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range res.Nodes {
+		name := path.Base(node.Key)
+
+		if name == "environments" && node.Dir {
+			for _, file := range node.Nodes {
+				environment := Environment{Name: path.Base(file.Key)}
+				err = json.Unmarshal([]byte(file.Value), &environment.EnvironmentConfiguration)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", file.Key, err)
+				}
+				environments[environment.Name] = environment
+			}
+			continue
+		}
+
+		if !node.Dir || reservedEnvironmentNames[name] {
+			continue
+		}
+
+		for _, child := range node.Nodes {
+			if _, found := environments[name]; !found && reservedEnvironmentNames[path.Base(child.Key)] {
+				environments[name] = Environment{Name: name}
+			}
+		}
+	}
+
+	var list []Environment
+	for _, environment := range environments {
+		list = append(list, environment)
+	}
+	sort.Sort(environmentsByName(list))
+
+	return list, nil
+}
+
+// Returns the configuration of an environment. Unregistered environments have the default configuration.
+func (c *Containrunner) GetEnvironmentConfiguration(env string, store ConfigStore) (EnvironmentConfiguration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	var configuration EnvironmentConfiguration
+
+	node, err := store.Get(c.GetEtcdRootPath() + "/environments/" + env)
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return configuration, nil
+		}
+		return configuration, err
+	}
+
+	err = json.Unmarshal([]byte(node.Value), &configuration)
+	return configuration, err
+}
+
+func (c *Containrunner) SetEnvironmentConfiguration(env string, configuration EnvironmentConfiguration, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	err := ValidateEnvironmentName(env)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(configuration)
+	if err != nil {
+		return err
+	}
+
+	return store.Set(c.GetEtcdRootPath()+"/environments/"+env, string(bytes), 0)
+}
+
+// Returns the service revision of a service in an environment.
+func (c *Containrunner) GetEnvironmentServiceRevision(service string, env string, store ConfigStore) (*ServiceRevision, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	node, err := store.Get(c.GetEnvironmentBasePath(env) + "/services/" + service + "/revision")
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return nil, fmt.Errorf("Service %s has no revision in environment %s", service, env)
+		}
+		return nil, err
+	}
+
+	revision := new(ServiceRevision)
+	err = json.Unmarshal([]byte(node.Value), revision)
+	if err != nil {
+		return nil, err
+	}
+
+	return revision, nil
+}
+
+// Copies the service revision from one environment into another. The service must already
+// be configured in the target environment. Machine specific revisions in the target
+// environment are removed and the change is added into its revision history, like with
+// SetServiceRevision.
+//
+// If expected is not empty the promote fails if the source revision is no longer expected
+// (for example because it was changed while the user was asked for a confirmation).
+//
+// Returns the promoted revision.
+func (c *Containrunner) PromoteServiceRevision(service string, from string, to string, expected string, store ConfigStore) (*ServiceRevision, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	if from == to {
+		return nil, fmt.Errorf("Can't promote service %s from environment %s into itself", service, from)
+	}
+
+	for _, env := range []string{from, to} {
+		err := ValidateEnvironmentName(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	revision, err := c.GetEnvironmentServiceRevision(service, from, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if expected != "" && revision.Revision != expected {
+		return nil, fmt.Errorf("Service %s revision in environment %s was changed to %s", service, from, revision.Revision)
+	}
+
+	target := c.GetEnvironmentBasePath(to) + "/services/" + service
+	_, err = store.Get(target + "/config")
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return nil, fmt.Errorf("Service %s is not configured in environment %s", service, to)
+		}
+		return nil, err
+	}
+
+	revision.DeploymentTime = time.Now()
+	err = setServiceRevision(target, *revision, store)
+	if err != nil {
+		return nil, err
+	}
+
+	return revision, nil
+}
+
+type environmentsByName []Environment
+
+func (a environmentsByName) Len() int           { return len(a) }
+func (a environmentsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a environmentsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,114 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateEnvironmentName(t *testing.T) {
+	assert.Nil(t, ValidateEnvironmentName("staging"))
+	assert.Nil(t, ValidateEnvironmentName("prod-2_eu"))
+	assert.NotNil(t, ValidateEnvironmentName(""))
+	assert.NotNil(t, ValidateEnvironmentName("Staging"))
+	assert.NotNil(t, ValidateEnvironmentName("-staging"))
+	assert.NotNil(t, ValidateEnvironmentName("a/b"))
+	assert.NotNil(t, ValidateEnvironmentName("services"))
+	assert.NotNil(t, ValidateEnvironmentName("environments"))
+}
+
+func TestSetEnvironment(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+
+	assert.Nil(t, ct.SetEnvironment("staging"))
+	assert.Equal(t, "/orbit/staging", ct.EtcdBasePath)
+	assert.Equal(t, "/orbit", ct.GetEtcdRootPath())
+	assert.Equal(t, "staging", ct.Environment)
+
+	// Switching again must not nest the environments
+	assert.Nil(t, ct.SetEnvironment("production"))
+	assert.Equal(t, "/orbit/production", ct.EtcdBasePath)
+	assert.Equal(t, "/orbit/production", ct.GetEnvironmentBasePath("production"))
+
+	assert.NotNil(t, ct.SetEnvironment("services"))
+	assert.Equal(t, "/orbit/production", ct.EtcdBasePath)
+}
+
+func TestGetEnvironments(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+
+	store := NewMemoryConfigStore()
+	store.Set("/orbit/staging/services/ubuntu/config", "{}", 0)
+	store.Set("/orbit/production/globalproperties", "{}", 0)
+	store.Set("/orbit/services/ubuntu/config", "{}", 0)
+	store.Set("/orbit/unrelated/foo", "bar", 0)
+
+	assert.Nil(t, ct.SetEnvironmentConfiguration("production", EnvironmentConfiguration{Protected: true}, store))
+	assert.Nil(t, ct.SetEnvironmentConfiguration("qa", EnvironmentConfiguration{}, store))
+	assert.NotNil(t, ct.SetEnvironmentConfiguration("Bad", EnvironmentConfiguration{}, store))
+
+	environments, err := ct.GetEnvironments(store)
+	assert.Nil(t, err)
+	assert.Equal(t, []Environment{
+		{Name: "production", EnvironmentConfiguration: EnvironmentConfiguration{Protected: true}},
+		{Name: "qa"},
+		{Name: "staging"},
+	}, environments)
+
+	configuration, err := ct.GetEnvironmentConfiguration("production", store)
+	assert.Nil(t, err)
+	assert.Equal(t, true, configuration.Protected)
+
+	configuration, err = ct.GetEnvironmentConfiguration("staging", store)
+	assert.Nil(t, err)
+	assert.Equal(t, false, configuration.Protected)
+}
+
+func TestPromoteServiceRevision(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+
+	store := NewMemoryConfigStore()
+	store.Set("/orbit/staging/services/ubuntu/config", "{}", 0)
+	store.Set("/orbit/staging/services/ubuntu/revision", `{"Revision":"asdf"}`, 0)
+	store.Set("/orbit/production/services/ubuntu/config", "{}", 0)
+	store.Set("/orbit/production/services/ubuntu/revision", `{"Revision":"old"}`, 0)
+	store.Set("/orbit/production/services/ubuntu/machines/10.0.0.1", `{"Revision":"old"}`, 0)
+
+	_, err := ct.PromoteServiceRevision("ubuntu", "staging", "production", "other", store)
+	assert.NotNil(t, err)
+
+	revision, err := ct.PromoteServiceRevision("ubuntu", "staging", "production", "asdf", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "asdf", revision.Revision)
+
+	revision, err = ct.GetEnvironmentServiceRevision("ubuntu", "production", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "asdf", revision.Revision)
+	assert.False(t, revision.DeploymentTime.IsZero())
+
+	_, err = store.Get("/orbit/production/services/ubuntu/machines")
+	assert.True(t, IsKeyNotFound(err))
+
+	// The promote is in the history of the target environment after the revision it replaced
+	production := Containrunner{EtcdBasePath: "/orbit/production"}
+	history, err := production.GetServiceRevisionHistory("ubuntu", store)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(history)) {
+		assert.Equal(t, "asdf", history[0].Revision)
+		assert.Equal(t, "old", history[1].Revision)
+	}
+	previous, err := production.FindServiceRevisionInHistory("ubuntu", "1", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", previous.Revision)
+
+	_, err = ct.PromoteServiceRevision("ubuntu", "staging", "staging", "", store)
+	assert.NotNil(t, err)
+
+	_, err = ct.PromoteServiceRevision("ubuntu", "staging", "qa", "", store)
+	assert.NotNil(t, err)
+
+	_, err = ct.PromoteServiceRevision("missing", "staging", "production", "", store)
+	assert.NotNil(t, err)
+}
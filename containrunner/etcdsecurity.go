@@ -0,0 +1,89 @@
+package containrunner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	etcd "github.com/coreos/etcd/client"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client certificates and credentials used for every etcd connection. The TLS files are used
+// only with https:// endpoints. Empty fields are not used.
+type EtcdSecurity struct {
+	// PEM file of the CA which signed the etcd server certificates. The system roots are used if empty
+	CAFile string
+
+	// PEM files of the client certificate and its key for mutual TLS. Both or neither must be set
+	CertFile string
+	KeyFile  string
+
+	Username string
+	Password string
+}
+
+// The password is not shown when the settings are printed
+func (e EtcdSecurity) String() string {
+	password := ""
+	if e.Password != "" {
+		password = RedactedValue
+	}
+	return fmt.Sprintf("{CAFile:%s CertFile:%s KeyFile:%s Username:%s Password:%s}", e.CAFile, e.CertFile, e.KeyFile, e.Username, password)
+}
+
+// Returns the TLS configuration for the certificate files, or nil if none are set
+func (e EtcdSecurity) TLSConfig() (*tls.Config, error) {
+	if e.CAFile == "" && e.CertFile == "" && e.KeyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if e.CAFile != "" {
+		data, err := ioutil.ReadFile(e.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in the etcd CA file %s", e.CAFile)
+		}
+	}
+
+	if (e.CertFile == "") != (e.KeyFile == "") {
+		return nil, errors.New("Both the etcd client certificate and its key file must be given")
+	}
+
+	if e.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(e.CertFile, e.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the etcd client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Returns the transport for the etcd v2 client. Same as etcd.DefaultTransport but with the TLS configuration.
+func (e EtcdSecurity) transport() (etcd.CancelableTransport, error) {
+	tlsConfig, err := e.TLSConfig()
+	if err != nil || tlsConfig == nil {
+		return etcd.DefaultTransport, err
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}, nil
+}
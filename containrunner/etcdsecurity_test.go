@@ -0,0 +1,80 @@
+package containrunner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a self signed certificate and its key into dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "orbitctl"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestEtcdSecurityTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdsecurity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config, err := EtcdSecurity{Username: "orbit", Password: "pw"}.TLSConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	config, err = EtcdSecurity{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}.TLSConfig()
+	assert.Nil(t, err)
+	if assert.NotNil(t, config) {
+		assert.Equal(t, 1, len(config.Certificates))
+		assert.NotNil(t, config.RootCAs)
+	}
+
+	_, err = EtcdSecurity{CertFile: certFile}.TLSConfig()
+	assert.NotNil(t, err)
+
+	_, err = EtcdSecurity{CAFile: keyFile}.TLSConfig()
+	assert.NotNil(t, err)
+
+	_, err = EtcdSecurity{CAFile: filepath.Join(dir, "missing.pem")}.TLSConfig()
+	assert.NotNil(t, err)
+}
+
+func TestEtcdSecurityString(t *testing.T) {
+	s := fmt.Sprintf("%+v", &Containrunner{EtcdSecurity: EtcdSecurity{Username: "orbit", Password: "hunter2"}})
+	assert.False(t, strings.Contains(s, "hunter2"))
+	assert.True(t, strings.Contains(s, "Username:orbit"))
+}
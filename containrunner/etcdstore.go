@@ -0,0 +1,141 @@
+package containrunner
+
+import (
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	etcd "github.com/coreos/etcd/client"
+	"time"
+)
+
+// ConfigStore which keeps the data in an etcd cluster using the etcd v2 api
+type EtcdConfigStore struct {
+	kapi etcd.KeysAPI
+}
+
+func NewEtcdConfigStore(endpoints []string, security EtcdSecurity) *EtcdConfigStore {
+	return NewEtcdConfigStoreFromKeysAPI(GetEtcdClient(endpoints, security))
+}
+
+func NewEtcdConfigStoreFromKeysAPI(kapi etcd.KeysAPI) *EtcdConfigStore {
+	return &EtcdConfigStore{kapi}
+}
+
+func (s *EtcdConfigStore) Get(key string) (*ConfigNode, error) {
+	res, err := s.kapi.Get(context.Background(), key, &etcd.GetOptions{Sort: true})
+	if err != nil {
+		return nil, etcdStoreError(key, err)
+	}
+
+	node := etcdToConfigNode(res.Node)
+	node.Index = res.Index
+	return node, nil
+}
+
+func (s *EtcdConfigStore) List(key string) (*ConfigNode, error) {
+	res, err := s.kapi.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Sort: true})
+	if err != nil {
+		return nil, etcdStoreError(key, err)
+	}
+
+	node := etcdToConfigNode(res.Node)
+	node.Index = res.Index
+	return node, nil
+}
+
+func (s *EtcdConfigStore) Set(key string, value string, ttl time.Duration) error {
+	_, err := s.kapi.Set(context.Background(), key, value, &etcd.SetOptions{TTL: ttl})
+	return etcdStoreError(key, err)
+}
+
+func (s *EtcdConfigStore) MkDir(key string) error {
+	_, err := s.kapi.Set(context.Background(), key, "", &etcd.SetOptions{Dir: true, PrevExist: etcd.PrevNoExist})
+	if etcdErr, ok := err.(etcd.Error); ok && (etcdErr.Code == etcd.ErrorCodeNodeExist || etcdErr.Code == etcd.ErrorCodeNotFile) {
+		return nil
+	}
+	return etcdStoreError(key, err)
+}
+
+func (s *EtcdConfigStore) Delete(key string) error {
+	_, err := s.kapi.Delete(context.Background(), key, &etcd.DeleteOptions{Recursive: true})
+	return etcdStoreError(key, err)
+}
+
+func (s *EtcdConfigStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	options := &etcd.SetOptions{PrevIndex: prevIndex}
+	if prevIndex == 0 {
+		options = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	}
+
+	_, err := s.kapi.Set(context.Background(), key, value, options)
+	return etcdStoreError(key, err)
+}
+
+func (s *EtcdConfigStore) Watch(key string, afterIndex uint64) ConfigWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdConfigWatcher{s.kapi.Watcher(key, &etcd.WatcherOptions{AfterIndex: afterIndex, Recursive: true}), ctx, cancel}
+}
+
+type etcdConfigWatcher struct {
+	watcher etcd.Watcher
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (w *etcdConfigWatcher) Next() (*ConfigEvent, error) {
+	res, err := w.watcher.Next(w.ctx)
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return nil, ErrWatcherStopped
+		}
+		return nil, etcdStoreError("", err)
+	}
+
+	event := &ConfigEvent{Node: etcdToConfigNode(res.Node)}
+	switch res.Action {
+	case "delete", "compareAndDelete":
+		event.Action = "delete"
+	case "expire":
+		event.Action = "expire"
+	default:
+		event.Action = "set"
+	}
+
+	return event, nil
+}
+
+func (w *etcdConfigWatcher) Stop() {
+	w.cancel()
+}
+
+func etcdToConfigNode(node *etcd.Node) *ConfigNode {
+	n := &ConfigNode{
+		Key:           node.Key,
+		Value:         node.Value,
+		Dir:           node.Dir,
+		ModifiedIndex: node.ModifiedIndex,
+	}
+
+	for _, child := range node.Nodes {
+		n.Nodes = append(n.Nodes, etcdToConfigNode(child))
+	}
+
+	return n
+}
+
+// Converts the etcd errors into the typed ConfigStore errors
+func etcdStoreError(key string, err error) error {
+	etcdErr, ok := err.(etcd.Error)
+	if !ok {
+		return err
+	}
+
+	switch etcdErr.Code {
+	case etcd.ErrorCodeKeyNotFound:
+		return &KeyNotFoundError{Key: key, Index: etcdErr.Index}
+	case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist:
+		return &CompareFailedError{Key: key}
+	case etcd.ErrorCodeEventIndexCleared:
+		return ErrIndexCleared
+	}
+
+	return err
+}
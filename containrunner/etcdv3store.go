@@ -0,0 +1,423 @@
+package containrunner
+
+import (
+	"context"
+	"errors"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default limit of operations in a single etcd v3 transaction (the --max-txn-ops of etcd)
+const DefaultMaxTxnOps = 128
+
+var ErrTransactionTooLarge = errors.New("ConfigStore: transaction has too many operations")
+
+// ConfigStore which keeps the data in an etcd cluster using the etcd v3 api.
+//
+// The v3 keyspace is flat, so the orbit tree is mapped into key prefixes: the key
+// "/orbit/services/comet/config" is stored as it is and its parent directories exist
+// implicitly as long as there are keys under them. Empty directories created with MkDir
+// are stored as marker keys which end with a slash ("/orbit/machineconfigurations/tags/web/").
+//
+// Keys which are set with a ttl get a lease of their own which every Set of the key refreshes,
+// so like with the etcd v2 ttl a key which is not set again expires. The lease is revoked when
+// the key is deleted or set without a ttl.
+type EtcdV3ConfigStore struct {
+	Client    *clientv3.Client
+	MaxTxnOps int
+
+	leaseLock sync.Mutex
+	leases    map[string]keyLease
+}
+
+type keyLease struct {
+	id      clientv3.LeaseID
+	seconds int64
+}
+
+func NewEtcdV3ConfigStore(endpoints []string, security EtcdSecurity) *EtcdV3ConfigStore {
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+		Username:    security.Username,
+		Password:    security.Password,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return NewEtcdV3ConfigStoreFromClient(client)
+}
+
+func NewEtcdV3ConfigStoreFromClient(client *clientv3.Client) *EtcdV3ConfigStore {
+	return &EtcdV3ConfigStore{Client: client, MaxTxnOps: DefaultMaxTxnOps}
+}
+
+// Returns the prefix for the keys under key
+func v3Prefix(key string) string {
+	if key == "/" {
+		return key
+	}
+	return key + "/"
+}
+
+func (s *EtcdV3ConfigStore) Get(key string) (*ConfigNode, error) {
+	return s.get(key, false)
+}
+
+func (s *EtcdV3ConfigStore) List(key string) (*ConfigNode, error) {
+	return s.get(key, true)
+}
+
+func (s *EtcdV3ConfigStore) get(key string, recursive bool) (*ConfigNode, error) {
+	key = cleanKey(key)
+
+	// Both reads are done in the same transaction so that they see the same revision
+	res, err := s.Client.Txn(context.Background()).Then(
+		clientv3.OpGet(key),
+		clientv3.OpGet(v3Prefix(key), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	index := uint64(res.Header.Revision)
+
+	if kvs := res.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		return &ConfigNode{Key: key, Value: string(kvs[0].Value), ModifiedIndex: uint64(kvs[0].ModRevision), Index: index}, nil
+	}
+
+	kvs := res.Responses[1].GetResponseRange().Kvs
+	if len(kvs) == 0 && key != "/" {
+		return nil, &KeyNotFoundError{Key: key, Index: index}
+	}
+
+	node := v3Tree(key, kvs, recursive)
+	node.Index = index
+	return node, nil
+}
+
+// Builds the directory tree under key from the key values under its prefix
+func v3Tree(key string, kvs []*mvccpb.KeyValue, recursive bool) *ConfigNode {
+	root := &ConfigNode{Key: key, Dir: true}
+	dirs := map[string]*ConfigNode{key: root}
+
+	var dir func(key string) *ConfigNode
+	dir = func(key string) *ConfigNode {
+		if node, found := dirs[key]; found {
+			return node
+		}
+
+		node := &ConfigNode{Key: key, Dir: true}
+		parent := dir(parentKey(key))
+		parent.Nodes = append(parent.Nodes, node)
+		dirs[key] = node
+		return node
+	}
+
+	for _, kv := range kvs {
+		k := string(kv.Key)
+		revision := uint64(kv.ModRevision)
+
+		var node *ConfigNode
+		if strings.HasSuffix(k, "/") {
+			node = dir(cleanKey(k))
+		} else {
+			node = &ConfigNode{Key: k, Value: string(kv.Value), ModifiedIndex: revision}
+			parent := dir(parentKey(k))
+			parent.Nodes = append(parent.Nodes, node)
+		}
+
+		// The ModifiedIndex of a directory is the latest change under it
+		for n := node; ; n = dirs[parentKey(n.Key)] {
+			if revision > n.ModifiedIndex {
+				n.ModifiedIndex = revision
+			}
+			if n == root {
+				break
+			}
+		}
+	}
+
+	var finish func(node *ConfigNode, depth int)
+	finish = func(node *ConfigNode, depth int) {
+		if !recursive && depth > 0 {
+			node.Nodes = nil
+			return
+		}
+		sortConfigNodes(node.Nodes)
+		for _, child := range node.Nodes {
+			finish(child, depth+1)
+		}
+	}
+	finish(root, 0)
+
+	return root
+}
+
+func (s *EtcdV3ConfigStore) Set(key string, value string, ttl time.Duration) error {
+	key = cleanKey(key)
+
+	var lease keyLease
+	var options []clientv3.OpOption
+	if ttl > 0 {
+		var err error
+		lease, err = s.getLease(key, ttl)
+		if err != nil {
+			return err
+		}
+		options = append(options, clientv3.WithLease(lease.id))
+	}
+
+	_, err := s.Client.Put(context.Background(), key, value, options...)
+	if err != nil {
+		return err
+	}
+
+	s.setLease(key, lease)
+	return nil
+}
+
+// Refreshes the lease of the key, or grants a new one if the key has no lease with the ttl
+// or if the lease has already expired.
+func (s *EtcdV3ConfigStore) getLease(key string, ttl time.Duration) (keyLease, error) {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	s.leaseLock.Lock()
+	current, found := s.leases[key]
+	s.leaseLock.Unlock()
+
+	if found && current.seconds == seconds {
+		_, err := s.Client.KeepAliveOnce(context.Background(), current.id)
+		if err == nil {
+			return current, nil
+		}
+	}
+
+	res, err := s.Client.Grant(context.Background(), seconds)
+	if err != nil {
+		return keyLease{}, err
+	}
+
+	return keyLease{id: res.ID, seconds: seconds}, nil
+}
+
+// Remembers the lease of the key after it has been written. The previous lease of the key is
+// revoked once the key has been moved away from it, so that the key doesn't disappear meanwhile.
+func (s *EtcdV3ConfigStore) setLease(key string, lease keyLease) {
+	s.leaseLock.Lock()
+	previous, found := s.leases[key]
+	if lease.id == clientv3.NoLease {
+		delete(s.leases, key)
+	} else {
+		if s.leases == nil {
+			s.leases = make(map[string]keyLease)
+		}
+		s.leases[key] = lease
+	}
+	s.leaseLock.Unlock()
+
+	if found && previous.id != lease.id {
+		s.revokeLease(previous.id)
+	}
+}
+
+// Revokes the leases of the key and the keys under it
+func (s *EtcdV3ConfigStore) releaseLeases(key string) {
+	var ids []clientv3.LeaseID
+
+	s.leaseLock.Lock()
+	for k, lease := range s.leases {
+		if k == key || strings.HasPrefix(k, v3Prefix(key)) {
+			ids = append(ids, lease.id)
+			delete(s.leases, k)
+		}
+	}
+	s.leaseLock.Unlock()
+
+	for _, id := range ids {
+		s.revokeLease(id)
+	}
+}
+
+// The lease may have expired already, so errors are only logged
+func (s *EtcdV3ConfigStore) revokeLease(id clientv3.LeaseID) {
+	_, err := s.Client.Revoke(context.Background(), id)
+	if err != nil {
+		log.Debug("Could not revoke etcd lease %x: %+v", id, err)
+	}
+}
+
+func (s *EtcdV3ConfigStore) MkDir(key string) error {
+	marker := v3Prefix(cleanKey(key))
+	_, err := s.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(marker), "=", 0)).
+		Then(clientv3.OpPut(marker, "")).
+		Commit()
+	return err
+}
+
+func (s *EtcdV3ConfigStore) Delete(key string) error {
+	key = cleanKey(key)
+
+	res, err := s.Client.Txn(context.Background()).Then(
+		clientv3.OpDelete(key),
+		clientv3.OpDelete(v3Prefix(key), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	s.releaseLeases(key)
+
+	if res.Responses[0].GetResponseDeleteRange().Deleted == 0 && res.Responses[1].GetResponseDeleteRange().Deleted == 0 {
+		return &KeyNotFoundError{Key: key, Index: uint64(res.Header.Revision)}
+	}
+
+	return nil
+}
+
+func (s *EtcdV3ConfigStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	key = cleanKey(key)
+
+	condition := clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))
+	if prevIndex == 0 {
+		condition = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}
+
+	res, err := s.Client.Txn(context.Background()).If(condition).Then(clientv3.OpPut(key, value)).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !res.Succeeded {
+		return &CompareFailedError{Key: key}
+	}
+
+	return nil
+}
+
+// A delete takes two etcd operations (the key and its prefix), so only half of MaxTxnOps
+// operations fit into a single Commit for sure.
+func (s *EtcdV3ConfigStore) MaxOperations() int {
+	return s.MaxTxnOps / 2
+}
+
+// Applies all operations in a single etcd transaction.
+func (s *EtcdV3ConfigStore) Commit(conditions map[string]uint64, operations []ConfigOperation) error {
+	var cmps []clientv3.Cmp
+	for key, prevIndex := range conditions {
+		key = cleanKey(key)
+		if prevIndex == 0 {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+		} else {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex)))
+		}
+	}
+
+	var ops []clientv3.Op
+	for _, operation := range operations {
+		key := cleanKey(operation.Key)
+		switch operation.Action {
+		case "set":
+			ops = append(ops, clientv3.OpPut(key, operation.Value))
+		case "mkdir":
+			ops = append(ops, clientv3.OpPut(v3Prefix(key), ""))
+		case "delete":
+			ops = append(ops, clientv3.OpDelete(key), clientv3.OpDelete(v3Prefix(key), clientv3.WithPrefix()))
+		}
+	}
+
+	if len(ops) > s.MaxTxnOps || len(cmps) > s.MaxTxnOps {
+		return ErrTransactionTooLarge
+	}
+
+	res, err := s.Client.Txn(context.Background()).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !res.Succeeded {
+		return &CompareFailedError{}
+	}
+
+	return nil
+}
+
+// Zero afterIndex watches only the changes which happen after this call.
+func (s *EtcdV3ConfigStore) Watch(key string, afterIndex uint64) ConfigWatcher {
+	key = cleanKey(key)
+
+	options := []clientv3.OpOption{clientv3.WithPrefix()}
+	if afterIndex > 0 {
+		options = append(options, clientv3.WithRev(int64(afterIndex)+1))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdV3ConfigWatcher{key: key, ch: s.Client.Watch(ctx, key, options...), ctx: ctx, cancel: cancel}
+}
+
+type etcdV3ConfigWatcher struct {
+	key     string
+	ch      clientv3.WatchChan
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending []*ConfigEvent
+}
+
+func (w *etcdV3ConfigWatcher) Next() (*ConfigEvent, error) {
+	for len(w.pending) == 0 {
+		res, ok := <-w.ch
+		if w.ctx.Err() != nil {
+			return nil, ErrWatcherStopped
+		}
+		if !ok {
+			return nil, errors.New("etcd watch channel was closed")
+		}
+		if res.CompactRevision != 0 {
+			return nil, ErrIndexCleared
+		}
+		if err := res.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, e := range res.Events {
+			k := string(e.Kv.Key)
+			node := &ConfigNode{Key: cleanKey(k), Value: string(e.Kv.Value), Dir: strings.HasSuffix(k, "/"), ModifiedIndex: uint64(e.Kv.ModRevision)}
+
+			// The prefix watch also matches keys like "/orbitfoo" when watching "/orbit"
+			if node.Key != w.key && !strings.HasPrefix(node.Key, v3Prefix(w.key)) {
+				continue
+			}
+
+			event := &ConfigEvent{Action: "set", Node: node}
+			if e.Type == mvccpb.DELETE {
+				// Deletions and lease expirations look the same in v3
+				event.Action = "delete"
+				node.Value = ""
+			}
+			w.pending = append(w.pending, event)
+		}
+	}
+
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	return event, nil
+}
+
+func (w *etcdV3ConfigWatcher) Stop() {
+	w.cancel()
+}
@@ -0,0 +1,100 @@
+package containrunner
+
+import (
+	"context"
+	"errors"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestV3Tree(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/test/machineconfigurations/tags/empty/"), ModRevision: 2},
+		{Key: []byte("/test/machineconfigurations/tags/web/haproxy_config"), Value: []byte("foo"), ModRevision: 5},
+		{Key: []byte("/test/machineconfigurations/tags/web/services/ubuntu"), Value: []byte("{}"), ModRevision: 3},
+	}
+
+	node := v3Tree("/test/machineconfigurations/tags", kvs, true)
+	assert.Equal(t, true, node.Dir)
+	assert.Equal(t, uint64(5), node.ModifiedIndex)
+	assert.Equal(t, 2, len(node.Nodes))
+
+	assert.Equal(t, "/test/machineconfigurations/tags/empty", node.Nodes[0].Key)
+	assert.Equal(t, true, node.Nodes[0].Dir)
+	assert.Equal(t, 0, len(node.Nodes[0].Nodes))
+
+	web := node.Nodes[1]
+	assert.Equal(t, "/test/machineconfigurations/tags/web", web.Key)
+	assert.Equal(t, 2, len(web.Nodes))
+	assert.Equal(t, "foo", web.Nodes[0].Value)
+	assert.Equal(t, "/test/machineconfigurations/tags/web/services/ubuntu", web.Nodes[1].Nodes[0].Key)
+	assert.Equal(t, uint64(3), web.Nodes[1].ModifiedIndex)
+
+	node = v3Tree("/test/machineconfigurations/tags", kvs, false)
+	assert.Equal(t, 2, len(node.Nodes))
+	assert.Equal(t, 0, len(node.Nodes[1].Nodes))
+}
+
+type fakeV3KV struct {
+	clientv3.KV
+}
+
+func (kv *fakeV3KV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return &clientv3.PutResponse{}, nil
+}
+
+// Leases which expire only when the test says so
+type fakeV3Lease struct {
+	clientv3.Lease
+	granted []clientv3.LeaseID
+	revoked []clientv3.LeaseID
+	expired map[clientv3.LeaseID]bool
+}
+
+func (l *fakeV3Lease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	id := clientv3.LeaseID(len(l.granted) + 1)
+	l.granted = append(l.granted, id)
+	return &clientv3.LeaseGrantResponse{ID: id, TTL: ttl}, nil
+}
+
+func (l *fakeV3Lease) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	if l.expired[id] {
+		return nil, errors.New("requested lease not found")
+	}
+	return &clientv3.LeaseKeepAliveResponse{ID: id}, nil
+}
+
+func (l *fakeV3Lease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	l.revoked = append(l.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func TestEtcdV3ConfigStoreLeasePerKey(t *testing.T) {
+	leases := &fakeV3Lease{expired: make(map[clientv3.LeaseID]bool)}
+	store := NewEtcdV3ConfigStoreFromClient(&clientv3.Client{KV: &fakeV3KV{}, Lease: leases})
+
+	// Every key gets its own lease which is refreshed on the next Set
+	assert.Nil(t, store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", time.Minute))
+	assert.Nil(t, store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", time.Minute))
+	assert.Nil(t, store.Set("/orbit/services/api/endpoints/10.0.0.1:3501", "{}", time.Minute))
+	assert.Equal(t, []clientv3.LeaseID{1, 2}, leases.granted)
+
+	// A lease which has expired is replaced
+	leases.expired[1] = true
+	assert.Nil(t, store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", time.Minute))
+	assert.Equal(t, []clientv3.LeaseID{1, 2, 3}, leases.granted)
+	assert.Equal(t, []clientv3.LeaseID{1}, leases.revoked)
+
+	// Changing the ttl or removing it revokes the previous lease
+	assert.Nil(t, store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", 30*time.Second))
+	assert.Equal(t, []clientv3.LeaseID{1, 3}, leases.revoked)
+	assert.Nil(t, store.Set("/orbit/services/web/endpoints/10.0.0.1:3500", "{}", 0))
+	assert.Equal(t, []clientv3.LeaseID{1, 3, 4}, leases.revoked)
+
+	store.releaseLeases("/orbit/services/api")
+	assert.Equal(t, []clientv3.LeaseID{1, 3, 4, 2}, leases.revoked)
+	assert.Empty(t, store.leases)
+}
@@ -28,6 +28,7 @@ type DeploymentEvent struct {
 	Revision       string
 	MachineAddress string
 	Jitter         int
+	Reason         string `json:",omitempty"`
 }
 
 type NoopEvent struct {
@@ -53,6 +54,14 @@ type NewRuntimeConfigurationEvent struct {
 	OldRuntimeConfigurationValid bool
 }
 
+// Published when a machine stops serving its endpoints, either because the daemon is
+// shutting down or because the machine has been drained
+type MachineLeavingEvent struct {
+	MachineAddress string
+	Reason         string
+	DrainPeriod    int
+}
+
 type ConvergeContainersEvent struct {
 	MachineConfiguration MachineConfiguration
 }
@@ -112,6 +121,14 @@ func NewOrbitEventFromString(str string) (OrbitEvent, error) {
 		}
 		e.Ptr = ee
 		break
+	case "MachineLeavingEvent":
+		var ee MachineLeavingEvent
+		err := json.Unmarshal(*e.Event, &ee)
+		if err != nil {
+			return e, err
+		}
+		e.Ptr = ee
+		break
 	}
 
 	return e, nil
@@ -0,0 +1,225 @@
+package containrunner
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+/*
+	The env entries, Container.Config.Hostname, Container.Config.Cmd, Container.HostConfig.Binds
+	and the check Url and HostPort of a service can use template variables which the daemon
+	expands for its own machine at converge time, for example:
+
+	"Env": ["ADVERTISE_ADDRESS={{.MachineAddress}}:{{.EndpointPort}}", "ZONE={{.AvailabilityZone}}"]
+
+	See ServiceTemplateVariables for the available variables. The containers are compared
+	against the expanded values, so a changed variable relaunches the container.
+*/
+
+// Comma separated when expanded as {{.Tags}}, "range" iterates the tags.
+type TemplateTags []string
+
+func (t TemplateTags) String() string {
+	return strings.Join(t, ",")
+}
+
+// Variables for the service configuration templates
+type ServiceTemplateVariables struct {
+	MachineAddress   string
+	AvailabilityZone string
+	Tags             TemplateTags
+	EndpointPort     int
+	Revision         string
+	Attributes       map[string]string
+}
+
+// Calls f for every field of the service which may contain template variables
+func visitTemplateFields(service *ServiceConfiguration, f func(field string, value *string)) {
+	if service.Container != nil {
+		for i := range service.Container.Config.Env {
+			f("Container.Config.Env", &service.Container.Config.Env[i])
+		}
+		f("Container.Config.Hostname", &service.Container.Config.Hostname)
+		for i := range service.Container.Config.Cmd {
+			f("Container.Config.Cmd", &service.Container.Config.Cmd[i])
+		}
+		for i := range service.Container.HostConfig.Binds {
+			f("Container.HostConfig.Binds", &service.Container.HostConfig.Binds[i])
+		}
+	}
+
+	for i := range service.Checks {
+		f("Checks.Url", &service.Checks[i].Url)
+		f("Checks.HostPort", &service.Checks[i].HostPort)
+	}
+}
+
+// Returns the template variables of the service on this machine
+func (s *Containrunner) GetServiceTemplateVariables(service ServiceConfiguration) ServiceTemplateVariables {
+	return ServiceTemplateVariables{
+		MachineAddress:   s.MachineAddress,
+		AvailabilityZone: s.AvailabilityZone,
+		Tags:             TemplateTags(s.Tags),
+		EndpointPort:     service.GetEndpointPort(),
+		Revision:         service.GetRevision(),
+		Attributes:       service.Attributes,
+	}
+}
+
+// Returns a copy of the service with the template variables expanded. Using an attribute
+// which the service doesn't have is an error.
+func ExpandServiceConfiguration(service ServiceConfiguration, vars ServiceTemplateVariables) (ServiceConfiguration, error) {
+	templates := false
+	visitTemplateFields(&service, func(field string, value *string) {
+		templates = templates || strings.Contains(*value, "{{")
+	})
+	if !templates {
+		return service, nil
+	}
+
+	service = CopyServiceConfiguration(service)
+
+	var err error
+	visitTemplateFields(&service, func(field string, value *string) {
+		if err != nil || !strings.Contains(*value, "{{") {
+			return
+		}
+
+		var expanded string
+		expanded, err = expandServiceTemplate(*value, vars, "missingkey=error")
+		if err != nil {
+			err = fmt.Errorf("Service %s: could not expand %s: %v", service.Name, field, err)
+			return
+		}
+		*value = expanded
+	})
+
+	if err != nil {
+		return ServiceConfiguration{}, err
+	}
+
+	return service, nil
+}
+
+func expandServiceTemplate(text string, vars ServiceTemplateVariables, option string) (string, error) {
+	tmpl, err := template.New("service").Option(option).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, vars)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Errors of the services whose templates could not be expanded, by the service name
+type ServiceExpansionErrors map[string]error
+
+func (e ServiceExpansionErrors) Error() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var messages []string
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("service %s: %v", name, e[name]))
+	}
+	return "Could not expand templates of " + strings.Join(messages, "; ")
+}
+
+// Returns a copy of the configuration where the templates of every service are expanded for this machine.
+// The services whose templates can't be expanded are left out and returned as ServiceExpansionErrors.
+func (s *Containrunner) ExpandMachineConfiguration(conf MachineConfiguration) (MachineConfiguration, error) {
+	services := make(map[string]BoundService)
+	failed := make(ServiceExpansionErrors)
+	for name, boundService := range conf.Services {
+		service := boundService.GetConfig()
+		expanded, err := ExpandServiceConfiguration(service, s.GetServiceTemplateVariables(service))
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		services[name] = BoundService{DefaultConfiguration: expanded}
+	}
+	conf.Services = services
+
+	if len(failed) > 0 {
+		return conf, failed
+	}
+	return conf, nil
+}
+
+// Puts the services which failed to expand back into the expanded configuration with the
+// configuration which was used at the previous converge, so that their running containers are
+// kept as they are. A service which hasn't been converged before stays out, and its image is
+// removed from the authoritative names so that a container which is already running isn't stopped.
+func keepFailedServices(expanded MachineConfiguration, raw MachineConfiguration, failed ServiceExpansionErrors, previous map[string]ServiceConfiguration) MachineConfiguration {
+	imageRegexp := regexp.MustCompile("^(.+):[^/]+$")
+
+	services := make(map[string]BoundService, len(expanded.Services)+len(failed))
+	for name, boundService := range expanded.Services {
+		services[name] = boundService
+	}
+
+	keepImages := make(map[string]bool)
+	for name := range failed {
+		if service, found := previous[name]; found {
+			log.Warning(LogString(fmt.Sprintf("Keeping the previous configuration of service %s", name)))
+			services[name] = BoundService{DefaultConfiguration: service}
+			continue
+		}
+
+		service := raw.Services[name].GetConfig()
+		if service.Container == nil {
+			continue
+		}
+		image := service.Container.Config.Image
+		if m := imageRegexp.FindStringSubmatch(image); m != nil {
+			image = m[1]
+		}
+		log.Warning(LogString(fmt.Sprintf("Service %s has no previous configuration, leaving its containers as they are", name)))
+		keepImages[image] = true
+	}
+	expanded.Services = services
+
+	if len(keepImages) > 0 {
+		var names []string
+		for _, name := range expanded.AuthoritativeNames {
+			if !keepImages[name] {
+				names = append(names, name)
+			}
+		}
+		expanded.AuthoritativeNames = names
+	}
+
+	return expanded
+}
+
+// Returns an error if a template of the service can't be parsed or uses an unknown variable.
+// Attributes are not checked as the tag overwrites may add them.
+func ValidateServiceTemplates(service ServiceConfiguration) error {
+	vars := ServiceTemplateVariables{Attributes: service.Attributes}
+
+	var err error
+	visitTemplateFields(&service, func(field string, value *string) {
+		if err != nil || !strings.Contains(*value, "{{") {
+			return
+		}
+		_, err = expandServiceTemplate(*value, vars, "missingkey=zero")
+		if err != nil {
+			err = fmt.Errorf("Invalid template in %s: %v", field, err)
+		}
+	})
+
+	return err
+}
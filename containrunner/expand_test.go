@@ -0,0 +1,134 @@
+package containrunner
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func expandTestService() ServiceConfiguration {
+	service := ServiceConfiguration{
+		Name:         "web",
+		EndpointPort: 3500,
+		Container:    &ContainerConfiguration{},
+		Checks:       []ServiceCheck{{Type: "http", Url: "http://{{.MachineAddress}}:{{.EndpointPort}}/check"}},
+		Revision:     &ServiceRevision{Revision: "abc123"},
+		Attributes:   map[string]string{"cluster": "blue"},
+	}
+	service.Container.Config.Image = "registry:5000/web:latest"
+	service.Container.Config.Hostname = "web-{{.AvailabilityZone}}"
+	service.Container.Config.Env = []string{
+		"ADVERTISE={{.MachineAddress}}:{{.EndpointPort}}",
+		"TAGS={{.Tags}}",
+		"CLUSTER={{.Attributes.cluster}}",
+		"PLAIN=value",
+	}
+	service.Container.Config.Cmd = []string{"--revision", "{{.Revision}}"}
+	service.Container.HostConfig.Binds = []string{"/data/{{.Attributes.cluster}}:/data"}
+	return service
+}
+
+func TestExpandServiceConfiguration(t *testing.T) {
+	var ct Containrunner
+	ct.MachineAddress = "10.0.0.1"
+	ct.AvailabilityZone = "eu-west-1a"
+	ct.Tags = []string{"frontend", "logging"}
+
+	service := expandTestService()
+	expanded, err := ExpandServiceConfiguration(service, ct.GetServiceTemplateVariables(service))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"ADVERTISE=10.0.0.1:3500", "TAGS=frontend,logging", "CLUSTER=blue", "PLAIN=value"}, expanded.Container.Config.Env)
+	assert.Equal(t, "web-eu-west-1a", expanded.Container.Config.Hostname)
+	assert.Equal(t, []string{"--revision", "abc123"}, expanded.Container.Config.Cmd)
+	assert.Equal(t, []string{"/data/blue:/data"}, expanded.Container.HostConfig.Binds)
+	assert.Equal(t, "http://10.0.0.1:3500/check", expanded.Checks[0].Url)
+
+	// The original is not changed
+	assert.Equal(t, "web-{{.AvailabilityZone}}", service.Container.Config.Hostname)
+
+	service.Container.Config.Env = append(service.Container.Config.Env, "MISSING={{.Attributes.missing}}")
+	_, err = ExpandServiceConfiguration(service, ct.GetServiceTemplateVariables(service))
+	assert.NotNil(t, err)
+}
+
+func TestExpandMachineConfiguration(t *testing.T) {
+	var ct Containrunner
+	ct.MachineAddress = "10.0.0.1"
+
+	var mc MachineConfiguration
+	mc.Services = map[string]BoundService{
+		"web": {DefaultConfiguration: expandTestService(), Overwrites: &ServiceConfiguration{Attributes: map[string]string{"cluster": "green"}}},
+	}
+
+	expanded, err := ct.ExpandMachineConfiguration(mc)
+	assert.Nil(t, err)
+	assert.Equal(t, "CLUSTER=green", expanded.Services["web"].GetConfig().Container.Config.Env[2])
+	assert.Equal(t, "CLUSTER={{.Attributes.cluster}}", mc.Services["web"].GetConfig().Container.Config.Env[2])
+
+	// A changed input doesn't match the running container any more
+	running := ContainerDetails{Container: &docker.Container{Name: "web", Config: &docker.Config{Image: "registry:5000/web:abc123"}}}
+	running.Container.Config.Hostname = "web-"
+	running.Container.Config.Env = expanded.Services["web"].GetConfig().Container.Config.Env
+	found, _ := FindMatchingContainers([]ContainerDetails{running}, expanded.Services["web"].GetConfig())
+	assert.Equal(t, 1, len(found))
+
+	ct.MachineAddress = "10.0.0.2"
+	expanded, err = ct.ExpandMachineConfiguration(mc)
+	assert.Nil(t, err)
+	found, _ = FindMatchingContainers([]ContainerDetails{running}, expanded.Services["web"].GetConfig())
+	assert.Equal(t, 0, len(found))
+}
+
+func TestValidateServiceTemplates(t *testing.T) {
+	assert.Nil(t, ValidateServiceTemplates(expandTestService()))
+
+	service := expandTestService()
+	service.Container.Config.Hostname = "{{.Machine}}"
+	assert.NotNil(t, ValidateServiceTemplates(service))
+
+	service = expandTestService()
+	service.Checks[0].Url = "http://{{.MachineAddress"
+	assert.NotNil(t, ValidateServiceTemplates(service))
+}
+
+func TestExpandMachineConfigurationWithFailingService(t *testing.T) {
+	var ct Containrunner
+	ct.MachineAddress = "10.0.0.1"
+
+	broken := expandTestService()
+	broken.Name = "api"
+	broken.Container.Config.Image = "registry:5000/api:latest"
+	broken.Container.Config.Env = []string{"BROKEN={{.NoSuchVariable}}"}
+
+	var mc MachineConfiguration
+	mc.AuthoritativeNames = []string{"registry:5000/web", "registry:5000/api"}
+	mc.Services = map[string]BoundService{
+		"web": {DefaultConfiguration: expandTestService()},
+		"api": {DefaultConfiguration: broken},
+	}
+
+	expanded, err := ct.ExpandMachineConfiguration(mc)
+	failed, ok := err.(ServiceExpansionErrors)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(failed))
+	assert.NotNil(t, failed["api"])
+	assert.Contains(t, err.Error(), "service api")
+	assert.Equal(t, 1, len(expanded.Services))
+	assert.Equal(t, "ADVERTISE=10.0.0.1:3500", expanded.Services["web"].GetConfig().Container.Config.Env[0])
+
+	// Without a previous configuration the running api container is left alone
+	kept := keepFailedServices(expanded, mc, failed, nil)
+	assert.Equal(t, 1, len(kept.Services))
+	assert.Equal(t, []string{"registry:5000/web"}, kept.AuthoritativeNames)
+	assert.Equal(t, 2, len(mc.AuthoritativeNames))
+
+	// With a previous configuration the service keeps running with it
+	previous := expandTestService()
+	previous.Name = "api"
+	kept = keepFailedServices(expanded, mc, failed, map[string]ServiceConfiguration{"api": previous})
+	assert.Equal(t, 2, len(kept.Services))
+	assert.Equal(t, "api", kept.Services["api"].GetConfig().Name)
+	assert.Equal(t, mc.AuthoritativeNames, kept.AuthoritativeNames)
+	assert.Equal(t, 1, len(expanded.Services))
+}
@@ -0,0 +1,364 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Snapshot of the runtime service revisions. These are not part of the configuration
+// directory tree, so they are exported into a separate file.
+type RevisionsSnapshot struct {
+	Services map[string]ServiceRevisionsSnapshot
+}
+
+type ServiceRevisionsSnapshot struct {
+	Revision *ServiceRevision           `json:",omitempty"`
+	Machines map[string]ServiceRevision `json:",omitempty"`
+}
+
+// Reads the orbit configuration from etcd into the same structure which LoadOrbitConfigurationFromFiles
+// returns. Runtime keys like revisions and endpoints are not included.
+func (c *Containrunner) GetOrbitConfigurationFromEtcd(store ConfigStore) (*OrbitConfiguration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	oc := new(OrbitConfiguration)
+	oc.MachineConfigurations = make(map[string]MachineConfiguration)
+	oc.Services = make(map[string]ServiceConfiguration)
+
+	var err error
+	oc.GlobalOrbitProperties, err = c.GetGlobalOrbitProperties(store)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/services")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, service := range res.Nodes {
+			for _, node := range service.Nodes {
+				if node.Key != service.Key+"/config" {
+					continue
+				}
+
+				var serviceConfiguration ServiceConfiguration
+				err = json.Unmarshal([]byte(node.Value), &serviceConfiguration)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+				}
+				oc.Services[path.Base(service.Key)] = serviceConfiguration
+			}
+		}
+	}
+
+	res, err = store.List(c.EtcdBasePath + "/machineconfigurations/tags")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err != nil {
+		return oc, nil
+	}
+
+	for _, tag := range res.Nodes {
+		if !tag.Dir {
+			continue
+		}
+
+		var mc MachineConfiguration
+		mc.Services = make(map[string]BoundService)
+
+		// haproxy_config needs to be read first because certs and haproxy_files are stored inside it
+		for _, node := range tag.Nodes {
+			if node.Key == tag.Key+"/haproxy_config" {
+				mc.HAProxyConfiguration = NewHAProxyConfiguration()
+				mc.HAProxyConfiguration.Template = node.Value
+			}
+		}
+
+		for _, node := range tag.Nodes {
+			switch path.Base(node.Key) {
+			case "authoritative_names":
+				err = json.Unmarshal([]byte(node.Value), &mc.AuthoritativeNames)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+				}
+			case "priority":
+				mc.Priority, err = strconv.Atoi(node.Value)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+				}
+			case "includes":
+				err = json.Unmarshal([]byte(node.Value), &mc.Includes)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+				}
+			case "certs", "haproxy_files":
+				if len(node.Nodes) == 0 {
+					continue
+				}
+				if mc.HAProxyConfiguration == nil {
+					return nil, fmt.Errorf("There are keys under %s but no haproxy_config for tag %s", node.Key, path.Base(tag.Key))
+				}
+				files := mc.HAProxyConfiguration.Certs
+				if path.Base(node.Key) == "haproxy_files" {
+					files = mc.HAProxyConfiguration.Files
+				}
+				for _, file := range node.Nodes {
+					files[path.Base(file.Key)] = file.Value
+				}
+			case "services":
+				for _, binding := range node.Nodes {
+					name := path.Base(binding.Key)
+					boundService := BoundService{}
+					if binding.Value != "" && binding.Value != "{}" {
+						boundService.Overwrites = &ServiceConfiguration{}
+						err = json.Unmarshal([]byte(binding.Value), boundService.Overwrites)
+						if err != nil {
+							return nil, fmt.Errorf("Could not parse %s. Error: %+v", binding.Key, err)
+						}
+					}
+					boundService.DefaultConfiguration = oc.Services[name]
+					mc.Services[name] = boundService
+				}
+			}
+		}
+
+		oc.MachineConfigurations[path.Base(tag.Key)] = mc
+	}
+
+	return oc, nil
+}
+
+// Reads the global and machine specific revisions of all services from etcd.
+func (c *Containrunner) GetRevisionsSnapshot(store ConfigStore) (*RevisionsSnapshot, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	snapshot := new(RevisionsSnapshot)
+	snapshot.Services = make(map[string]ServiceRevisionsSnapshot)
+
+	res, err := store.List(c.EtcdBasePath + "/services")
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err != nil {
+		return snapshot, nil
+	}
+
+	for _, service := range res.Nodes {
+		var revisions ServiceRevisionsSnapshot
+
+		for _, node := range service.Nodes {
+			if node.Key == service.Key+"/revision" {
+				revisions.Revision = new(ServiceRevision)
+				err = json.Unmarshal([]byte(node.Value), revisions.Revision)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", node.Key, err)
+				}
+			}
+
+			if node.Key == service.Key+"/machines" {
+				revisions.Machines = make(map[string]ServiceRevision)
+				for _, machine := range node.Nodes {
+					var revision ServiceRevision
+					err = json.Unmarshal([]byte(machine.Value), &revision)
+					if err != nil {
+						return nil, fmt.Errorf("Could not parse %s. Error: %+v", machine.Key, err)
+					}
+					revisions.Machines[path.Base(machine.Key)] = revision
+				}
+			}
+		}
+
+		if revisions.Revision != nil || len(revisions.Machines) > 0 {
+			snapshot.Services[path.Base(service.Key)] = revisions
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Files and directories which ExportOrbitConfigurationToFiles replaces
+var exportedNames = []string{"globalproperties.json", "services", "machineconfigurations"}
+
+// Returns the paths inside the directory which ExportOrbitConfigurationToFiles would replace.
+// The caller should confirm these before exporting, because local files which don't exist in
+// the configuration are deleted.
+func ExportReplacedPaths(startpath string) ([]string, error) {
+	var paths []string
+	for _, name := range exportedNames {
+		_, err := os.Stat(startpath + "/" + name)
+		if err == nil {
+			paths = append(paths, startpath+"/"+name)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// Writes the orbit configuration into a directory tree which can be read back with LoadOrbitConfigurationFromFiles.
+//
+// The globalproperties.json, services/ and machineconfigurations/ inside the directory are replaced
+// so that files which don't exist in the configuration are not left behind. Other files
+// (like .git) are left alone. See ExportReplacedPaths.
+func (c *Containrunner) ExportOrbitConfigurationToFiles(orbitConfiguration *OrbitConfiguration, startpath string) error {
+	for _, name := range exportedNames {
+		err := os.RemoveAll(startpath + "/" + name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeJSONFile(startpath+"/globalproperties.json", orbitConfiguration.GlobalOrbitProperties)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(startpath+"/services", 0755)
+	if err != nil {
+		return err
+	}
+
+	for name, service := range orbitConfiguration.Services {
+		err = writeJSONFile(startpath+"/services/"+name+".json", service)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(startpath+"/machineconfigurations/tags", 0755)
+	if err != nil {
+		return err
+	}
+
+	for tag, mc := range orbitConfiguration.MachineConfigurations {
+		tagpath := startpath + "/machineconfigurations/tags/" + tag
+
+		err = os.MkdirAll(tagpath+"/services", 0755)
+		if err != nil {
+			return err
+		}
+
+		for name, boundService := range mc.Services {
+			if boundService.Overwrites == nil {
+				err = ioutil.WriteFile(tagpath+"/services/"+name+".json", []byte("{}\n"), 0644)
+			} else {
+				err = writeJSONFile(tagpath+"/services/"+name+".json", boundService.Overwrites)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(mc.AuthoritativeNames) > 0 {
+			err = writeJSONFile(tagpath+"/authoritative_names.json", mc.AuthoritativeNames)
+			if err != nil {
+				return err
+			}
+		}
+
+		if mc.Priority != 0 {
+			err = writeJSONFile(tagpath+"/priority.json", mc.Priority)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(mc.Includes) > 0 {
+			err = writeJSONFile(tagpath+"/includes.json", mc.Includes)
+			if err != nil {
+				return err
+			}
+		}
+
+		if mc.HAProxyConfiguration == nil {
+			continue
+		}
+
+		err = ioutil.WriteFile(tagpath+"/haproxy.tpl", []byte(mc.HAProxyConfiguration.Template), 0644)
+		if err != nil {
+			return err
+		}
+
+		err = writeFiles(tagpath+"/certs", mc.HAProxyConfiguration.Certs)
+		if err != nil {
+			return err
+		}
+
+		err = writeFiles(tagpath+"/haproxy_files", mc.HAProxyConfiguration.Files)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the orbit configuration from etcd and writes it into a directory tree.
+// If revisionsFile is not empty then a snapshot of the service revisions is also written into it.
+func (c *Containrunner) ExportToLocalDirectory(directory string, revisionsFile string) error {
+	store := c.GetConfigStore()
+
+	oc, err := c.GetOrbitConfigurationFromEtcd(store)
+	if err != nil {
+		return err
+	}
+
+	err = c.ExportOrbitConfigurationToFiles(oc, directory)
+	if err != nil {
+		return err
+	}
+
+	if revisionsFile != "" {
+		snapshot, err := c.GetRevisionsSnapshot(store)
+		if err != nil {
+			return err
+		}
+
+		err = writeJSONFile(revisionsFile, snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeJSONFile(filename string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(bytes, '\n'), 0644)
+}
+
+func writeFiles(directory string, files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	for name, contents := range files {
+		err = ioutil.WriteFile(directory+"/"+name, []byte(contents), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExportOrbitConfigurationToFilesRoundTrip(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "orbitctl-export")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	paths, err := ExportReplacedPaths(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, paths)
+
+	// Stale files from a previous export must not survive
+	os.MkdirAll(dir+"/services", 0755)
+	ioutil.WriteFile(dir+"/services/removed.json", []byte(`{"Name":"removed"}`), 0644)
+
+	paths, err = ExportReplacedPaths(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/services"}, paths)
+
+	err = ct.ExportOrbitConfigurationToFiles(orbitConfiguration, dir)
+	assert.Nil(t, err)
+
+	exported, err := ct.LoadOrbitConfigurationFromFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, orbitConfiguration, exported)
+
+	_, err = os.Stat(dir + "/services/removed.json")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetOrbitConfigurationFromEtcd(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/globalproperties", Value: `{"AMQPUrl":"amqp://localhost"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/config", Value: `{"Name":"ubuntu","EndpointPort":3500}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/revision", Value: `{"Revision":"asdf"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/machines/10.0.0.1", Value: `{"Revision":"qwerty"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/endpoints/10.0.0.1:3500", Value: `{"Revision":"qwerty"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/test/config", Value: `{"Name":"test","EndpointPort":3501}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/services/ubuntu", Value: `{"EndpointPort":3502}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/services/test", Value: `{}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/haproxy_config", Value: "foobar"}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/certs/test.pem", Value: "----TEST-----"}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/haproxy_files/500.http", Value: "HTTP/1.0 500"}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/authoritative_names", Value: `["ubuntu"]`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/emptytag/services", Dir: true}})
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	oc, err := ct.GetOrbitConfigurationFromEtcd(cc)
+	assert.Nil(t, err)
+	assert.Equal(t, "amqp://localhost", oc.GlobalOrbitProperties.AMQPUrl)
+	assert.Equal(t, 2, len(oc.Services))
+	assert.Nil(t, oc.Services["ubuntu"].Revision)
+
+	mc := oc.MachineConfigurations["testtag"]
+	assert.Equal(t, 3502, mc.Services["ubuntu"].Overwrites.EndpointPort)
+	assert.Equal(t, 3500, mc.Services["ubuntu"].DefaultConfiguration.EndpointPort)
+	assert.Nil(t, mc.Services["test"].Overwrites)
+	assert.Equal(t, "foobar", mc.HAProxyConfiguration.Template)
+	assert.Equal(t, "----TEST-----", mc.HAProxyConfiguration.Certs["test.pem"])
+	assert.Equal(t, "HTTP/1.0 500", mc.HAProxyConfiguration.Files["500.http"])
+	assert.Equal(t, []string{"ubuntu"}, mc.AuthoritativeNames)
+
+	assert.Equal(t, 0, len(oc.MachineConfigurations["emptytag"].Services))
+	assert.Nil(t, oc.MachineConfigurations["emptytag"].HAProxyConfiguration)
+
+	snapshot, err := ct.GetRevisionsSnapshot(cc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(snapshot.Services))
+	assert.Equal(t, "asdf", snapshot.Services["ubuntu"].Revision.Revision)
+	assert.Equal(t, "qwerty", snapshot.Services["ubuntu"].Machines["10.0.0.1"].Revision)
+}
@@ -0,0 +1,550 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Every import writes an immutable, numbered configuration generation:
+
+	/orbit/generations/<n>/snapshot		// JSON map of all configuration keys (relative to the base path) and their values
+	/orbit/generations/<n>/meta			// JSON file containing ConfigurationGeneration data
+	/orbit/active_generation			// Number of the generation which the daemons use
+
+	The daemons read the configuration keys (globalproperties, machineconfigurations and
+	services/<name>/config) from the snapshot of the active generation, so switching the
+	active_generation pointer applies an import atomically. Runtime keys like revisions and
+	endpoints are always read from the live tree.
+
+	Only the newest generations are kept (see ConfigurationGenerationRetention). The active
+	generation and the one before it, which is the target of a rollback, are never removed.
+*/
+
+// Number of configuration generations kept by default
+const DefaultConfigurationGenerationRetention = 50
+
+var ErrConcurrentImport = errors.New("active_generation was changed by someone else during the import")
+
+// Metadata of a single configuration generation
+type ConfigurationGeneration struct {
+	Generation int
+	User       string
+	Time       time.Time
+	GitCommit  string `json:",omitempty"`
+	Message    string `json:",omitempty"`
+	RollbackOf int    `json:",omitempty"` // Set if this generation was created by rolling back into an older generation
+}
+
+// Returns the number of the active generation or zero if no generation has been activated.
+func (c *Containrunner) GetActiveGeneration(store ConfigStore) (int, error) {
+	generation, _, err := c.getActiveGeneration(store)
+	return generation, err
+}
+
+func (c *Containrunner) getActiveGeneration(store ConfigStore) (int, uint64, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	node, err := store.Get(c.EtcdBasePath + "/active_generation")
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	generation, err := strconv.Atoi(node.Value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid active_generation '%s'", node.Value)
+	}
+
+	return generation, node.ModifiedIndex, nil
+}
+
+// Returns the metadata of all generations, oldest first.
+func (c *Containrunner) GetConfigurationGenerations(store ConfigStore) ([]ConfigurationGeneration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	var generations []ConfigurationGeneration
+
+	res, err := store.List(c.EtcdBasePath + "/generations")
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return generations, nil
+		}
+		return nil, err
+	}
+
+	for _, node := range res.Nodes {
+		n, err := strconv.Atoi(path.Base(node.Key))
+		if err != nil {
+			continue
+		}
+
+		generation := ConfigurationGeneration{Generation: n}
+		for _, file := range node.Nodes {
+			if file.Key == node.Key+"/meta" {
+				err = json.Unmarshal([]byte(file.Value), &generation)
+				if err != nil {
+					return nil, fmt.Errorf("Could not parse %s. Error: %+v", file.Key, err)
+				}
+			}
+		}
+		generations = append(generations, generation)
+	}
+
+	sort.Sort(configurationGenerationsByNumber(generations))
+
+	return generations, nil
+}
+
+// Returns the configuration keys and values of a generation. The keys are absolute etcd keys.
+func (c *Containrunner) GetConfigurationGenerationValues(generation int, store ConfigStore) (map[string]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	key := fmt.Sprintf("%s/generations/%d/snapshot", c.EtcdBasePath, generation)
+	node, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot map[string]string
+	err = json.Unmarshal([]byte(node.Value), &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s. Error: %+v", key, err)
+	}
+
+	values := make(map[string]string, len(snapshot))
+	for key, value := range snapshot {
+		values[c.EtcdBasePath+key] = value
+	}
+
+	return values, nil
+}
+
+// Writes a new generation with the given configuration values. The generation number is
+// allocated by creating the snapshot key, so concurrent imports can't get the same number.
+func (c *Containrunner) CreateConfigurationGeneration(values map[string]string, generation ConfigurationGeneration, store ConfigStore) (ConfigurationGeneration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	snapshot := make(map[string]string, len(values))
+	for key, value := range values {
+		snapshot[strings.TrimPrefix(key, c.EtcdBasePath)] = value
+	}
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return generation, err
+	}
+
+	generations, err := c.GetConfigurationGenerations(store)
+	if err != nil {
+		return generation, err
+	}
+
+	generation.Generation = 1
+	if len(generations) > 0 {
+		generation.Generation = generations[len(generations)-1].Generation + 1
+	}
+
+	for {
+		key := fmt.Sprintf("%s/generations/%d/snapshot", c.EtcdBasePath, generation.Generation)
+		err = store.CompareAndSwap(key, string(bytes), 0)
+		if err == nil {
+			break
+		}
+
+		if !IsCompareFailed(err) {
+			return generation, err
+		}
+		generation.Generation++
+	}
+
+	if generation.Time.IsZero() {
+		generation.Time = time.Now()
+	}
+
+	bytes, err = json.Marshal(generation)
+	if err != nil {
+		return generation, err
+	}
+
+	err = store.Set(fmt.Sprintf("%s/generations/%d/meta", c.EtcdBasePath, generation.Generation), string(bytes), 0)
+	if err != nil {
+		return generation, err
+	}
+
+	return generation, nil
+}
+
+// Switches the active_generation pointer. Fails with ErrConcurrentImport if the pointer
+// was changed after it was read with getActiveGeneration (previousIndex).
+func (c *Containrunner) activateConfigurationGeneration(generation int, previousIndex uint64, store ConfigStore) error {
+	err := store.CompareAndSwap(c.EtcdBasePath+"/active_generation", strconv.Itoa(generation), previousIndex)
+	if err != nil {
+		if IsCompareFailed(err) {
+			return ErrConcurrentImport
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Imports the orbit configuration as a new generation.
+//
+// The snapshot is written first, then the live keys are updated (and pruned if prune is set)
+// for the tools which read them directly and finally the new generation is activated. If the
+// store supports transactions the live keys are only written while no other import has been
+// activated, and the activation is committed last in its own transaction.
+func (c *Containrunner) ImportOrbitConfiguration(orbitConfiguration *OrbitConfiguration, generation ConfigurationGeneration, prune bool, store ConfigStore) (ConfigurationGeneration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	values, err := c.GetOrbitConfigurationValues(orbitConfiguration)
+	if err != nil {
+		return generation, err
+	}
+
+	_, previousIndex, err := c.getActiveGeneration(store)
+	if err != nil {
+		return generation, err
+	}
+
+	generation, err = c.CreateConfigurationGeneration(values, generation, store)
+	if err != nil {
+		return generation, err
+	}
+
+	if transactional, ok := store.(TransactionalConfigStore); ok {
+		err = c.commitOrbitConfiguration(orbitConfiguration, values, generation.Generation, previousIndex, prune, transactional)
+		if err != nil {
+			return generation, err
+		}
+
+		c.pruneConfigurationGenerationsAfterImport(store)
+		return generation, nil
+	}
+
+	err = c.UploadOrbitConfigurationToEtcd(orbitConfiguration, store)
+	if err != nil {
+		return generation, err
+	}
+
+	if prune {
+		_, err = c.PruneOrbitConfigurationFromEtcd(orbitConfiguration, store)
+		if err != nil {
+			return generation, err
+		}
+	}
+
+	err = c.activateConfigurationGeneration(generation.Generation, previousIndex, store)
+	if err != nil {
+		return generation, err
+	}
+
+	c.pruneConfigurationGenerationsAfterImport(store)
+
+	return generation, nil
+}
+
+// The import has already been activated, so failing to remove the old generations is only logged
+func (c *Containrunner) pruneConfigurationGenerationsAfterImport(store ConfigStore) {
+	_, err := c.PruneConfigurationGenerations(c.ConfigurationGenerationRetention, store)
+	if err != nil {
+		log.Warning("Could not remove old configuration generations: %+v", err)
+	}
+}
+
+// Removes the oldest generations so that keep generations are left. The active generation and
+// the generation before it (the rollback target) are kept even if they are older. Zero keep
+// means DefaultConfigurationGenerationRetention. Returns the numbers of the removed generations.
+func (c *Containrunner) PruneConfigurationGenerations(keep int, store ConfigStore) ([]int, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+	if keep <= 0 {
+		keep = DefaultConfigurationGenerationRetention
+	}
+
+	generations, err := c.GetConfigurationGenerations(store)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := c.GetActiveGeneration(store)
+	if err != nil {
+		return nil, err
+	}
+
+	rollbackTarget := 0
+	for _, generation := range generations {
+		if generation.Generation < active {
+			rollbackTarget = generation.Generation
+		}
+	}
+
+	var removed []int
+	for i := 0; i < len(generations)-keep; i++ {
+		n := generations[i].Generation
+		if n == active || n == rollbackTarget {
+			continue
+		}
+
+		err = store.Delete(fmt.Sprintf("%s/generations/%d", c.EtcdBasePath, n))
+		if err != nil && !IsKeyNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, n)
+	}
+
+	return removed, nil
+}
+
+// Updates the live configuration keys and then activates the generation. Only the keys which
+// differ from the store contents are written. The changes are committed in as large transactions
+// as the store allows, each of them only if active_generation hasn't been changed since
+// previousIndex, and the activation is committed last. The daemons read the configuration
+// from the active generation, so they see the whole import at once.
+func (c *Containrunner) commitOrbitConfiguration(orbitConfiguration *OrbitConfiguration, values map[string]string, generation int, previousIndex uint64, prune bool, store TransactionalConfigStore) error {
+	existing := make(map[string]*ConfigNode)
+	res, err := store.List(c.EtcdBasePath)
+	if err != nil && !IsKeyNotFound(err) {
+		return err
+	}
+	if err == nil {
+		var add func(node *ConfigNode)
+		add = func(node *ConfigNode) {
+			existing[node.Key] = node
+			for _, child := range node.Nodes {
+				add(child)
+			}
+		}
+		add(res)
+	}
+
+	var operations []ConfigOperation
+
+	if prune {
+		prunable, err := c.GetPrunableKeys(orbitConfiguration, store)
+		if err != nil {
+			return err
+		}
+		for _, key := range prunable {
+			fmt.Printf("Key %s does not exists any more in the configuration, deleting it.\n", key)
+			operations = append(operations, ConfigOperation{Action: "delete", Key: key})
+		}
+	}
+
+	var keys []string
+	for key := range c.GetOrbitConfigurationKeys(orbitConfiguration) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node := existing[key]
+		if value, found := values[key]; found {
+			if node == nil || node.Dir || node.Value != value {
+				operations = append(operations, ConfigOperation{Action: "set", Key: key, Value: value})
+			}
+		} else if node == nil {
+			operations = append(operations, ConfigOperation{Action: "mkdir", Key: key})
+		}
+	}
+
+	conditions := map[string]uint64{c.EtcdBasePath + "/active_generation": previousIndex}
+
+	chunkSize := store.MaxOperations()
+	if chunkSize <= 0 {
+		chunkSize = len(operations)
+	}
+	for len(operations) > 0 {
+		chunk := operations
+		if len(chunk) > chunkSize {
+			chunk = operations[:chunkSize]
+		}
+		operations = operations[len(chunk):]
+
+		err = store.Commit(conditions, chunk)
+		if IsCompareFailed(err) {
+			return ErrConcurrentImport
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = store.Commit(conditions, []ConfigOperation{{Action: "set", Key: c.EtcdBasePath + "/active_generation", Value: strconv.Itoa(generation)}})
+	if IsCompareFailed(err) {
+		return ErrConcurrentImport
+	}
+
+	return err
+}
+
+// Restores an older generation by importing its snapshot as a new generation.
+func (c *Containrunner) RollbackConfigurationGeneration(rollbackTo int, generation ConfigurationGeneration, store ConfigStore) (ConfigurationGeneration, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	values, err := c.GetConfigurationGenerationValues(rollbackTo, store)
+	if err != nil {
+		return generation, err
+	}
+
+	orbitConfiguration, err := c.GetOrbitConfigurationFromValues(values)
+	if err != nil {
+		return generation, err
+	}
+
+	generation.RollbackOf = rollbackTo
+	if generation.Message == "" {
+		generation.Message = fmt.Sprintf("Rollback to generation %d", rollbackTo)
+	}
+
+	return c.ImportOrbitConfiguration(orbitConfiguration, generation, true, store)
+}
+
+// Parses configuration keys and values (as returned by GetOrbitConfigurationValues) back into an OrbitConfiguration.
+func (c *Containrunner) GetOrbitConfigurationFromValues(values map[string]string) (*OrbitConfiguration, error) {
+	cc := NewConfigurationCache(c.EtcdBasePath)
+	for key, value := range values {
+		cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Value: value}})
+	}
+
+	return c.GetOrbitConfigurationFromEtcd(cc)
+}
+
+// Returns true if the key is owned by the configuration snapshots instead of being a runtime key.
+func (c *Containrunner) isOrbitConfigurationKey(key string) bool {
+	if key == c.EtcdBasePath+"/globalproperties" || strings.HasPrefix(key, c.EtcdBasePath+"/machineconfigurations/") {
+		return true
+	}
+
+	rest := strings.TrimPrefix(key, c.EtcdBasePath+"/services/")
+	parts := strings.Split(rest, "/")
+	return rest != key && len(parts) == 2 && parts[1] == "config"
+}
+
+// Returns a read only view of the configuration where the configuration keys come from
+// the snapshot of the active generation and the runtime keys from store.
+//
+// If no generation has been activated (the configuration was imported with an older orbitctl)
+// then store is returned as it is.
+//
+// The snapshots never change, so the values of the active one are kept between the calls. When
+// store is the ConfigurationCache the view is also reused until the cache index changes.
+func (c *Containrunner) GetActiveConfigurationView(store ConfigStore) (ConfigStore, error) {
+	generation, err := c.GetActiveGeneration(store)
+	if err != nil || generation == 0 {
+		return store, err
+	}
+
+	c.activeViewMu.Lock()
+	defer c.activeViewMu.Unlock()
+
+	cached := &c.activeView
+	cache, isCache := store.(*ConfigurationCache)
+	if isCache && cached.view != nil && cached.store == store && cached.generation == generation && cached.index == cache.Index() {
+		return cached.view, nil
+	}
+
+	if cached.values == nil || cached.generation != generation {
+		values, err := c.GetConfigurationGenerationValues(generation, store)
+		if err != nil {
+			return nil, err
+		}
+		*cached = activeConfigurationView{generation: generation, values: values}
+	}
+
+	var index uint64
+	if isCache {
+		index = cache.Index()
+	}
+
+	view := NewConfigurationCache(c.EtcdBasePath)
+
+	// Only the runtime keys are read from the store, the generations are left out as they
+	// contain every snapshot
+	res, err := store.Get(c.EtcdBasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var add func(node *ConfigNode)
+	add = func(node *ConfigNode) {
+		if c.isOrbitConfigurationKey(node.Key) {
+			return
+		}
+		if !node.Dir {
+			view.Apply(&ConfigEvent{Action: "set", Node: node})
+		}
+		for _, child := range node.Nodes {
+			add(child)
+		}
+	}
+
+	for _, child := range res.Nodes {
+		if child.Key == c.EtcdBasePath+"/generations" {
+			continue
+		}
+		if child.Dir {
+			child, err = store.List(child.Key)
+			if err != nil {
+				if IsKeyNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		add(child)
+	}
+
+	for key, value := range cached.values {
+		view.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Value: value}})
+	}
+
+	cached.view = nil
+	if isCache {
+		cached.store = store
+		cached.index = index
+		cached.view = view
+	}
+
+	return view, nil
+}
+
+// Cached result of GetActiveConfigurationView
+type activeConfigurationView struct {
+	generation int
+	values     map[string]string
+
+	store ConfigStore
+	index uint64
+	view  ConfigStore
+}
+
+type configurationGenerationsByNumber []ConfigurationGeneration
+
+func (a configurationGenerationsByNumber) Len() int      { return len(a) }
+func (a configurationGenerationsByNumber) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a configurationGenerationsByNumber) Less(i, j int) bool {
+	return a[i].Generation < a[j].Generation
+}
@@ -0,0 +1,224 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetActiveConfigurationView(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+
+	// Live tree which is half way through an import
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/config", Value: `{"Name":"ubuntu","EndpointPort":3600}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/revision", Value: `{"Revision":"asdf"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/endpoints/10.0.0.1:3500", Value: `{"Revision":"asdf"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/services/ubuntu", Value: `{}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/machineconfigurations/tags/testtag/services/new", Value: `{}`}})
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	// Without generations the live tree is used as it is
+	view, err := ct.GetActiveConfigurationView(cc)
+	assert.Nil(t, err)
+	assert.Equal(t, cc, view)
+
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/generations/1/snapshot", Value: `{"/services/ubuntu/config":"{\"Name\":\"ubuntu\",\"EndpointPort\":3500}","/machineconfigurations/tags/testtag/services/ubuntu":"{}"}`}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/active_generation", Value: "1"}})
+
+	view, err = ct.GetActiveConfigurationView(cc)
+	assert.Nil(t, err)
+
+	configuration, err := ct.GetMachineConfigurationByTags(view, []string{"testtag"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(configuration.Services))
+	assert.Equal(t, 3500, configuration.Services["ubuntu"].GetConfig().EndpointPort)
+	assert.Equal(t, "asdf", configuration.Services["ubuntu"].GetConfig().Revision.Revision)
+
+	backends, err := GetAllServiceEndpointsFromStore(view, "/test")
+	assert.Nil(t, err)
+	assert.Equal(t, "asdf", backends["ubuntu"]["10.0.0.1:3500"].Revision)
+
+	_, err = view.Get("/test/generations")
+	assert.NotNil(t, err)
+}
+
+func TestGetOrbitConfigurationFromValues(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	values, err := ct.GetOrbitConfigurationValues(orbitConfiguration)
+	assert.Nil(t, err)
+
+	restored, err := ct.GetOrbitConfigurationFromValues(values)
+	assert.Nil(t, err)
+	assert.Equal(t, orbitConfiguration, restored)
+}
+
+func TestImportAndRollbackConfigurationGeneration(t *testing.T) {
+	store := NewMemoryConfigStore()
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	generation, err := ct.ImportOrbitConfiguration(orbitConfiguration, ConfigurationGeneration{User: "test", Message: "first"}, true, store)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, generation.Generation)
+
+	delete(orbitConfiguration.Services, "test")
+	generation, err = ct.ImportOrbitConfiguration(orbitConfiguration, ConfigurationGeneration{User: "test", Message: "second"}, true, store)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, generation.Generation)
+
+	_, err = store.Get("/test/services/test/config")
+	assert.NotNil(t, err)
+
+	generation, err = ct.RollbackConfigurationGeneration(1, ConfigurationGeneration{User: "test"}, store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, generation.Generation)
+	assert.Equal(t, 1, generation.RollbackOf)
+
+	active, err := ct.GetActiveGeneration(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, active)
+
+	_, err = store.Get("/test/services/test/config")
+	assert.Nil(t, err)
+
+	generations, err := ct.GetConfigurationGenerations(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(generations))
+	assert.Equal(t, "first", generations[0].Message)
+	assert.Equal(t, "Rollback to generation 1", generations[2].Message)
+}
+
+func TestPruneConfigurationGenerations(t *testing.T) {
+	store := NewMemoryConfigStore()
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+	ct.ConfigurationGenerationRetention = 3
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = ct.ImportOrbitConfiguration(orbitConfiguration, ConfigurationGeneration{User: "test"}, true, store)
+		assert.Nil(t, err)
+	}
+
+	generations, err := ct.GetConfigurationGenerations(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(generations))
+	assert.Equal(t, 3, generations[0].Generation)
+
+	// The active generation and its rollback target are kept even when they are the oldest ones
+	store.Set("/test/active_generation", "3", 0)
+	for _, n := range []string{"6", "7"} {
+		store.Set("/test/generations/"+n+"/snapshot", "{}", 0)
+	}
+	store.Set("/test/generations/1/snapshot", "{}", 0)
+
+	removed, err := ct.PruneConfigurationGenerations(2, store)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 5}, removed)
+
+	generations, err = ct.GetConfigurationGenerations(store)
+	assert.Nil(t, err)
+	var numbers []int
+	for _, generation := range generations {
+		numbers = append(numbers, generation.Generation)
+	}
+	assert.Equal(t, []int{1, 3, 6, 7}, numbers)
+}
+
+func TestGetActiveConfigurationViewIsReused(t *testing.T) {
+	cc := NewConfigurationCache("/test")
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/generations/1/snapshot", Value: `{"/services/ubuntu/config":"{\"Name\":\"ubuntu\"}"}`, ModifiedIndex: 1}})
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/active_generation", Value: "1", ModifiedIndex: 2}})
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	view, err := ct.GetActiveConfigurationView(cc)
+	assert.Nil(t, err)
+	again, err := ct.GetActiveConfigurationView(cc)
+	assert.Nil(t, err)
+	assert.True(t, view == again)
+
+	// A runtime change gives a new view
+	cc.Apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: "/test/services/ubuntu/revision", Value: `{"Revision":"asdf"}`, ModifiedIndex: 3}})
+	again, err = ct.GetActiveConfigurationView(cc)
+	assert.Nil(t, err)
+	assert.False(t, view == again)
+
+	res, err := again.Get("/test/services/ubuntu/revision")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Revision":"asdf"}`, res.Value)
+	res, err = again.Get("/test/services/ubuntu/config")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Name":"ubuntu"}`, res.Value)
+}
+
+// MemoryConfigStore which can only commit a few operations at once, like etcd with --max-txn-ops
+type limitedTransactionStore struct {
+	*MemoryConfigStore
+	max     int
+	commits [][]ConfigOperation
+}
+
+func (s *limitedTransactionStore) Commit(conditions map[string]uint64, operations []ConfigOperation) error {
+	if len(operations) > s.max {
+		return ErrTransactionTooLarge
+	}
+	s.commits = append(s.commits, operations)
+	return s.MemoryConfigStore.Commit(conditions, operations)
+}
+
+func (s *limitedTransactionStore) MaxOperations() int {
+	return s.max
+}
+
+func TestImportOrbitConfigurationInChunks(t *testing.T) {
+	store := &limitedTransactionStore{MemoryConfigStore: NewMemoryConfigStore(), max: 2}
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	orbitConfiguration, err := ct.LoadOrbitConfigurationFromFiles("../testdata")
+	assert.Nil(t, err)
+
+	generation, err := ct.ImportOrbitConfiguration(orbitConfiguration, ConfigurationGeneration{User: "test"}, true, store)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, generation.Generation)
+	assert.True(t, len(store.commits) > 2)
+
+	// The generation is activated last and on its own
+	last := store.commits[len(store.commits)-1]
+	assert.Equal(t, []ConfigOperation{{Action: "set", Key: "/test/active_generation", Value: "1"}}, last)
+	for _, commit := range store.commits[:len(store.commits)-1] {
+		for _, operation := range commit {
+			assert.NotEqual(t, "/test/active_generation", operation.Key)
+		}
+	}
+
+	restored, err := ct.GetOrbitConfigurationFromEtcd(store)
+	assert.Nil(t, err)
+	assert.Equal(t, len(orbitConfiguration.Services), len(restored.Services))
+
+	// Someone else activated a generation during the import
+	store.MemoryConfigStore.Set("/test/active_generation", "1", 0)
+	_, previousIndex, err := ct.getActiveGeneration(store)
+	assert.Nil(t, err)
+	store.MemoryConfigStore.Set("/test/active_generation", "1", 0)
+	values, err := ct.GetOrbitConfigurationValues(orbitConfiguration)
+	assert.Nil(t, err)
+	err = ct.commitOrbitConfiguration(orbitConfiguration, values, 2, previousIndex, true, store)
+	assert.Equal(t, ErrConcurrentImport, err)
+}
@@ -0,0 +1,165 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The daemons count the check results of their endpoints from the ServiceStateEvents and publish
+// the counters under <EtcdBasePath>/services/<name>/health/<endpoint> so that the health of
+// different machines and revisions can be compared, for example by a canary deployment.
+// The counters start from zero when the revision of the endpoint changes. The configuration caches
+// don't poll the configuration when the counters are published.
+const (
+	EndpointHealthTTL             = 5 * time.Minute
+	endpointHealthPublishInterval = 10 * time.Second
+)
+
+type EndpointHealth struct {
+	Service  string
+	Endpoint string
+	Revision string
+
+	// When the counters were started
+	Since time.Time
+
+	Checks       int64
+	Passed       int64
+	StateChanges int64
+
+	UpdatedAt time.Time
+}
+
+type endpointHealthState struct {
+	health      EndpointHealth
+	publishedAt time.Time
+}
+
+// Updates the counters of the endpoint. Returns the counters and whether they should be published.
+func (s *Containrunner) recordEndpointHealth(e ServiceStateEvent) (EndpointHealth, bool) {
+	s.endpointHealthMu.Lock()
+	defer s.endpointHealthMu.Unlock()
+
+	if s.endpointHealth == nil {
+		s.endpointHealth = make(map[string]*endpointHealthState)
+	}
+
+	revision := ""
+	if e.EndpointInfo != nil {
+		revision = e.EndpointInfo.Revision
+	}
+
+	now := time.Now()
+	key := e.Service + "/" + e.Endpoint
+	state, found := s.endpointHealth[key]
+	if !found || state.health.Revision != revision {
+		state = &endpointHealthState{health: EndpointHealth{Service: e.Service, Endpoint: e.Endpoint, Revision: revision, Since: now}}
+		s.endpointHealth[key] = state
+	}
+
+	state.health.Checks++
+	if e.IsUp {
+		state.health.Passed++
+	}
+
+	// The first result is always a change from the unknown state
+	if e.StateChanged && state.health.Checks > 1 {
+		state.health.StateChanges++
+	}
+	state.health.UpdatedAt = now
+
+	publish := e.StateChanged || now.Sub(state.publishedAt) >= endpointHealthPublishInterval
+	if publish {
+		state.publishedAt = now
+	}
+
+	return state.health, publish
+}
+
+func (c *Containrunner) PublishEndpointHealth(health EndpointHealth, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	bytes, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+
+	return store.Set(c.EtcdBasePath+"/services/"+health.Service+"/health/"+health.Endpoint, string(bytes), EndpointHealthTTL)
+}
+
+// Returns the published health counters of the endpoints of the service by the endpoint
+func (c *Containrunner) GetEndpointHealth(service string, store ConfigStore) (map[string]EndpointHealth, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	healths := make(map[string]EndpointHealth)
+
+	res, err := store.List(c.EtcdBasePath + "/services/" + service + "/health")
+	if IsKeyNotFound(err) {
+		return healths, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, node := range res.Nodes {
+		var health EndpointHealth
+		if node.Dir || json.Unmarshal([]byte(node.Value), &health) != nil {
+			continue
+		}
+		healths[health.Endpoint] = health
+	}
+
+	return healths, nil
+}
+
+// Health of a group of endpoints over a period
+type HealthSummary struct {
+	Endpoints    int
+	Checks       int64
+	Passed       int64
+	StateChanges int64
+}
+
+// Returns the share of passed checks, or 1 if there are no checks
+func (h HealthSummary) PassRate() float64 {
+	if h.Checks == 0 {
+		return 1
+	}
+	return float64(h.Passed) / float64(h.Checks)
+}
+
+// Returns the number of state changes per endpoint
+func (h HealthSummary) FlapRate() float64 {
+	if h.Endpoints == 0 {
+		return 0
+	}
+	return float64(h.StateChanges) / float64(h.Endpoints)
+}
+
+// Sums the counters of the endpoints on the machines between two GetEndpointHealth snapshots.
+// Counters which were restarted after the start snapshot are counted from zero.
+func SummarizeEndpointHealth(start map[string]EndpointHealth, end map[string]EndpointHealth, machines []string) HealthSummary {
+	var summary HealthSummary
+
+	for endpoint, health := range end {
+		if !stringInSlice(endpointMachineAddress(endpoint), machines) {
+			continue
+		}
+
+		if previous, found := start[endpoint]; found && previous.Since.Equal(health.Since) && previous.Revision == health.Revision {
+			health.Checks -= previous.Checks
+			health.Passed -= previous.Passed
+			health.StateChanges -= previous.StateChanges
+		}
+
+		summary.Endpoints++
+		summary.Checks += health.Checks
+		summary.Passed += health.Passed
+		summary.StateChanges += health.StateChanges
+	}
+
+	return summary
+}
@@ -76,7 +76,14 @@ func FindMatchingContainers(existing_containers []ContainerDetails, required_ser
 			remaining_containers = append(remaining_containers, container_details)
 			continue
 		}
-		if container_details.Container.Name != required_service.Name {
+		// A blue/green service matches only the container of its current slot
+		if container_details.Container.Name != required_service.GetContainerName() {
+			remaining_containers = append(remaining_containers, container_details)
+			continue
+		}
+
+		// The secrets of the container have been changed. See SetSecretDigestLabel
+		if digest := required_service.Container.Config.Labels[SecretDigestLabel]; digest != "" && container_details.Container.Config.Labels[SecretDigestLabel] != digest {
 			remaining_containers = append(remaining_containers, container_details)
 			continue
 		}
@@ -91,7 +98,7 @@ func FindMatchingContainers(existing_containers []ContainerDetails, required_ser
 				for _, env2 := range container_details.Container.Config.Env {
 					env2p := strings.Split(env2, "=")
 
-					if env1p[0] == env2p[0] && env1p[1] == env2p[1] {
+					if env1p[0] == env2p[0] && envValueMatches(env1p[1], env2p[1]) {
 						env_found = true
 						break
 					}
@@ -113,7 +120,7 @@ func FindMatchingContainers(existing_containers []ContainerDetails, required_ser
 
 					if env1p[0] == env2p[0] {
 						key_found = true
-						if env1p[1] == env2p[1] {
+						if envValueMatches(env2p[1], env1p[1]) {
 							env_match = true
 						}
 						break
@@ -143,9 +150,30 @@ func FindMatchingContainers(existing_containers []ContainerDetails, required_ser
 	return found_containers, remaining_containers
 }
 
-func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool, client *docker.Client) error {
+// The running container has the decrypted value of a secret reference, which is treated as
+// matching here. A changed secret is noticed from the SecretDigestLabel instead.
+func envValueMatches(required string, existing string) bool {
+	return required == existing || IsSecretReference(required)
+}
+
+// Replaces the running container of a blue/green service which doesn't match the configuration.
+// name is the name of the service in the machine configuration. See Containrunner.ReplaceContainer
+type ContainerReplacer func(name string, service ServiceConfiguration, running ContainerDetails) error
+
+type containerReplacement struct {
+	name    string
+	service ServiceConfiguration
+	running ContainerDetails
+}
+
+// Starts the containers which are missing or don't match the configuration. The secret references
+// of a service are resolved with secrets just before its container is launched and the images are
+// pulled with the credentials in registries. A running container of a blue/green service is left
+// running and given to replace, if it's not nil, instead.
+func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool, secrets SecretResolver, registries map[string]RegistryCredentials, replace ContainerReplacer, client *docker.Client) error {
 	var opts docker.ListContainersOptions
 	var ready_for_launch []ServiceConfiguration
+	var ready_for_replace []containerReplacement
 	opts.All = true
 	existing_containers_info, err := client.ListContainers(opts)
 	if err != nil {
@@ -172,7 +200,7 @@ func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool
 	}
 
 	var matching_containers []ContainerDetails
-	for _, required_bound_service := range conf.Services {
+	for name, required_bound_service := range conf.Services {
 		required_service := required_bound_service.GetConfig()
 
 		//log.Debug("required_bound_service: %+v", required_bound_service)
@@ -180,6 +208,11 @@ func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool
 			continue
 		}
 
+		required_service, err = SetSecretDigestLabel(required_service, secrets)
+		if err != nil {
+			log.Warning(LogString(err.Error()))
+		}
+
 		matching_containers, existing_containers = FindMatchingContainers(existing_containers, required_service)
 
 		if len(matching_containers) > 1 {
@@ -187,8 +220,18 @@ func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool
 		}
 
 		if len(matching_containers) == 0 {
-			log.Debug("No containers found matching ", required_service, ". Marking for launch...")
-			ready_for_launch = append(ready_for_launch, required_service)
+			var running *ContainerDetails
+			if required_service.BlueGreen != nil && replace != nil {
+				running, existing_containers = takeRunningContainer(existing_containers, required_service.GetContainerName())
+			}
+
+			if running != nil {
+				log.Debug("Container %s doesn't match service %s. Marking for replacement...", running.Container.Name, required_service.Name)
+				ready_for_replace = append(ready_for_replace, containerReplacement{name, required_service, *running})
+			} else {
+				log.Debug("No containers found matching service %s. Marking for launch...", required_service.Name)
+				ready_for_launch = append(ready_for_launch, required_service)
+			}
 		}
 
 		if len(matching_containers) == 1 {
@@ -230,6 +273,10 @@ func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool
 		imageName := GetContainerImageNameWithRevision(container, "")
 		preserveImages = append(preserveImages, imageName)
 	}
+	for _, replacement := range ready_for_replace {
+		imageName := GetContainerImageNameWithRevision(replacement.service, "")
+		preserveImages = append(preserveImages, imageName)
+	}
 
 	log.Debug("Preserving images %+v\n", preserveImages)
 
@@ -242,15 +289,41 @@ func ConvergeContainers(conf MachineConfiguration, preDelay bool, postDelay bool
 	for _, container := range ready_for_launch {
 		imageName := GetContainerImageNameWithRevision(container, "")
 
-		err = LaunchContainer(container.Name, imageName, container.Container, preDelay, postDelay, client)
+		container, err = ResolveServiceSecrets(container, secrets)
+		if err != nil {
+			log.Error(LogString(err.Error()))
+			somethingFailed = err
+			continue
+		}
+
+		err = LaunchContainer(container.GetContainerName(), imageName, container.Container, registries, preDelay, postDelay, client)
 		if err != nil {
 			somethingFailed = err
 		}
 	}
 
+	for _, replacement := range ready_for_replace {
+		err = replace(replacement.name, replacement.service, replacement.running)
+		if err != nil {
+			log.Error(LogString(err.Error()))
+			somethingFailed = err
+		}
+	}
+
 	return somethingFailed
 }
 
+// Removes the running container with the name from the containers
+func takeRunningContainer(containers []ContainerDetails, name string) (*ContainerDetails, []ContainerDetails) {
+	for i, container := range containers {
+		if container.Container.Name == name && container.Container.State.Running {
+			remaining := append(append([]ContainerDetails{}, containers[:i]...), containers[i+1:]...)
+			return &container, remaining
+		}
+	}
+	return nil, containers
+}
+
 type Int64Slice []int64
 
 func (a Int64Slice) Len() int           { return len(a) }
@@ -415,31 +488,33 @@ type RepositoryV2TagResponse struct {
 	Tag           string `json:"tag"`
 }
 
-func VerifyContainerExistsInRepository(image_name string, overrided_revision string) (bool, int64, error) {
-	found, lastUpdate, err := VerifyContainerExistsInRepositoryV1(image_name, overrided_revision)
+// Checks that the image exists in its registry, with the v2 registry API first and then the v1 API.
+// registries has the credentials of the registries, see GetRegistryCredentials.
+func VerifyContainerExistsInRepository(image_name string, overrided_revision string, registries map[string]RegistryCredentials) (bool, int64, error) {
+	found, lastUpdate, err := VerifyContainerExistsInRepositoryV2(image_name, overrided_revision, registries)
 
 	if err != nil {
-		found, lastUpdate, err = VerifyContainerExistsInRepositoryV2(image_name, overrided_revision)
+		found, lastUpdate, err = VerifyContainerExistsInRepositoryV1(image_name, overrided_revision)
 	}
 
 	return found, lastUpdate, nil
 }
 
+// The v1 API is plain http, so the registry credentials are never sent with it.
 func VerifyContainerExistsInRepositoryV1(image_name string, overrided_revision string) (bool, int64, error) {
 	// http://registry.applifier.info:5000/comet:ac937833f0af968be564230820a625c17f2e3ef1
-	var imageRegexp = regexp.MustCompile("(.+)/(.+?):(.+)")
-	m := imageRegexp.FindStringSubmatch(image_name)
+	host, repository, tag := ParseImageName(image_name)
 
-	if len(m) == 0 {
+	if host == "" {
 		return false, 0, errors.New("Invalid image name format. Maybe this is not a local registry? Global Docker registry is currently not supported")
 	}
 
 	if overrided_revision != "" {
-		m[3] = overrided_revision
+		tag = overrided_revision
 	}
 
 	// http://registry.applifier.info:5000/v1/repositories/comet/tags/ac937833f0af968be564230820a625c17f2e3ef1/json
-	url := "http://" + m[1] + "/v1/repositories/" + m[2] + "/tags/" + m[3] + "/json"
+	url := "http://" + host + "/v1/repositories/" + repository + "/tags/" + tag + "/json"
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -461,41 +536,46 @@ func VerifyContainerExistsInRepositoryV1(image_name string, overrided_revision s
 	return true, data.LastUpdate, nil
 }
 
-func VerifyContainerExistsInRepositoryV2(image_name string, overrided_revision string) (bool, int64, error) {
+func VerifyContainerExistsInRepositoryV2(image_name string, overrided_revision string, registries map[string]RegistryCredentials) (bool, int64, error) {
 	// http://registry.applifier.info:5000/comet:ac937833f0af968be564230820a625c17f2e3ef1
-	var imageRegexp = regexp.MustCompile("(.+)/(.+?):(.+)")
-	m := imageRegexp.FindStringSubmatch(image_name)
+	host, repository, tag := ParseImageName(image_name)
 
-	if len(m) == 0 {
+	if host == "" {
 		return false, 0, errors.New("Invalid image name format. Maybe this is not a local registry? Global Docker registry is currently not supported")
 	}
 
 	if overrided_revision != "" {
-		m[3] = overrided_revision
+		tag = overrided_revision
 	}
 
-	// http://registry.applifier.info:5000/v1/repositories/comet/tags/ac937833f0af968be564230820a625c17f2e3ef1/json
-	// https://registry2.applifier.info:5005/v2/comet/manifests/ac937833f0af968be564230820a625c17f2e3ef1
-	url := "https://" + m[1] + "/v2/" + m[2] + "/manifests/" + m[3]
-
-	resp, err := http.Get(url)
+	credentials := registries[host]
+	client, err := credentials.httpClient()
 	if err != nil {
 		return false, 0, err
 	}
-	defer resp.Body.Close()
 
-	var data RepositoryV2TagResponse
+	// https://registry2.applifier.info:5005/v2/comet/manifests/ac937833f0af968be564230820a625c17f2e3ef1
+	url := "https://" + host + "/v2/" + repository + "/manifests/" + tag
 
-	body, err := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal([]byte(body), &data)
+	resp, err := registryV2Get(client, url, credentials)
 	if err != nil {
 		return false, 0, err
 	}
+	defer resp.Body.Close()
 
-	return true, 0, nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, 0, nil
+	case http.StatusNotFound:
+		return false, 0, nil
+	default:
+		return false, 0, fmt.Errorf("Registry %s returned %s for %s:%s", host, resp.Status, repository, tag)
+	}
 }
 
-func LaunchContainer(name string, imageName string, container *ContainerConfiguration, preDelay bool, postDelay bool, client *docker.Client) error {
+// Pulls the image if needed, with the credentials of its registry from registries, and replaces
+// the container with the name with a new one.
+func LaunchContainer(name string, imageName string, container *ContainerConfiguration, registries map[string]RegistryCredentials, preDelay bool, postDelay bool, client *docker.Client) error {
 
 	image, err := GetContainerImage(imageName, client)
 	if err != nil {
@@ -523,7 +603,7 @@ func LaunchContainer(name string, imageName string, container *ContainerConfigur
 
 			pullImageOptions.OutputStream = os.Stderr
 
-			err = client.PullImage(pullImageOptions, docker.AuthConfiguration{})
+			err = client.PullImage(pullImageOptions, RegistryAuthConfiguration(registries, imageName))
 			if err != nil {
 				if tries > 2 {
 					fmt.Printf("Could not pull, too many tries. Aborting")
@@ -557,7 +637,8 @@ func LaunchContainer(name string, imageName string, container *ContainerConfigur
 	//log.Info(LogEvent(ContainerLogEvent{"create-and-launch", imageName, name}))
 	new_container, err := client.CreateContainer(options)
 	if err != nil {
-		fmt.Printf("Error on CreateContainer %+v: %+v", options, err)
+		// The options are not printed as the env contains the decrypted secrets
+		fmt.Printf("Error on CreateContainer %s (image %s): %+v", options.Name, imageName, err)
 		return err
 	}
 
@@ -0,0 +1,521 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Check types which the CheckEngine knows how to run
+var KnownServiceCheckTypes = []string{"dummy", "http", "tcp"}
+
+// A single problem found by LintOrbitConfigurationTree. Line is zero if the problem
+// isn't about any specific line in the file.
+type LintProblem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p LintProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+type linter struct {
+	problems []LintProblem
+}
+
+func (l *linter) add(file string, line int, format string, args ...interface{}) {
+	l.problems = append(l.problems, LintProblem{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validates an orbit configuration directory tree without touching etcd or docker.
+//
+// Unlike LoadOrbitConfigurationFromFiles this doesn't stop on the first error but returns
+// every problem found, sorted by file and line.
+func LintOrbitConfigurationTree(startpath string) []LintProblem {
+	l := new(linter)
+
+	file := startpath + "/globalproperties.json"
+	if _, err := os.Stat(file); err == nil {
+		var gop GlobalOrbitProperties
+		data, ok := l.lintJSONFile(file, &gop)
+		if ok {
+			l.lintRegistries(file, data, gop.Registries)
+		}
+	}
+
+	services := make(map[string]ServiceConfiguration)
+
+	files, err := ioutil.ReadDir(startpath + "/services/")
+	if err != nil {
+		l.add(startpath+"/services", 0, "could not read services directory: %v", err)
+	}
+	for _, f := range files {
+		fname := startpath + "/services/" + f.Name()
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			l.add(fname, 0, "only .json files are allowed in the services directory")
+			continue
+		}
+
+		var service ServiceConfiguration
+		data, ok := l.lintJSONFile(fname, &service)
+		if !ok {
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), ".json")
+		if service.Name != name {
+			l.add(fname, jsonKeyLine(data, "Name"), "service name '%s' doesn't match the file name '%s'", service.Name, name)
+		}
+
+		l.lintServiceConfiguration(fname, data, service)
+
+		// Tag overwrites can set a part of the policy, so only the service definitions are checked
+		if service.RollbackPolicy != nil {
+			if err := service.RollbackPolicy.Validate(); err != nil {
+				l.add(fname, jsonKeyLine(data, "RollbackPolicy"), "%v", err)
+			}
+		}
+		if service.BlueGreen != nil {
+			if err := service.BlueGreen.Validate(); err != nil {
+				l.add(fname, jsonKeyLine(data, "BlueGreen"), "%v", err)
+			}
+		}
+		services[name] = service
+	}
+
+	files, err = ioutil.ReadDir(startpath + "/machineconfigurations/tags/")
+	if err != nil {
+		l.add(startpath+"/machineconfigurations/tags", 0, "could not read tags directory: %v", err)
+	}
+	tags := make(map[string]*MachineConfiguration)
+	for _, tag := range files {
+		tagpath := startpath + "/machineconfigurations/tags/" + tag.Name()
+		if !tag.IsDir() {
+			l.add(tagpath, 0, "only tag directories are allowed in the tags directory")
+			continue
+		}
+
+		tags[tag.Name()] = &MachineConfiguration{TagConfiguration{Includes: l.lintTag(tagpath, services)}}
+	}
+
+	l.lintTagIncludes(startpath, tags)
+
+	sort.Stable(lintProblemsByFile(l.problems))
+
+	return l.problems
+}
+
+// Returns the tags which the tag includes
+func (l *linter) lintTag(tagpath string, services map[string]ServiceConfiguration) []string {
+	hasHAProxy := false
+
+	fname := tagpath + "/haproxy.tpl"
+	if bytes, err := ioutil.ReadFile(fname); err == nil {
+		hasHAProxy = true
+
+		_, err = template.New("main").Funcs(haproxyTemplateFuncs()).Parse(string(bytes))
+		if err != nil {
+			l.add(fname, templateErrorLine(err), "template parse error: %v", err)
+		}
+	}
+
+	fname = tagpath + "/authoritative_names.json"
+	if _, err := os.Stat(fname); err == nil {
+		var names []string
+		l.lintJSONFile(fname, &names)
+	}
+
+	fname = tagpath + "/priority.json"
+	if _, err := os.Stat(fname); err == nil {
+		var priority int
+		l.lintJSONFile(fname, &priority)
+	}
+
+	var includes []string
+	fname = tagpath + "/includes.json"
+	if _, err := os.Stat(fname); err == nil {
+		l.lintJSONFile(fname, &includes)
+	}
+
+	for _, dir := range []string{"certs", "haproxy_files"} {
+		files, err := ioutil.ReadDir(tagpath + "/" + dir)
+		if err != nil {
+			continue
+		}
+
+		for _, f := range files {
+			if f.IsDir() {
+				l.add(tagpath+"/"+dir+"/"+f.Name(), 0, "directories are not allowed inside %s", dir)
+			}
+		}
+
+		if len(files) > 0 && !hasHAProxy {
+			l.add(tagpath+"/"+dir, 0, "there are %s but no haproxy.tpl", dir)
+		}
+	}
+
+	files, err := ioutil.ReadDir(tagpath + "/services")
+	if err != nil {
+		return includes
+	}
+
+	ports := make(map[int]string)
+	claimPort := func(fname string, name string, field string, port int) {
+		if port == 0 {
+			return
+		}
+		if other, found := ports[port]; found {
+			l.add(fname, 0, "%s %d is already used by service '%s' in this tag", field, port, other)
+		} else {
+			ports[port] = name
+		}
+	}
+
+	for _, f := range files {
+		fname := tagpath + "/services/" + f.Name()
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			l.add(fname, 0, "only .json files are allowed in the tag services directory")
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), ".json")
+		service, found := services[name]
+		if !found {
+			l.add(fname, 0, "tag references unknown service '%s'", name)
+		}
+
+		port := service.EndpointPort
+		alternatePort := 0
+		if service.BlueGreen != nil {
+			alternatePort = service.BlueGreen.AlternatePort
+		}
+
+		bytes, err := ioutil.ReadFile(fname)
+		if err != nil {
+			l.add(fname, 0, "could not read file: %v", err)
+			continue
+		}
+
+		if str := strings.TrimSpace(string(bytes)); str != "" && str != "{}" {
+			var overwrites ServiceConfiguration
+			data, ok := l.lintJSONFile(fname, &overwrites)
+			if !ok {
+				continue
+			}
+			l.lintServiceConfiguration(fname, data, overwrites)
+
+			if overwrites.EndpointPort != 0 {
+				port = overwrites.EndpointPort
+			}
+			if overwrites.BlueGreen != nil && overwrites.BlueGreen.AlternatePort != 0 {
+				alternatePort = overwrites.BlueGreen.AlternatePort
+			}
+		}
+
+		if port != 0 && port == alternatePort {
+			l.add(fname, 0, "BlueGreen.AlternatePort %d is the same as the EndpointPort", port)
+			continue
+		}
+
+		// The green slot of a blue/green service needs its port too
+		claimPort(fname, name, "EndpointPort", port)
+		claimPort(fname, name, "BlueGreen.AlternatePort", alternatePort)
+	}
+
+	return includes
+}
+
+// The registry passwords are stored in the global properties, so they must be secret references
+func (l *linter) lintRegistries(fname string, data []byte, registries map[string]RegistryCredentials) {
+	for host, credentials := range registries {
+		line := jsonKeyLine(data, "Registries", host)
+		if credentials.Password != "" && !IsSecretReference(credentials.Password) {
+			l.add(fname, line, "registry %s has a plain text password, use a secret reference", host)
+		}
+		for _, value := range []string{credentials.Username, credentials.Password} {
+			if !IsSecretReference(value) {
+				continue
+			}
+			if err := ValidateSecretName(value[len(SecretPrefix):]); err != nil {
+				l.add(fname, line, "%v", err)
+			}
+		}
+	}
+}
+
+// Checks that the included tags exist and that the includes don't form a cycle
+func (l *linter) lintTagIncludes(startpath string, tags map[string]*MachineConfiguration) {
+	var names []string
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Unknown tags are reported only by the tag which includes them
+	lookup := func(tag string) (*MachineConfiguration, error) {
+		if mc, found := tags[tag]; found {
+			return mc, nil
+		}
+		return new(MachineConfiguration), nil
+	}
+
+	for _, name := range names {
+		fname := startpath + "/machineconfigurations/tags/" + name + "/includes.json"
+		for _, include := range tags[name].Includes {
+			if _, found := tags[include]; !found {
+				l.add(fname, 0, "tag includes unknown tag '%s'", include)
+			}
+		}
+
+		_, _, err := ResolveTagConfiguration(name, lookup)
+		if err != nil {
+			l.add(fname, 0, "%v", err)
+		}
+	}
+}
+
+func (l *linter) lintServiceConfiguration(fname string, data []byte, service ServiceConfiguration) {
+	for i, check := range service.Checks {
+		keys := []string{"Checks"}
+		for j := 0; j <= i; j++ {
+			keys = append(keys, "Type")
+		}
+
+		known := false
+		for _, t := range KnownServiceCheckTypes {
+			if check.Type == t {
+				known = true
+			}
+		}
+
+		if !known {
+			l.add(fname, jsonKeyLine(data, keys...), "check %d has unknown type '%s', must be one of %s", i, check.Type, strings.Join(KnownServiceCheckTypes, ", "))
+		}
+	}
+
+	err := ValidateMergeDirectives(service.Merge)
+	if err != nil {
+		l.add(fname, jsonKeyLine(data, "Merge"), "%v", err)
+	}
+
+	err = ValidateServiceTemplates(service)
+	if err != nil {
+		l.add(fname, 0, "%v", err)
+	}
+
+	for _, name := range GetSecretReferences(service) {
+		if err := ValidateSecretName(name); err != nil {
+			l.add(fname, 0, "%v", err)
+		}
+	}
+
+	if service.Container != nil {
+		image := service.Container.Config.Image
+		if image == "" {
+			l.add(fname, jsonKeyLine(data, "Container", "Config"), "container has no image")
+		} else if !imageHasTag(image) {
+			l.add(fname, jsonKeyLine(data, "Container", "Config", "Image"), "image '%s' has no tag", image)
+		}
+	}
+}
+
+// Reads a json file into v and checks that it doesn't contain any fields which v doesn't have.
+// Returns the file contents and false if the file couldn't be parsed.
+func (l *linter) lintJSONFile(fname string, v interface{}) ([]byte, bool) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		l.add(fname, 0, "could not read file: %v", err)
+		return nil, false
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		line := 0
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			line = offsetLine(data, e.Offset)
+		case *json.UnmarshalTypeError:
+			line = offsetLine(data, e.Offset)
+		}
+		l.add(fname, line, "invalid json: %v", err)
+		return data, false
+	}
+
+	var raw interface{}
+	json.Unmarshal(data, &raw)
+	for _, field := range unknownJSONFields(raw, reflect.TypeOf(v), nil) {
+		l.add(fname, jsonKeyLine(data, field...), "unknown field '%s'", strings.Join(field, "."))
+	}
+
+	return data, true
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// Returns the paths of all fields in the decoded json value which don't exist in type t.
+// Field names are matched case insensitively like encoding/json does.
+func unknownJSONFields(value interface{}, t reflect.Type, path []string) [][]string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	var unknown [][]string
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		collectJSONFields(t, fields)
+
+		for key, v := range object {
+			fieldPath := append(append([]string{}, path...), key)
+			ft, found := fields[strings.ToLower(key)]
+			if !found {
+				unknown = append(unknown, fieldPath)
+				continue
+			}
+			unknown = append(unknown, unknownJSONFields(v, ft, fieldPath)...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, v := range object {
+			unknown = append(unknown, unknownJSONFields(v, t.Elem(), append(append([]string{}, path...), key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for _, v := range array {
+			unknown = append(unknown, unknownJSONFields(v, t.Elem(), path)...)
+		}
+	}
+
+	sort.Sort(fieldPaths(unknown))
+
+	return unknown
+}
+
+// Collects the json names (lowercased) of all fields in the struct type, including embedded structs.
+func collectJSONFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if name == "" && f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectJSONFields(ft, fields)
+				continue
+			}
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+}
+
+// Returns the line of the given key path in a json document. Each key is searched after
+// the previous one, so this is only an approximation but good enough to point the user into
+// the right place. Returns zero if the key was not found.
+func jsonKeyLine(data []byte, keys ...string) int {
+	text := strings.ToLower(string(data))
+
+	offset := 0
+	for _, key := range keys {
+		i := strings.Index(text[offset:], `"`+strings.ToLower(key)+`"`)
+		if i == -1 {
+			return 0
+		}
+		offset += i + 1
+	}
+
+	return offsetLine(data, int64(offset-1))
+}
+
+func offsetLine(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	return strings.Count(string(data[0:offset]), "\n") + 1
+}
+
+var templateErrorLineRegexp = regexp.MustCompile(`^template: [^:]*:(\d+)`)
+
+func templateErrorLine(err error) int {
+	match := templateErrorLineRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+func imageHasTag(image string) bool {
+	name := image[strings.LastIndex(image, "/")+1:]
+	return strings.Contains(name, ":") || strings.Contains(name, "@")
+}
+
+// The template functions which are available in haproxy.tpl. These need to match
+// the functions which HAProxySettings.GetNewConfig provides.
+func haproxyTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"Endpoints":      func(service_name string) ([]BackendParameters, error) { return nil, nil },
+		"LocalEndpoints": func(service_name string) ([]BackendParameters, error) { return nil, nil },
+	}
+}
+
+type lintProblemsByFile []LintProblem
+
+func (a lintProblemsByFile) Len() int      { return len(a) }
+func (a lintProblemsByFile) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a lintProblemsByFile) Less(i, j int) bool {
+	if a[i].File != a[j].File {
+		return a[i].File < a[j].File
+	}
+	return a[i].Line < a[j].Line
+}
+
+type fieldPaths [][]string
+
+func (a fieldPaths) Len() int           { return len(a) }
+func (a fieldPaths) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fieldPaths) Less(i, j int) bool { return strings.Join(a[i], ".") < strings.Join(a[j], ".") }
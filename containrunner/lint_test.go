@@ -0,0 +1,156 @@
+package containrunner
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLintTestFile(t *testing.T, filename string, contents string) {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filename, []byte(contents), 0644)
+	assert.Nil(t, err)
+}
+
+func TestLintOrbitConfigurationTreeTestdata(t *testing.T) {
+	problems := LintOrbitConfigurationTree("../testdata")
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+
+	assert.Contains(t, messages, "../testdata/services/ubuntu.json:19: image 'ubuntu' has no tag")
+	assert.Contains(t, messages, "../testdata/services/ubuntu.json:30: unknown field 'SourceControl.OAuth'")
+}
+
+func TestLintOrbitConfigurationTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-lint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLintTestFile(t, dir+"/globalproperties.json", `{"AMQPUrl":"", "Foo": 1}`)
+	writeLintTestFile(t, dir+"/services/web.json", `{
+	"Name": "web",
+	"EndpointPort": 3500,
+	"Checks": [
+		{"Type": "http", "Url": "http://127.0.0.1:3500/"},
+		{"Type": "htpt", "Url": "http://127.0.0.1:3500/"}
+	],
+	"Container": {"Config": {"Image": "registry:5000/web:1.0"}, "HostConfig": {"NetworkMode": "host"}}
+}`)
+	writeLintTestFile(t, dir+"/services/api.json", `{"Name": "api", "EndpointPort": 3500, "RollbackPolicy": {"MaxDownFraction": 0.2, "TimeoutSeconds": 300}}`)
+	writeLintTestFile(t, dir+"/services/worker.json", "{\n\"Name\": \"worker\",\n\"RollbackPolicy\": {\"MaxDownFraction\": 1.5, \"TimeoutSeconds\": 300}\n}")
+	writeLintTestFile(t, dir+"/services/broken.json", "{\n\"Name\": \"broken\",\n}")
+	writeLintTestFile(t, dir+"/services/typo.json", "{\n\"Name\": \"typo\",\n\"EndpointPort\": \"80\"\n}")
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/haproxy.tpl", "global\n{{range Endpoints \"web\"}}\n{{Backends \"web\"}}\n{{end}}\n")
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/web.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/api.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/missing.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/backend/certs/test.pem", "cert")
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/backend/services/api.json", `{"EndpointPort": 3501}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/backend/services/web.json", `{}`)
+
+	problems := LintOrbitConfigurationTree(dir)
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("%s:%d: %s", problem.File[len(dir):], problem.Line, problem.Message))
+	}
+
+	assert.Equal(t, []string{
+		"/globalproperties.json:1: unknown field 'Foo'",
+		"/machineconfigurations/tags/backend/certs:0: there are certs but no haproxy.tpl",
+		"/machineconfigurations/tags/frontend/haproxy.tpl:3: template parse error: template: main:3: function \"Backends\" not defined",
+		"/machineconfigurations/tags/frontend/services/missing.json:0: tag references unknown service 'missing'",
+		"/machineconfigurations/tags/frontend/services/web.json:0: EndpointPort 3500 is already used by service 'api' in this tag",
+		"/services/broken.json:3: invalid json: invalid character '}' looking for beginning of object key string",
+		"/services/typo.json:3: invalid json: json: cannot unmarshal string into Go struct field ServiceConfiguration.EndpointPort of type int",
+		"/services/web.json:6: check 1 has unknown type 'htpt', must be one of dummy, http, tcp",
+		"/services/worker.json:3: RollbackPolicy.MaxDownFraction must be at least 0 and less than 1",
+	}, messages)
+}
+
+func TestLintOrbitConfigurationTreeTagIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-lint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLintTestFile(t, dir+"/services/web.json", `{"Name": "web"}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/base/services/web.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/includes.json", `["base", "missing"]`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/a/includes.json", `["b"]`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/b/includes.json", `["a"]`)
+
+	problems := LintOrbitConfigurationTree(dir)
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.File[len(dir):]+": "+problem.Message)
+	}
+
+	assert.Equal(t, []string{
+		"/machineconfigurations/tags/a/includes.json: Tag includes form a cycle: a -> b -> a",
+		"/machineconfigurations/tags/b/includes.json: Tag includes form a cycle: b -> a -> b",
+		"/machineconfigurations/tags/frontend/includes.json: tag includes unknown tag 'missing'",
+	}, messages)
+}
+
+func TestLintOrbitConfigurationTreeBlueGreen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-lint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLintTestFile(t, dir+"/services/api.json", `{"Name": "api", "EndpointPort": 3501}`)
+	writeLintTestFile(t, dir+"/services/web.json", `{"Name": "web", "EndpointPort": 3500, "BlueGreen": {"AlternatePort": 3501}}`)
+	writeLintTestFile(t, dir+"/services/worker.json", "{\n\"Name\": \"worker\",\n\"BlueGreen\": {\"Timeout\": 60}\n}")
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/api.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/web.json", `{}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/backend/services/web.json", `{"EndpointPort": 3501}`)
+
+	problems := LintOrbitConfigurationTree(dir)
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("%s:%d: %s", problem.File[len(dir):], problem.Line, problem.Message))
+	}
+
+	assert.Equal(t, []string{
+		"/machineconfigurations/tags/backend/services/web.json:0: BlueGreen.AlternatePort 3501 is the same as the EndpointPort",
+		"/machineconfigurations/tags/frontend/services/web.json:0: BlueGreen.AlternatePort 3501 is already used by service 'api' in this tag",
+		"/services/worker.json:3: BlueGreen.AlternatePort must be a valid port number",
+	}, messages)
+}
+
+func TestLintOrbitConfigurationTreeRegistries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-lint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLintTestFile(t, dir+"/globalproperties.json", `{
+	"AMQPUrl": "",
+	"Registries": {
+		"registry.example.com:5000": {"Username": "orbit", "Password": "secret:registry/orbit"},
+		"other.example.com": {"Username": "orbit", "Password": "hunter2"},
+		"third.example.com": {"Username": "orbit", "Password": "secret:../x"}
+	}
+}`)
+	writeLintTestFile(t, dir+"/services/web.json", `{"Name": "web"}`)
+	writeLintTestFile(t, dir+"/machineconfigurations/tags/frontend/services/web.json", `{}`)
+
+	problems := LintOrbitConfigurationTree(dir)
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("%s:%d: %s", problem.File[len(dir):], problem.Line, problem.Message))
+	}
+
+	assert.Equal(t, []string{
+		"/globalproperties.json:5: registry other.example.com has a plain text password, use a secret reference",
+		"/globalproperties.json:6: Invalid secret name '../x'",
+	}, messages)
+}
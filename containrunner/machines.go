@@ -0,0 +1,271 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every daemon publishes its MachineInfo under <EtcdBasePath>/machines/<address>/info and refreshes
+// the <address>/heartbeat key, which expires after MachineHeartbeatTTL. A machine whose info exists
+// but whose heartbeat has expired is shown as missing until it's removed with ForgetMachine.
+//
+// The info is written only when it changes and the timestamps which change on every heartbeat are
+// kept in the heartbeat key, so that the heartbeats don't wake up the configuration caches of the
+// other daemons with changes which they don't need.
+const (
+	MachineHeartbeatInterval = 30 * time.Second
+	MachineHeartbeatTTL      = 90 * time.Second
+)
+
+type MachineInfo struct {
+	Address          string
+	Tags             []string
+	AvailabilityZone string
+	Services         []string
+
+	// Build date of orbitctl
+	Version        string
+	DockerVersion  string
+	HAProxyVersion string
+
+	StartedAt time.Time
+
+	// Stored in the heartbeat key, so it's not known after the heartbeat has expired
+	LastHeartbeat time.Time `json:"-"`
+
+	// Time and error (empty if it succeeded) of the last ConvergeContainers. The time is stored in the heartbeat key
+	LastConverge      time.Time `json:"-"`
+	LastConvergeError string
+
+	// The machine doesn't publish its endpoints. LeftAt is set when the daemon has shut down
+	Draining bool
+	LeftAt   time.Time `json:",omitempty"`
+}
+
+type MachineStatus struct {
+	MachineInfo
+
+	// False if the heartbeat has expired
+	Alive bool
+}
+
+// Value of the heartbeat key
+type machineHeartbeat struct {
+	Time         time.Time
+	LastConverge time.Time
+}
+
+func (m MachineInfo) Uptime() time.Duration {
+	if m.StartedAt.IsZero() || m.LastHeartbeat.IsZero() {
+		return 0
+	}
+	return m.LastHeartbeat.Sub(m.StartedAt)
+}
+
+func (m MachineInfo) HasTag(tag string) bool {
+	return stringInSlice(tag, m.Tags)
+}
+
+func (c *Containrunner) getMachineKey(address string) string {
+	return c.EtcdBasePath + "/machines/" + address
+}
+
+// Records the result of a ConvergeContainers run for the machine heartbeat
+func (s *Containrunner) setConvergeResult(err error) {
+	s.lastConvergeMu.Lock()
+	defer s.lastConvergeMu.Unlock()
+	s.lastConvergeAttempt = time.Now()
+	s.lastConvergeError = ""
+	if err != nil {
+		s.lastConvergeError = err.Error()
+	}
+}
+
+// Returns the current information of this machine
+func (s *Containrunner) GetMachineInfo() MachineInfo {
+	info := MachineInfo{
+		Address:          s.MachineAddress,
+		Tags:             s.Tags,
+		AvailabilityZone: s.AvailabilityZone,
+		Version:          s.Version,
+		HAProxyVersion:   s.haproxyVersion,
+		StartedAt:        s.startedAt,
+		LastHeartbeat:    time.Now(),
+		Draining:         s.IsDraining(),
+	}
+
+	for name := range s.getCurrentConfiguration().MachineConfiguration.Services {
+		info.Services = append(info.Services, name)
+	}
+	sort.Strings(info.Services)
+
+	s.lastConvergeMu.Lock()
+	info.LastConverge = s.lastConvergeAttempt
+	info.LastConvergeError = s.lastConvergeError
+	s.lastConvergeMu.Unlock()
+
+	client := s.Docker
+	if client == nil {
+		client = GetDockerClient()
+	}
+	version, err := client.Version()
+	if err == nil {
+		info.DockerVersion = version.Get("Version")
+	}
+
+	return info
+}
+
+// Returns the version from the first line of "haproxy -v", for example "1.5.8" from
+// "HA-Proxy version 1.5.8 2014/10/31". Returns an empty string if haproxy can't be run.
+func getHAProxyVersion(binary string) string {
+	if binary == "" {
+		return ""
+	}
+
+	out, err := exec.Command(binary, "-v").Output()
+	if err != nil {
+		return ""
+	}
+
+	return parseHAProxyVersion(string(out))
+}
+
+func parseHAProxyVersion(out string) string {
+	fields := strings.Fields(strings.SplitN(out, "\n", 2)[0])
+	for i, field := range fields {
+		if field == "version" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+func (s *Containrunner) PublishMachineHeartbeat(info MachineInfo, store ConfigStore) error {
+	if store == nil {
+		store = s.GetConfigStore()
+	}
+
+	bytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	key := s.getMachineKey(info.Address) + "/info"
+	res, err := store.Get(key)
+	if err != nil && !IsKeyNotFound(err) {
+		return err
+	}
+	if err != nil || res.Value != string(bytes) {
+		err = store.Set(key, string(bytes), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	bytes, err = json.Marshal(machineHeartbeat{Time: info.LastHeartbeat, LastConverge: info.LastConverge})
+	if err != nil {
+		return err
+	}
+
+	return store.Set(s.getMachineKey(info.Address)+"/heartbeat", string(bytes), MachineHeartbeatTTL)
+}
+
+// Publishes the machine heartbeat every MachineHeartbeatInterval
+func (s *Containrunner) MachineHeartbeatLoop() {
+	for atomic.LoadInt32(&s.leaving) == 0 {
+		err := s.PublishMachineHeartbeat(s.GetMachineInfo(), nil)
+		if err != nil {
+			log.Warning(LogString("Could not publish machine heartbeat: " + err.Error()))
+		}
+		time.Sleep(MachineHeartbeatInterval)
+	}
+}
+
+// Returns the known machines sorted by their address
+func (c *Containrunner) GetMachines(store ConfigStore) ([]MachineStatus, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/machines")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var machines []MachineStatus
+	for _, node := range res.Nodes {
+		machine, ok := parseMachineNode(node)
+		if ok {
+			machines = append(machines, machine)
+		}
+	}
+
+	sort.Sort(machineStatusesByAddress(machines))
+	return machines, nil
+}
+
+// Returns nil if the machine is not known
+func (c *Containrunner) GetMachine(address string, store ConfigStore) (*MachineStatus, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.List(c.getMachineKey(address))
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	machine, ok := parseMachineNode(res)
+	if !ok {
+		return nil, nil
+	}
+	return &machine, nil
+}
+
+// Removes a machine which doesn't exist any more
+func (c *Containrunner) ForgetMachine(address string, store ConfigStore) error {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	return store.Delete(c.getMachineKey(address))
+}
+
+func parseMachineNode(node *ConfigNode) (MachineStatus, bool) {
+	var machine MachineStatus
+	found := false
+
+	for _, child := range node.Nodes {
+		switch child.Key {
+		case node.Key + "/info":
+			if json.Unmarshal([]byte(child.Value), &machine.MachineInfo) == nil {
+				found = true
+			}
+		case node.Key + "/heartbeat":
+			machine.Alive = true
+
+			var heartbeat machineHeartbeat
+			if json.Unmarshal([]byte(child.Value), &heartbeat) == nil {
+				machine.LastHeartbeat = heartbeat.Time
+				machine.LastConverge = heartbeat.LastConverge
+			}
+		}
+	}
+
+	return machine, found
+}
+
+type machineStatusesByAddress []MachineStatus
+
+func (a machineStatusesByAddress) Len() int           { return len(a) }
+func (a machineStatusesByAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a machineStatusesByAddress) Less(i, j int) bool { return a[i].Address < a[j].Address }
@@ -0,0 +1,96 @@
+package containrunner
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseHAProxyVersion(t *testing.T) {
+	assert.Equal(t, "1.5.8", parseHAProxyVersion("HA-Proxy version 1.5.8 2014/10/31\nCopyright 2000-2014 Willy Tarreau <w@1wt.eu>\n"))
+	assert.Equal(t, "", parseHAProxyVersion("command not found"))
+}
+
+func TestPublishMachineHeartbeat(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	store := NewMemoryConfigStore()
+
+	machines, err := ct.GetMachines(store)
+	assert.Nil(t, err)
+	assert.Empty(t, machines)
+
+	now := time.Now()
+	err = ct.PublishMachineHeartbeat(MachineInfo{
+		Address:       "10.0.0.2",
+		Tags:          []string{"frontend"},
+		StartedAt:     now.Add(-time.Hour),
+		LastHeartbeat: now,
+	}, store)
+	assert.Nil(t, err)
+
+	info := MachineInfo{
+		Address:           "10.0.0.1",
+		Tags:              []string{"backend"},
+		StartedAt:         now.Add(-time.Minute),
+		LastHeartbeat:     now,
+		LastConverge:      now,
+		LastConvergeError: "Could not pull",
+	}
+	err = ct.PublishMachineHeartbeat(info, store)
+	assert.Nil(t, err)
+
+	// Only the heartbeat key changes when the info stays the same
+	res, err := store.Get("/orbit/machines/10.0.0.1/info")
+	assert.Nil(t, err)
+	infoIndex := res.ModifiedIndex
+	info.LastHeartbeat = now.Add(time.Minute)
+	err = ct.PublishMachineHeartbeat(info, store)
+	assert.Nil(t, err)
+	res, err = store.Get("/orbit/machines/10.0.0.1/info")
+	assert.Nil(t, err)
+	assert.Equal(t, infoIndex, res.ModifiedIndex)
+
+	// The heartbeat of 10.0.0.2 has expired
+	err = store.Delete("/orbit/machines/10.0.0.2/heartbeat")
+	assert.Nil(t, err)
+
+	machines, err = ct.GetMachines(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(machines))
+	if len(machines) == 2 {
+		assert.Equal(t, "10.0.0.1", machines[0].Address)
+		assert.True(t, machines[0].Alive)
+		assert.Equal(t, "Could not pull", machines[0].LastConvergeError)
+		assert.Equal(t, now.Unix(), machines[0].LastConverge.Unix())
+		assert.Equal(t, 2*time.Minute, machines[0].Uptime())
+		assert.Equal(t, "10.0.0.2", machines[1].Address)
+		assert.False(t, machines[1].Alive)
+		assert.True(t, machines[1].HasTag("frontend"))
+		assert.True(t, machines[1].LastHeartbeat.IsZero())
+		assert.Equal(t, time.Duration(0), machines[1].Uptime())
+	}
+
+	machine, err := ct.GetMachine("10.0.0.2", store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"frontend"}, machine.Tags)
+
+	assert.Nil(t, ct.ForgetMachine("10.0.0.2", store))
+	machine, err = ct.GetMachine("10.0.0.2", store)
+	assert.Nil(t, err)
+	assert.Nil(t, machine)
+}
+
+func TestSetConvergeResult(t *testing.T) {
+	var ct Containrunner
+	ct.MachineAddress = "10.0.0.1"
+
+	ct.setConvergeResult(errors.New("Could not pull"))
+	info := ct.GetMachineInfo()
+	assert.Equal(t, "Could not pull", info.LastConvergeError)
+	assert.False(t, info.LastConverge.IsZero())
+
+	ct.setConvergeResult(nil)
+	assert.Equal(t, "", ct.GetMachineInfo().LastConvergeError)
+}
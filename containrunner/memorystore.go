@@ -0,0 +1,399 @@
+package containrunner
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of events which are kept for watchers which are behind
+const memoryConfigStoreHistory = 1000
+
+// ConfigStore which keeps everything in memory. Used by the tests and as the storage
+// of the ConfigurationCache.
+type MemoryConfigStore struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	nodes    map[string]*ConfigNode     // key -> node without its children
+	children map[string]map[string]bool // directory key -> set of child keys
+	expires  map[string]time.Time
+	index    uint64
+	history  []*ConfigEvent
+	cleared  uint64 // events up to this index have been dropped from the history
+}
+
+func NewMemoryConfigStore() *MemoryConfigStore {
+	s := new(MemoryConfigStore)
+	s.cond = sync.NewCond(&s.lock)
+	s.reset()
+
+	return s
+}
+
+func (s *MemoryConfigStore) reset() {
+	s.nodes = make(map[string]*ConfigNode)
+	s.children = make(map[string]map[string]bool)
+	s.expires = make(map[string]time.Time)
+	s.nodes["/"] = &ConfigNode{Key: "/", Dir: true}
+}
+
+// Returns the current index of the store
+func (s *MemoryConfigStore) Index() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.index
+}
+
+func (s *MemoryConfigStore) Get(key string) (*ConfigNode, error) {
+	return s.get(key, false)
+}
+
+func (s *MemoryConfigStore) List(key string) (*ConfigNode, error) {
+	return s.get(key, true)
+}
+
+func (s *MemoryConfigStore) get(key string, recursive bool) (*ConfigNode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire()
+
+	key = cleanKey(key)
+	if _, found := s.nodes[key]; !found {
+		return nil, &KeyNotFoundError{Key: key, Index: s.index}
+	}
+
+	node := s.node(key, recursive, 0)
+	node.Index = s.index
+	return node, nil
+}
+
+// Builds the node for key. Must be called while holding the lock.
+func (s *MemoryConfigStore) node(key string, recursive bool, depth int) *ConfigNode {
+	n := *s.nodes[key]
+	if !n.Dir || (!recursive && depth > 0) {
+		return &n
+	}
+
+	var keys []string
+	for child := range s.children[key] {
+		keys = append(keys, child)
+	}
+	sort.Strings(keys)
+
+	for _, child := range keys {
+		n.Nodes = append(n.Nodes, s.node(child, recursive, depth+1))
+	}
+
+	return &n
+}
+
+func (s *MemoryConfigStore) Set(key string, value string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(cleanKey(key), value, ttl)
+	return nil
+}
+
+// Must be called while holding the lock.
+func (s *MemoryConfigStore) set(key string, value string, ttl time.Duration) {
+	s.index++
+	s.apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Value: value, ModifiedIndex: s.index}})
+
+	delete(s.expires, key)
+	if ttl > 0 {
+		s.expires[key] = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.expire()
+		})
+	}
+}
+
+func (s *MemoryConfigStore) MkDir(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = cleanKey(key)
+	if node, found := s.nodes[key]; found && node.Dir {
+		return nil
+	}
+
+	s.index++
+	s.apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Dir: true, ModifiedIndex: s.index}})
+	return nil
+}
+
+func (s *MemoryConfigStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire()
+
+	key = cleanKey(key)
+	if _, found := s.nodes[key]; !found {
+		return &KeyNotFoundError{Key: key, Index: s.index}
+	}
+
+	s.index++
+	s.apply(&ConfigEvent{Action: "delete", Node: &ConfigNode{Key: key, ModifiedIndex: s.index}})
+	return nil
+}
+
+func (s *MemoryConfigStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire()
+
+	key = cleanKey(key)
+	node, found := s.nodes[key]
+	if (prevIndex == 0 && found) || (prevIndex != 0 && (!found || node.ModifiedIndex != prevIndex)) {
+		return &CompareFailedError{Key: key}
+	}
+
+	s.set(key, value, 0)
+	return nil
+}
+
+func (s *MemoryConfigStore) Commit(conditions map[string]uint64, operations []ConfigOperation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire()
+
+	for key, prevIndex := range conditions {
+		key = cleanKey(key)
+		node, found := s.nodes[key]
+		if (prevIndex == 0 && found) || (prevIndex != 0 && (!found || node.ModifiedIndex != prevIndex)) {
+			return &CompareFailedError{Key: key}
+		}
+	}
+
+	for _, operation := range operations {
+		key := cleanKey(operation.Key)
+		switch operation.Action {
+		case "set":
+			s.set(key, operation.Value, 0)
+		case "mkdir":
+			if node, found := s.nodes[key]; !found || !node.Dir {
+				s.index++
+				s.apply(&ConfigEvent{Action: "set", Node: &ConfigNode{Key: key, Dir: true, ModifiedIndex: s.index}})
+			}
+		case "delete":
+			if _, found := s.nodes[key]; found {
+				s.index++
+				s.apply(&ConfigEvent{Action: "delete", Node: &ConfigNode{Key: key, ModifiedIndex: s.index}})
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryConfigStore) MaxOperations() int {
+	return 0
+}
+
+// Removes the keys whose ttl has passed. Must be called while holding the lock.
+func (s *MemoryConfigStore) expire() {
+	now := time.Now()
+	for key, expires := range s.expires {
+		if expires.After(now) {
+			continue
+		}
+
+		delete(s.expires, key)
+		if _, found := s.nodes[key]; found {
+			s.index++
+			s.apply(&ConfigEvent{Action: "expire", Node: &ConfigNode{Key: key, ModifiedIndex: s.index}})
+		}
+	}
+}
+
+// Applies a change into the store and records it for the watchers. Returns true if
+// the contents changed; setting a key into its current value is not a change.
+//
+// The ConfigurationCache uses this to apply the events from the upstream store,
+// so the index of the event is used as it is.
+func (s *MemoryConfigStore) Apply(event *ConfigEvent) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.apply(event)
+}
+
+// Must be called while holding the lock.
+func (s *MemoryConfigStore) apply(event *ConfigEvent) bool {
+	if event.Node.ModifiedIndex > s.index {
+		s.index = event.Node.ModifiedIndex
+	}
+
+	key := event.Node.Key
+	changed := false
+
+	switch event.Action {
+	case "set":
+		old, found := s.nodes[key]
+		if !found || old.Dir != event.Node.Dir || old.Value != event.Node.Value {
+			changed = true
+		}
+		if found && old.Dir && !event.Node.Dir {
+			s.remove(key)
+		}
+		s.store(event.Node)
+	case "delete", "expire":
+		changed = s.remove(key)
+		if key == "/" {
+			s.reset()
+		}
+	}
+
+	s.history = append(s.history, event)
+	if len(s.history) > memoryConfigStoreHistory {
+		s.cleared = s.history[0].Node.ModifiedIndex
+		s.history = s.history[1:]
+	}
+	s.cond.Broadcast()
+
+	return changed
+}
+
+// Stores a single node (without its children) and makes sure that all its parent directories exists.
+// Must be called while holding the lock.
+func (s *MemoryConfigStore) store(node *ConfigNode) {
+	n := *node
+	n.Nodes = nil
+	n.Index = 0
+	if old, found := s.nodes[n.Key]; found && old.Dir && n.Dir {
+		// Setting an existing directory doesn't change it
+		return
+	}
+	s.nodes[n.Key] = &n
+
+	key := n.Key
+	for key != "/" {
+		parent := parentKey(key)
+		if _, found := s.children[parent]; !found {
+			s.children[parent] = make(map[string]bool)
+		}
+		s.children[parent][key] = true
+
+		if _, found := s.nodes[parent]; found {
+			break
+		}
+		s.nodes[parent] = &ConfigNode{Key: parent, Dir: true, ModifiedIndex: n.ModifiedIndex}
+		key = parent
+	}
+}
+
+// Removes a node and everything under it. Must be called while holding the lock.
+func (s *MemoryConfigStore) remove(key string) bool {
+	if _, found := s.nodes[key]; !found {
+		return false
+	}
+
+	for child := range s.children[key] {
+		s.remove(child)
+	}
+
+	delete(s.children, key)
+	delete(s.nodes, key)
+	delete(s.expires, key)
+	if parent := parentKey(key); s.children[parent] != nil {
+		delete(s.children[parent], key)
+	}
+
+	return true
+}
+
+// Zero afterIndex watches only the changes which happen after this call.
+func (s *MemoryConfigStore) Watch(key string, afterIndex uint64) ConfigWatcher {
+	if afterIndex == 0 {
+		afterIndex = s.Index()
+	}
+	return &memoryConfigWatcher{store: s, key: cleanKey(key), index: afterIndex}
+}
+
+type memoryConfigWatcher struct {
+	store   *MemoryConfigStore
+	key     string
+	index   uint64
+	stopped bool
+}
+
+func (w *memoryConfigWatcher) Next() (*ConfigEvent, error) {
+	s := w.store
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if w.stopped {
+			return nil, ErrWatcherStopped
+		}
+
+		if w.index < s.cleared {
+			return nil, ErrIndexCleared
+		}
+
+		for _, event := range s.history {
+			if event.Node.ModifiedIndex <= w.index {
+				continue
+			}
+			w.index = event.Node.ModifiedIndex
+
+			if event.Node.Key == w.key || strings.HasPrefix(event.Node.Key, w.key+"/") || w.key == "/" {
+				return event, nil
+			}
+		}
+
+		s.cond.Wait()
+	}
+}
+
+func (w *memoryConfigWatcher) Stop() {
+	w.store.lock.Lock()
+	defer w.store.lock.Unlock()
+
+	w.stopped = true
+	w.store.cond.Broadcast()
+}
+
+// Replaces the whole contents of the store with the tree under root.
+func (s *MemoryConfigStore) replace(root *ConfigNode, index uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.reset()
+
+	var add func(node *ConfigNode)
+	add = func(node *ConfigNode) {
+		if node.Key != "/" {
+			s.store(node)
+		}
+		for _, child := range node.Nodes {
+			add(child)
+		}
+	}
+	if root != nil {
+		add(root)
+	}
+
+	s.index = index
+	s.history = nil
+	s.cleared = index
+	s.cond.Broadcast()
+}
+
+// Moves the index forward without changing the contents.
+func (s *MemoryConfigStore) advanceIndex(index uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if index > s.index {
+		s.index = index
+	}
+}
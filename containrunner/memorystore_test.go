@@ -0,0 +1,140 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryConfigStoreSetGetList(t *testing.T) {
+	store := NewMemoryConfigStore()
+
+	err := store.Set("/test/services/ubuntu/config", "{}", 0)
+	assert.Nil(t, err)
+	err = store.Set("/test/services/ubuntu/endpoints/10.0.0.1:3500", "ok", 0)
+	assert.Nil(t, err)
+	err = store.MkDir("/test/machineconfigurations")
+	assert.Nil(t, err)
+	assert.Nil(t, store.MkDir("/test/machineconfigurations"))
+
+	node, err := store.Get("/test/services/ubuntu/config")
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", node.Value)
+	assert.Equal(t, uint64(1), node.ModifiedIndex)
+
+	node, err = store.Get("/test/services/ubuntu")
+	assert.Nil(t, err)
+	assert.Equal(t, true, node.Dir)
+	assert.Equal(t, 2, len(node.Nodes))
+	assert.Equal(t, "/test/services/ubuntu/config", node.Nodes[0].Key)
+	assert.Equal(t, "/test/services/ubuntu/endpoints", node.Nodes[1].Key)
+	assert.Equal(t, 0, len(node.Nodes[1].Nodes))
+
+	node, err = store.List("/test/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/test/services/ubuntu/config":                  "{}",
+		"/test/services/ubuntu/endpoints/10.0.0.1:3500": "ok",
+	}, FlattenConfigNode(node))
+
+	err = store.Delete("/test/services")
+	assert.Nil(t, err)
+
+	_, err = store.Get("/test/services/ubuntu/config")
+	assert.True(t, IsKeyNotFound(err))
+	assert.True(t, IsKeyNotFound(store.Delete("/test/services")))
+}
+
+func TestMemoryConfigStoreCompareAndSwap(t *testing.T) {
+	store := NewMemoryConfigStore()
+
+	err := store.CompareAndSwap("/test/active_generation", "1", 0)
+	assert.Nil(t, err)
+
+	err = store.CompareAndSwap("/test/active_generation", "1", 0)
+	assert.True(t, IsCompareFailed(err))
+
+	node, _ := store.Get("/test/active_generation")
+	err = store.CompareAndSwap("/test/active_generation", "2", node.ModifiedIndex+1)
+	assert.True(t, IsCompareFailed(err))
+
+	err = store.CompareAndSwap("/test/active_generation", "2", node.ModifiedIndex)
+	assert.Nil(t, err)
+
+	node, _ = store.Get("/test/active_generation")
+	assert.Equal(t, "2", node.Value)
+}
+
+func TestMemoryConfigStoreTTL(t *testing.T) {
+	store := NewMemoryConfigStore()
+
+	store.Set("/test/services/ubuntu/endpoints/10.0.0.1:3500", "ok", 50*time.Millisecond)
+	_, err := store.Get("/test/services/ubuntu/endpoints/10.0.0.1:3500")
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = store.Get("/test/services/ubuntu/endpoints/10.0.0.1:3500")
+	assert.True(t, IsKeyNotFound(err))
+}
+
+func TestMemoryConfigStoreWatch(t *testing.T) {
+	store := NewMemoryConfigStore()
+	store.Set("/test/services/ubuntu/config", "{}", 0)
+
+	watcher := store.Watch("/test/services", 0)
+
+	store.Set("/other/foo", "bar", 0)
+	store.Set("/test/services/ubuntu/revision", "asdf", 0)
+	store.Delete("/test/services/ubuntu/config")
+
+	event, err := watcher.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "set", event.Action)
+	assert.Equal(t, "/test/services/ubuntu/revision", event.Node.Key)
+	assert.Equal(t, "asdf", event.Node.Value)
+
+	event, err = watcher.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "delete", event.Action)
+	assert.Equal(t, "/test/services/ubuntu/config", event.Node.Key)
+
+	// Watching from an older index replays the earlier changes
+	event, err = store.Watch("/test", 1).Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "/test/services/ubuntu/revision", event.Node.Key)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		watcher.Stop()
+	}()
+	_, err = watcher.Next()
+	assert.Equal(t, ErrWatcherStopped, err)
+}
+
+func TestMemoryConfigStoreCommit(t *testing.T) {
+	store := NewMemoryConfigStore()
+	store.Set("/test/services/old/config", "{}", 0)
+
+	operations := []ConfigOperation{
+		{Action: "delete", Key: "/test/services/old"},
+		{Action: "set", Key: "/test/services/new/config", Value: "{}"},
+		{Action: "mkdir", Key: "/test/machineconfigurations/tags/empty"},
+	}
+
+	err := store.Commit(map[string]uint64{"/test/active_generation": 1}, operations)
+	assert.True(t, IsCompareFailed(err))
+	_, err = store.Get("/test/services/old/config")
+	assert.Nil(t, err)
+
+	err = store.Commit(map[string]uint64{"/test/active_generation": 0}, operations)
+	assert.Nil(t, err)
+
+	_, err = store.Get("/test/services/old")
+	assert.True(t, IsKeyNotFound(err))
+	_, err = store.Get("/test/services/new/config")
+	assert.Nil(t, err)
+	node, err := store.Get("/test/machineconfigurations/tags/empty")
+	assert.Nil(t, err)
+	assert.Equal(t, true, node.Dir)
+}
@@ -0,0 +1,332 @@
+package containrunner
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	MergeServiceConfig merges the overwrites of a tag binding into the default configuration
+	of a service field by field. Fields are named with their dotted Go path, for example
+	"Container.HostConfig.Binds" (case insensitive, so "Container.Config.Dns" works too).
+
+	Strategies:
+
+	- Scalars (strings, numbers, booleans) replace the default if they are set (non zero) in the overwrites.
+	- Structs and pointers to structs (Container, SourceControl, RestartPolicy...) are merged field by field.
+	- Maps (Attributes, Labels, PortBindings, Volumes, ExposedPorts, LogConfig.Config) are deep merged:
+	  the keys of the overwrites replace the same keys of the default and other keys are kept.
+	- Keyed lists replace the items which have the same key and append the others:
+	  Container.Config.Env (key is the variable name), Container.HostConfig.Binds (container path),
+	  Container.HostConfig.ExtraHosts (host name), Container.HostConfig.Ulimits (Name) and
+	  Container.HostConfig.LxcConf (Key). Env is sorted after the merge.
+	- Set lists append the items which the default doesn't have: Container.Config.PortSpecs,
+	  Container.Config.DNS, Container.HostConfig.CapAdd, CapDrop, Links, Dns, DnsSearch and VolumesFrom.
+	- All other lists (Checks, Container.Config.Cmd, Container.Config.Entrypoint...) replace the default.
+
+	The overwrites can change the strategies with the "Merge" directives:
+
+	"Merge": {
+		"Replace": ["Container.Config.Env"],
+		"Remove": ["Container.Config.Hostname", "Container.HostConfig.Binds=/data", "Attributes=foo"]
+	}
+
+	Replace makes the field of the overwrites replace the default as a whole, even if it's empty.
+	Remove removes inherited values before the merge: a field name resets the field and "field=key"
+	removes a single map key or list item. The key of a list item is the same as above and the
+	item itself for other lists.
+*/
+
+// Merge directives of a tag binding. See MergeServiceConfig.
+type MergeDirectives struct {
+	Replace []string
+	Remove  []string
+}
+
+// Returns the key of a keyed list item
+type listKeyFunc func(item reflect.Value) string
+
+var keyedListFields = map[string]listKeyFunc{
+	"container.config.env": func(item reflect.Value) string {
+		return strings.SplitN(item.String(), "=", 2)[0]
+	},
+	"container.hostconfig.binds": func(item reflect.Value) string {
+		parts := strings.Split(item.String(), ":")
+		if len(parts) > 1 {
+			return parts[1]
+		}
+		return parts[0]
+	},
+	"container.hostconfig.extrahosts": func(item reflect.Value) string {
+		return strings.SplitN(item.String(), ":", 2)[0]
+	},
+	"container.hostconfig.ulimits": func(item reflect.Value) string {
+		return item.FieldByName("Name").String()
+	},
+	"container.hostconfig.lxcconf": func(item reflect.Value) string {
+		return item.FieldByName("Key").String()
+	},
+}
+
+var setListFields = map[string]bool{
+	"container.config.portspecs":       true,
+	"container.config.dns":             true,
+	"container.hostconfig.capadd":      true,
+	"container.hostconfig.capdrop":     true,
+	"container.hostconfig.links":       true,
+	"container.hostconfig.dns":         true,
+	"container.hostconfig.dnssearch":   true,
+	"container.hostconfig.volumesfrom": true,
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func MergeServiceConfig(dst ServiceConfiguration, overwrite ServiceConfiguration) ServiceConfiguration {
+
+	dst = CopyServiceConfiguration(dst)
+	overwrite = CopyServiceConfiguration(overwrite)
+
+	directives := overwrite.Merge
+	if directives == nil {
+		directives = new(MergeDirectives)
+	}
+	overwrite.Merge = nil
+	dst.Merge = nil
+
+	for _, remove := range directives.Remove {
+		removeServiceConfigValue(reflect.ValueOf(&dst).Elem(), remove)
+	}
+
+	replace := make(map[string]bool)
+	for _, field := range directives.Replace {
+		replace[strings.ToLower(field)] = true
+	}
+
+	mergeValue("", reflect.ValueOf(&dst).Elem(), reflect.ValueOf(overwrite), replace)
+
+	if dst.Container != nil && overwrite.Container != nil && len(overwrite.Container.Config.Env) > 0 {
+		sort.Strings(dst.Container.Config.Env)
+	}
+
+	return dst
+}
+
+func mergeValue(path string, dst reflect.Value, src reflect.Value, replace map[string]bool) {
+	if replace[path] {
+		dst.Set(src)
+		return
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			if dst.IsNil() || !replacesUnder(path, replace) {
+				return
+			}
+			// Fields under this path are replaced even if the overwrites don't have it at all
+			src = reflect.New(src.Type().Elem())
+		}
+		if dst.IsNil() {
+			dst.Set(src)
+			return
+		}
+		mergeValue(path, dst.Elem(), src.Elem(), replace)
+
+	case reflect.Struct:
+		if dst.Type() == timeType {
+			if !src.Interface().(time.Time).IsZero() {
+				dst.Set(src)
+			}
+			return
+		}
+
+		for i := 0; i < dst.NumField(); i++ {
+			field := dst.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			mergeValue(joinFieldPath(path, field.Name), dst.Field(i), src.Field(i), replace)
+		}
+
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		for _, key := range src.MapKeys() {
+			dst.SetMapIndex(key, src.MapIndex(key))
+		}
+
+	case reflect.Slice:
+		if src.Len() == 0 {
+			return
+		}
+
+		if keyFunc, found := keyedListFields[path]; found {
+			result := reflect.AppendSlice(reflect.MakeSlice(dst.Type(), 0, dst.Len()+src.Len()), dst)
+			for i := 0; i < src.Len(); i++ {
+				item := src.Index(i)
+				replaced := false
+				for j := 0; j < result.Len(); j++ {
+					if keyFunc(result.Index(j)) == keyFunc(item) {
+						result.Index(j).Set(item)
+						replaced = true
+						break
+					}
+				}
+				if !replaced {
+					result = reflect.Append(result, item)
+				}
+			}
+			dst.Set(result)
+		} else if setListFields[path] {
+			result := reflect.AppendSlice(reflect.MakeSlice(dst.Type(), 0, dst.Len()+src.Len()), dst)
+			for i := 0; i < src.Len(); i++ {
+				if !sliceContains(result, src.Index(i)) {
+					result = reflect.Append(result, src.Index(i))
+				}
+			}
+			dst.Set(result)
+		} else {
+			dst.Set(src)
+		}
+
+	default:
+		if !isZeroValue(src) {
+			dst.Set(src)
+		}
+	}
+}
+
+// Applies a single Remove directive into the configuration. Fields which don't exist
+// in the configuration (for example a nil Container) are silently skipped.
+func removeServiceConfigValue(v reflect.Value, directive string) {
+	parts := strings.SplitN(directive, "=", 2)
+
+	path := ""
+	for _, name := range strings.Split(parts[0], ".") {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return
+		}
+		v = fieldByNameFold(v, name)
+		if !v.IsValid() {
+			return
+		}
+		path = joinFieldPath(path, name)
+	}
+
+	if len(parts) == 1 {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+
+	key := parts[1]
+	switch v.Kind() {
+	case reflect.Map:
+		if !v.IsNil() {
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), reflect.Value{})
+		}
+	case reflect.Slice:
+		keyFunc, found := keyedListFields[path]
+		if !found {
+			keyFunc = func(item reflect.Value) string { return fmt.Sprint(item.Interface()) }
+		}
+
+		result := reflect.MakeSlice(v.Type(), 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if keyFunc(v.Index(i)) != key {
+				result = reflect.Append(result, v.Index(i))
+			}
+		}
+		v.Set(result)
+	}
+}
+
+// Returns an error if a directive refers to a field which ServiceConfiguration doesn't have
+// or tries to remove a key from a field which is not a map or a list.
+func ValidateMergeDirectives(directives *MergeDirectives) error {
+	if directives == nil {
+		return nil
+	}
+
+	for _, field := range directives.Replace {
+		if _, err := serviceConfigFieldType(field); err != nil {
+			return err
+		}
+	}
+
+	for _, remove := range directives.Remove {
+		parts := strings.SplitN(remove, "=", 2)
+		t, err := serviceConfigFieldType(parts[0])
+		if err != nil {
+			return err
+		}
+		if len(parts) == 2 && t.Kind() != reflect.Map && t.Kind() != reflect.Slice {
+			return fmt.Errorf("Can't remove '%s' from %s which is not a map or a list", parts[1], parts[0])
+		}
+	}
+
+	return nil
+}
+
+func serviceConfigFieldType(path string) (reflect.Type, error) {
+	t := reflect.TypeOf(ServiceConfiguration{})
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("Unknown field '%s' in merge directives", path)
+		}
+		field, found := t.FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+		if !found {
+			return nil, fmt.Errorf("Unknown field '%s' in merge directives", path)
+		}
+		t = field.Type
+	}
+	return t, nil
+}
+
+func fieldByNameFold(v reflect.Value, name string) reflect.Value {
+	return v.FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+}
+
+func replacesUnder(path string, replace map[string]bool) bool {
+	for field := range replace {
+		if strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func joinFieldPath(path string, name string) string {
+	if path == "" {
+		return strings.ToLower(name)
+	}
+	return path + "." + strings.ToLower(name)
+}
+
+func sliceContains(slice reflect.Value, item reflect.Value) bool {
+	for i := 0; i < slice.Len(); i++ {
+		if reflect.DeepEqual(slice.Index(i).Interface(), item.Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZeroValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
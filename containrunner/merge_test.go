@@ -0,0 +1,181 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func parseTestServiceConfiguration(t *testing.T, str string) ServiceConfiguration {
+	var service ServiceConfiguration
+	err := json.Unmarshal([]byte(str), &service)
+	assert.Nil(t, err)
+	return service
+}
+
+func TestMergeServiceConfigContainerConfiguration(t *testing.T) {
+	defaults := parseTestServiceConfiguration(t, `{
+	"Name": "web",
+	"EndpointPort": 80,
+	"SourceControl": {"Origin": "github.com/garo/web"},
+	"Container": {
+		"HostConfig": {
+			"Binds": ["/var/log/web:/logs", "/tmp:/data:ro"],
+			"PortBindings": {"80/tcp": [{"HostPort": "80"}]},
+			"Memory": 1000,
+			"NetworkMode": "bridge",
+			"CapAdd": ["NET_ADMIN"],
+			"ExtraHosts": ["db:10.0.0.1"],
+			"Ulimits": [{"Name": "nofile", "Soft": 1024, "Hard": 1024}],
+			"RestartPolicy": {"Name": "always"},
+			"LogConfig": {"Type": "syslog", "Config": {"tag": "web"}}
+		},
+		"Config": {
+			"Image": "registry:5000/web",
+			"Hostname": "web",
+			"Env": ["NODE_ENV=production", "FOO=bar"],
+			"Cmd": ["node", "server.js"],
+			"Entrypoint": ["/bin/sh", "-c"],
+			"Labels": {"team": "web", "tier": "frontend"}
+		}
+	}
+}`)
+
+	overwrite := parseTestServiceConfiguration(t, `{
+	"SourceControl": {"CIUrl": "http://ci/web"},
+	"Container": {
+		"HostConfig": {
+			"Binds": ["/mnt/data:/data"],
+			"PortBindings": {"443/tcp": [{"HostPort": "443"}]},
+			"Memory": 2000,
+			"NetworkMode": "host",
+			"CapAdd": ["NET_ADMIN", "SYS_TIME"],
+			"ExtraHosts": ["db:10.0.0.2", "cache:10.0.0.3"],
+			"Ulimits": [{"Name": "nofile", "Soft": 4096, "Hard": 4096}],
+			"LogConfig": {"Config": {"facility": "local0"}}
+		},
+		"Config": {
+			"Env": ["NODE_ENV=staging"],
+			"Cmd": ["node", "server.js", "--debug"],
+			"Labels": {"tier": "canary"}
+		}
+	}
+}`)
+
+	merged := MergeServiceConfig(defaults, overwrite)
+
+	assert.Equal(t, "web", merged.Name)
+	assert.Equal(t, 80, merged.EndpointPort)
+	assert.Equal(t, &SourceControl{Origin: "github.com/garo/web", CIUrl: "http://ci/web"}, merged.SourceControl)
+
+	hostConfig := merged.Container.HostConfig
+	assert.Equal(t, []string{"/var/log/web:/logs", "/mnt/data:/data"}, hostConfig.Binds)
+	assert.Equal(t, map[docker.Port][]docker.PortBinding{
+		"80/tcp":  {{HostPort: "80"}},
+		"443/tcp": {{HostPort: "443"}},
+	}, hostConfig.PortBindings)
+	assert.Equal(t, int64(2000), hostConfig.Memory)
+	assert.Equal(t, "host", hostConfig.NetworkMode)
+	assert.Equal(t, []string{"NET_ADMIN", "SYS_TIME"}, hostConfig.CapAdd)
+	assert.Equal(t, []string{"db:10.0.0.2", "cache:10.0.0.3"}, hostConfig.ExtraHosts)
+	assert.Equal(t, []docker.ULimit{{Name: "nofile", Soft: 4096, Hard: 4096}}, hostConfig.Ulimits)
+	assert.Equal(t, "always", hostConfig.RestartPolicy.Name)
+	assert.Equal(t, docker.LogConfig{Type: "syslog", Config: map[string]string{"tag": "web", "facility": "local0"}}, hostConfig.LogConfig)
+
+	config := merged.Container.Config
+	assert.Equal(t, "registry:5000/web", config.Image)
+	assert.Equal(t, "web", config.Hostname)
+	assert.Equal(t, []string{"FOO=bar", "NODE_ENV=staging"}, config.Env)
+	assert.Equal(t, []string{"node", "server.js", "--debug"}, config.Cmd)
+	assert.Equal(t, []string{"/bin/sh", "-c"}, config.Entrypoint)
+	assert.Equal(t, map[string]string{"team": "web", "tier": "canary"}, config.Labels)
+
+	// The defaults must not be modified
+	assert.Equal(t, []string{"/var/log/web:/logs", "/tmp:/data:ro"}, defaults.Container.HostConfig.Binds)
+	assert.Equal(t, "frontend", defaults.Container.Config.Labels["tier"])
+}
+
+func TestMergeServiceConfigWithoutDefaultContainer(t *testing.T) {
+	defaults := parseTestServiceConfiguration(t, `{"Name": "web", "EndpointPort": 80}`)
+	overwrite := parseTestServiceConfiguration(t, `{"Container": {"Config": {"Image": "web:1.0", "Env": ["B=2", "A=1"]}}}`)
+
+	merged := MergeServiceConfig(defaults, overwrite)
+	assert.Equal(t, "web:1.0", merged.Container.Config.Image)
+	assert.Equal(t, []string{"A=1", "B=2"}, merged.Container.Config.Env)
+	assert.Nil(t, defaults.Container)
+
+	merged = MergeServiceConfig(overwrite, defaults)
+	assert.Equal(t, "web:1.0", merged.Container.Config.Image)
+	assert.Equal(t, 80, merged.EndpointPort)
+}
+
+func TestMergeServiceConfigDirectives(t *testing.T) {
+	defaults := parseTestServiceConfiguration(t, `{
+	"Name": "web",
+	"Attributes": {"foo": "1", "bar": "2"},
+	"Container": {
+		"HostConfig": {
+			"Binds": ["/var/log/web:/logs", "/tmp:/data:ro"],
+			"PortBindings": {"80/tcp": [{"HostPort": "80"}]},
+			"CapAdd": ["NET_ADMIN", "SYS_TIME"],
+			"Privileged": true
+		},
+		"Config": {
+			"Image": "web:1.0",
+			"Hostname": "web",
+			"Env": ["NODE_ENV=production", "DEBUG=1", "FOO=bar"]
+		}
+	}
+}`)
+
+	overwrite := parseTestServiceConfiguration(t, `{
+	"Container": {
+		"Config": {
+			"Env": ["ONLY=this"]
+		}
+	},
+	"Merge": {
+		"Replace": ["Container.Config.Env"],
+		"Remove": [
+			"Container.Config.Hostname",
+			"container.hostconfig.privileged",
+			"Container.HostConfig.Binds=/data",
+			"Container.HostConfig.PortBindings=80/tcp",
+			"Container.HostConfig.CapAdd=SYS_TIME",
+			"Attributes=foo",
+			"Container.Config.Missing=foo"
+		]
+	}
+}`)
+
+	assert.NotNil(t, ValidateMergeDirectives(overwrite.Merge))
+	overwrite.Merge.Remove = overwrite.Merge.Remove[0 : len(overwrite.Merge.Remove)-1]
+	assert.Nil(t, ValidateMergeDirectives(overwrite.Merge))
+
+	merged := MergeServiceConfig(defaults, overwrite)
+	assert.Nil(t, merged.Merge)
+	assert.Equal(t, "", merged.Container.Config.Hostname)
+	assert.Equal(t, "web:1.0", merged.Container.Config.Image)
+	assert.Equal(t, []string{"ONLY=this"}, merged.Container.Config.Env)
+	assert.Equal(t, false, merged.Container.HostConfig.Privileged)
+	assert.Equal(t, []string{"/var/log/web:/logs"}, merged.Container.HostConfig.Binds)
+	assert.Equal(t, 0, len(merged.Container.HostConfig.PortBindings))
+	assert.Equal(t, []string{"NET_ADMIN"}, merged.Container.HostConfig.CapAdd)
+	assert.Equal(t, map[string]string{"bar": "2"}, merged.Attributes)
+
+	// Replace with an empty value clears the inherited value
+	overwrite = parseTestServiceConfiguration(t, `{"Merge": {"Replace": ["Attributes", "Container.HostConfig.Binds"]}}`)
+	merged = MergeServiceConfig(defaults, overwrite)
+	assert.Nil(t, merged.Attributes)
+	assert.Nil(t, merged.Container.HostConfig.Binds)
+	assert.Equal(t, []string{"NET_ADMIN", "SYS_TIME"}, merged.Container.HostConfig.CapAdd)
+}
+
+func TestValidateMergeDirectives(t *testing.T) {
+	assert.Nil(t, ValidateMergeDirectives(nil))
+	assert.Nil(t, ValidateMergeDirectives(&MergeDirectives{Replace: []string{"Checks", "Container.Config.Dns"}}))
+	assert.NotNil(t, ValidateMergeDirectives(&MergeDirectives{Replace: []string{"Container.Foo"}}))
+	assert.NotNil(t, ValidateMergeDirectives(&MergeDirectives{Remove: []string{"EndpointPort=80"}}))
+	assert.NotNil(t, ValidateMergeDirectives(&MergeDirectives{Remove: []string{"Name.Foo"}}))
+}
@@ -0,0 +1,59 @@
+package containrunner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Copies everything under the base path from one ConfigStore into another, for example
+// from etcd v2 into etcd v3. Returns the number of copied keys.
+//
+// Service endpoints are not copied because they are published with a ttl by the daemons,
+// which will publish them again into the new store. The copy is refused if the target
+// already contains data under the base path unless overwrite is set.
+func (c *Containrunner) MigrateConfigStore(from ConfigStore, to ConfigStore, overwrite bool) (int, error) {
+	if !overwrite {
+		_, err := to.Get(c.EtcdBasePath)
+		if err == nil {
+			return 0, fmt.Errorf("Target already contains %s", c.EtcdBasePath)
+		}
+		if !IsKeyNotFound(err) {
+			return 0, err
+		}
+	}
+
+	res, err := from.List(c.EtcdBasePath)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+
+	var migrate func(node *ConfigNode) error
+	migrate = func(node *ConfigNode) error {
+		rest := strings.TrimPrefix(node.Key, c.EtcdBasePath+"/services/")
+		if parts := strings.Split(rest, "/"); rest != node.Key && len(parts) == 2 && parts[1] == "endpoints" {
+			return nil
+		}
+
+		if !node.Dir {
+			copied++
+			return to.Set(node.Key, node.Value, 0)
+		}
+
+		if len(node.Nodes) == 0 {
+			return to.MkDir(node.Key)
+		}
+
+		for _, child := range node.Nodes {
+			err := migrate(child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = migrate(res)
+	return copied, err
+}
@@ -0,0 +1,40 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMigrateConfigStore(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	from := NewMemoryConfigStore()
+	from.Set("/test/services/ubuntu/config", "{}", 0)
+	from.Set("/test/services/ubuntu/revision", `{"Revision":"asdf"}`, 0)
+	from.Set("/test/services/ubuntu/endpoints/10.0.0.1:3500", "{}", 0)
+	from.MkDir("/test/machineconfigurations/tags/empty")
+	from.Set("/other/foo", "bar", 0)
+
+	to := NewMemoryConfigStore()
+	copied, err := ct.MigrateConfigStore(from, to, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, copied)
+
+	node, err := to.List("/")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/test/services/ubuntu/config":   "{}",
+		"/test/services/ubuntu/revision": `{"Revision":"asdf"}`,
+	}, FlattenConfigNode(node))
+
+	node, err = to.Get("/test/machineconfigurations/tags/empty")
+	assert.Nil(t, err)
+	assert.Equal(t, true, node.Dir)
+
+	_, err = ct.MigrateConfigStore(from, to, false)
+	assert.NotNil(t, err)
+
+	_, err = ct.MigrateConfigStore(from, to, true)
+	assert.Nil(t, err)
+}
@@ -22,6 +22,7 @@ func TestPublishAndConsume(t *testing.T) {
 		"revision id",
 		"machine address",
 		10,
+		"",
 	})
 
 	fmt.Printf("Publishing to mq\n")
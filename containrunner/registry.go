@@ -0,0 +1,351 @@
+package containrunner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Credentials of private docker registries are configured by the registry host either in the
+	global properties, with the password as a secret reference (see secrets.go):
+
+	"Registries": {"registry.example.com:5000": {"Username": "orbit", "Password": "secret:registry/orbit"}}
+
+	or in the docker config.json of the machine as written by docker login (see DockerConfigFile).
+	The global properties take precedence. The credentials are used when the daemon pulls an image
+	and when orbitctl checks that an image exists in the registry, including the bearer token
+	handshake of the v2 registry API.
+*/
+
+type RegistryCredentials struct {
+	Username string
+	Password string
+
+	// PEM file of the CA which signed the registry certificate. The system roots are used if empty
+	CAFile string `json:",omitempty"`
+
+	// Don't verify the registry certificate
+	InsecureSkipVerify bool `json:",omitempty"`
+}
+
+// The password is not shown when the credentials are printed
+func (r RegistryCredentials) String() string {
+	password := r.Password
+	if password != "" && !IsSecretReference(password) {
+		password = RedactedValue
+	}
+	return fmt.Sprintf("{Username:%s Password:%s CAFile:%s InsecureSkipVerify:%t}", r.Username, password, r.CAFile, r.InsecureSkipVerify)
+}
+
+// Returns the HTTP client for the registry API
+func (r RegistryCredentials) httpClient() (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: r.InsecureSkipVerify}
+
+	if r.CAFile != "" {
+		data, err := ioutil.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in the registry CA file %s", r.CAFile)
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     config,
+		},
+		Timeout: 30 * time.Second,
+	}, nil
+}
+
+// Returns the docker config.json of the user: $DOCKER_CONFIG/config.json or ~/.docker/config.json
+func DefaultDockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// Reads the registry credentials from a docker config.json. A missing file has no credentials.
+// Credential helpers (credsStore) are not supported.
+func LoadDockerConfigCredentials(filename string) (map[string]RegistryCredentials, error) {
+	registries := make(map[string]RegistryCredentials)
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return registries, nil
+	} else if err != nil {
+		return registries, err
+	}
+
+	var config dockerConfigFile
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return registries, fmt.Errorf("Invalid docker config file %s: %v", filename, err)
+	}
+
+	for server, auth := range config.Auths {
+		credentials := RegistryCredentials{Username: auth.Username, Password: auth.Password}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if err != nil || len(parts) != 2 {
+				return registries, fmt.Errorf("Invalid auth of registry %s in docker config file %s", server, filename)
+			}
+			credentials.Username, credentials.Password = parts[0], parts[1]
+		}
+		registries[registryServerHost(server)] = credentials
+	}
+
+	return registries, nil
+}
+
+// Returns the host of a docker config.json server entry, which can also be an URL such as "https://registry:5000/v1/"
+func registryServerHost(server string) string {
+	if i := strings.Index(server, "://"); i != -1 {
+		server = server[i+3:]
+	}
+	if i := strings.Index(server, "/"); i != -1 {
+		server = server[:i]
+	}
+	return server
+}
+
+// Returns the credentials of the registries: the Registries of the global properties with their
+// secret references resolved, and the docker config.json of the machine for the other registries.
+// For the registries whose secrets can't be resolved the config.json is used instead, and the
+// first such error is returned together with the credentials.
+func (c *Containrunner) GetRegistryCredentials(store ConfigStore) (map[string]RegistryCredentials, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	filename := c.DockerConfigFile
+	if filename == "" {
+		filename = DefaultDockerConfigFile()
+	}
+
+	var firstErr error
+	registries, err := LoadDockerConfigCredentials(filename)
+	if err != nil {
+		firstErr = err
+	}
+
+	gop, err := c.GetGlobalOrbitProperties(store)
+	if err != nil {
+		return registries, err
+	}
+
+	var hosts []string
+	for host := range gop.Registries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	resolve := c.GetSecretResolver(store)
+	for _, host := range hosts {
+		credentials := gop.Registries[host]
+		err = resolveRegistryCredentials(&credentials, resolve)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Could not resolve the credentials of registry %s, using the docker config.json for it: %v", host, err)
+			}
+			continue
+		}
+		registries[host] = credentials
+	}
+
+	return registries, firstErr
+}
+
+func resolveRegistryCredentials(credentials *RegistryCredentials, resolve SecretResolver) error {
+	for _, value := range []*string{&credentials.Username, &credentials.Password} {
+		if !IsSecretReference(*value) {
+			continue
+		}
+		plaintext, err := resolve((*value)[len(SecretPrefix):])
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// Splits an image name such as "registry.example.com:5000/team/web:abc123" into the registry
+// host, the repository and the tag. The host is empty for images of the default registry and
+// the tag defaults to "latest".
+func ParseImageName(image string) (host string, repository string, tag string) {
+	repository = image
+	if i := strings.Index(image, "/"); i != -1 {
+		first := image[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host = first
+			repository = image[i+1:]
+		}
+	}
+
+	tag = "latest"
+	if i := strings.LastIndex(repository, ":"); i != -1 {
+		tag = repository[i+1:]
+		repository = repository[:i]
+	}
+
+	return host, repository, tag
+}
+
+// Returns the credentials for pulling the image, or empty credentials if the registry has none
+func RegistryAuthConfiguration(registries map[string]RegistryCredentials, image string) docker.AuthConfiguration {
+	host, _, _ := ParseImageName(image)
+	if host == "" {
+		return docker.AuthConfiguration{}
+	}
+
+	credentials := registries[host]
+	return docker.AuthConfiguration{Username: credentials.Username, Password: credentials.Password}
+}
+
+var registryChallengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Does a GET request to the v2 registry API. If the registry answers with an authentication
+// challenge the request is repeated with the credentials: directly with basic authentication,
+// or with a bearer token which is first fetched from the token service of the registry.
+func registryV2Get(client *http.Client, url string, credentials RegistryCredentials) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+		req.Header.Add("Accept", "application/vnd.oci.image.manifest.v1+json")
+		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v1+prettyjws")
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		if credentials.Username == "" {
+			return nil, fmt.Errorf("Registry requires authentication but there are no credentials for it")
+		}
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	case "bearer":
+		token, err := fetchRegistryToken(client, challenge, credentials)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, fmt.Errorf("Unsupported registry authentication challenge '%s'", challenge)
+	}
+
+	return client.Do(req)
+}
+
+type registryTokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// Fetches a bearer token from the token service given in the challenge, such as
+// Bearer realm="https://auth.example.com/token",service="registry",scope="repository:web:pull".
+// The credentials are sent with basic authentication, without them an anonymous token is requested.
+func fetchRegistryToken(client *http.Client, challenge string, credentials RegistryCredentials) (string, error) {
+	params := make(map[string]string)
+	for _, m := range registryChallengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+
+	if params["realm"] == "" {
+		return "", fmt.Errorf("Registry authentication challenge '%s' has no realm", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credentials.Username != "" {
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Registry token service %s returned %s", realm.Host, resp.Status)
+	}
+
+	var data registryTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return "", err
+	}
+
+	if data.Token != "" {
+		return data.Token, nil
+	}
+	if data.AccessToken != "" {
+		return data.AccessToken, nil
+	}
+	return "", errors.New("Registry token service returned no token")
+}
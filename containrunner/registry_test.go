@@ -0,0 +1,215 @@
+package containrunner
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseImageName(t *testing.T) {
+	tests := []struct{ image, host, repository, tag string }{
+		{"registry.example.com:5000/web:abc123", "registry.example.com:5000", "web", "abc123"},
+		{"registry.example.com/team/web:abc123", "registry.example.com", "team/web", "abc123"},
+		{"localhost/web", "localhost", "web", "latest"},
+		{"127.0.0.1:5000/web:1.0", "127.0.0.1:5000", "web", "1.0"},
+		{"ubuntu:14.04", "", "ubuntu", "14.04"},
+		{"library/ubuntu", "", "library/ubuntu", "latest"},
+	}
+
+	for _, test := range tests {
+		host, repository, tag := ParseImageName(test.image)
+		assert.Equal(t, test.host, host, test.image)
+		assert.Equal(t, test.repository, repository, test.image)
+		assert.Equal(t, test.tag, tag, test.image)
+	}
+}
+
+func writeRegistryTestFile(t *testing.T, dir string, name string, contents string) string {
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, []byte(contents), 0600)
+	assert.Nil(t, err)
+	return filename
+}
+
+func TestLoadDockerConfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registries, err := LoadDockerConfigCredentials(filepath.Join(dir, "missing.json"))
+	assert.Nil(t, err)
+	assert.Empty(t, registries)
+
+	filename := writeRegistryTestFile(t, dir, "config.json", `{"auths": {
+		"https://registry.example.com:5000/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("orbit:pass:word"))+`"},
+		"other.example.com": {"username": "deploy", "password": "hunter2"}
+	}}`)
+	registries, err = LoadDockerConfigCredentials(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, RegistryCredentials{Username: "orbit", Password: "pass:word"}, registries["registry.example.com:5000"])
+	assert.Equal(t, RegistryCredentials{Username: "deploy", Password: "hunter2"}, registries["other.example.com"])
+
+	filename = writeRegistryTestFile(t, dir, "broken.json", `{"auths": {"registry": {"auth": "not base64"}}}`)
+	_, err = LoadDockerConfigCredentials(filename)
+	assert.NotNil(t, err)
+}
+
+func TestGetRegistryCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	ct.SecretKeyFile = writeRegistryTestFile(t, dir, "secret.key", base64.StdEncoding.EncodeToString(secretTestKey()))
+	ct.DockerConfigFile = writeRegistryTestFile(t, dir, "config.json", `{"auths": {
+		"registry.example.com:5000": {"username": "local", "password": "local"},
+		"other.example.com": {"username": "deploy", "password": "hunter2"},
+		"third.example.com": {"username": "third", "password": "third"}
+	}}`)
+	store := NewMemoryConfigStore()
+
+	_, err = ct.ImportSecrets(&OrbitConfiguration{}, map[string]string{"registry/orbit": "s3cret"}, secretTestKey(), store)
+	assert.Nil(t, err)
+
+	gop := GlobalOrbitProperties{Registries: map[string]RegistryCredentials{
+		"registry.example.com:5000": {Username: "orbit", Password: "secret:registry/orbit"},
+		"other.example.com":         {Username: "orbit", Password: "secret:registry/missing"},
+	}}
+	bytes, _ := json.Marshal(gop)
+	store.Set("/orbit/globalproperties", string(bytes), 0)
+
+	oc := OrbitConfiguration{GlobalOrbitProperties: gop}
+	assert.Equal(t, []string{"registry/missing", "registry/orbit"}, oc.GetSecretReferences())
+
+	// The global properties take precedence, a secret which can't be resolved falls back to the config.json
+	registries, err := ct.GetRegistryCredentials(store)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "other.example.com")
+	assert.Equal(t, RegistryCredentials{Username: "orbit", Password: "s3cret"}, registries["registry.example.com:5000"])
+	assert.Equal(t, RegistryCredentials{Username: "deploy", Password: "hunter2"}, registries["other.example.com"])
+	assert.Equal(t, RegistryCredentials{Username: "third", Password: "third"}, registries["third.example.com"])
+
+	auth := RegistryAuthConfiguration(registries, "registry.example.com:5000/web:abc123")
+	assert.Equal(t, "orbit", auth.Username)
+	assert.Equal(t, "s3cret", auth.Password)
+	auth = RegistryAuthConfiguration(registries, "ubuntu:14.04")
+	assert.Equal(t, "", auth.Username)
+
+	assert.NotContains(t, registries["registry.example.com:5000"].String(), "s3cret")
+}
+
+// Stand-in for a v2 registry which has the image web:abc123. With the bearer scheme the manifests
+// need a token from /token, which needs the credentials. With the basic scheme they are checked directly.
+func newTestRegistry(scheme string) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, hasAuth := r.BasicAuth()
+		validAuth := hasAuth && username == "orbit" && password == "s3cret"
+
+		if r.URL.Path == "/token" {
+			if !validAuth || r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:web:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "good-token"}`))
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if scheme == "bearer" && r.Header.Get("Authorization") != "Bearer good-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+ts.URL+`/token",service="test-registry",scope="repository:web:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if scheme == "basic" && !validAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/v2/web/manifests/abc123" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": [{"code": "MANIFEST_UNKNOWN"}]}`))
+			return
+		}
+		w.Write([]byte(`{"schemaVersion": 2}`))
+	}))
+	return ts
+}
+
+func TestVerifyContainerExistsInRepositoryV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbit-registry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, scheme := range []string{"bearer", "basic"} {
+		ts := newTestRegistry(scheme)
+
+		host := strings.TrimPrefix(ts.URL, "https://")
+		image := host + "/web:latest"
+		caFile := writeRegistryTestFile(t, dir, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})))
+
+		// The registry certificate is not trusted without the CA file
+		_, _, err = VerifyContainerExistsInRepositoryV2(image, "abc123", nil)
+		assert.NotNil(t, err, scheme)
+
+		registries := map[string]RegistryCredentials{host: {CAFile: caFile}}
+		_, _, err = VerifyContainerExistsInRepositoryV2(image, "abc123", registries)
+		assert.NotNil(t, err, scheme)
+
+		registries[host] = RegistryCredentials{Username: "orbit", Password: "s3cret", CAFile: caFile}
+		found, _, err := VerifyContainerExistsInRepositoryV2(image, "abc123", registries)
+		assert.Nil(t, err, scheme)
+		assert.True(t, found, scheme)
+
+		found, _, err = VerifyContainerExistsInRepositoryV2(image, "missing", registries)
+		assert.Nil(t, err, scheme)
+		assert.False(t, found, scheme)
+
+		// The v2 API is tried first
+		found, _, err = VerifyContainerExistsInRepository(host+"/web:abc123", "", registries)
+		assert.Nil(t, err, scheme)
+		assert.True(t, found, scheme)
+
+		ts.Close()
+	}
+}
+
+// A v1 registry which is available only over plain http never gets the credentials
+func TestVerifyContainerExistsInRepositoryV1(t *testing.T) {
+	var authorization []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		if r.URL.Path != "/v1/repositories/web/tags/abc123/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"last_update": 1420000000}`))
+	}))
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	registries := map[string]RegistryCredentials{host: {Username: "orbit", Password: "s3cret"}}
+
+	found, lastUpdate, err := VerifyContainerExistsInRepository(host+"/web:abc123", "", registries)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(1420000000), lastUpdate)
+
+	if assert.Equal(t, 1, len(authorization)) {
+		assert.Equal(t, "", authorization[0])
+	}
+}
@@ -0,0 +1,187 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of revision changes which are kept in the history of a service under
+// <EtcdBasePath>/services/<name>/revisions/. Older changes are removed.
+const RevisionHistoryLength = 20
+
+// Sets the revision of the service under servicePath (<base path>/services/<name>, so that
+// services in other environments can be changed too), removes its machine specific revisions
+// and appends the change into its revision history.
+func setServiceRevision(servicePath string, revision ServiceRevision, store ConfigStore) error {
+	// Services which were deployed before the history was kept get their current revision into it first
+	keys, err := getRevisionHistoryKeys(servicePath, store)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		node, err := store.Get(servicePath + "/revision")
+		if err == nil {
+			var current ServiceRevision
+			err = json.Unmarshal([]byte(node.Value), &current)
+			if err == nil {
+				err = appendServiceRevisionHistory(servicePath, current, store)
+			}
+		}
+		if err != nil && !IsKeyNotFound(err) {
+			return err
+		}
+	}
+
+	bytes, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+
+	err = store.Set(servicePath+"/revision", string(bytes), 0)
+	if err != nil {
+		return err
+	}
+
+	err = store.Delete(servicePath + "/machines")
+	if err != nil && !IsKeyNotFound(err) {
+		return err
+	}
+
+	return appendServiceRevisionHistory(servicePath, revision, store)
+}
+
+func appendServiceRevisionHistory(servicePath string, revision ServiceRevision, store ConfigStore) error {
+	bytes, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+
+	// Zero padded so that the keys sort in the order they were added
+	key := fmt.Sprintf("%s/revisions/%019d", servicePath, time.Now().UnixNano())
+	err = store.Set(key, string(bytes), 0)
+	if err != nil {
+		return err
+	}
+
+	keys, err := getRevisionHistoryKeys(servicePath, store)
+	if err != nil {
+		return err
+	}
+	for len(keys) > RevisionHistoryLength {
+		err = store.Delete(keys[0])
+		if err != nil && !IsKeyNotFound(err) {
+			return err
+		}
+		keys = keys[1:]
+	}
+
+	return nil
+}
+
+// Returns the history keys oldest first
+func getRevisionHistoryKeys(servicePath string, store ConfigStore) ([]string, error) {
+	res, err := store.List(servicePath + "/revisions")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, node := range res.Nodes {
+		if !node.Dir {
+			keys = append(keys, node.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Returns the revision changes of the service, latest first
+func (c *Containrunner) GetServiceRevisionHistory(service string, store ConfigStore) ([]ServiceRevision, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/services/" + service + "/revisions")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	values := FlattenConfigNode(res)
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	var history []ServiceRevision
+	for _, key := range keys {
+		var revision ServiceRevision
+		err = json.Unmarshal([]byte(values[key]), &revision)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid revision history entry %s: %v", key, err)
+		}
+		history = append(history, revision)
+	}
+
+	return history, nil
+}
+
+// Returns the latest revision in the history which differs from the current revision, or nil
+func (c *Containrunner) GetPreviousServiceRevision(service string, store ConfigStore) (*ServiceRevision, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	current, err := c.GetServiceRevision(service, store)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := c.GetServiceRevisionHistory(service, store)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revision := range history {
+		if current == nil || revision.Revision != current.Revision {
+			previous := revision
+			return &previous, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Finds a revision to roll back to from the history. The target is either the number of steps
+// back in the history as listed by GetServiceRevisionHistory ("1" is the change before the
+// latest) or a revision, which can be abbreviated.
+func (c *Containrunner) FindServiceRevisionInHistory(service string, target string, store ConfigStore) (*ServiceRevision, error) {
+	history, err := c.GetServiceRevisionHistory(service, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if steps, err := strconv.Atoi(target); err == nil && steps <= RevisionHistoryLength {
+		if steps < 1 || steps >= len(history) {
+			return nil, fmt.Errorf("Service %s has %d revisions in its history, can't go %d steps back", service, len(history), steps)
+		}
+		revision := history[steps]
+		return &revision, nil
+	}
+
+	for _, revision := range history {
+		if strings.HasPrefix(revision.Revision, target) {
+			return &revision, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Revision %s is not in the history of service %s", target, service)
+}
@@ -0,0 +1,117 @@
+package containrunner
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Restores the previous revision of a service if a new revision doesn't become healthy. A machine
+// is down when it doesn't have a healthy endpoint which reports the new revision. If more than
+// MaxDownFraction of the machines are down once TimeoutSeconds has passed since the revision was
+// set, the previous revision is set back. For example:
+//
+//	"RollbackPolicy": {"MaxDownFraction": 0.25, "TimeoutSeconds": 300}
+type RollbackPolicy struct {
+	MaxDownFraction float64
+	TimeoutSeconds  int
+}
+
+func (p RollbackPolicy) Validate() error {
+	if p.MaxDownFraction < 0 || p.MaxDownFraction >= 1 {
+		return errors.New("RollbackPolicy.MaxDownFraction must be at least 0 and less than 1")
+	}
+	if p.TimeoutSeconds <= 0 {
+		return errors.New("RollbackPolicy.TimeoutSeconds must be positive")
+	}
+	return nil
+}
+
+// A deployment watched with WatchDeployment
+type DeploymentWatch struct {
+	Service  string
+	Revision ServiceRevision
+
+	// Revision which is restored if the policy is violated
+	Previous ServiceRevision
+
+	// Machines which should run the new revision
+	Machines []string
+
+	Policy RollbackPolicy
+	User   string
+
+	// How often the endpoints are checked. Defaults to one second
+	PollInterval time.Duration
+
+	// Called after every check with the machines which don't run the new revision yet and which do
+	Progress func(pending []string, updated []string)
+}
+
+// Watches a deployment until all machines run the new revision or the rollback policy timeout
+// passes. If the policy is violated the previous revision is set back and a DeploymentEvent
+// with the AutoRollback action is published. Returns the reason if the deployment was rolled back.
+func (c *Containrunner) WatchDeployment(w DeploymentWatch, store ConfigStore) (string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	pollInterval := w.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	deadline := time.Now().Add(time.Duration(w.Policy.TimeoutSeconds) * time.Second)
+	for {
+		pending, err := c.GetMachinesPendingRevision(w.Service, w.Revision.Revision, w.Machines, store)
+		if err != nil {
+			return "", err
+		}
+
+		if w.Progress != nil {
+			var updated []string
+			for _, machine := range w.Machines {
+				if !stringInSlice(machine, pending) {
+					updated = append(updated, machine)
+				}
+			}
+			w.Progress(pending, updated)
+		}
+
+		if len(pending) == 0 {
+			return "", nil
+		}
+
+		if time.Now().After(deadline) {
+			if float64(len(pending)) <= w.Policy.MaxDownFraction*float64(len(w.Machines)) {
+				return "", nil
+			}
+
+			reason := fmt.Sprintf("%d of %d machines did not have a healthy endpoint with revision %s after %d seconds",
+				len(pending), len(w.Machines), w.Revision.Revision, w.Policy.TimeoutSeconds)
+
+			// Only roll back if nobody has deployed something else meanwhile
+			current, err := c.GetServiceRevision(w.Service, store)
+			if err != nil {
+				return "", err
+			}
+			if current == nil || current.Revision != w.Revision.Revision {
+				return "", fmt.Errorf("%s, but the revision has been changed meanwhile so it was not rolled back", reason)
+			}
+
+			previous := w.Previous
+			previous.DeploymentTime = time.Now()
+			previous.User = w.User
+			previous.Message = "Automatic rollback: " + reason
+			err = c.SetServiceRevision(w.Service, previous, store)
+			if err != nil {
+				return "", err
+			}
+
+			c.publishDeploymentEvent("AutoRollback", w.Service, previous.Revision, nil, w.User, reason)
+			return reason, nil
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,110 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServiceRevisionHistory(t *testing.T) {
+	ct, store, _ := setupDeployTest()
+
+	previous, err := ct.GetPreviousServiceRevision("web", store)
+	assert.Nil(t, err)
+	assert.Nil(t, previous)
+
+	for i := 0; i < RevisionHistoryLength+5; i++ {
+		err = ct.SetServiceRevision("web", ServiceRevision{Revision: string(rune('a' + i))}, store)
+		assert.Nil(t, err)
+	}
+
+	history, err := ct.GetServiceRevisionHistory("web", store)
+	assert.Nil(t, err)
+	assert.Equal(t, RevisionHistoryLength, len(history))
+	assert.Equal(t, string(rune('a'+RevisionHistoryLength+4)), history[0].Revision)
+
+	previous, err = ct.GetPreviousServiceRevision("web", store)
+	assert.Nil(t, err)
+	assert.Equal(t, string(rune('a'+RevisionHistoryLength+3)), previous.Revision)
+
+	// The revision which was set before the history existed is kept
+	ct, store, _ = setupDeployTest()
+	ct.SetServiceRevision("web", ServiceRevision{Revision: "new"}, store)
+	history, _ = ct.GetServiceRevisionHistory("web", store)
+	if assert.Equal(t, 2, len(history)) {
+		assert.Equal(t, "old", history[1].Revision)
+	}
+}
+
+func TestWatchDeploymentRollsBack(t *testing.T) {
+	ct, store, machines := setupDeployTest()
+	recorder := new(TestEventRecorder)
+	ct.Events = recorder
+
+	ct.SetServiceRevision("web", ServiceRevision{Revision: "new"}, store)
+
+	// Two of five machines come up with the new revision, the rest keep the old endpoints
+	var stop int32
+	go simulateDeployDaemons(store, machines, []string{"10.0.0.3", "10.0.0.4", "10.0.0.5"}, &stop)
+	defer atomic.StoreInt32(&stop, 1)
+	for _, machine := range machines[0:2] {
+		ct.SetServiceRevisionForMachine("web", ServiceRevision{Revision: "new"}, machine, store)
+	}
+
+	w := DeploymentWatch{
+		Service:      "web",
+		Revision:     ServiceRevision{Revision: "new"},
+		Previous:     ServiceRevision{Revision: "old"},
+		Machines:     machines,
+		Policy:       RollbackPolicy{MaxDownFraction: 0.5, TimeoutSeconds: 0},
+		PollInterval: time.Millisecond,
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	reason, err := ct.WatchDeployment(w, store)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(reason, "3 of 5 machines"))
+
+	revision, _ := ct.GetServiceRevision("web", store)
+	assert.Equal(t, "old", revision.Revision)
+	assert.True(t, strings.HasPrefix(revision.Message, "Automatic rollback: 3 of 5"))
+	if assert.Equal(t, 1, len(recorder.events)) {
+		assert.Equal(t, "AutoRollback", recorder.events[0].Ptr.(DeploymentEvent).Action)
+		assert.Equal(t, "old", recorder.events[0].Ptr.(DeploymentEvent).Revision)
+	}
+
+	// Within the policy
+	ct.SetServiceRevision("web", ServiceRevision{Revision: "new"}, store)
+	w.Policy.MaxDownFraction = 0.6
+	reason, err = ct.WatchDeployment(w, store)
+	assert.Nil(t, err)
+	assert.Equal(t, "", reason)
+}
+
+func TestFindServiceRevisionInHistory(t *testing.T) {
+	ct, store, _ := setupDeployTest()
+	ct.SetServiceRevision("web", ServiceRevision{Revision: "1a2b3c", User: "garo", Message: "first"}, store)
+	ct.SetServiceRevision("web", ServiceRevision{Revision: "4d5e6f"}, store)
+
+	revision, err := ct.FindServiceRevisionInHistory("web", "1", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "1a2b3c", revision.Revision)
+	assert.Equal(t, "first", revision.Message)
+
+	revision, err = ct.FindServiceRevisionInHistory("web", "2", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", revision.Revision)
+
+	revision, err = ct.FindServiceRevisionInHistory("web", "1a2b", store)
+	assert.Nil(t, err)
+	assert.Equal(t, "garo", revision.User)
+
+	_, err = ct.FindServiceRevisionInHistory("web", "3", store)
+	assert.NotNil(t, err)
+	_, err = ct.FindServiceRevisionInHistory("web", "0", store)
+	assert.NotNil(t, err)
+	_, err = ct.FindServiceRevisionInHistory("web", "ffff", store)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,462 @@
+package containrunner
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Secrets are referenced from the service configuration with "secret:<name>", for example
+	the env entry "DB_PASSWORD=secret:db/password" or the check Password "secret:checks/admin".
+	References are allowed in Container.Config.Env values, check Username and Password,
+	SourceControl.OAuthToken and the Username and Password of the global Registries.
+
+	The plain text values are given to orbitctl import in a separate secrets file which is not
+	kept in git. They are encrypted with the cluster key (AES-256-GCM) and stored under
+	<EtcdBasePath>/secrets/<name>. Only the daemon has the key file and it decrypts the values
+	just before launching the container, so etcd, the /status endpoint and the logs only ever
+	see the references. The container gets a digest of its decrypted env values as the
+	SecretDigestLabel, so a container is relaunched when a secret it uses has been changed.
+*/
+
+const SecretPrefix = "secret:"
+
+// Container label which holds the digest of the decrypted env secrets of the container
+const SecretDigestLabel = "orbit.secret-digest"
+
+// Shown instead of a plain text credential when a configuration is displayed
+const RedactedValue = "<redacted>"
+
+// Looks up and decrypts a single secret by its name
+type SecretResolver func(name string) (string, error)
+
+var secretNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(/[a-zA-Z0-9_.-]+)*$`)
+
+// Environment variables whose names contain any of these are redacted when displayed
+// even if they don't use a secret reference.
+var sensitiveEnvNames = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "_KEY"}
+
+const secretCiphertextPrefix = "aesgcm:"
+
+func IsSecretReference(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+func ValidateSecretName(name string) error {
+	if !secretNameRegexp.MatchString(name) || stringInSlice(".", strings.Split(name, "/")) || stringInSlice("..", strings.Split(name, "/")) {
+		return fmt.Errorf("Invalid secret name '%s'", name)
+	}
+	return nil
+}
+
+// Returns a new random cluster key, base64 encoded as it's stored in the key file
+func GenerateSecretKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Reads the cluster key from a file which contains the base64 encoded 32 byte key
+func LoadSecretKey(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secret key file %s: %v", filename, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid secret key file %s: key must be 32 bytes, got %d", filename, len(key))
+	}
+
+	return key, nil
+}
+
+func EncryptSecret(key []byte, plaintext string) (string, error) {
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretCiphertextPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptSecret(key []byte, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, secretCiphertextPrefix) {
+		return "", errors.New("Unknown secret encryption format")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext[len(secretCiphertextPrefix):])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("Secret ciphertext is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("Could not decrypt secret, wrong key?")
+	}
+
+	return string(plaintext), nil
+}
+
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the names of the secrets which the service refers to, sorted
+func GetSecretReferences(service ServiceConfiguration) []string {
+	found := make(map[string]bool)
+
+	visitSecretFields(&service, true, func(value *string) {
+		if IsSecretReference(*value) {
+			found[(*value)[len(SecretPrefix):]] = true
+		}
+	})
+
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the names of all secrets referenced by the services and tag overwrites of the configuration
+// and by the registry credentials of the global properties
+func (oc *OrbitConfiguration) GetSecretReferences() []string {
+	found := make(map[string]bool)
+
+	for _, credentials := range oc.GlobalOrbitProperties.Registries {
+		for _, value := range []string{credentials.Username, credentials.Password} {
+			if IsSecretReference(value) {
+				found[value[len(SecretPrefix):]] = true
+			}
+		}
+	}
+
+	for _, service := range oc.Services {
+		for _, name := range GetSecretReferences(service) {
+			found[name] = true
+		}
+	}
+
+	for _, mc := range oc.MachineConfigurations {
+		for _, boundService := range mc.Services {
+			if boundService.Overwrites == nil {
+				continue
+			}
+			for _, name := range GetSecretReferences(*boundService.Overwrites) {
+				found[name] = true
+			}
+		}
+	}
+
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Calls f for every field of the service which may hold a secret reference. For env
+// entries f gets only the value part, which is written back if f changed it.
+// SourceControl.OAuthToken is visited only if sourceControl is set, as the daemon doesn't need it.
+func visitSecretFields(service *ServiceConfiguration, sourceControl bool, f func(value *string)) {
+	if service.Container != nil {
+		for i, env := range service.Container.Config.Env {
+			parts := strings.SplitN(env, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value := parts[1]
+			f(&value)
+			if value != parts[1] {
+				service.Container.Config.Env[i] = parts[0] + "=" + value
+			}
+		}
+	}
+
+	for i := range service.Checks {
+		f(&service.Checks[i].Username)
+		f(&service.Checks[i].Password)
+	}
+
+	if sourceControl && service.SourceControl != nil {
+		f(&service.SourceControl.OAuthToken)
+	}
+}
+
+// Returns a copy of the service where the secret references in the env and in the check credentials
+// are replaced with the decrypted values.
+// Only the daemon should call this and the result must never be logged or stored.
+func ResolveServiceSecrets(service ServiceConfiguration, resolve SecretResolver) (ServiceConfiguration, error) {
+	references := false
+	visitSecretFields(&service, false, func(value *string) {
+		references = references || IsSecretReference(*value)
+	})
+	if !references {
+		return service, nil
+	}
+
+	service = CopyServiceConfiguration(service)
+
+	var err error
+	visitSecretFields(&service, false, func(value *string) {
+		if err != nil || !IsSecretReference(*value) {
+			return
+		}
+		if resolve == nil {
+			err = fmt.Errorf("Service %s references secret %s but there is no secret key", service.Name, (*value)[len(SecretPrefix):])
+			return
+		}
+
+		var plaintext string
+		plaintext, err = resolve((*value)[len(SecretPrefix):])
+		if err != nil {
+			err = fmt.Errorf("Service %s: could not resolve secret %s: %v", service.Name, (*value)[len(SecretPrefix):], err)
+			return
+		}
+		*value = plaintext
+	})
+
+	if err != nil {
+		return ServiceConfiguration{}, err
+	}
+
+	return service, nil
+}
+
+// Returns a copy of the service where the container has SecretDigestLabel set to a digest of the
+// decrypted values of its env secret references. The running container has the decrypted values,
+// so this is how a container whose secrets have been changed is told apart. A service without env
+// secret references is returned as it is, and so is the service if a secret can't be resolved.
+func SetSecretDigestLabel(service ServiceConfiguration, resolve SecretResolver) (ServiceConfiguration, error) {
+	if service.Container == nil {
+		return service, nil
+	}
+
+	hash := sha256.New()
+	found := false
+	for _, env := range service.Container.Config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !IsSecretReference(parts[1]) {
+			continue
+		}
+		name := parts[1][len(SecretPrefix):]
+		if resolve == nil {
+			return service, fmt.Errorf("Service %s references secret %s but there is no secret key", service.Name, name)
+		}
+
+		plaintext, err := resolve(name)
+		if err != nil {
+			return service, fmt.Errorf("Service %s: could not resolve secret %s: %v", service.Name, name, err)
+		}
+		fmt.Fprintf(hash, "%s=%s\n", parts[0], plaintext)
+		found = true
+	}
+
+	if !found {
+		return service, nil
+	}
+
+	container := *service.Container
+	container.Config.Labels = make(map[string]string, len(service.Container.Config.Labels)+1)
+	for key, value := range service.Container.Config.Labels {
+		container.Config.Labels[key] = value
+	}
+	container.Config.Labels[SecretDigestLabel] = hex.EncodeToString(hash.Sum(nil))
+	service.Container = &container
+
+	return service, nil
+}
+
+// Returns a copy of the service which is safe to display. Secret references are kept as they are,
+// plain text OAuth tokens, check passwords and env variables which look like credentials are
+// replaced with RedactedValue.
+func RedactServiceConfiguration(service ServiceConfiguration) ServiceConfiguration {
+	service = CopyServiceConfiguration(service)
+
+	if service.Container != nil {
+		for i, env := range service.Container.Config.Env {
+			parts := strings.SplitN(env, "=", 2)
+			if len(parts) == 2 && parts[1] != "" && !IsSecretReference(parts[1]) && isSensitiveEnvName(parts[0]) {
+				service.Container.Config.Env[i] = parts[0] + "=" + RedactedValue
+			}
+		}
+	}
+
+	for i, check := range service.Checks {
+		if check.Password != "" && !IsSecretReference(check.Password) {
+			service.Checks[i].Password = RedactedValue
+		}
+	}
+
+	if service.SourceControl != nil && service.SourceControl.OAuthToken != "" && !IsSecretReference(service.SourceControl.OAuthToken) {
+		service.SourceControl.OAuthToken = RedactedValue
+	}
+
+	return service
+}
+
+func isSensitiveEnvName(name string) bool {
+	name = strings.ToUpper(name)
+	for _, sensitive := range sensitiveEnvNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Containrunner) getSecretKey(name string) string {
+	return c.EtcdBasePath + "/secrets/" + name
+}
+
+/*
+Encrypts the plain text secrets with the key and stores them. Every secret referenced by
+the configuration must be either in secrets or already in the store, otherwise an error is
+returned before anything is written. Secrets whose value hasn't changed are not rewritten.
+
+Returns the names of the secrets which were written.
+*/
+func (c *Containrunner) ImportSecrets(oc *OrbitConfiguration, secrets map[string]string, key []byte, store ConfigStore) ([]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	for name := range secrets {
+		err := ValidateSecretName(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range oc.GetSecretReferences() {
+		if _, found := secrets[name]; found {
+			continue
+		}
+		_, err := store.Get(c.getSecretKey(name))
+		if IsKeyNotFound(err) {
+			return nil, fmt.Errorf("Secret %s is referenced but it's not in the secrets file nor in the store", name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var written []string
+	for _, name := range names {
+		res, err := store.Get(c.getSecretKey(name))
+		if err == nil {
+			existing, err := DecryptSecret(key, res.Value)
+			if err == nil && existing == secrets[name] {
+				continue
+			}
+		} else if !IsKeyNotFound(err) {
+			return written, err
+		}
+
+		ciphertext, err := EncryptSecret(key, secrets[name])
+		if err != nil {
+			return written, err
+		}
+
+		err = store.Set(c.getSecretKey(name), ciphertext, 0)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, name)
+	}
+
+	return written, nil
+}
+
+// Returns the names of the secrets in the store, sorted
+func (c *Containrunner) GetSecretNames(store ConfigStore) ([]string, error) {
+	if store == nil {
+		store = c.GetConfigStore()
+	}
+
+	res, err := store.List(c.EtcdBasePath + "/secrets")
+	if IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for key := range FlattenConfigNode(res) {
+		names = append(names, key[len(c.getSecretKey("")):])
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Returns a resolver which reads the secrets from the store and decrypts them with the key from
+// SecretKeyFile. The key file is read on every call so that it can be replaced without a restart.
+func (c *Containrunner) GetSecretResolver(store ConfigStore) SecretResolver {
+	return func(name string) (string, error) {
+		if c.SecretKeyFile == "" {
+			return "", errors.New("no secret key file set (--secret-key-file)")
+		}
+
+		key, err := LoadSecretKey(c.SecretKeyFile)
+		if err != nil {
+			return "", err
+		}
+
+		s := store
+		if s == nil {
+			s = c.GetConfigStore()
+		}
+
+		res, err := s.Get(c.getSecretKey(name))
+		if err != nil {
+			return "", err
+		}
+
+		return DecryptSecret(key, res.Value)
+	}
+}
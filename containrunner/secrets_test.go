@@ -0,0 +1,214 @@
+package containrunner
+
+import (
+	"encoding/base64"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func secretTestKey() []byte {
+	return []byte("0123456789abcdef0123456789abcdef")
+}
+
+func secretTestService() ServiceConfiguration {
+	service := ServiceConfiguration{
+		Name:          "web",
+		Container:     &ContainerConfiguration{},
+		Checks:        []ServiceCheck{{Type: "http", Username: "admin", Password: "secret:checks/admin"}},
+		SourceControl: &SourceControl{Origin: "garo/web", OAuthToken: "secret:github/token"},
+	}
+	service.Container.Config.Env = []string{"DB_HOST=db", "DB_PASSWORD=secret:db/password", "API_TOKEN=abc"}
+	return service
+}
+
+func TestEncryptAndDecryptSecret(t *testing.T) {
+	ciphertext, err := EncryptSecret(secretTestKey(), "hunter2")
+	assert.Nil(t, err)
+	assert.NotContains(t, ciphertext, "hunter2")
+
+	plaintext, err := DecryptSecret(secretTestKey(), ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", plaintext)
+
+	_, err = DecryptSecret([]byte("fedcba9876543210fedcba9876543210"), ciphertext)
+	assert.NotNil(t, err)
+
+	_, err = DecryptSecret(secretTestKey(), "hunter2")
+	assert.NotNil(t, err)
+}
+
+func TestLoadSecretKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "orbit-secret-key")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	key, err := GenerateSecretKey()
+	assert.Nil(t, err)
+	ioutil.WriteFile(f.Name(), []byte(key+"\n"), 0600)
+
+	loaded, err := LoadSecretKey(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(loaded))
+
+	ioutil.WriteFile(f.Name(), []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+	_, err = LoadSecretKey(f.Name())
+	assert.NotNil(t, err)
+}
+
+func TestGetSecretReferences(t *testing.T) {
+	assert.Equal(t, []string{"checks/admin", "db/password", "github/token"}, GetSecretReferences(secretTestService()))
+	assert.Nil(t, GetSecretReferences(ServiceConfiguration{Name: "plain"}))
+}
+
+func TestResolveServiceSecrets(t *testing.T) {
+	service := secretTestService()
+	resolve := func(name string) (string, error) {
+		return "value-of-" + name, nil
+	}
+
+	resolved, err := ResolveServiceSecrets(service, resolve)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DB_HOST=db", "DB_PASSWORD=value-of-db/password", "API_TOKEN=abc"}, resolved.Container.Config.Env)
+	assert.Equal(t, "value-of-checks/admin", resolved.Checks[0].Password)
+	assert.Equal(t, "admin", resolved.Checks[0].Username)
+
+	// The daemon doesn't need the OAuth token and the original must not change
+	assert.Equal(t, "secret:github/token", resolved.SourceControl.OAuthToken)
+	assert.Equal(t, "DB_PASSWORD=secret:db/password", service.Container.Config.Env[1])
+	assert.Equal(t, "secret:checks/admin", service.Checks[0].Password)
+
+	_, err = ResolveServiceSecrets(service, nil)
+	assert.NotNil(t, err)
+
+	plain := ServiceConfiguration{Name: "plain", SourceControl: &SourceControl{OAuthToken: "secret:github/token"}}
+	resolved, err = ResolveServiceSecrets(plain, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, resolved)
+}
+
+func TestRedactServiceConfiguration(t *testing.T) {
+	service := secretTestService()
+	service.Checks[0].Password = "hunter2"
+	service.SourceControl.OAuthToken = "abcdef"
+
+	redacted := RedactServiceConfiguration(service)
+	assert.Equal(t, []string{"DB_HOST=db", "DB_PASSWORD=secret:db/password", "API_TOKEN=" + RedactedValue}, redacted.Container.Config.Env)
+	assert.Equal(t, RedactedValue, redacted.Checks[0].Password)
+	assert.Equal(t, RedactedValue, redacted.SourceControl.OAuthToken)
+	assert.Equal(t, "hunter2", service.Checks[0].Password)
+}
+
+func TestImportSecrets(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	store := NewMemoryConfigStore()
+
+	oc := &OrbitConfiguration{Services: map[string]ServiceConfiguration{"web": secretTestService()}}
+	secrets := map[string]string{"db/password": "hunter2", "checks/admin": "admin-pw"}
+
+	// github/token is missing
+	_, err := ct.ImportSecrets(oc, secrets, secretTestKey(), store)
+	assert.NotNil(t, err)
+	names, _ := ct.GetSecretNames(store)
+	assert.Empty(t, names)
+
+	secrets["github/token"] = "abcdef"
+	written, err := ct.ImportSecrets(oc, secrets, secretTestKey(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"checks/admin", "db/password", "github/token"}, written)
+
+	res, err := store.Get("/orbit/secrets/db/password")
+	assert.Nil(t, err)
+	assert.NotContains(t, res.Value, "hunter2")
+
+	// Unchanged secrets are not rewritten and existing secrets don't need to be given again
+	secrets = map[string]string{"db/password": "changed"}
+	written, err = ct.ImportSecrets(oc, secrets, secretTestKey(), store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db/password"}, written)
+
+	names, err = ct.GetSecretNames(store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"checks/admin", "db/password", "github/token"}, names)
+
+	_, err = ct.ImportSecrets(oc, map[string]string{"../x": "y"}, secretTestKey(), store)
+	assert.NotNil(t, err)
+}
+
+func TestGetSecretResolver(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/orbit"
+	store := NewMemoryConfigStore()
+
+	oc := &OrbitConfiguration{Services: map[string]ServiceConfiguration{}}
+	_, err := ct.ImportSecrets(oc, map[string]string{"db/password": "hunter2"}, secretTestKey(), store)
+	assert.Nil(t, err)
+
+	_, err = ct.GetSecretResolver(store)("db/password")
+	assert.NotNil(t, err)
+
+	f, err := ioutil.TempFile("", "orbit-secret-key")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte(base64.StdEncoding.EncodeToString(secretTestKey())), 0600)
+	ct.SecretKeyFile = f.Name()
+
+	value, err := ct.GetSecretResolver(store)("db/password")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = ct.GetSecretResolver(store)("db/missing")
+	assert.NotNil(t, err)
+}
+
+func TestEnvValueMatches(t *testing.T) {
+	assert.True(t, envValueMatches("a", "a"))
+	assert.False(t, envValueMatches("a", "b"))
+	assert.True(t, envValueMatches("secret:db/password", "hunter2"))
+	assert.False(t, envValueMatches("hunter2", "secret:db/password"))
+}
+
+func TestSetSecretDigestLabel(t *testing.T) {
+	password := "hunter2"
+	secrets := func(name string) (string, error) {
+		return password, nil
+	}
+
+	service := secretTestService()
+	service.Container.Config.Image = "registry:5000/web:1.0"
+	service.Container.Config.Labels = map[string]string{"team": "web"}
+
+	labeled, err := SetSecretDigestLabel(service, secrets)
+	assert.Nil(t, err)
+	digest := labeled.Container.Config.Labels[SecretDigestLabel]
+	assert.Equal(t, 64, len(digest))
+	assert.Equal(t, "web", labeled.Container.Config.Labels["team"])
+	assert.Equal(t, "", service.Container.Config.Labels[SecretDigestLabel])
+
+	// The container launched with the labeled configuration matches it
+	running := ContainerDetails{Container: &docker.Container{Name: "web", Config: &docker.Config{Image: "registry:5000/web:1.0"}}}
+	running.Container.Config.Env = []string{"DB_HOST=db", "DB_PASSWORD=hunter2", "API_TOKEN=abc"}
+	running.Container.Config.Labels = labeled.Container.Config.Labels
+	found, _ := FindMatchingContainers([]ContainerDetails{running}, labeled)
+	assert.Equal(t, 1, len(found))
+
+	// The secret was changed, the running container has the old value
+	password = "correct horse"
+	labeled, err = SetSecretDigestLabel(service, secrets)
+	assert.Nil(t, err)
+	assert.NotEqual(t, digest, labeled.Container.Config.Labels[SecretDigestLabel])
+	found, _ = FindMatchingContainers([]ContainerDetails{running}, labeled)
+	assert.Equal(t, 0, len(found))
+
+	_, err = SetSecretDigestLabel(service, nil)
+	assert.NotNil(t, err)
+
+	// Services without env secrets don't get the label
+	service.Container.Config.Env = []string{"DB_HOST=db"}
+	labeled, err = SetSecretDigestLabel(service, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", labeled.Container.Config.Labels[SecretDigestLabel])
+}
@@ -0,0 +1,83 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Last known good RuntimeConfiguration which is stored on the local disk so that the daemon
+// can converge its containers and haproxy even when etcd can't be reached, for example
+// if the machine is rebooted during an etcd outage.
+type RuntimeConfigurationState struct {
+	SavedAt              time.Time
+	MachineConfiguration MachineConfiguration
+	ServiceBackends      map[string]map[string]*EndpointInfo
+}
+
+// Saves the configuration into a state file. The file is first written into a temporary
+// file which is then renamed so that a crash can't leave a partially written state file behind.
+func SaveRuntimeConfiguration(filename string, configuration RuntimeConfiguration) error {
+	state := RuntimeConfigurationState{
+		SavedAt:              time.Now(),
+		MachineConfiguration: configuration.MachineConfiguration,
+		ServiceBackends:      configuration.ServiceBackends,
+	}
+
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(bytes)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Loads the configuration from a state file written by SaveRuntimeConfiguration.
+// Returns also the time when the configuration was saved.
+func LoadRuntimeConfiguration(filename string) (RuntimeConfiguration, time.Time, error) {
+	var configuration RuntimeConfiguration
+
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return configuration, time.Time{}, err
+	}
+
+	var state RuntimeConfigurationState
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return configuration, time.Time{}, err
+	}
+
+	configuration.MachineConfiguration = state.MachineConfiguration
+	configuration.ServiceBackends = state.ServiceBackends
+
+	return configuration, state.SavedAt, nil
+}
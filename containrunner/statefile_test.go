@@ -0,0 +1,70 @@
+package containrunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func getTestingRuntimeConfiguration() RuntimeConfiguration {
+	var configuration RuntimeConfiguration
+	configuration.MachineConfiguration = *NewMachineConfiguration()
+	configuration.MachineConfiguration.Services["ubuntu"] = BoundService{
+		DefaultConfiguration: ServiceConfiguration{Name: "ubuntu", EndpointPort: 3500},
+		Overwrites:           &ServiceConfiguration{EndpointPort: 3501},
+	}
+	configuration.MachineConfiguration.HAProxyConfiguration = NewHAProxyConfiguration()
+	configuration.MachineConfiguration.HAProxyConfiguration.Template = "foobar"
+
+	configuration.ServiceBackends = make(map[string]map[string]*EndpointInfo)
+	configuration.ServiceBackends["ubuntu"] = make(map[string]*EndpointInfo)
+	configuration.ServiceBackends["ubuntu"]["10.0.0.1:3501"] = &EndpointInfo{Revision: "asdf", AvailabilityZone: "az"}
+
+	return configuration
+}
+
+func TestSaveAndLoadRuntimeConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = SaveRuntimeConfiguration(dir+"/sub/state.json", getTestingRuntimeConfiguration())
+	assert.Nil(t, err)
+
+	configuration, savedAt, err := LoadRuntimeConfiguration(dir + "/sub/state.json")
+	assert.Nil(t, err)
+	assert.False(t, savedAt.IsZero())
+	assert.Equal(t, 3501, configuration.MachineConfiguration.Services["ubuntu"].GetConfig().EndpointPort)
+	assert.Equal(t, "foobar", configuration.MachineConfiguration.HAProxyConfiguration.Template)
+	assert.Equal(t, "asdf", configuration.ServiceBackends["ubuntu"]["10.0.0.1:3501"].Revision)
+
+	_, _, err = LoadRuntimeConfiguration(dir + "/missing.json")
+	assert.NotNil(t, err)
+}
+
+func TestUseLastKnownGoodConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = SaveRuntimeConfiguration(dir+"/state.json", getTestingRuntimeConfiguration())
+	assert.Nil(t, err)
+
+	var containrunner Containrunner
+	containrunner.StateFile = dir + "/state.json"
+	containrunner.incomingLoopbackEvents = make(chan OrbitEvent, 10)
+
+	containrunner.UseLastKnownGoodConfiguration()
+
+	stale, _ := containrunner.IsConfigurationStale()
+	assert.True(t, stale)
+	assert.Equal(t, "foobar", containrunner.currentConfiguration.MachineConfiguration.HAProxyConfiguration.Template)
+
+	event := <-containrunner.incomingLoopbackEvents
+	assert.Equal(t, "NewRuntimeConfigurationEvent", event.Type)
+
+	// Second failure keeps using the same configuration and doesn't trigger new events
+	containrunner.UseLastKnownGoodConfiguration()
+	assert.Equal(t, 0, len(containrunner.incomingLoopbackEvents))
+}
@@ -0,0 +1,393 @@
+package containrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+/*
+	A tag can include other tags by listing them in /orbit/machineconfigurations/tags/<tag>/includes
+	(includes.json in the configuration tree). The resolved tag is built by merging the included
+	tags in the listed order and the tag itself last, so that:
+
+	- a tag always wins over the tags it includes
+	- a later include wins over an earlier one
+	- included tags can include other tags. A tag which is included several times (for example
+	  from two different includes) is merged only once, at its first position.
+
+	When merging an include a service binding (with its overwrites) replaces the binding of the same service, a haproxy template replaces the earlier
+	template while certs and haproxy files are merged file by file, and authoritative names replace
+	the earlier list.
+
+	When a machine has several tags the tags are not ordered like includes, so a conflict between
+	them is an error instead of being silently resolved by the tag order (see MergeMachineTags).
+	A tag can declare a priority (/orbit/machineconfigurations/tags/<tag>/priority, priority.json
+	in the configuration tree) and the tag with the highest priority wins a conflict.
+*/
+
+// Returns the configuration of a single tag without resolving its includes or nil if the tag doesn't exist.
+type TagLookupFunc func(tag string) (*MachineConfiguration, error)
+
+// Resolves the includes of a tag. Returns the resolved configuration and the names of the
+// tags which were merged into it, in the merge order (the tag itself is the last).
+// Returns a nil configuration if the tag doesn't exist and an error if an included tag
+// doesn't exist or the includes form a cycle.
+func ResolveTagConfiguration(tag string, lookup TagLookupFunc) (*MachineConfiguration, []string, error) {
+	var order []string
+	configurations := make(map[string]*MachineConfiguration)
+
+	var resolve func(tag string, stack []string) error
+	resolve = func(tag string, stack []string) error {
+		for i, parent := range stack {
+			if parent == tag {
+				return fmt.Errorf("Tag includes form a cycle: %s", strings.Join(append(stack[i:], tag), " -> "))
+			}
+		}
+
+		if _, found := configurations[tag]; found {
+			return nil
+		}
+
+		mc, err := lookup(tag)
+		if err != nil {
+			return err
+		}
+		if mc == nil {
+			return fmt.Errorf("Tag %s includes unknown tag %s", stack[len(stack)-1], tag)
+		}
+
+		for _, include := range mc.Includes {
+			err = resolve(include, append(stack, tag))
+			if err != nil {
+				return err
+			}
+		}
+
+		configurations[tag] = mc
+		order = append(order, tag)
+		return nil
+	}
+
+	mc, err := lookup(tag)
+	if err != nil || mc == nil {
+		return nil, nil, err
+	}
+
+	for _, include := range mc.Includes {
+		err = resolve(include, []string{tag})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	configurations[tag] = mc
+	order = append(order, tag)
+
+	resolved := new(MachineConfiguration)
+	for _, name := range order {
+		MergeTagConfiguration(resolved, *configurations[name])
+	}
+	resolved.Includes = mc.Includes
+	resolved.Priority = mc.Priority
+
+	return resolved, order, nil
+}
+
+// Merges src on top of dst. See the rules above.
+func MergeTagConfiguration(dst *MachineConfiguration, src MachineConfiguration) {
+	if src.Services != nil {
+		if dst.Services == nil {
+			dst.Services = make(map[string]BoundService, len(src.Services))
+		}
+		for name, boundService := range src.Services {
+			dst.Services[name] = boundService
+		}
+	}
+
+	if src.HAProxyConfiguration != nil {
+		if dst.HAProxyConfiguration == nil {
+			dst.HAProxyConfiguration = NewHAProxyConfiguration()
+		}
+		if src.HAProxyConfiguration.Template != "" {
+			dst.HAProxyConfiguration.Template = src.HAProxyConfiguration.Template
+		}
+		for name, contents := range src.HAProxyConfiguration.Certs {
+			dst.HAProxyConfiguration.Certs[name] = contents
+		}
+		for name, contents := range src.HAProxyConfiguration.Files {
+			dst.HAProxyConfiguration.Files[name] = contents
+		}
+	}
+
+	if src.AuthoritativeNames != nil {
+		dst.AuthoritativeNames = src.AuthoritativeNames
+	}
+}
+
+// Returns a TagLookupFunc which reads the tags from the OrbitConfiguration
+func (oc *OrbitConfiguration) TagLookup() TagLookupFunc {
+	return func(tag string) (*MachineConfiguration, error) {
+		mc, found := oc.MachineConfigurations[tag]
+		if !found {
+			return nil, nil
+		}
+		return &mc, nil
+	}
+}
+
+// A part of the machine configuration which two or more tags of a machine define differently
+type TagConflict struct {
+	// "services/<name>", "haproxy_config", "certs/<name>" or "haproxy_files/<name>"
+	Part string
+
+	// The conflicting tags, all with the same priority
+	Tags []string
+
+	// The fields which differ between the service bindings
+	Fields []string
+}
+
+func (c TagConflict) String() string {
+	str := fmt.Sprintf("Tags %s define %s differently", strings.Join(c.Tags, ", "), c.Part)
+	if len(c.Fields) > 0 {
+		str += fmt.Sprintf(" (fields %s)", strings.Join(c.Fields, ", "))
+	}
+	return str
+}
+
+type tagCandidate struct {
+	tag      string
+	priority int
+	value    string
+}
+
+// Returns the candidate with the highest priority. If several candidates have the highest
+// priority and they don't all have the same value a conflict is returned instead.
+func pickTagCandidate(part string, candidates []tagCandidate) (int, *TagConflict) {
+	winner := 0
+	for i, candidate := range candidates {
+		if candidate.priority > candidates[winner].priority {
+			winner = i
+		}
+	}
+
+	var conflict *TagConflict
+	for _, candidate := range candidates {
+		if candidate.priority != candidates[winner].priority || candidate.value == candidates[winner].value {
+			continue
+		}
+
+		if conflict == nil {
+			conflict = &TagConflict{Part: part, Tags: []string{candidates[winner].tag}}
+		}
+		conflict.Tags = append(conflict.Tags, candidate.tag)
+
+		if strings.HasPrefix(part, "services/") {
+			fields, _ := DiffJSON(candidates[winner].value, candidate.value)
+			for _, field := range fields {
+				conflict.Fields = appendMissing(conflict.Fields, field.Field)
+			}
+		}
+	}
+
+	if conflict != nil {
+		return -1, conflict
+	}
+	return winner, nil
+}
+
+func appendMissing(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// Merges the resolved configurations of all tags of a single machine. Tags without
+// a configuration are skipped.
+//
+// Unlike with includes a service binding, haproxy template, cert or haproxy file which
+// several tags define differently is a conflict unless one of the tags has a higher priority
+// than the others. Conflicting service bindings are left out of the result and if any part of
+// the haproxy configuration conflicts the whole HAProxyConfiguration is left out. The
+// conflicts are returned sorted by part.
+func MergeMachineTags(tags []string, configurations map[string]*MachineConfiguration) (MachineConfiguration, []TagConflict) {
+	var configuration MachineConfiguration
+	var conflicts []TagConflict
+
+	services := make(map[string][]tagCandidate)
+	haproxy := make(map[string][]tagCandidate)
+	hasHAProxy := false
+
+	for _, tag := range tags {
+		mc, found := configurations[tag]
+		if !found || mc == nil {
+			continue
+		}
+
+		if mc.Services != nil && configuration.Services == nil {
+			configuration.Services = make(map[string]BoundService)
+		}
+
+		for name, boundService := range mc.Services {
+			// A binding without overwrites is compared as empty overwrites so that only the set fields differ
+			overwrites := ServiceConfiguration{}
+			if boundService.Overwrites != nil {
+				overwrites = *boundService.Overwrites
+			}
+			bytes, _ := json.Marshal(overwrites)
+			value := string(bytes)
+			services[name] = append(services[name], tagCandidate{tag, mc.Priority, value})
+		}
+
+		if mc.HAProxyConfiguration != nil {
+			hasHAProxy = true
+			if mc.HAProxyConfiguration.Template != "" {
+				haproxy["haproxy_config"] = append(haproxy["haproxy_config"], tagCandidate{tag, mc.Priority, mc.HAProxyConfiguration.Template})
+			}
+			for name, contents := range mc.HAProxyConfiguration.Certs {
+				haproxy["certs/"+name] = append(haproxy["certs/"+name], tagCandidate{tag, mc.Priority, contents})
+			}
+			for name, contents := range mc.HAProxyConfiguration.Files {
+				haproxy["haproxy_files/"+name] = append(haproxy["haproxy_files/"+name], tagCandidate{tag, mc.Priority, contents})
+			}
+		}
+
+		if mc.AuthoritativeNames != nil {
+			configuration.AuthoritativeNames = mc.AuthoritativeNames
+		}
+	}
+
+	for name, candidates := range services {
+		winner, conflict := pickTagCandidate("services/"+name, candidates)
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+			continue
+		}
+		configuration.Services[name] = configurations[candidates[winner].tag].Services[name]
+	}
+
+	if hasHAProxy {
+		configuration.HAProxyConfiguration = NewHAProxyConfiguration()
+	}
+
+	haproxyConflicts := false
+	for part, candidates := range haproxy {
+		winner, conflict := pickTagCandidate(part, candidates)
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+			haproxyConflicts = true
+			continue
+		}
+
+		value := candidates[winner].value
+		switch {
+		case part == "haproxy_config":
+			configuration.HAProxyConfiguration.Template = value
+		case strings.HasPrefix(part, "certs/"):
+			configuration.HAProxyConfiguration.Certs[strings.TrimPrefix(part, "certs/")] = value
+		default:
+			configuration.HAProxyConfiguration.Files[strings.TrimPrefix(part, "haproxy_files/")] = value
+		}
+	}
+
+	if haproxyConflicts {
+		configuration.HAProxyConfiguration = nil
+	}
+
+	sort.Sort(tagConflictsByPart(conflicts))
+
+	return configuration, conflicts
+}
+
+// Replaces the parts of a new machine configuration which had conflicts with the parts of
+// the currently running configuration, so that the daemon keeps running what it already has.
+func (s *Containrunner) refuseTagConflicts(configuration *MachineConfiguration, conflicts []TagConflict) {
+	current := s.getCurrentConfiguration().MachineConfiguration
+
+	for _, conflict := range conflicts {
+		log.Error(LogString(fmt.Sprintf("Refusing configuration: %s. Declare a tag priority to resolve the conflict", conflict)))
+
+		if strings.HasPrefix(conflict.Part, "services/") {
+			name := strings.TrimPrefix(conflict.Part, "services/")
+			if boundService, found := current.Services[name]; found {
+				if configuration.Services == nil {
+					configuration.Services = make(map[string]BoundService)
+				}
+				configuration.Services[name] = boundService
+			}
+		} else {
+			configuration.HAProxyConfiguration = current.HAProxyConfiguration
+		}
+	}
+}
+
+// Checks offline that the tag combinations of every machine in an inventory file can be
+// merged without conflicts. The inventory file is a JSON object which maps machine names
+// (or addresses) into lists of tags, for example {"10.0.0.1": ["frontend", "logging"]}.
+func LintMachineInventory(oc *OrbitConfiguration, filename string) []LintProblem {
+	l := new(linter)
+
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		l.add(filename, 0, "could not read file: %v", err)
+		return l.problems
+	}
+
+	var inventory map[string][]string
+	err = json.Unmarshal(bytes, &inventory)
+	if err != nil {
+		l.add(filename, 0, "could not parse inventory: %v", err)
+		return l.problems
+	}
+
+	var machines []string
+	for machine := range inventory {
+		machines = append(machines, machine)
+	}
+	sort.Strings(machines)
+
+	// Many machines usually share the same tags, so every combination is merged only once
+	checked := make(map[string][]TagConflict)
+
+	for _, machine := range machines {
+		tags := inventory[machine]
+		key := strings.Join(tags, ",")
+
+		conflicts, found := checked[key]
+		if !found {
+			configurations := make(map[string]*MachineConfiguration)
+			for _, tag := range tags {
+				mc, _, err := ResolveTagConfiguration(tag, oc.TagLookup())
+				if err != nil {
+					l.add(filename, jsonKeyLine(bytes, machine), "machine %s: %v", machine, err)
+					continue
+				}
+				if mc == nil {
+					l.add(filename, jsonKeyLine(bytes, machine), "machine %s has unknown tag '%s'", machine, tag)
+					continue
+				}
+				configurations[tag] = mc
+			}
+
+			_, conflicts = MergeMachineTags(tags, configurations)
+			checked[key] = conflicts
+		}
+
+		for _, conflict := range conflicts {
+			l.add(filename, jsonKeyLine(bytes, machine), "machine %s: %s", machine, conflict)
+		}
+	}
+
+	return l.problems
+}
+
+type tagConflictsByPart []TagConflict
+
+func (a tagConflictsByPart) Len() int           { return len(a) }
+func (a tagConflictsByPart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a tagConflictsByPart) Less(i, j int) bool { return a[i].Part < a[j].Part }
@@ -0,0 +1,205 @@
+package containrunner
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testTagConfiguration(includes []string, services ...string) MachineConfiguration {
+	var mc MachineConfiguration
+	mc.Includes = includes
+	mc.Services = make(map[string]BoundService)
+	for _, name := range services {
+		mc.Services[name] = BoundService{DefaultConfiguration: ServiceConfiguration{Name: name}}
+	}
+	return mc
+}
+
+func TestResolveTagConfiguration(t *testing.T) {
+	oc := new(OrbitConfiguration)
+	oc.MachineConfigurations = make(map[string]MachineConfiguration)
+
+	base := testTagConfiguration(nil, "comet", "web")
+	base.HAProxyConfiguration = NewHAProxyConfiguration()
+	base.HAProxyConfiguration.Template = "base"
+	base.HAProxyConfiguration.Certs["base.pem"] = "base"
+	base.AuthoritativeNames = []string{"base"}
+	oc.MachineConfigurations["base"] = base
+
+	logging := testTagConfiguration([]string{"base"}, "fluentd")
+	logging.HAProxyConfiguration = NewHAProxyConfiguration()
+	logging.HAProxyConfiguration.Certs["logging.pem"] = "logging"
+	oc.MachineConfigurations["logging"] = logging
+
+	canary := testTagConfiguration([]string{"base", "logging"}, "web")
+	canary.Services["web"] = BoundService{DefaultConfiguration: ServiceConfiguration{Name: "web"}, Overwrites: &ServiceConfiguration{EndpointPort: 3501}}
+	canary.HAProxyConfiguration = NewHAProxyConfiguration()
+	canary.HAProxyConfiguration.Template = "canary"
+	oc.MachineConfigurations["frontend-canary"] = canary
+
+	mc, order, err := ResolveTagConfiguration("frontend-canary", oc.TagLookup())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"base", "logging", "frontend-canary"}, order)
+	assert.Equal(t, []string{"base", "logging"}, mc.Includes)
+	assert.Equal(t, 3, len(mc.Services))
+	assert.Equal(t, 3501, mc.Services["web"].Overwrites.EndpointPort)
+	assert.Nil(t, mc.Services["comet"].Overwrites)
+	assert.Equal(t, "canary", mc.HAProxyConfiguration.Template)
+	assert.Equal(t, map[string]string{"base.pem": "base", "logging.pem": "logging"}, mc.HAProxyConfiguration.Certs)
+	assert.Equal(t, []string{"base"}, mc.AuthoritativeNames)
+
+	// The included tags must not be modified by the merge
+	assert.Nil(t, oc.MachineConfigurations["base"].Services["web"].Overwrites)
+	assert.Equal(t, "base", oc.MachineConfigurations["base"].HAProxyConfiguration.Template)
+
+	mc, order, err = ResolveTagConfiguration("missing", oc.TagLookup())
+	assert.Nil(t, err)
+	assert.Nil(t, mc)
+	assert.Nil(t, order)
+}
+
+func TestResolveTagConfigurationErrors(t *testing.T) {
+	oc := new(OrbitConfiguration)
+	oc.MachineConfigurations = make(map[string]MachineConfiguration)
+	oc.MachineConfigurations["a"] = testTagConfiguration([]string{"b"})
+	oc.MachineConfigurations["b"] = testTagConfiguration([]string{"c"})
+	oc.MachineConfigurations["c"] = testTagConfiguration([]string{"a"})
+	oc.MachineConfigurations["d"] = testTagConfiguration([]string{"unknown"})
+	oc.MachineConfigurations["e"] = testTagConfiguration([]string{"e"})
+
+	_, _, err := ResolveTagConfiguration("a", oc.TagLookup())
+	assert.Equal(t, "Tag includes form a cycle: a -> b -> c -> a", err.Error())
+
+	_, _, err = ResolveTagConfiguration("d", oc.TagLookup())
+	assert.Equal(t, "Tag d includes unknown tag unknown", err.Error())
+
+	_, _, err = ResolveTagConfiguration("e", oc.TagLookup())
+	assert.Equal(t, "Tag includes form a cycle: e -> e", err.Error())
+}
+
+func TestGetMachineConfigurationByTagsWithIncludes(t *testing.T) {
+	var ct Containrunner
+	ct.EtcdBasePath = "/test"
+
+	store := NewMemoryConfigStore()
+	store.Set("/test/services/comet/config", `{"Name":"comet","EndpointPort":3500}`, 0)
+	store.Set("/test/services/web/config", `{"Name":"web","EndpointPort":80}`, 0)
+	store.Set("/test/machineconfigurations/tags/base/services/comet", "{}", 0)
+	store.Set("/test/machineconfigurations/tags/base/services/web", "{}", 0)
+	store.Set("/test/machineconfigurations/tags/base/haproxy_config", "base", 0)
+	store.Set("/test/machineconfigurations/tags/frontend-a/includes", `["base"]`, 0)
+	store.Set("/test/machineconfigurations/tags/frontend-a/services/web", `{"EndpointPort":8080}`, 0)
+
+	configuration, err := ct.GetMachineConfigurationByTags(store, []string{"frontend-a", "nonexisting"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 3500, configuration.Services["comet"].GetConfig().EndpointPort)
+	assert.Equal(t, 8080, configuration.Services["web"].GetConfig().EndpointPort)
+	assert.Equal(t, "base", configuration.HAProxyConfiguration.Template)
+
+	mc, order, err := ct.GetResolvedTagConfiguration("frontend-a", store)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"base", "frontend-a"}, order)
+	assert.Equal(t, 2, len(mc.Services))
+
+	_, _, err = ct.GetResolvedTagConfiguration("nonexisting", store)
+	assert.NotNil(t, err)
+
+	store.Set("/test/machineconfigurations/tags/base/includes", `["frontend-a"]`, 0)
+	_, err = ct.GetMachineConfigurationByTags(store, []string{"frontend-a"}, "")
+	assert.NotNil(t, err)
+}
+
+func TestMergeMachineTags(t *testing.T) {
+	frontend := testTagConfiguration(nil, "comet", "web")
+	frontend.HAProxyConfiguration = NewHAProxyConfiguration()
+	frontend.HAProxyConfiguration.Template = "frontend"
+	frontend.HAProxyConfiguration.Certs["a.pem"] = "a"
+
+	canary := testTagConfiguration(nil, "web")
+	canary.Services["web"] = BoundService{DefaultConfiguration: ServiceConfiguration{Name: "web"}, Overwrites: &ServiceConfiguration{EndpointPort: 3501, Attributes: map[string]string{"canary": "true"}}}
+	canary.HAProxyConfiguration = NewHAProxyConfiguration()
+	canary.HAProxyConfiguration.Template = "canary"
+	canary.HAProxyConfiguration.Certs["a.pem"] = "a"
+
+	logging := testTagConfiguration(nil, "comet", "fluentd")
+
+	configurations := map[string]*MachineConfiguration{"frontend": &frontend, "canary": &canary, "logging": &logging}
+
+	mc, conflicts := MergeMachineTags([]string{"frontend", "canary", "logging", "missing"}, configurations)
+	assert.Equal(t, 2, len(conflicts))
+	assert.Equal(t, "haproxy_config", conflicts[0].Part)
+	assert.Equal(t, []string{"frontend", "canary"}, conflicts[0].Tags)
+	assert.Equal(t, "services/web", conflicts[1].Part)
+	assert.Equal(t, []string{"Attributes", "EndpointPort"}, conflicts[1].Fields)
+	assert.Equal(t, "Tags frontend, canary define services/web differently (fields Attributes, EndpointPort)", conflicts[1].String())
+
+	// Identical bindings are not conflicts, conflicting parts are left out
+	assert.Equal(t, 2, len(mc.Services))
+	assert.NotNil(t, mc.Services["comet"])
+	assert.NotNil(t, mc.Services["fluentd"])
+	assert.Nil(t, mc.HAProxyConfiguration)
+
+	// The order of the tags doesn't matter
+	_, reversed := MergeMachineTags([]string{"logging", "canary", "frontend"}, configurations)
+	assert.Equal(t, []string{"canary", "frontend"}, reversed[1].Tags)
+	assert.Equal(t, conflicts[1].Fields, reversed[1].Fields)
+
+	canary.Priority = 10
+	mc, conflicts = MergeMachineTags([]string{"frontend", "canary", "logging"}, configurations)
+	assert.Equal(t, 0, len(conflicts))
+	assert.Equal(t, 3501, mc.Services["web"].Overwrites.EndpointPort)
+	assert.Equal(t, "canary", mc.HAProxyConfiguration.Template)
+	assert.Equal(t, "a", mc.HAProxyConfiguration.Certs["a.pem"])
+}
+
+func TestRefuseTagConflicts(t *testing.T) {
+	var ct Containrunner
+	ct.currentConfiguration.MachineConfiguration = testTagConfiguration(nil, "web")
+	ct.currentConfiguration.MachineConfiguration.HAProxyConfiguration = NewHAProxyConfiguration()
+	ct.currentConfiguration.MachineConfiguration.HAProxyConfiguration.Template = "current"
+
+	configuration := testTagConfiguration(nil, "comet")
+	ct.refuseTagConflicts(&configuration, []TagConflict{
+		{Part: "services/web", Tags: []string{"a", "b"}},
+		{Part: "services/fluentd", Tags: []string{"a", "b"}},
+		{Part: "haproxy_config", Tags: []string{"a", "b"}},
+	})
+
+	assert.Equal(t, 2, len(configuration.Services))
+	assert.NotNil(t, configuration.Services["web"])
+	assert.Equal(t, "current", configuration.HAProxyConfiguration.Template)
+}
+
+func TestLintMachineInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orbitctl-inventory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	oc := new(OrbitConfiguration)
+	oc.MachineConfigurations = make(map[string]MachineConfiguration)
+	oc.MachineConfigurations["frontend"] = testTagConfiguration(nil, "web")
+	canary := testTagConfiguration(nil, "web")
+	canary.Services["web"] = BoundService{Overwrites: &ServiceConfiguration{EndpointPort: 3501}}
+	oc.MachineConfigurations["canary"] = canary
+
+	writeLintTestFile(t, dir+"/inventory.json", `{
+	"10.0.0.1": ["frontend"],
+	"10.0.0.2": ["frontend", "canary"],
+	"10.0.0.3": ["frontend", "unknown"]
+}`)
+
+	problems := LintMachineInventory(oc, dir+"/inventory.json")
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("%d: %s", problem.Line, problem.Message))
+	}
+
+	assert.Equal(t, []string{
+		"3: machine 10.0.0.2: Tags frontend, canary define services/web differently (fields EndpointPort)",
+		"4: machine 10.0.0.3 has unknown tag 'unknown'",
+	}, messages)
+}
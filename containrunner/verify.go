@@ -3,8 +3,6 @@ package containrunner
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
-	etcd "github.com/coreos/etcd/client"
 )
 
 type MissingEtcdPathError struct {
@@ -35,34 +33,34 @@ func (c *Containrunner) VerifyAgainstLocalDirectory(directory string) error {
 }
 
 func (c *Containrunner) VerifyAgainstConfiguration(localoc *OrbitConfiguration) error {
-	etcdClient := GetEtcdClient(c.EtcdEndpoints)
+	store := c.GetConfigStore()
 
 	if localoc.MachineConfigurations != nil {
 		for tagName, machineConfiguration := range localoc.MachineConfigurations {
 
 			path := c.EtcdBasePath + "/machineconfigurations/tags/" + tagName
-			_, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+			_, err := store.List(path)
 			if err != nil {
 				return &MissingEtcdPathError{"etcd path missing: " + path}
 			}
 
 			if machineConfiguration.Services != nil {
 				path := c.EtcdBasePath + "/machineconfigurations/tags/" + tagName + "/services"
-				_, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+				_, err := store.List(path)
 				if err != nil {
 					return &MissingEtcdPathError{"etcd path missing: " + path}
 				}
 
 				for serviceName, boundServiceConfiguration := range machineConfiguration.Services {
 					path := c.EtcdBasePath + "/machineconfigurations/tags/" + tagName + "/services/" + serviceName
-					res, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+					res, err := store.List(path)
 					if err != nil {
 						return &MissingEtcdPathError{"etcd path missing: " + path}
 					}
 
 					var serviceConfiguration ServiceConfiguration
-					if res.Node.Value != "" && res.Node.Value != "{}" {
-						err = json.Unmarshal([]byte(res.Node.Value), &serviceConfiguration)
+					if res.Value != "" && res.Value != "{}" {
+						err = json.Unmarshal([]byte(res.Value), &serviceConfiguration)
 						if err != nil {
 							return &InvalidEtcdConfigFileError{"invalid json: " + path}
 						}
@@ -70,9 +68,8 @@ func (c *Containrunner) VerifyAgainstConfiguration(localoc *OrbitConfiguration)
 
 					if boundServiceConfiguration.Overwrites != nil {
 						if DeepEqual(serviceConfiguration, *boundServiceConfiguration.Overwrites) == false {
-							fmt.Printf("serviceConfiguration.Container: %+v\n", serviceConfiguration.Container)
-							fmt.Printf("          overwrites.Container: %+v\n", boundServiceConfiguration.Overwrites.Container)
-							fmt.Printf("tag service overwrite str: %s\n", res.Node.Value)
+							fmt.Printf("serviceConfiguration.Container: %+v\n", RedactServiceConfiguration(serviceConfiguration).Container)
+							fmt.Printf("          overwrites.Container: %+v\n", RedactServiceConfiguration(*boundServiceConfiguration.Overwrites).Container)
 
 							return &InvalidEtcdConfigFileError{"invalid content: " + path}
 						}
@@ -83,12 +80,12 @@ func (c *Containrunner) VerifyAgainstConfiguration(localoc *OrbitConfiguration)
 
 			if machineConfiguration.HAProxyConfiguration != nil {
 				path := c.EtcdBasePath + "/machineconfigurations/tags/" + tagName + "/haproxy_config"
-				res, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+				res, err := store.List(path)
 				if err != nil {
 					return &MissingEtcdPathError{"etcd path missing: " + path}
 				}
 
-				if string(res.Node.Value) != machineConfiguration.HAProxyConfiguration.Template {
+				if string(res.Value) != machineConfiguration.HAProxyConfiguration.Template {
 					return &InvalidEtcdConfigFileError{"invalid content: " + path}
 				}
 
@@ -101,21 +98,25 @@ func (c *Containrunner) VerifyAgainstConfiguration(localoc *OrbitConfiguration)
 	if localoc.Services != nil {
 		for serviceName, serviceConfig := range localoc.Services {
 			path := c.EtcdBasePath + "/services/" + serviceName
-			_, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+			_, err := store.List(path)
 			if err != nil {
 				return &MissingEtcdPathError{"etcd path missing: " + path}
 			}
 
 			path = c.EtcdBasePath + "/services/" + serviceName + "/config"
-			res, err := etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: true})
+			res, err := store.List(path)
 			if err != nil {
 				return &MissingEtcdPathError{"etcd path missing: " + path}
 			}
 
 			bytes, err := json.Marshal(serviceConfig)
-			if res.Node.Value != string(bytes) {
-				fmt.Printf("marshalled config: %s\n", bytes)
-				fmt.Printf("res.Node   config: %s\n", res.Node.Value)
+			if res.Value != string(bytes) {
+				var storeConfig ServiceConfiguration
+				json.Unmarshal([]byte(res.Value), &storeConfig)
+				redacted, _ := json.Marshal(RedactServiceConfiguration(serviceConfig))
+				fmt.Printf("marshalled config: %s\n", redacted)
+				redacted, _ = json.Marshal(RedactServiceConfiguration(storeConfig))
+				fmt.Printf("res.Node   config: %s\n", redacted)
 				return &InvalidEtcdConfigFileError{"invalid content: " + path}
 			}
 			//c.Assert(res.Node.Value, Equals, `HTTP/1.0 500 Service Unavailable
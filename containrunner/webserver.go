@@ -42,17 +42,37 @@ func (ce *Webserver) checkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Returns all services as json. If the daemon is running with a stale configuration (etcd is not
+// available) then the services are taken from the current machine configuration and the response
+// has X-Orbit-Stale-Configuration header which tells when the configuration was loaded from etcd.
 func (ce *Webserver) statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Service", "orbit")
 	w.Header().Set("Content-type", "text/javascript")
+
+	stale, loadedAt := ce.Containrunner.IsConfigurationStale()
+	if stale {
+		w.Header().Set("X-Orbit-Stale-Configuration", loadedAt.Format(time.RFC3339))
+	}
+
 	services, err := ce.Containrunner.GetAllServices(nil)
-	if err != nil {
+	if err != nil && stale {
+		services = make(map[string]ServiceConfiguration)
+		for name, boundService := range ce.Containrunner.getCurrentConfiguration().MachineConfiguration.Services {
+			services[name] = boundService.GetConfig()
+		}
+	} else if err != nil {
 		http.Error(w, "GetAllServices error: "+err.Error(), 500)
+		return
+	}
+
+	for name, service := range services {
+		services[name] = RedactServiceConfiguration(service)
 	}
 
 	bytes, err := json.Marshal(services)
 	if err != nil {
 		http.Error(w, "json.Marshall error: "+err.Error(), 500)
+		return
 	}
 
 	w.Write(bytes)
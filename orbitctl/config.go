@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var configHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}.
+
+USAGE:
+   {{.Name}} history
+			List configuration generations
+
+   {{.Name}} rollback <generation> [--message message]
+			Restore the configuration of an older generation
+
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "config",
+			Usage: "Manage configuration generations",
+			Action: func(c *cli.Context) {
+				cli.HelpPrinter(configHelpTemplate, c.App)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "history",
+					Usage: "List configuration generations",
+					Action: func(c *cli.Context) {
+						generations, err := containrunnerInstance.GetConfigurationGenerations(nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						active, err := containrunnerInstance.GetActiveGeneration(nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						fmt.Fprintf(out, "\tGENERATION\tTIME\tUSER\tCOMMIT\tMESSAGE\n")
+						for _, generation := range generations {
+							marker := ""
+							if generation.Generation == active {
+								marker = "*"
+							}
+							commit := generation.GitCommit
+							if len(commit) > 10 {
+								commit = commit[0:10]
+							}
+							fmt.Fprintf(out, "%s\t%d\t%s\t%s\t%s\t%s\n", marker, generation.Generation, generation.Time.Format(time.RFC3339), generation.User, commit, generation.Message)
+						}
+						out.Flush()
+					},
+				},
+				{
+					Name:  "rollback",
+					Usage: "Restore the configuration of an older generation",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "message, m",
+							Value: "",
+							Usage: "Message which is stored with the new configuration generation",
+						},
+					},
+					Action: func(c *cli.Context) {
+						rollbackTo, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.HelpPrinter(configHelpTemplate, c.App)
+							os.Exit(1)
+						}
+
+						err = checkEnvironmentWritable()
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						generation, err := containrunnerInstance.RollbackConfigurationGeneration(rollbackTo, newConfigurationGeneration(c.String("message")), nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						fmt.Printf("Rolled back to generation %d. Configuration generation %d is now active\n", rollbackTo, generation.Generation)
+					},
+				},
+			},
+		})
+}
+
+func newConfigurationGeneration(message string) containrunner.ConfigurationGeneration {
+	generation := containrunner.ConfigurationGeneration{}
+	generation.Message = message
+	generation.Time = time.Now()
+
+	user, err := user.Current()
+	if err == nil {
+		generation.User = user.Username
+	}
+
+	return generation
+}
+
+// Returns the git commit of the directory or an empty string if it's not inside a git repository.
+func getGitCommit(path string) string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = path
+
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 func init() {
@@ -15,6 +18,17 @@ func init() {
 			Action: func(c *cli.Context) {
 
 				containrunnerInstance.Start()
+
+				// Remove the endpoints of this machine before exiting so that the loadbalancers
+				// don't need to wait for the endpoint TTL. The containers are left running.
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+				go func() {
+					sig := <-signals
+					containrunnerInstance.Shutdown("got signal " + sig.String())
+					os.Exit(0)
+				}()
+
 				containrunnerInstance.Wait()
 
 			},
@@ -38,6 +52,11 @@ func init() {
 				containrunnerInstance.HAProxySettings.HAProxyBinary = c.String("haproxy-binary")
 				containrunnerInstance.HAProxySettings.HAProxyReloadCommand = c.String("haproxy-reload-command")
 				containrunnerInstance.HAProxySettings.HAProxySocket = c.String("haproxy-socket")
+				containrunnerInstance.StateFile = c.String("state-file")
+				containrunnerInstance.SecretKeyFile = c.String("secret-key-file")
+				containrunnerInstance.DrainPeriodInSeconds = c.Int("drain-period")
+				containrunnerInstance.DNSAddress = c.String("dns-address")
+				containrunnerInstance.DNSTTL = c.Int("dns-ttl")
 
 				fmt.Printf("Settings: %+v\n", containrunnerInstance)
 				return nil
@@ -83,6 +102,35 @@ func init() {
 					Value: "/etc/init.d/haproxy reload",
 					Usage: "Command to reload haproxy",
 				},
+				cli.StringFlag{
+					Name:   "state-file",
+					Value:  "/var/lib/orbitctl/state.json",
+					Usage:  "File where the last known good configuration is stored. Used when etcd is not available. Empty value disables",
+					EnvVar: "ORBITCTL_STATE_FILE",
+				},
+				cli.IntFlag{
+					Name:   "drain-period",
+					Value:  0,
+					Usage:  "Seconds to wait on SIGTERM after the endpoints of this machine have been removed, so that the loadbalancers can finish their requests",
+					EnvVar: "ORBITCTL_DRAIN_PERIOD",
+				},
+				cli.StringFlag{
+					Name:   "dns-address",
+					Value:  "",
+					Usage:  "Address (for example 127.0.0.1:8600) where the service discovery DNS server listens on UDP and TCP. Empty value disables",
+					EnvVar: "ORBITCTL_DNS_ADDRESS",
+				},
+				cli.IntFlag{
+					Name:  "dns-ttl",
+					Value: 5,
+					Usage: "TTL in seconds of the service discovery DNS records",
+				},
+				cli.StringFlag{
+					Name:   "secret-key-file",
+					Value:  "/etc/orbitctl/secret.key",
+					Usage:  "File with the cluster key which decrypts the secrets referenced by the services",
+					EnvVar: "ORBITCTL_SECRET_KEY_FILE",
+				},
 				cli.StringFlag{
 					Name:  "haproxy-socket",
 					Value: "/var/run/haproxy/admin*.sock",
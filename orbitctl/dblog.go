@@ -18,9 +18,9 @@ func init() {
 					return
 				}
 
-				etcdClient := containrunner.GetEtcdClient(containrunnerInstance.EtcdEndpoints)
+				store := containrunnerInstance.GetConfigStore()
 
-				globalConfiguration, err := containrunnerInstance.GetGlobalOrbitProperties(etcdClient)
+				globalConfiguration, err := containrunnerInstance.GetGlobalOrbitProperties(store)
 				if err != nil {
 					fmt.Printf("Could not get global orbit properties")
 					return
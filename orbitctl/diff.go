@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+)
+
+var diffHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+USAGE:
+   {{.Name}} [--json] [path to local directory tree]
+
+   Exit status is 0 if etcd matches the local tree, 1 if there are differences and 2 on errors.
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "diff",
+			Usage: "Show all differences between a local directory tree and etcd",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the differences as json",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					cli.HelpPrinter(diffHelpTemplate, c.App)
+					return errors.New("local path is missing")
+				}
+
+				return nil
+			},
+			Action: func(c *cli.Context) {
+				differences, err := containrunnerInstance.DiffAgainstLocalDirectory(c.Args().First(), nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(2)
+				}
+
+				if c.Bool("json") {
+					bytes, err := containrunner.FormatConfigurationDifferencesJSON(differences)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(2)
+					}
+					fmt.Printf("%s\n", bytes)
+				} else {
+					for _, difference := range differences {
+						fmt.Printf("%s %s\n", difference.Type, difference.Key)
+						for _, field := range difference.Fields {
+							fmt.Printf("    %s: etcd %s, local %s\n", fieldName(field.Field), jsonString(field.Etcd), jsonString(field.Local))
+						}
+						if difference.Diff != "" {
+							fmt.Printf("%s", difference.Diff)
+						}
+					}
+				}
+
+				if len(differences) > 0 {
+					if !c.Bool("json") {
+						fmt.Fprintf(os.Stderr, "%d differences found\n", len(differences))
+					}
+					os.Exit(1)
+				}
+			},
+		})
+}
+
+func fieldName(field string) string {
+	if field == "" {
+		return "(value)"
+	}
+	return field
+}
+
+func jsonString(v interface{}) string {
+	if v == nil {
+		return "(missing)"
+	}
+
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+
+	return string(bytes)
+}
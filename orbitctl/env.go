@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"os"
+)
+
+var envHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}.
+
+USAGE:
+   {{.Name}} list
+			List environments
+
+   {{.Name}} protect <env>
+			Require an explicit --env for commands which change the environment
+
+   {{.Name}} unprotect <env>
+			Remove the protection
+
+
+`
+
+var promoteHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+USAGE:
+   {{.Name}} <service> --from <env> --to <env>
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "env",
+			Usage: "Manage environments",
+			Action: func(c *cli.Context) {
+				cli.HelpPrinter(envHelpTemplate, c.App)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List environments",
+					Action: func(c *cli.Context) {
+						environments, err := containrunnerInstance.GetEnvironments(nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						fmt.Fprintf(out, "\tENVIRONMENT\tPROTECTED\n")
+						for _, environment := range environments {
+							marker := ""
+							if environment.Name == containrunnerInstance.Environment {
+								marker = "*"
+							}
+							fmt.Fprintf(out, "%s\t%s\t%t\n", marker, environment.Name, environment.Protected)
+						}
+						out.Flush()
+					},
+				},
+				{
+					Name:  "protect",
+					Usage: "Require an explicit --env for commands which change the environment",
+					Action: func(c *cli.Context) {
+						setEnvironmentProtection(c, true)
+					},
+				},
+				{
+					Name:  "unprotect",
+					Usage: "Remove the protection of an environment",
+					Action: func(c *cli.Context) {
+						setEnvironmentProtection(c, false)
+					},
+				},
+			},
+		},
+		cli.Command{
+			Name:  "promote",
+			Usage: "Copy a service revision from one environment into another",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: "",
+					Usage: "Environment where the revision is copied from",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Value: "",
+					Usage: "Environment where the revision is copied to",
+				},
+			},
+			Action: func(c *cli.Context) {
+				service := c.Args().First()
+				from := c.String("from")
+				to := c.String("to")
+				if service == "" || from == "" || to == "" {
+					cli.HelpPrinter(promoteHelpTemplate, c.App)
+					os.Exit(1)
+				}
+
+				revision, err := containrunnerInstance.GetEnvironmentServiceRevision(service, from, nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				current, err := containrunnerInstance.GetEnvironmentServiceRevision(service, to, nil)
+				if err == nil {
+					fmt.Printf("Service %s in %s is currently at revision %s\n", service, to, current.Revision)
+				}
+
+				fmt.Printf("Promoting service %s revision %s from %s to %s\n", service, revision.Revision, from, to)
+				if !confirm(fmt.Sprintf("Are you sure you want to deploy %s with this revision into %s? (y/N) ", service, to)) {
+					fmt.Printf("Abort!\n")
+					os.Exit(1)
+				}
+
+				promoted, err := containrunnerInstance.PromoteServiceRevision(service, from, to, revision.Revision, nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("Service %s in %s is now at revision %s\n", service, to, promoted.Revision)
+			},
+		})
+}
+
+func setEnvironmentProtection(c *cli.Context, protected bool) {
+	env := c.Args().First()
+	if env == "" {
+		cli.HelpPrinter(envHelpTemplate, c.App)
+		os.Exit(1)
+	}
+
+	configuration, err := containrunnerInstance.GetEnvironmentConfiguration(env, nil)
+	if err == nil {
+		configuration.Protected = protected
+		err = containrunnerInstance.SetEnvironmentConfiguration(env, configuration, nil)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Returns an error if the current environment is protected and it was not given explicitly
+// on the command line with --env. Setting the environment with ORBITCTL_ENV is not enough, so
+// that an exported variable in a shell can't accidentally change production.
+func checkEnvironmentWritable() error {
+	if containrunnerInstance.Environment == "" || globalFlags.EnvExplicit {
+		return nil
+	}
+
+	configuration, err := containrunnerInstance.GetEnvironmentConfiguration(containrunnerInstance.Environment, nil)
+	if err != nil {
+		return err
+	}
+
+	if configuration.Protected {
+		return fmt.Errorf("Environment %s is protected. Give --env %s explicitly on the command line", containrunnerInstance.Environment, containrunnerInstance.Environment)
+	}
+
+	return nil
+}
+
+// Asks a yes/no question. Always true with --force.
+func confirm(question string) bool {
+	if globalFlags.Force {
+		return true
+	}
+
+	fmt.Printf("%s", question)
+	bytes, _ := bufio.NewReader(os.Stdin).ReadBytes('\n')
+	return len(bytes) > 0 && (bytes[0] == 'y' || bytes[0] == 'Y')
+}
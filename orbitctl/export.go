@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+	"strings"
+)
+
+var exportHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+USAGE:
+   {{.Name}} [--revisions file] [export path for orbit configuration]
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "export",
+			Usage: "Export orbit configuration from etcd into a directory tree",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "revisions",
+					Value: "",
+					Usage: "Also write a snapshot of the current service revisions into this file",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					cli.HelpPrinter(exportHelpTemplate, c.App)
+					return errors.New("export path is missing")
+				}
+
+				return nil
+			},
+			Action: func(c *cli.Context) {
+				path := c.Args().First()
+
+				replaced, err := containrunner.ExportReplacedPaths(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+				if len(replaced) > 0 && !confirm(fmt.Sprintf("Export replaces %s and deletes the files which are not in etcd. Continue? (y/N) ", strings.Join(replaced, ", "))) {
+					fmt.Fprintf(os.Stderr, "Export cancelled\n")
+					os.Exit(1)
+				}
+
+				fmt.Printf("export to %s\n", path)
+
+				err = containrunnerInstance.ExportToLocalDirectory(path, c.String("revisions"))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+			},
+		})
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"io/ioutil"
 	"os"
 )
 
@@ -19,7 +22,33 @@ func init() {
 		cli.Command{
 			Name:  "import",
 			Usage: "Import orbit configurations from directory tree",
-			Flags: nil,
+			Flags: []cli.Flag{
+				cli.BoolTFlag{
+					Name:  "prune",
+					Usage: "Delete keys from etcd which do not exists any more in the directory tree. Use --prune=false to disable",
+				},
+				cli.StringFlag{
+					Name:  "env",
+					Value: "",
+					Usage: "Environment where the configuration is imported. Overrides the global --env",
+				},
+				cli.StringFlag{
+					Name:  "message, m",
+					Value: "",
+					Usage: "Message which is stored with the new configuration generation",
+				},
+				cli.StringFlag{
+					Name:  "secrets",
+					Value: "",
+					Usage: "JSON file with the plain text values of the secrets (\"db/password\": \"...\"). Keep it out of git",
+				},
+				cli.StringFlag{
+					Name:   "secret-key-file",
+					Value:  "",
+					Usage:  "File with the cluster key which encrypts the secrets. Required with --secrets",
+					EnvVar: "ORBITCTL_SECRET_KEY_FILE",
+				},
+			},
 			Before: func(c *cli.Context) error {
 				if c.Args().First() == "" {
 					cli.HelpPrinter(importHelpTemplate, c.App)
@@ -30,7 +59,23 @@ func init() {
 			},
 			Action: func(c *cli.Context) {
 				path := c.Args()[1]
-				fmt.Printf("import from %s\n", path)
+
+				if c.String("env") != "" {
+					err := containrunnerInstance.SetEnvironment(c.String("env"))
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+					globalFlags.EnvExplicit = true
+				}
+
+				err := checkEnvironmentWritable()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("import from %s into %s\n", path, containrunnerInstance.EtcdBasePath)
 
 				orbitConfiguration, err := containrunnerInstance.LoadOrbitConfigurationFromFiles(path)
 				if err != nil {
@@ -38,13 +83,58 @@ func init() {
 					os.Exit(1)
 				}
 
-				err = containrunnerInstance.UploadOrbitConfigurationToEtcd(orbitConfiguration, nil)
+				err = importSecrets(orbitConfiguration, c.String("secrets"), c.String("secret-key-file"))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				generation := newConfigurationGeneration(c.String("message"))
+				generation.GitCommit = getGitCommit(path)
+
+				generation, err = containrunnerInstance.ImportOrbitConfiguration(orbitConfiguration, generation, c.BoolT("prune"), nil)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
 					os.Exit(1)
 				} else {
+					fmt.Printf("Configuration generation %d is now active\n", generation.Generation)
 					fmt.Printf("NOTICE! New configure uploaded, but there's currently no feedback in case of haproxy config errors\nYou need to ssh into a loadbalancer and tail -f /var/log/upstart/orbitctl.log to catch any hidden problems.\n")
 				}
 			},
 		})
 }
+
+// Encrypts and uploads the secrets from the secrets file. Without the file this only checks that
+// the secrets referenced by the configuration already exist.
+func importSecrets(orbitConfiguration *containrunner.OrbitConfiguration, filename string, keyFile string) error {
+	secrets := make(map[string]string)
+	var key []byte
+
+	if filename != "" {
+		if keyFile == "" {
+			return errors.New("--secret-key-file is required with --secrets")
+		}
+
+		var err error
+		key, err = containrunner.LoadSecretKey(keyFile)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(data, &secrets)
+		if err != nil {
+			return fmt.Errorf("Invalid secrets file %s: %v", filename, err)
+		}
+	}
+
+	written, err := containrunnerInstance.ImportSecrets(orbitConfiguration, secrets, key, nil)
+	for _, name := range written {
+		fmt.Printf("Updated secret %s\n", name)
+	}
+	return err
+}
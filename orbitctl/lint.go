@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+)
+
+var lintHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+USAGE:
+   {{.Name}} [--inventory inventory.json] [path to local directory tree]
+
+   With --inventory the tags of every machine in the inventory file are also
+   checked for conflicts. The file maps machines into their tags, for example
+   {"10.0.0.1": ["frontend-a", "logging"]}
+
+   Exit status is 0 if no problems were found and 1 otherwise.
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "lint",
+			Usage: "Validate orbit configuration directory tree without touching etcd",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "inventory",
+					Value: "",
+					Usage: "Machine inventory file whose tag combinations are checked for conflicts",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if c.Args().First() == "" {
+					cli.HelpPrinter(lintHelpTemplate, c.App)
+					return errors.New("local path is missing")
+				}
+
+				return nil
+			},
+			Action: func(c *cli.Context) {
+				problems := containrunner.LintOrbitConfigurationTree(c.Args().First())
+
+				// The tree can be loaded only if it's valid
+				if c.String("inventory") != "" && len(problems) == 0 {
+					oc, err := containrunnerInstance.LoadOrbitConfigurationFromFiles(c.Args().First())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+
+					problems = containrunner.LintMachineInventory(oc, c.String("inventory"))
+				}
+				for _, problem := range problems {
+					fmt.Printf("%s\n", problem)
+				}
+
+				if len(problems) > 0 {
+					fmt.Fprintf(os.Stderr, "%d problems found\n", len(problems))
+					os.Exit(1)
+				}
+			},
+		})
+}
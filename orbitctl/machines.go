@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+var machineHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+
+USAGE:
+   {{.Name}} <ip>
+			Show the machine details
+
+   {{.Name}} <ip> drain
+			Remove the endpoints of the machine and stop its checks. The containers keep running
+
+   {{.Name}} <ip> undrain
+			Start serving the endpoints of the machine again
+
+   {{.Name}} <ip> forget
+			Remove a machine which doesn't exist any more
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "machines",
+			Usage: "List the machines which run the orbitctl daemon",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "tag",
+					Value: "",
+					Usage: "List only machines which have this tag",
+				},
+			},
+			Action: func(c *cli.Context) {
+				machines, err := containrunnerInstance.GetMachines(nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				fmt.Fprintf(out, "ADDRESS\tSTATE\tTAGS\tZONE\tVERSION\tUPTIME\tLAST CONVERGE\n")
+				for _, machine := range machines {
+					if c.String("tag") != "" && !machine.HasTag(c.String("tag")) {
+						continue
+					}
+
+					fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", machine.Address, machineState(machine),
+						strings.Join(machine.Tags, ","), machine.AvailabilityZone, machine.Version,
+						formatDuration(machine.Uptime()), convergeResult(machine.MachineInfo))
+				}
+				out.Flush()
+			},
+		})
+
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "machine",
+			Usage: "Show or manage a single machine",
+			Action: func(c *cli.Context) {
+				address := c.Args().First()
+				if address == "" {
+					cli.HelpPrinter(machineHelpTemplate, c.App)
+					os.Exit(1)
+				}
+
+				machine, err := containrunnerInstance.GetMachine(address, nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+				if machine == nil {
+					fmt.Fprintf(os.Stderr, "Error: machine %s is not known\n", address)
+					os.Exit(1)
+				}
+
+				switch c.Args().Get(1) {
+				case "drain", "undrain", "forget":
+					err = checkEnvironmentWritable()
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+				}
+
+				switch c.Args().Get(1) {
+				case "":
+					request, err := containrunnerInstance.GetMachineDrainRequest(address, nil)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+					printMachine(*machine, request)
+				case "drain":
+					request := containrunner.DrainRequest{RequestedAt: time.Now()}
+					user, err := user.Current()
+					if err == nil {
+						request.User = user.Username
+					}
+					err = containrunnerInstance.RequestMachineDrain(address, request, nil)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+					fmt.Printf("Machine %s will drain within a few seconds\n", address)
+					if !machine.Alive {
+						fmt.Printf("Warning! The machine has no heartbeat, it will drain when its daemon is running again\n")
+					}
+				case "undrain":
+					err = containrunnerInstance.CancelMachineDrain(address, nil)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+					fmt.Printf("Machine %s will start serving its endpoints again\n", address)
+				case "forget":
+					if machine.Alive && !globalFlags.Force {
+						fmt.Fprintf(os.Stderr, "Error: machine %s is still alive. Use --force to forget it anyway\n", address)
+						os.Exit(1)
+					}
+					err = containrunnerInstance.ForgetMachine(address, nil)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+						os.Exit(1)
+					}
+					fmt.Printf("Machine %s forgotten\n", address)
+				default:
+					cli.HelpPrinter(machineHelpTemplate, c.App)
+					os.Exit(1)
+				}
+			},
+		})
+}
+
+func printMachine(machine containrunner.MachineStatus, drainRequest *containrunner.DrainRequest) {
+	fmt.Fprintf(out, "Address:\t%s\n", machine.Address)
+	fmt.Fprintf(out, "State:\t%s\n", machineState(machine))
+	if drainRequest != nil {
+		fmt.Fprintf(out, "Drain requested:\tby %s at %s\n", drainRequest.User, drainRequest.RequestedAt.Format(time.RFC3339))
+	}
+	if !machine.LeftAt.IsZero() {
+		fmt.Fprintf(out, "Left at:\t%s\n", machine.LeftAt.Format(time.RFC3339))
+	}
+	if !machine.LastHeartbeat.IsZero() {
+		fmt.Fprintf(out, "Last heartbeat:\t%s (%s ago)\n", machine.LastHeartbeat.Format(time.RFC3339), formatDuration(time.Since(machine.LastHeartbeat)))
+	}
+	fmt.Fprintf(out, "Tags:\t%s\n", strings.Join(machine.Tags, ", "))
+	fmt.Fprintf(out, "Availability zone:\t%s\n", machine.AvailabilityZone)
+	fmt.Fprintf(out, "Services:\t%s\n", strings.Join(machine.Services, ", "))
+	fmt.Fprintf(out, "Orbitctl version:\t%s\n", machine.Version)
+	fmt.Fprintf(out, "Docker version:\t%s\n", machine.DockerVersion)
+	fmt.Fprintf(out, "HAProxy version:\t%s\n", machine.HAProxyVersion)
+	fmt.Fprintf(out, "Uptime:\t%s\n", formatDuration(machine.Uptime()))
+	if !machine.LastConverge.IsZero() {
+		fmt.Fprintf(out, "Last converge:\t%s (%s ago)\n", machine.LastConverge.Format(time.RFC3339), formatDuration(time.Since(machine.LastConverge)))
+	}
+	fmt.Fprintf(out, "Last converge result:\t%s\n", convergeResult(machine.MachineInfo))
+	out.Flush()
+}
+
+func machineState(machine containrunner.MachineStatus) string {
+	if !machine.Alive && !machine.LeftAt.IsZero() {
+		return "left"
+	} else if !machine.Alive {
+		return "MISSING"
+	} else if machine.Draining {
+		return "draining"
+	}
+	return "alive"
+}
+
+func convergeResult(machine containrunner.MachineInfo) string {
+	if machine.LastConvergeError != "" {
+		return "error: " + machine.LastConvergeError
+	}
+	if machine.LastConverge.IsZero() {
+		return "-"
+	}
+	return "ok"
+}
+
+func formatDuration(d time.Duration) string {
+	return (d / time.Second * time.Second).String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+	"strings"
+)
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "migrate-v2-to-v3",
+			Usage: "Copy the orbit data from the etcd v2 api into the etcd v3 api",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target-endpoint",
+					Value: "",
+					Usage: "etcd v3 endpoint as http://host:port[,http://host:port] string. Defaults to --etcd-endpoint. The same etcd certificates and credentials are used",
+				},
+			},
+			Action: func(c *cli.Context) {
+				endpoints := containrunnerInstance.EtcdEndpoints
+				if c.String("target-endpoint") != "" {
+					endpoints = strings.Split(c.String("target-endpoint"), ",")
+				}
+
+				from := containrunner.NewEtcdConfigStore(containrunnerInstance.EtcdEndpoints, containrunnerInstance.EtcdSecurity)
+				to := containrunner.NewEtcdV3ConfigStore(endpoints, containrunnerInstance.EtcdSecurity)
+
+				copied, err := containrunnerInstance.MigrateConfigStore(from, to, globalFlags.Force)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				fmt.Printf("Copied %d keys into etcd v3 at %s\n", copied, strings.Join(endpoints, ","))
+			},
+		})
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/garo/orbitcontrol/containrunner"
@@ -36,6 +37,7 @@ var (
 		EtcdEndpoint string
 		EtcdBasePath string
 		Force        bool
+		EnvExplicit  bool // --env was given on the command line (not with ORBITCTL_ENV)
 	}{}
 
 	containrunnerInstance containrunner.Containrunner
@@ -110,14 +112,91 @@ func main() {
 			Usage:  "Disable sleep before container start",
 			EnvVar: "ORBITCTL_NO_SLEEP",
 		},
+		cli.StringFlag{
+			Name:   "env",
+			Usage:  "Environment to use. The data is then kept under [etcd-base-path]/[env]",
+			EnvVar: "ORBITCTL_ENV",
+		},
+		cli.StringFlag{
+			Name:   "etcd-api",
+			Value:  "v2",
+			Usage:  "etcd api version to use: v2 or v3",
+			EnvVar: "ORBITCTL_ETCD_API",
+		},
+		cli.StringFlag{
+			Name:   "store-dir",
+			Usage:  "Keep the orbit data in this local directory instead of etcd (standalone mode)",
+			EnvVar: "ORBITCTL_STORE_DIR",
+		},
 		etcdBasePathFlag,
 		etcdEndpointFlag,
+		cli.StringFlag{
+			Name:   "etcd-ca-file",
+			Usage:  "PEM file of the CA which signed the etcd server certificates. Used with https:// endpoints",
+			EnvVar: "ORBITCTL_ETCD_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "etcd-cert-file",
+			Usage:  "PEM file of the client certificate for etcd mutual TLS",
+			EnvVar: "ORBITCTL_ETCD_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "etcd-key-file",
+			Usage:  "PEM file of the key of --etcd-cert-file",
+			EnvVar: "ORBITCTL_ETCD_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "etcd-username",
+			Usage:  "Username for etcd authentication",
+			EnvVar: "ORBITCTL_ETCD_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "etcd-password",
+			Usage:  "Password for etcd authentication. Prefer the environment variable over the command line",
+			EnvVar: "ORBITCTL_ETCD_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "docker-config",
+			Usage:  "Docker config.json with the registry credentials. Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json",
+			EnvVar: "ORBITCTL_DOCKER_CONFIG",
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
 
 		containrunnerInstance.EtcdEndpoints = strings.Split(c.String("etcd-endpoint"), ",")
 		containrunnerInstance.EtcdBasePath = c.String("etcd-base-path")
+		containrunnerInstance.EtcdSecurity = containrunner.EtcdSecurity{
+			CAFile:   c.String("etcd-ca-file"),
+			CertFile: c.String("etcd-cert-file"),
+			KeyFile:  c.String("etcd-key-file"),
+			Username: c.String("etcd-username"),
+			Password: c.String("etcd-password"),
+		}
+
+		// Fail here instead of when the etcd client is created
+		_, err := containrunnerInstance.EtcdSecurity.TLSConfig()
+		if err != nil {
+			return err
+		}
+		containrunnerInstance.Version = builddate
+		containrunnerInstance.DockerConfigFile = c.String("docker-config")
+
+		if c.String("env") != "" {
+			err := containrunnerInstance.SetEnvironment(c.String("env"))
+			if err != nil {
+				return err
+			}
+			globalFlags.EnvExplicit = c.IsSet("env")
+		}
+
+		if c.String("store-dir") != "" {
+			containrunnerInstance.ConfigStore = containrunner.NewDirectoryConfigStore(c.String("store-dir"))
+		} else if c.String("etcd-api") == "v3" {
+			containrunnerInstance.ConfigStore = containrunner.NewEtcdV3ConfigStore(containrunnerInstance.EtcdEndpoints, containrunnerInstance.EtcdSecurity)
+		} else if c.String("etcd-api") != "v2" {
+			return fmt.Errorf("Unknown --etcd-api %s", c.String("etcd-api"))
+		}
 
 		globalFlags.Force = c.Bool("force")
 
@@ -143,8 +222,8 @@ func main() {
 			containrunnerInstance.NoSleep = true
 		}
 
-		// dblog is a special case which doesn't want the containrunner to be initiated.
-		if len(c.Args()) > 0 && c.Args()[0] != "dblog" {
+		// dblog and lint are special cases which don't want the containrunner to be initiated.
+		if len(c.Args()) > 0 && c.Args()[0] != "dblog" && c.Args()[0] != "lint" {
 			containrunnerInstance.Init()
 		}
 
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/garo/orbitcontrol/containrunner"
+	"os"
+)
+
+var secretsHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}.
+
+USAGE:
+   {{.Name}} list
+			List the names of the stored secrets
+
+   {{.Name}} genkey
+			Print a new random cluster key for the --secret-key-file
+
+`
+
+func init() {
+	app.Commands = append(app.Commands,
+		cli.Command{
+			Name:  "secrets",
+			Usage: "Manage encrypted secrets",
+			Action: func(c *cli.Context) {
+				cli.HelpPrinter(secretsHelpTemplate, c.App)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List the names of the stored secrets",
+					Action: func(c *cli.Context) {
+						names, err := containrunnerInstance.GetSecretNames(nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+						for _, name := range names {
+							fmt.Println(name)
+						}
+					},
+				},
+				{
+					Name:  "genkey",
+					Usage: "Print a new random cluster key for the --secret-key-file",
+					Action: func(c *cli.Context) {
+						key, err := containrunner.GenerateSecretKey()
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+						fmt.Println(key)
+					},
+				},
+			},
+		})
+}
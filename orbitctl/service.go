@@ -45,6 +45,19 @@ USAGE:
    {{.Name}} [service name] set revision <revision> on machine <ip>
    			Set service revision for particular machine
 
+   {{.Name}} [service name] history
+			Lists the latest revision changes
+
+   {{.Name}} [service name] rollback [steps|revision]
+			Set the service revision back to an earlier revision from the history. Defaults to one step back
+
+   {{.Name}} [service name] deploy [--batch-size n] [--message text] [--pause seconds] [--timeout seconds] <revision>
+			Set service revision machine by machine, waiting for each batch to become healthy
+
+   {{.Name}} [service name] canary (--count n | --percent p) [--bake seconds] <revision>
+			Set service revision on a few machines, compare their health against the rest
+			for the bake period and then either promote the revision or roll the canaries back
+
 
 `
 
@@ -85,6 +98,208 @@ func init() {
 				}
 			},
 		},
+		{
+			Name:     "history",
+			HideHelp: true,
+			Action: func(c *cli.Context) {
+				history, err := containrunnerInstance.GetServiceRevisionHistory(c.App.Name, nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				if len(history) == 0 {
+					fmt.Printf("Service %s has no revision history\n", c.App.Name)
+					return
+				}
+
+				fmt.Fprintf(out, "Step\tTime\tRevision\tUser\tMessage\n")
+				for i, revision := range history {
+					fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\n", i, revision.DeploymentTime.Format(time.RFC3339), revision.Revision, revision.User, revision.Message)
+				}
+				out.Flush()
+			},
+		},
+		{
+			Name:     "rollback",
+			HideHelp: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "message, m",
+					Value: "",
+					Usage: "Message which is stored with the revision in the revision history",
+				},
+			},
+			Action: func(c *cli.Context) {
+				name := c.App.Name
+
+				target := "1"
+				if len(c.Args()) > 0 {
+					target = c.Args()[0]
+				}
+
+				revision, err := containrunnerInstance.FindServiceRevisionInHistory(name, target, nil)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+					os.Exit(1)
+				}
+
+				message := c.String("message")
+				if message == "" {
+					message = "Rollback to " + revision.Revision
+				}
+
+				t := &oauth.Transport{
+					Token: &oauth.Token{AccessToken: c.GlobalString("github-token")},
+				}
+				githubClient := github.NewClient(t.Client())
+
+				retval, serviceConfiguration := getServiceInfo(name, githubClient)
+				if retval != 0 {
+					os.Exit(retval)
+				}
+
+				fmt.Printf("Rolling back service %s to revision %s which was set at %s by %s\n\n", name, revision.Revision, revision.DeploymentTime.Format(time.RFC3339), revision.User)
+
+				retval = setServiceRevision(name, revision.Revision, "", message, serviceConfiguration, githubClient)
+				if retval != 0 {
+					os.Exit(retval)
+				}
+
+				deploymentEvent := containrunner.DeploymentEvent{}
+				deploymentEvent.Action = "Rollback"
+				deploymentEvent.Service = name
+				deploymentEvent.Revision = revision.Revision
+				deploymentEvent.Reason = message
+				user, err := user.Current()
+				if err == nil {
+					deploymentEvent.User = user.Username
+				}
+				if containrunnerInstance.Events != nil {
+					containrunnerInstance.Events.PublishOrbitEvent(containrunner.NewOrbitEvent(deploymentEvent))
+				}
+			},
+		},
+		{
+			Name:     "deploy",
+			HideHelp: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "message, m",
+					Value: "",
+					Usage: "Message which is stored with the revision in the revision history",
+				},
+				cli.IntFlag{
+					Name:  "batch-size",
+					Value: 1,
+					Usage: "Number of machines updated at the same time",
+				},
+				cli.IntFlag{
+					Name:  "pause",
+					Value: 0,
+					Usage: "Seconds to wait after a batch is healthy before starting the next one",
+				},
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: 300,
+					Usage: "Seconds to wait for a batch to report the new revision before halting the deployment",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					cli.HelpPrinter(serviceHelpTemplate, c.App)
+					os.Exit(1)
+				}
+
+				t := &oauth.Transport{
+					Token: &oauth.Token{AccessToken: c.GlobalString("github-token")},
+				}
+				githubClient := github.NewClient(t.Client())
+
+				retval, serviceConfiguration := getServiceInfo(c.App.Name, githubClient)
+				if retval != 0 {
+					os.Exit(retval)
+				}
+
+				deployment := containrunner.RollingDeployment{
+					Service:      c.App.Name,
+					Revision:     containrunner.ServiceRevision{Revision: c.Args()[0], Message: c.String("message")},
+					BatchSize:    c.Int("batch-size"),
+					Pause:        time.Duration(c.Int("pause")) * time.Second,
+					BatchTimeout: time.Duration(c.Int("timeout")) * time.Second,
+				}
+
+				os.Exit(deployServiceRevision(deployment, serviceConfiguration, githubClient))
+			},
+		},
+		{
+			Name:     "canary",
+			HideHelp: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "message, m",
+					Value: "",
+					Usage: "Message which is stored with the revision in the revision history",
+				},
+				cli.IntFlag{
+					Name:  "count",
+					Usage: "Number of canary machines",
+				},
+				cli.Float64Flag{
+					Name:  "percent",
+					Usage: "Percentage of the machines used as canaries, if --count is not given",
+				},
+				cli.IntFlag{
+					Name:  "bake",
+					Value: 600,
+					Usage: "Seconds to compare the health of the canaries against the other machines",
+				},
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: 300,
+					Usage: "Seconds to wait for the canaries to report the new revision",
+				},
+				cli.Float64Flag{
+					Name:  "max-pass-rate-drop",
+					Value: 1,
+					Usage: "Percentage points the check pass rate of the canaries can be below the other machines",
+				},
+				cli.Float64Flag{
+					Name:  "max-extra-flaps",
+					Value: 1,
+					Usage: "How many more up/down state changes per endpoint the canaries can have than the other machines",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 || (c.Int("count") <= 0 && c.Float64("percent") <= 0) {
+					cli.HelpPrinter(serviceHelpTemplate, c.App)
+					os.Exit(1)
+				}
+
+				t := &oauth.Transport{
+					Token: &oauth.Token{AccessToken: c.GlobalString("github-token")},
+				}
+				githubClient := github.NewClient(t.Client())
+
+				retval, serviceConfiguration := getServiceInfo(c.App.Name, githubClient)
+				if retval != 0 {
+					os.Exit(retval)
+				}
+
+				canary := containrunner.CanaryDeployment{
+					Service:         c.App.Name,
+					Revision:        containrunner.ServiceRevision{Revision: c.Args()[0], Message: c.String("message")},
+					Count:           c.Int("count"),
+					Percent:         c.Float64("percent"),
+					Timeout:         time.Duration(c.Int("timeout")) * time.Second,
+					BakePeriod:      time.Duration(c.Int("bake")) * time.Second,
+					MaxPassRateDrop: c.Float64("max-pass-rate-drop") / 100,
+					MaxExtraFlaps:   c.Float64("max-extra-flaps"),
+				}
+
+				os.Exit(canaryServiceRevision(canary, serviceConfiguration, githubClient))
+			},
+		},
 		{
 			Name:     "set",
 			HideHelp: true,
@@ -105,6 +320,13 @@ func init() {
 				{
 					Name:     "revision",
 					HideHelp: true,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "message, m",
+							Value: "",
+							Usage: "Message which is stored with the revision in the revision history",
+						},
+					},
 					Before: func(c *cli.Context) error {
 						if c.Bool(cli.BashCompletionFlag.Name) || c.Args()[len(c.Args())-1] == "--generate-bash-completion" {
 							if len(c.Args()) == 2 {
@@ -160,7 +382,7 @@ func init() {
 							containrunnerInstance.Events.PublishOrbitEvent(event)
 						}
 
-						retval = setServiceRevision(name, revision, machineAddress, serviceConfiguration, githubClient)
+						retval = setServiceRevision(name, revision, machineAddress, c.String("message"), serviceConfiguration, githubClient)
 						if retval != 0 {
 							os.Exit(retval)
 						}
@@ -246,9 +468,20 @@ func getServiceInfo(name string, githubClient *github.Client) (exit int, service
 		fmt.Printf("Continuous Integration server url for this service: %s\n", serviceConfiguration.SourceControl.CIUrl)
 	}
 
+	redacted := containrunner.RedactServiceConfiguration(serviceConfiguration)
+	if redacted.Container != nil && len(redacted.Container.Config.Env) > 0 {
+		fmt.Printf("\nEnvironment:\n")
+		for _, env := range redacted.Container.Config.Env {
+			fmt.Printf("  %s\n", env)
+		}
+	}
+
 	fmt.Printf("\n")
 	if serviceConfiguration.Revision != nil && !serviceConfiguration.Revision.DeploymentTime.IsZero() {
 		fmt.Printf("\x1b[1mDeployment was done at %s (%s ago)\x1b[0m\n", serviceConfiguration.Revision.DeploymentTime, time.Since(serviceConfiguration.Revision.DeploymentTime))
+		if serviceConfiguration.Revision.User != "" {
+			fmt.Printf("Deployed by %s: %s\n", serviceConfiguration.Revision.User, serviceConfiguration.Revision.Message)
+		}
 	}
 
 	if serviceConfiguration.SourceControl != nil && serviceConfiguration.SourceControl.Origin != "" && commit != nil {
@@ -260,9 +493,10 @@ func getServiceInfo(name string, githubClient *github.Client) (exit int, service
 
 		var deployable_commits = make([]github.RepositoryCommit, 0)
 		if len(commits) > 0 {
+			registries := getRegistryCredentials()
 			for _, commit := range commits {
 				fmt.Printf("Commit: %s\n", *commit.SHA)
-				exists, _, err := containrunner.VerifyContainerExistsInRepository(serviceConfiguration.Container.Config.Image, *commit.SHA)
+				exists, _, err := containrunner.VerifyContainerExistsInRepository(serviceConfiguration.Container.Config.Image, *commit.SHA, registries)
 				if err != nil {
 					fmt.Printf("Error! Unable to get container registry information on newer revision for commit %s\nError: %+v\n", *commit.SHA, err)
 					return 1, serviceConfiguration
@@ -294,8 +528,24 @@ func getServiceInfo(name string, githubClient *github.Client) (exit int, service
 	return 0, serviceConfiguration
 }
 
-func setServiceRevision(name string, revision string, machineAddress string, serviceConfiguration containrunner.ServiceConfiguration, githubClient *github.Client) int {
-	reader := bufio.NewReader(os.Stdin)
+// Returns the credentials for the registry lookups. The registries whose secrets can't be
+// decrypted on this machine use the local docker config.json instead.
+func getRegistryCredentials() map[string]containrunner.RegistryCredentials {
+	registries, err := containrunnerInstance.GetRegistryCredentials(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %+v\n", err)
+	}
+	return registries
+}
+
+// Checks that the revision exists in the source control and that its container exists. Returns the
+// full revision, or an empty revision if the service already runs it, and the exit code.
+func verifyServiceRevision(name string, revision string, serviceConfiguration containrunner.ServiceConfiguration, githubClient *github.Client) (string, int) {
+	err := checkEnvironmentWritable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		return "", 1
+	}
 
 	if serviceConfiguration.SourceControl != nil && serviceConfiguration.SourceControl.Origin != "" {
 		commit, err := GetCommitInfo(serviceConfiguration.SourceControl, revision, githubClient)
@@ -303,7 +553,7 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 			fmt.Printf("Error! Unable to get source control information on revision.\nError: %+v\n", err)
 			fmt.Printf("Can't deploy something which can't exists in the source control system!\n")
 
-			return 1
+			return "", 1
 		} else {
 			PrintCommitInfo(commit)
 
@@ -315,7 +565,7 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 
 		if serviceConfiguration.GetRevision() == revision {
 			fmt.Printf("Service %s is already at revision %s\n", name, revision)
-			return 0
+			return "", 0
 		} else if serviceConfiguration.Revision != nil {
 			fmt.Printf("Previous revision: %s\n", serviceConfiguration.Revision.Revision)
 		} else {
@@ -328,19 +578,19 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 
 	if serviceConfiguration.Container == nil {
 		fmt.Printf("Error! The service %s configuration in incomplete! Missign Container data\n", name)
-		return 1
+		return "", 1
 	}
 
 	image_name := containrunner.GetContainerImageNameWithRevision(serviceConfiguration, revision)
-	exists, last_update, err := containrunner.VerifyContainerExistsInRepository(image_name, "")
+	exists, last_update, err := containrunner.VerifyContainerExistsInRepository(image_name, "", getRegistryCredentials())
 	if err != nil {
 		fmt.Printf("Container %s not found from local repository!\n", image_name)
-		return 1
+		return "", 1
 	}
 
 	if exists == false {
 		fmt.Printf("Error! Unable to find correct container from repository for this revision!\nMissing container name: %s\n", image_name)
-		return 1
+		return "", 1
 	}
 
 	diff := time.Since(time.Unix(last_update, 0))
@@ -350,6 +600,33 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 		fmt.Printf("The container %s you are about to deploy was last updated at %s ago\n", revision, diff)
 	}
 
+	return revision, 0
+}
+
+func newServiceRevision(revision string, message string) containrunner.ServiceRevision {
+	serviceRevision := containrunner.ServiceRevision{
+		Revision:       revision,
+		DeploymentTime: time.Now(),
+		Message:        message,
+	}
+
+	user, err := user.Current()
+	if err == nil {
+		serviceRevision.User = user.Username
+	}
+
+	return serviceRevision
+}
+
+func setServiceRevision(name string, revision string, machineAddress string, message string, serviceConfiguration containrunner.ServiceConfiguration, githubClient *github.Client) int {
+	reader := bufio.NewReader(os.Stdin)
+
+	revision, retval := verifyServiceRevision(name, revision, serviceConfiguration, githubClient)
+	if retval != 0 || revision == "" {
+		return retval
+	}
+
+	var err error
 	if machineAddress != "" {
 		fmt.Printf("Setting service %s revision to %s for machine ip %s\n\n", name, revision, machineAddress)
 	} else {
@@ -365,9 +642,16 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 		}
 	}
 
-	var serviceRevision = containrunner.ServiceRevision{
-		Revision:       revision,
-		DeploymentTime: time.Now(),
+	serviceRevision := newServiceRevision(revision, message)
+
+	// The rollback policy needs the revision and the machines from before the deployment
+	var watch *containrunner.DeploymentWatch
+	if machineAddress == "" && serviceConfiguration.RollbackPolicy != nil && len(serviceConfiguration.Checks) > 0 {
+		watch, err = newDeploymentWatch(name, serviceRevision, *serviceConfiguration.RollbackPolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+			return 1
+		}
 	}
 
 	if machineAddress != "" {
@@ -381,6 +665,21 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 
 	if serviceConfiguration.Checks == nil || len(serviceConfiguration.Checks) == 0 {
 		fmt.Printf("Service has no checks, so deployment progress can't be monitored\n")
+	} else if watch != nil {
+		fmt.Printf("Monitoring deployment progress. The revision is rolled back if more than %.0f%% of the %d machines are not healthy with it after %d seconds\n",
+			watch.Policy.MaxDownFraction*100, len(watch.Machines), watch.Policy.TimeoutSeconds)
+
+		reason, err := containrunnerInstance.WatchDeployment(*watch, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %+v\n", err)
+			return 1
+		}
+		if reason != "" {
+			fmt.Printf("\nRolled back to revision %s: %s\n", watch.Previous.Revision, reason)
+			return 1
+		}
+
+		fmt.Printf("\nAll servers updated\n")
 	} else {
 		fmt.Printf("Monitoring deployment progress (New deployment has been committed, you can press Ctrl-C to stop monitoring)\n")
 		fmt.Printf("Full deployment takes around two minutes\n")
@@ -414,6 +713,176 @@ func setServiceRevision(name string, revision string, machineAddress string, ser
 	return 0
 }
 
+// Returns a watch which restores the current revision of the service if the new revision violates the policy.
+// Returns nil if the service has no current revision or no machines.
+func newDeploymentWatch(name string, serviceRevision containrunner.ServiceRevision, policy containrunner.RollbackPolicy) (*containrunner.DeploymentWatch, error) {
+	previous, err := containrunnerInstance.GetServiceRevision(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		fmt.Printf("Service %s has no previous revision, so it can't be rolled back automatically\n", name)
+		return nil, nil
+	}
+
+	machines, err := containrunnerInstance.GetServiceMachines(name, nil)
+	if err != nil || len(machines) == 0 {
+		return nil, err
+	}
+
+	watch := &containrunner.DeploymentWatch{
+		Service:  name,
+		Revision: serviceRevision,
+		Previous: *previous,
+		Machines: machines,
+		Policy:   policy,
+		Progress: func(pending []string, updated []string) {
+			fmt.Printf("Servers with old revision: %d, servers with new revision: %d... \r", len(pending), len(updated))
+		},
+	}
+
+	user, err := user.Current()
+	if err == nil {
+		watch.User = user.Username
+	}
+
+	return watch, nil
+}
+
+func deployServiceRevision(deployment containrunner.RollingDeployment, serviceConfiguration containrunner.ServiceConfiguration, githubClient *github.Client) int {
+	reader := bufio.NewReader(os.Stdin)
+	name := deployment.Service
+
+	if len(serviceConfiguration.Checks) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: service %s has no checks so the deployment progress can't be monitored. Use set revision instead\n", name)
+		return 1
+	}
+
+	revision, retval := verifyServiceRevision(name, deployment.Revision.Revision, serviceConfiguration, githubClient)
+	if retval != 0 || revision == "" {
+		return retval
+	}
+	deployment.Revision = newServiceRevision(revision, deployment.Revision.Message)
+
+	machines, err := containrunnerInstance.GetServiceMachines(name, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		return 1
+	}
+	if len(machines) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no machines are running service %s\n", name)
+		return 1
+	}
+	deployment.Machines = machines
+
+	batches := containrunner.SplitDeploymentBatches(machines, deployment.BatchSize)
+	fmt.Printf("Deploying service %s revision %s to %d machines in %d batches\n\n", name, revision, len(machines), len(batches))
+
+	if globalFlags.Force == false {
+		fmt.Printf("Are you sure you want to deploy %s with this revision into production? (y/N) ", name)
+		bytes, _ := reader.ReadBytes('\n')
+		if bytes[0] != 'y' && bytes[0] != 'Y' {
+			fmt.Printf("Abort!\n")
+			return 1
+		}
+	}
+
+	deploymentEvent := containrunner.DeploymentEvent{}
+	deploymentEvent.Action = "SetRevision"
+	deploymentEvent.Service = name
+	deploymentEvent.Revision = revision
+	user, err := user.Current()
+	if err == nil {
+		deploymentEvent.User = user.Username
+	}
+	if containrunnerInstance.Events != nil {
+		containrunnerInstance.Events.PublishOrbitEvent(containrunner.NewOrbitEvent(deploymentEvent))
+	}
+
+	deployment.Progress = func(message string) {
+		fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), message)
+	}
+
+	result, err := containrunnerInstance.RollingDeploy(deployment, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		fmt.Fprintf(os.Stderr, "Deployment halted. Machines already set to revision %s: %s\n", revision, strings.Join(result.Updated, ", "))
+		fmt.Fprintf(os.Stderr, "Run the deploy again to continue or set the previous revision to roll back\n")
+
+		deploymentEvent.Action = "DeployFailed"
+		if containrunnerInstance.Events != nil {
+			containrunnerInstance.Events.PublishOrbitEvent(containrunner.NewOrbitEvent(deploymentEvent))
+		}
+		return 1
+	}
+
+	fmt.Printf("\nAll servers updated\n")
+
+	deploymentEvent.Action = "DeployCompleted"
+	if containrunnerInstance.Events != nil {
+		containrunnerInstance.Events.PublishOrbitEvent(containrunner.NewOrbitEvent(deploymentEvent))
+	}
+
+	return 0
+}
+
+func canaryServiceRevision(canary containrunner.CanaryDeployment, serviceConfiguration containrunner.ServiceConfiguration, githubClient *github.Client) int {
+	reader := bufio.NewReader(os.Stdin)
+	name := canary.Service
+
+	if len(serviceConfiguration.Checks) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: service %s has no checks so the canaries can't be compared. Use set revision instead\n", name)
+		return 1
+	}
+
+	revision, retval := verifyServiceRevision(name, canary.Revision.Revision, serviceConfiguration, githubClient)
+	if retval != 0 || revision == "" {
+		return retval
+	}
+	canary.Revision = newServiceRevision(revision, canary.Revision.Message)
+
+	if globalFlags.Force == false {
+		fmt.Printf("Are you sure you want to start a canary of %s with this revision in production? (y/N) ", name)
+		bytes, _ := reader.ReadBytes('\n')
+		if bytes[0] != 'y' && bytes[0] != 'Y' {
+			fmt.Printf("Abort!\n")
+			return 1
+		}
+	}
+
+	user, err := user.Current()
+	if err == nil {
+		canary.User = user.Username
+	}
+
+	canary.Progress = func(message string) {
+		fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), message)
+	}
+
+	result, err := containrunnerInstance.RunCanary(canary, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		if result != nil {
+			fmt.Fprintf(os.Stderr, "Canaries %s may have been left at revision %s\n", strings.Join(result.Machines, ", "), revision)
+		}
+		return 1
+	}
+
+	fmt.Printf("\nCanaries: %s\n", strings.Join(result.Machines, ", "))
+	fmt.Fprintf(out, "\tEndpoints\tChecks\tPassed\tState changes\n")
+	fmt.Fprintf(out, "Canary\t%d\t%d\t%.1f%%\t%d\n", result.Canary.Endpoints, result.Canary.Checks, result.Canary.PassRate()*100, result.Canary.StateChanges)
+	fmt.Fprintf(out, "Baseline\t%d\t%d\t%.1f%%\t%d\n", result.Baseline.Endpoints, result.Baseline.Checks, result.Baseline.PassRate()*100, result.Baseline.StateChanges)
+	out.Flush()
+
+	if !result.Promoted {
+		fmt.Printf("\nCanary rolled back: %s\n", result.Reason)
+		return 1
+	}
+
+	fmt.Printf("\nRevision %s promoted to all machines\n", revision)
+	return 0
+}
+
 func GetCommitInfo(sc *containrunner.SourceControl, revision string, client *github.Client) (*github.RepositoryCommit, error) {
 
 	// github.com/Applifier/comet
@@ -4,8 +4,22 @@ import (
 	"fmt"
 	"github.com/codegangsta/cli"
 	"os"
+	"sort"
+	"strings"
 )
 
+var tagsHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+
+USAGE:
+   {{.Name}}
+			List known machine tags
+
+   {{.Name}} show <tag>
+			Show the tag with its includes resolved
+
+`
+
 func init() {
 	app.Commands = append(app.Commands,
 		cli.Command{
@@ -19,5 +33,66 @@ func init() {
 				}
 				fmt.Printf("%+v\n", tags)
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "Show the tag with its includes resolved",
+					Action: func(c *cli.Context) {
+						tag := c.Args().First()
+						if tag == "" {
+							cli.HelpPrinter(tagsHelpTemplate, c.App)
+							os.Exit(1)
+						}
+
+						mc, order, err := containrunnerInstance.GetResolvedTagConfiguration(tag, nil)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+							os.Exit(1)
+						}
+
+						fmt.Printf("Tag: %s\n", tag)
+						fmt.Printf("Includes: %s\n", strings.Join(mc.Includes, ", "))
+						fmt.Printf("Merge order: %s\n", strings.Join(order, ", "))
+
+						var names []string
+						for name := range mc.Services {
+							names = append(names, name)
+						}
+						sort.Strings(names)
+
+						fmt.Printf("\nServices:\n")
+						fmt.Fprintf(out, "NAME\tENDPOINT PORT\tIMAGE\tOVERWRITES\n")
+						for _, name := range names {
+							boundService := mc.Services[name]
+							config := boundService.GetConfig()
+							image := ""
+							if config.Container != nil {
+								image = config.Container.Config.Image
+							}
+							fmt.Fprintf(out, "%s\t%d\t%s\t%t\n", name, config.EndpointPort, image, boundService.Overwrites != nil)
+						}
+						out.Flush()
+
+						if len(mc.AuthoritativeNames) > 0 {
+							fmt.Printf("\nAuthoritative names: %s\n", strings.Join(mc.AuthoritativeNames, ", "))
+						}
+
+						if mc.HAProxyConfiguration != nil {
+							fmt.Printf("\nHAProxy certs: %s\n", strings.Join(sortedKeys(mc.HAProxyConfiguration.Certs), ", "))
+							fmt.Printf("HAProxy files: %s\n", strings.Join(sortedKeys(mc.HAProxyConfiguration.Files), ", "))
+							fmt.Printf("HAProxy template:\n%s\n", mc.HAProxyConfiguration.Template)
+						}
+					},
+				},
+			},
 		})
 }
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}